@@ -126,6 +126,12 @@ struct QueueEntry {
 
   longlong             DiscardPadding;
 
+  // ReferenceBlocks in ns relative to Start, and the raw BlockAdditions
+  longlong            *References;
+  unsigned int         nReferences;
+  char                *Additions;
+  unsigned int         AdditionsLength;
+
   unsigned int         flags;
 };
 
@@ -529,12 +535,21 @@ static struct QueueEntry  *QAlloc(MatroskaFile *mf) {
   qe = mf->QFreeList;
   mf->QFreeList = qe->next;
 
+  qe->References = NULL;
+  qe->nReferences = 0;
+  qe->Additions = NULL;
+  qe->AdditionsLength = 0;
+
   return qe;
 }
 
 static inline void QFree(MatroskaFile *mf,struct QueueEntry *qe) {
   mf->cache->memfree(mf->cache, qe->Data);
   qe->Data = NULL;
+  mf->cache->memfree(mf->cache, qe->References);
+  qe->References = NULL;
+  mf->cache->memfree(mf->cache, qe->Additions);
+  qe->Additions = NULL;
   qe->next = mf->QFreeList;
   mf->QFreeList = qe;
 }
@@ -2073,6 +2088,82 @@ static void parseChapters(MatroskaFile *mf,ulonglong toplen) {
   ENDFOR(mf);
 }
 
+static void DeleteSimpleTag(MatroskaFile *mf,struct SimpleTag *st) {
+  unsigned i;
+
+  mf->cache->memfree(mf->cache,st->Name);
+  mf->cache->memfree(mf->cache,st->Value);
+  mf->cache->memfree(mf->cache,st->LanguageBCP47);
+  mf->cache->memfree(mf->cache,st->Binary);
+
+  for (i=0;i<st->nChildren;++i)
+    DeleteSimpleTag(mf,&st->Children[i]);
+  mf->cache->memfree(mf->cache,st->Children);
+}
+
+// Returns 0 if the simple tag has no name, in which case it is freed
+// and should be dropped.
+static int parseSimpleTag(MatroskaFile *mf,ulonglong toplen,struct SimpleTag *st) {
+  struct SimpleTag *child;
+
+  memset(st,0,sizeof(*st));
+  st->Default = 1;
+
+  FOREACH(mf,toplen)
+    case 0x45a3: // TagName
+      if (st->Name)
+        skipbytes(mf,len);
+      else
+        STRGETM(mf,st->Name,len);
+      break;
+    case 0x4487: // TagString
+      if (st->Value)
+        skipbytes(mf,len);
+      else
+        STRGETM(mf,st->Value,len);
+      break;
+    case 0x4485: // TagBinary
+      if (st->Binary)
+        skipbytes(mf,len);
+      else {
+        if (len>33554432) // 32MB
+          errorjmp(mf,"TagBinary is too large: %d",(int)len);
+        st->Binary = mf->cache->memalloc(mf->cache,len ? (size_t)len : 1);
+        if (st->Binary == NULL)
+          errorjmp(mf,"Out of memory");
+        st->BinaryLength = (unsigned)len;
+        readbytes(mf,st->Binary,(int)len);
+      }
+      break;
+    case 0x447a: // TagLanguage
+      readLangCC(mf, len, st->Language);
+      break;
+    case 0x447b: // TagLanguageBCP47
+      if (st->LanguageBCP47)
+        skipbytes(mf,len);
+      else
+        STRGETM(mf,st->LanguageBCP47,len);
+      break;
+    case 0x4484: // TagDefault
+      st->Default = readUInt(mf,(unsigned)len)!=0;
+      break;
+    case 0x67c8: // Nested SimpleTag
+      child = ASGET(mf,st,Children);
+      if (!parseSimpleTag(mf,len,child))
+        --st->nChildren;
+      break;
+  ENDFOR(mf);
+
+  ARELEASE(mf,st,Children);
+
+  if (!st->Name) {
+    DeleteSimpleTag(mf,st);
+    return 0;
+  }
+
+  return 1;
+}
+
 static void parseTags(MatroskaFile *mf,ulonglong toplen) {
   struct Tag  *tag;
   struct Target *target;
@@ -2088,6 +2179,15 @@ static void parseTags(MatroskaFile *mf,ulonglong toplen) {
       FOREACH(mf,len)
         case 0x63c0: // Targets
           FOREACH(mf,len)
+            case 0x68ca: // TargetTypeValue
+              tag->TargetTypeValue = readUInt(mf,(unsigned)len);
+              break;
+            case 0x63ca: // TargetType
+              if (tag->TargetType)
+                skipbytes(mf,len);
+              else
+                STRGETM(mf,tag->TargetType,len);
+              break;
             case 0x63c5: // TrackUID
               target = ASGET(mf,tag,Targets);
               target->UID = readUInt(mf,(unsigned)len);
@@ -2112,36 +2212,13 @@ static void parseTags(MatroskaFile *mf,ulonglong toplen) {
           break;
         case 0x67c8: // SimpleTag
           st = ASGET(mf,tag,SimpleTags);
-          memset(st,0,sizeof(*st));
-
-          FOREACH(mf,len)
-            case 0x45a3: // TagName
-              if (st->Name)
-                skipbytes(mf,len);
-              else
-                STRGETM(mf,st->Name,len);
-              break;
-            case 0x4487: // TagString
-              if (st->Value)
-                skipbytes(mf,len);
-              else
-                STRGETM(mf,st->Value,len);
-              break;
-            case 0x447a: // TagLanguage
-              readLangCC(mf, len, st->Language);
-              break;
-            case 0x4484: // TagDefault
-              st->Default = readUInt(mf,(unsigned)len)!=0;
-              break;
-          ENDFOR(mf);
-
-          if (!st->Name || !st->Value) {
-            mf->cache->memfree(mf->cache,st->Name);
-            mf->cache->memfree(mf->cache,st->Value);
+          if (!parseSimpleTag(mf,len,st))
             --tag->nSimpleTags;
-          }
           break;
       ENDFOR(mf);
+
+      if (tag->TargetTypeValue == 0)
+        tag->TargetTypeValue = 50;
       break;
   ENDFOR(mf);
 }
@@ -2349,13 +2426,20 @@ static void parseBlockGroup(MatroskaFile *mf,ulonglong toplen,ulonglong timecode
   unsigned        nframes = 0,i;
   unsigned        *sizes;
   signed short        block_timecode;
+  longlong        *refs = NULL;
+  unsigned        nrefs = 0;
+  char                *adds = NULL;
+  unsigned        addslen = 0;
 
   if (blockex)
     goto blockex;
 
   FOREACH(mf,toplen)
     case 0xfb: // ReferenceBlock
-      readSInt(mf,(unsigned)len);
+      refs = mf->cache->memrealloc(mf->cache,refs,(nrefs+1)*sizeof(*refs));
+      if (refs == NULL)
+        errorjmp(mf,"Out of memory");
+      refs[nrefs++] = readSInt(mf,(unsigned)len);
       ref = 1;
       break;
 blockex:
@@ -2380,6 +2464,8 @@ blockex:
 
       // bad trackid/unsupported track
       skipbytes(mf,start + tmplen - filepos(mf)); // shortcut
+      mf->cache->memfree(mf->cache,refs);
+      mf->cache->memfree(mf->cache,adds);
       return;
 found:
 
@@ -2482,10 +2568,12 @@ found:
       have_duration = 1;
       break;
     case 0x75a1: // BlockAdditions
-      /*if (nframes > 0) // have some frames
-        parseBlockAdditions(mf, len, timecode, tracknum);
-      else*/
-        skipbytes(mf, len);
+      // kept raw, the BlockMore elements are parsed by the caller
+      adds = mf->cache->memrealloc(mf->cache,adds,addslen+(unsigned)len);
+      if (adds == NULL)
+        errorjmp(mf,"Out of memory");
+      readbytes(mf,adds+addslen,(unsigned)len);
+      addslen += (unsigned)len;
       break;
     case 0x75a2: // DiscardPadding
       discard = readSInt(mf,(unsigned)len);
@@ -2536,6 +2624,19 @@ out:
     qf->DiscardPadding = discard;
   }
 
+  if (qf) {
+    for (i=0;i<nrefs;++i)
+      refs[i] = mul3(mf->Tracks[tracknum]->TimecodeScale,
+        refs[i] * mf->Seg.TimecodeScale);
+    qf->References = refs;
+    qf->nReferences = nrefs;
+    qf->Additions = adds;
+    qf->AdditionsLength = addslen;
+  } else {
+    mf->cache->memfree(mf->cache,refs);
+    mf->cache->memfree(mf->cache,adds);
+  }
+
   if (ref)
     while (qf) {
       qf->flags &= ~FRAME_KF;
@@ -2550,6 +2651,10 @@ static void ClearQueue(MatroskaFile *mf,struct Queue *q) {
     qn = qe->next;
     mf->cache->memfree(mf->cache, qe->Data);
     qe->Data = NULL;
+    mf->cache->memfree(mf->cache, qe->References);
+    qe->References = NULL;
+    mf->cache->memfree(mf->cache, qe->Additions);
+    qe->Additions = NULL;
     qe->next = mf->QFreeList;
     mf->QFreeList = qe;
   }
@@ -3031,18 +3136,12 @@ segment:
   // found it
   mf->pSegment = filepos(mf);
 
-  // we want to read data until we find a seekhead or a trackinfo
+  // we want to read data until we find the segment info
   FOREACH2(mf,len,0x1f43b675)
     case 0x1549a966: // SegmentInfo
       mf->pSegmentInfo = cur;
-      FOREACH(mf,len)
-        case 0x73a4: // SegmentUID
-          if (len != sizeof(mf->Seg.UID))
-            errorjmp(mf,"SegmentUID size is not %d bytes",mf->Seg.UID);
-          readbytes(mf,mf->Seg.UID,sizeof(mf->Seg.UID));
-          return;
-      ENDFOR(mf);
-      break;
+      parseSegmentInfo(mf,len);
+      return;
   ENDFOR1(mf);
     // if we found our segment info
     if (mf->pSegmentInfo)
@@ -3305,10 +3404,9 @@ void              mkv_Close(MatroskaFile *mf) {
   mf->cache->memfree(mf->cache,mf->Chapters);
 
   for (i=0;i<mf->nTags;++i) {
-    for (j=0;j<mf->Tags[i].nSimpleTags;++j) {
-      mf->cache->memfree(mf->cache,mf->Tags[i].SimpleTags[j].Name);
-      mf->cache->memfree(mf->cache,mf->Tags[i].SimpleTags[j].Value);
-    }
+    for (j=0;j<mf->Tags[i].nSimpleTags;++j)
+      DeleteSimpleTag(mf,&mf->Tags[i].SimpleTags[j]);
+    mf->cache->memfree(mf->cache,mf->Tags[i].TargetType);
     mf->cache->memfree(mf->cache,mf->Tags[i].Targets);
     mf->cache->memfree(mf->cache,mf->Tags[i].SimpleTags);
   }
@@ -3716,7 +3814,9 @@ int              mkv_ReadFrame(MatroskaFile *mf,
                             ulonglong mask,unsigned int *track,
                             ulonglong *StartTime,ulonglong *EndTime,
                             ulonglong *FilePos,unsigned int *FrameSize,
-                            char **FrameData,unsigned int *FrameFlags, longlong *FrameDiscard)
+                            char **FrameData,unsigned int *FrameFlags, longlong *FrameDiscard,
+                            longlong **References,unsigned int *nReferences,
+                            char **Additions,unsigned int *AdditionsLength)
 {
   unsigned int            i,j;
   struct QueueEntry *qe;
@@ -3749,8 +3849,14 @@ int              mkv_ReadFrame(MatroskaFile *mf,
       *FrameData = qe->Data;
       *FrameFlags = qe->flags;
       *FrameDiscard = qe->DiscardPadding;
+      *References = qe->References;
+      *nReferences = qe->nReferences;
+      *Additions = qe->Additions;
+      *AdditionsLength = qe->AdditionsLength;
 
       qe->Data = NULL;
+      qe->References = NULL;
+      qe->Additions = NULL;
       QFree(mf,qe);
 
       return 0;
@@ -296,9 +296,19 @@ struct SimpleTag {
   char		    *Value;
   char		    Language[4];
   unsigned	    Default:1;
+
+  char		    *LanguageBCP47;
+  unsigned	    BinaryLength;
+  void		    *Binary;
+
+  unsigned	    nChildren,nChildrenSize;
+  struct SimpleTag  *Children;
 };
 
 struct Tag {
+  ulonglong	    TargetTypeValue;
+  char		    *TargetType;
+
   unsigned	    nTargets,nTargetsSize;
   struct Target	    *Targets;
 
@@ -323,7 +333,8 @@ X MatroskaFile  *mkv_OpenEx(/* in */  InputStream *io,
 			  /* out */ char *err_msg,
 			  /* in */  unsigned msgsize);
 
-/* Open the file and only parse enough information to find the segment uid */
+/* Open the file and only parse its segment info, to find the segment uid
+ * and linking information. Only mkv_GetFileInfo may be used on the result. */
 X MatroskaFile  *mkv_OpenSparse(/* in */ InputStream *io,
         /* out */ char *err_msg,
         /* in */  unsigned msgsize);
@@ -402,6 +413,8 @@ X void	      mkv_SetTrackMask(/* in */ MatroskaFile *mf,/* in */ ulonglong mask)
 
 /* Read one frame from the queue.
  * mask specifies what tracks to ignore.
+ * FrameData, References and Additions are allocated with the
+ * InputStream's memalloc, and are freed by the caller.
  * Returns -1 if there are no more frames in the specified
  * set of tracks, 0 on success
  */
@@ -414,7 +427,11 @@ X int	      mkv_ReadFrame(/* in */  MatroskaFile *mf,
 			    /* out */ unsigned int *FrameSize /* in bytes */,
 			    /* out */ char **FrameData,
 			    /* out */ unsigned int *FrameFlags,
-			    /* out */ longlong *FrameDiscard);
+			    /* out */ longlong *FrameDiscard,
+			    /* out */ longlong **References /* in ns, relative to StartTime */,
+			    /* out */ unsigned int *nReferences,
+			    /* out */ char **Additions /* contents of BlockAdditions */,
+			    /* out */ unsigned int *AdditionsLength);
 
 #ifdef MATROSKA_COMPRESSION_SUPPORT
 /* Compressed streams support */
@@ -0,0 +1,278 @@
+package matroska
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// chainLink is a single segment of a chain.
+type chainLink struct {
+	path   string
+	info   *SegmentInfo
+	f      *os.File
+	d      *Demuxer
+	offset uint64
+}
+
+// ChainReader reads a chain of hard-linked segments, as linked by their
+// PrevUID and NextUID, as one continuous stream.
+//
+// Each segment's timestamps are assumed to start at 0, and are offset by
+// the durations of the segments before it. Tracks are those of the first
+// segment, and are matched in the others as for VirtualDemuxer.
+type ChainReader struct {
+	links []*chainLink
+	v     *VirtualDemuxer
+}
+
+// NewChainReader finds the whole chain the file at path is part of, and
+// opens it. Linked segments are looked for in the same directory, first by
+// their PrevFilename or NextFilename, and then by probing every Matroska
+// file there for their UID.
+func NewChainReader(path string) (*ChainReader, error) {
+	links, err := findChain(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ChainReader{
+		links: links,
+	}
+
+	for _, l := range links {
+		l.f, err = os.Open(l.path)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("could not open segment: %s", err.Error())
+		}
+		l.d, err = NewDemuxer(l.f)
+		if err != nil {
+			l.f.Close()
+			l.f = nil
+			c.Close()
+			return nil, fmt.Errorf("could not open segment %s: %s", l.path, err.Error())
+		}
+	}
+
+	c.v, err = newVirtualDemuxer(links[0].d)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	for _, l := range links {
+		seg, err := c.v.newSegment(l.d, l.f)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("could not open segment %s: %s", l.path, err.Error())
+		}
+
+		// The parser's duration is more reliable than the one in the
+		// segment info.
+		info, err := l.d.GetFileInfo()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		// Empty segments have no part, but still need their offset
+		// for their chapters and cues.
+		l.offset = c.v.duration
+		if info.Duration == 0 {
+			continue
+		}
+
+		c.v.parts = append(c.v.parts, &virtualPart{
+			seg:    seg,
+			start:  0,
+			end:    info.Duration,
+			offset: l.offset,
+		})
+		c.v.duration += info.Duration
+	}
+
+	return c, nil
+}
+
+// findChain probes its way along the chain in both directions.
+func findChain(path string) ([]*chainLink, error) {
+	dir := filepath.Dir(path)
+
+	info, err := probeFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not probe %s: %s", path, err.Error())
+	}
+
+	var index map[[16]byte]string
+	find := func(uid [16]byte, name string) (*chainLink, error) {
+		if name != "" {
+			p := filepath.Join(dir, filepath.Base(name))
+			info, err := probeFile(p)
+			if err == nil && info.UID == uid {
+				return &chainLink{path: p, info: info}, nil
+			}
+		}
+
+		if index == nil {
+			index, err = indexDirectory(dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p, ok := index[uid]
+		if !ok {
+			return nil, fmt.Errorf("no file in %s has segment UID %x", dir, uid)
+		}
+		info, err := probeFile(p)
+		if err != nil {
+			return nil, err
+		}
+		return &chainLink{path: p, info: info}, nil
+	}
+
+	links := []*chainLink{{path: path, info: info}}
+	if isZeroUID(info.UID) {
+		return links, nil
+	}
+	seen := map[[16]byte]bool{info.UID: true}
+
+	for cur := info; !isZeroUID(cur.PrevUID); {
+		l, err := find(cur.PrevUID, cur.PrevFilename)
+		if err != nil {
+			return nil, fmt.Errorf("could not find previous segment %x: %s", cur.PrevUID, err.Error())
+		}
+		if seen[l.info.UID] {
+			break
+		}
+		seen[l.info.UID] = true
+		links = append([]*chainLink{l}, links...)
+		cur = l.info
+	}
+
+	for cur := info; !isZeroUID(cur.NextUID); {
+		l, err := find(cur.NextUID, cur.NextFilename)
+		if err != nil {
+			return nil, fmt.Errorf("could not find next segment %x: %s", cur.NextUID, err.Error())
+		}
+		if seen[l.info.UID] {
+			break
+		}
+		seen[l.info.UID] = true
+		links = append(links, l)
+		cur = l.info
+	}
+
+	return links, nil
+}
+
+// GetSegments returns the segment info of each segment in the chain, in
+// order.
+func (c *ChainReader) GetSegments() []*SegmentInfo {
+	ret := make([]*SegmentInfo, len(c.links))
+	for i, l := range c.links {
+		ret[i] = l.info
+	}
+	return ret
+}
+
+// GetNumTracks returns the number of tracks, which are those of the first
+// segment.
+func (c *ChainReader) GetNumTracks() (uint, error) {
+	return c.v.GetNumTracks()
+}
+
+// GetTrackInfo returns the first segment's track info for a given track.
+func (c *ChainReader) GetTrackInfo(track uint) (*TrackInfo, error) {
+	return c.v.GetTrackInfo(track)
+}
+
+// GetDuration returns the combined duration of the chain.
+func (c *ChainReader) GetDuration() uint64 {
+	return c.v.GetDuration()
+}
+
+// shiftChapter returns a copy of ch and its children, moved by offset.
+func shiftChapter(ch *Chapter, offset uint64) *Chapter {
+	ret := *ch
+	ret.Start += offset
+	if ret.End != 0 {
+		ret.End += offset
+	}
+
+	ret.Children = nil
+	for _, child := range ch.Children {
+		ret.Children = append(ret.Children, shiftChapter(child, offset))
+	}
+
+	return &ret
+}
+
+// GetChapters returns the chapters of the default edition of every
+// segment, moved to their place in the chain, as a single edition.
+// Chapters with a UID already seen in an earlier segment are skipped. The
+// returned slice may be of length 0.
+func (c *ChainReader) GetChapters() []*Chapter {
+	var chapters []*Chapter
+	seen := make(map[uint64]bool)
+
+	for _, l := range c.links {
+		e := DefaultEdition(l.d.GetEditions())
+		if e == nil {
+			continue
+		}
+		for _, ch := range e.Chapters {
+			if ch.UID != 0 && seen[ch.UID] {
+				continue
+			}
+			seen[ch.UID] = true
+			chapters = append(chapters, shiftChapter(ch, l.offset))
+		}
+	}
+
+	if len(chapters) == 0 {
+		return []*Chapter{}
+	}
+	return []*Chapter{{
+		Enabled:  true,
+		Default:  true,
+		Children: chapters,
+	}}
+}
+
+// GetCues returns the cues of every segment, with their times moved to
+// their place in the chain. Positions are still relative to each
+// segment. The returned slice may be of length 0.
+func (c *ChainReader) GetCues() []*Cue {
+	ret := []*Cue{}
+	for _, l := range c.links {
+		for _, cue := range l.d.GetCues() {
+			cue.Time += l.offset
+			ret = append(ret, cue)
+		}
+	}
+	return ret
+}
+
+// ReadPacket returns the next packet of the chain.
+func (c *ChainReader) ReadPacket() (*Packet, error) {
+	return c.v.ReadPacket()
+}
+
+// Seek seeks to a time in the chain, landing on the previous keyframe of
+// the reference track.
+func (c *ChainReader) Seek(timecode uint64) error {
+	return c.v.Seek(timecode)
+}
+
+// Close closes all segments of the chain.
+func (c *ChainReader) Close() {
+	for _, l := range c.links {
+		if l.d != nil {
+			l.d.Close()
+		}
+		if l.f != nil {
+			l.f.Close()
+		}
+	}
+	c.links = nil
+}
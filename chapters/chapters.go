@@ -0,0 +1,183 @@
+// Package chapters converts between Matroska chapters, as returned by
+// matroska.Demuxer.GetChapters, and mkvmerge's chapter XML, OGM simple
+// chapters, ffmpeg's FFMETADATA and WebVTT chapter tracks.
+//
+// As with GetChapters, top-level chapters are editions, and their children
+// are the actual chapters. Only the XML format can hold everything, such as
+// UIDs, flags, multiple languages, nested chapters and multiple editions.
+// The other formats are written from the default edition (or the first
+// one), using the first display string of each of its top-level chapters,
+// and are read into a single edition.
+package chapters
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Format is a chapter file format.
+type Format int
+
+// Supported formats.
+const (
+	XML Format = iota
+	OGM
+	FFMetadata
+	WebVTT
+)
+
+func (f Format) String() string {
+	switch f {
+	case XML:
+		return "XML"
+	case OGM:
+		return "OGM"
+	case FFMetadata:
+		return "FFMETADATA"
+	case WebVTT:
+		return "WebVTT"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Parse reads chapters of the given format from r.
+func Parse(r io.Reader, format Format) ([]*matroska.Chapter, error) {
+	switch format {
+	case XML:
+		return parseXML(r)
+	case OGM:
+		return parseOGM(r)
+	case FFMetadata:
+		return parseFFMetadata(r)
+	case WebVTT:
+		return parseWebVTT(r)
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+// Write writes chapters to w in the given format.
+func Write(w io.Writer, chapters []*matroska.Chapter, format Format) error {
+	switch format {
+	case XML:
+		return writeXML(w, chapters)
+	case OGM:
+		return writeOGM(w, chapters)
+	case FFMetadata:
+		return writeFFMetadata(w, chapters)
+	case WebVTT:
+		return writeWebVTT(w, chapters)
+	}
+	return fmt.Errorf("unsupported format: %s", format)
+}
+
+// Convert reads chapters in format from from r, and writes them to w in
+// format to.
+func Convert(r io.Reader, from Format, w io.Writer, to Format) error {
+	chapters, err := Parse(r, from)
+	if err != nil {
+		return err
+	}
+	return Write(w, chapters, to)
+}
+
+// defaultEdition returns the edition the simple formats are written from.
+func defaultEdition(editions []*matroska.Chapter) *matroska.Chapter {
+	if len(editions) == 0 {
+		return &matroska.Chapter{}
+	}
+	for _, e := range editions {
+		if e.Default {
+			return e
+		}
+	}
+	return editions[0]
+}
+
+// edition wraps chapters read from a simple format in an edition.
+func edition(chapters []*matroska.Chapter) []*matroska.Chapter {
+	if len(chapters) == 0 {
+		return nil
+	}
+	return []*matroska.Chapter{{
+		Default:  true,
+		Enabled:  true,
+		Children: chapters,
+	}}
+}
+
+// title returns the first display string of a chapter.
+func title(c *matroska.Chapter) string {
+	if len(c.Display) == 0 {
+		return ""
+	}
+	return c.Display[0].String
+}
+
+// newChapter creates an enabled chapter with a single display string, in
+// an unknown language.
+func newChapter(start uint64, name string) *matroska.Chapter {
+	ret := &matroska.Chapter{
+		Start:   start,
+		Enabled: true,
+	}
+	if name != "" {
+		ret.Display = []matroska.ChapterDisplay{{String: name}}
+	}
+	return ret
+}
+
+// formatTime formats a nanosecond timestamp as HH:MM:SS.fff, with digits
+// digits of fractional seconds.
+func formatTime(ns uint64, digits int) string {
+	secs := ns / 1000000000
+	frac := fmt.Sprintf("%09d", ns%1000000000)
+	return fmt.Sprintf("%02d:%02d:%02d.%s", secs/3600, (secs/60)%60, secs%60, frac[:digits])
+}
+
+// parseTime parses [HH:]MM:SS[.fff] timestamps, with up to nanosecond
+// precision, into nanoseconds.
+func parseTime(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+
+	var frac uint64
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		f := s[i+1:]
+		if len(f) > 9 {
+			f = f[:9]
+		}
+		for len(f) < 9 {
+			f += "0"
+		}
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp: %s", s)
+		}
+		frac = v
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+
+	var secs uint64
+	for _, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp: %s", s)
+		}
+		secs = secs*60 + v
+	}
+
+	return secs*1000000000 + frac, nil
+}
+
+func normalizeNewlines(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\r", "\n", -1)
+}
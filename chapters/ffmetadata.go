@@ -0,0 +1,178 @@
+package chapters
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// FFMETADATA escapes these with a backslash.
+var ffEscaper = strings.NewReplacer("\\", "\\\\", "=", "\\=", ";", "\\;", "#", "\\#", "\n", "\\\n")
+
+// unescapeFF removes backslash escapes.
+func unescapeFF(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// splitFF splits an unescaped key=value line.
+func splitFF(line string) (string, string, bool) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '=':
+			return unescapeFF(line[:i]), unescapeFF(line[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// escapedNewline returns whether line ends in an odd number of
+// backslashes.
+func escapedNewline(line string) bool {
+	n := 0
+	for n < len(line) && line[len(line)-1-n] == '\\' {
+		n++
+	}
+	return n%2 == 1
+}
+
+// scale converts a time in units of num/den seconds to nanoseconds.
+func scale(t, num, den uint64) uint64 {
+	t *= num
+	return t/den*1000000000 + t%den*1000000000/den
+}
+
+// parseFFMetadata parses the chapters of an ffmpeg FFMETADATA file. Global
+// and stream metadata is ignored.
+func parseFFMetadata(r io.Reader) ([]*matroska.Chapter, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+
+	if !s.Scan() || !strings.HasPrefix(strings.TrimPrefix(s.Text(), "\ufeff"), ";FFMETADATA") {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not find FFMETADATA header")
+	}
+
+	var ret []*matroska.Chapter
+	var c *matroska.Chapter
+	var start, end uint64
+	num, den := uint64(1), uint64(1000)
+
+	finish := func() {
+		if c == nil {
+			return
+		}
+		c.Start = scale(start, num, den)
+		c.End = scale(end, num, den)
+		ret = append(ret, c)
+		c = nil
+	}
+
+	var line string
+	for s.Scan() {
+		// A backslash at the end of a line escapes the newline.
+		line += s.Text()
+		if escapedNewline(line) {
+			line = line[:len(line)-1] + "\\\n"
+			continue
+		}
+		l := line
+		line = ""
+
+		if l == "" || l[0] == ';' || l[0] == '#' {
+			continue
+		}
+		if l[0] == '[' {
+			finish()
+			if strings.TrimSpace(l) == "[CHAPTER]" {
+				c = newChapter(0, "")
+				start, end = 0, 0
+				num, den = 1, 1000
+			}
+			continue
+		}
+		if c == nil {
+			continue
+		}
+
+		key, value, ok := splitFF(l)
+		if !ok {
+			return nil, fmt.Errorf("invalid FFMETADATA line: %s", l)
+		}
+
+		var err error
+		switch strings.ToUpper(key) {
+		case "TIMEBASE":
+			parts := strings.Split(value, "/")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid TIMEBASE: %s", value)
+			}
+			num, err = strconv.ParseUint(parts[0], 10, 64)
+			if err == nil {
+				den, err = strconv.ParseUint(parts[1], 10, 64)
+			}
+			if err != nil || num == 0 || den == 0 {
+				return nil, fmt.Errorf("invalid TIMEBASE: %s", value)
+			}
+		case "START":
+			start, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid START: %s", value)
+			}
+		case "END":
+			end, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid END: %s", value)
+			}
+		case "TITLE":
+			c.Display = []matroska.ChapterDisplay{{String: value}}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+
+	return edition(ret), nil
+}
+
+func writeFFMetadata(w io.Writer, chapters []*matroska.Chapter) error {
+	children := defaultEdition(chapters).Children
+
+	var b []byte
+	b = append(b, ";FFMETADATA1\n"...)
+	for i, c := range children {
+		end := c.End
+		if end == 0 && i+1 < len(children) {
+			end = children[i+1].Start
+		}
+		if end < c.Start {
+			end = c.Start
+		}
+
+		b = append(b, "[CHAPTER]\nTIMEBASE=1/1000000000\n"...)
+		b = append(b, fmt.Sprintf("START=%d\nEND=%d\n", c.Start, end)...)
+		if t := title(c); t != "" {
+			b = append(b, "title="...)
+			b = append(b, ffEscaper.Replace(t)...)
+			b = append(b, '\n')
+		}
+	}
+
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,86 @@
+package chapters
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// parseOGM parses OGM simple chapters:
+//
+//	CHAPTER01=00:00:00.000
+//	CHAPTER01NAME=Intro
+func parseOGM(r io.Reader) ([]*matroska.Chapter, error) {
+	byNumber := make(map[int]*matroska.Chapter)
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(s.Text(), "\ufeff"))
+		if line == "" {
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 || !strings.HasPrefix(strings.ToUpper(line), "CHAPTER") {
+			return nil, fmt.Errorf("invalid OGM chapter line: %s", line)
+		}
+		key := strings.ToUpper(line[len("CHAPTER"):eq])
+		value := line[eq+1:]
+
+		isName := strings.HasSuffix(key, "NAME")
+		key = strings.TrimSuffix(key, "NAME")
+		n, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OGM chapter line: %s", line)
+		}
+
+		c, ok := byNumber[n]
+		if !ok {
+			c = newChapter(0, "")
+			byNumber[n] = c
+		}
+		if isName {
+			c.Display = []matroska.ChapterDisplay{{String: value}}
+		} else {
+			c.Start, err = parseTime(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	var numbers []int
+	for n := range byNumber {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	var ret []*matroska.Chapter
+	for _, n := range numbers {
+		ret = append(ret, byNumber[n])
+	}
+
+	return edition(ret), nil
+}
+
+func writeOGM(w io.Writer, chapters []*matroska.Chapter) error {
+	var b []byte
+	for i, c := range defaultEdition(chapters).Children {
+		b = append(b, fmt.Sprintf("CHAPTER%02d=%s\n", i+1, formatTime(c.Start, 3))...)
+		// Names are a single line.
+		name := strings.Replace(normalizeNewlines(title(c)), "\n", " ", -1)
+		b = append(b, fmt.Sprintf("CHAPTER%02dNAME=%s\n", i+1, name)...)
+	}
+
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,94 @@
+package chapters
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+var (
+	vttEscaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	vttUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ")
+)
+
+// parseWebVTT parses a WebVTT chapter track, using the text of each cue as
+// the chapter name.
+func parseWebVTT(r io.Reader) ([]*matroska.Chapter, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	text := normalizeNewlines(strings.TrimPrefix(string(data), "\ufeff"))
+	blocks := strings.Split(text, "\n\n")
+	if len(blocks) == 0 || !strings.HasPrefix(blocks[0], "WEBVTT") {
+		return nil, fmt.Errorf("could not find WEBVTT header")
+	}
+
+	var ret []*matroska.Chapter
+	for _, block := range blocks[1:] {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		if lines[0] == "" || strings.HasPrefix(lines[0], "NOTE") ||
+			strings.HasPrefix(lines[0], "STYLE") || strings.HasPrefix(lines[0], "REGION") {
+			continue
+		}
+
+		// The cue identifier is optional.
+		if !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 || !strings.Contains(lines[0], "-->") {
+			return nil, fmt.Errorf("invalid WebVTT cue: %s", block)
+		}
+
+		times := strings.SplitN(lines[0], "-->", 2)
+		start, err := parseTime(times[0])
+		if err != nil {
+			return nil, err
+		}
+		// Cue settings may follow the end time.
+		endFields := strings.Fields(times[1])
+		if len(endFields) == 0 {
+			return nil, fmt.Errorf("invalid WebVTT cue timing: %s", lines[0])
+		}
+		end, err := parseTime(endFields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		c := newChapter(start, vttUnescaper.Replace(strings.Join(lines[1:], "\n")))
+		c.End = end
+		ret = append(ret, c)
+	}
+
+	return edition(ret), nil
+}
+
+func writeWebVTT(w io.Writer, chapters []*matroska.Chapter) error {
+	children := defaultEdition(chapters).Children
+
+	var b []byte
+	b = append(b, "WEBVTT\n"...)
+	for i, c := range children {
+		// Every cue needs an end time.
+		end := c.End
+		if end == 0 && i+1 < len(children) {
+			end = children[i+1].Start
+		}
+		if end < c.Start {
+			end = c.Start
+		}
+
+		b = append(b, fmt.Sprintf("\n%d\n%s --> %s\n", i+1, formatTime(c.Start, 3), formatTime(end, 3))...)
+		// Blank lines would end the cue early.
+		t := strings.Replace(normalizeNewlines(title(c)), "\n\n", "\n", -1)
+		b = append(b, vttEscaper.Replace(t)...)
+		b = append(b, '\n')
+	}
+
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,272 @@
+package chapters
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/dwbuiten/matroska/internal/mkvxml"
+)
+
+// The layout of mkvmerge's chapter XML. Flags are pointers, since some
+// default to 1 when missing.
+type xmlChapters struct {
+	XMLName  xml.Name     `xml:"Chapters"`
+	Editions []xmlEdition `xml:"EditionEntry"`
+}
+
+type xmlEdition struct {
+	UID     uint64    `xml:"EditionUID,omitempty"`
+	Hidden  *int      `xml:"EditionFlagHidden"`
+	Default *int      `xml:"EditionFlagDefault"`
+	Ordered *int      `xml:"EditionFlagOrdered"`
+	Atoms   []xmlAtom `xml:"ChapterAtom"`
+}
+
+type xmlAtom struct {
+	UID        uint64         `xml:"ChapterUID,omitempty"`
+	Start      string         `xml:"ChapterTimeStart"`
+	End        string         `xml:"ChapterTimeEnd,omitempty"`
+	Hidden     *int           `xml:"ChapterFlagHidden"`
+	Enabled    *int           `xml:"ChapterFlagEnabled"`
+	SegmentUID *mkvxml.Binary `xml:"ChapterSegmentUID"`
+	Tracks     *xmlTracks     `xml:"ChapterTrack"`
+	Display    []xmlDisplay   `xml:"ChapterDisplay"`
+	Process    []xmlProcess   `xml:"ChapterProcess"`
+	Atoms      []xmlAtom      `xml:"ChapterAtom"`
+}
+
+type xmlTracks struct {
+	Numbers []uint64 `xml:"ChapterTrackNumber"`
+}
+
+type xmlDisplay struct {
+	String    string   `xml:"ChapterString"`
+	Languages []string `xml:"ChapterLanguage"`
+	Countries []string `xml:"ChapterCountry"`
+}
+
+type xmlProcess struct {
+	CodecID  uint32         `xml:"ChapterProcessCodecID"`
+	Private  *mkvxml.Binary `xml:"ChapterProcessPrivate"`
+	Commands []xmlCommand   `xml:"ChapterProcessCommand"`
+}
+
+type xmlCommand struct {
+	Time uint32        `xml:"ChapterProcessTime"`
+	Data mkvxml.Binary `xml:"ChapterProcessData"`
+}
+
+func flag(v bool) *int {
+	ret := 0
+	if v {
+		ret = 1
+	}
+	return &ret
+}
+
+func flagValue(v *int, def bool) bool {
+	if v == nil {
+		return def
+	}
+	return *v != 0
+}
+
+func toXMLAtom(c *matroska.Chapter) xmlAtom {
+	ret := xmlAtom{
+		UID:     c.UID,
+		Start:   formatTime(c.Start, 9),
+		Hidden:  flag(c.Hidden),
+		Enabled: flag(c.Enabled),
+	}
+	if c.End != 0 {
+		ret.End = formatTime(c.End, 9)
+	}
+	var zero [16]byte
+	if c.SegmentUID != zero {
+		ret.SegmentUID = mkvxml.NewBinary(c.SegmentUID[:])
+	}
+	if len(c.Tracks) != 0 {
+		ret.Tracks = &xmlTracks{Numbers: c.Tracks}
+	}
+
+	for _, d := range c.Display {
+		display := xmlDisplay{
+			String: d.String,
+		}
+		if lang := strings.TrimRight(d.Language, "\x00 "); lang != "" {
+			display.Languages = []string{lang}
+		}
+		if country := strings.TrimRight(d.Country, "\x00 "); country != "" {
+			display.Countries = []string{country}
+		}
+		ret.Display = append(ret.Display, display)
+	}
+
+	for _, p := range c.Process {
+		process := xmlProcess{
+			CodecID: p.CodecID,
+		}
+		if len(p.CodecPrivate) != 0 {
+			process.Private = mkvxml.NewBinary(p.CodecPrivate)
+		}
+		for _, cmd := range p.Commands {
+			process.Commands = append(process.Commands, xmlCommand{
+				Time: cmd.Time,
+				Data: *mkvxml.NewBinary(cmd.Command),
+			})
+		}
+		ret.Process = append(ret.Process, process)
+	}
+
+	for _, child := range c.Children {
+		ret.Atoms = append(ret.Atoms, toXMLAtom(child))
+	}
+
+	return ret
+}
+
+func writeXML(w io.Writer, chapters []*matroska.Chapter) error {
+	var doc xmlChapters
+	for _, e := range chapters {
+		edition := xmlEdition{
+			UID:     e.UID,
+			Hidden:  flag(e.Hidden),
+			Default: flag(e.Default),
+			Ordered: flag(e.Ordered),
+		}
+		for _, c := range e.Children {
+			edition.Atoms = append(edition.Atoms, toXMLAtom(c))
+		}
+		doc.Editions = append(doc.Editions, edition)
+	}
+
+	b, err := xml.MarshalIndent(&doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	out = append(out, "<?xml version=\"1.0\"?>\n"...)
+	out = append(out, "<!-- <!DOCTYPE Chapters SYSTEM \"matroskachapters.dtd\"> -->\n"...)
+	out = append(out, b...)
+	out = append(out, '\n')
+
+	_, err = w.Write(out)
+	return err
+}
+
+func fromXMLAtom(a *xmlAtom) (*matroska.Chapter, error) {
+	start, err := parseTime(a.Start)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &matroska.Chapter{
+		UID:     a.UID,
+		Start:   start,
+		Hidden:  flagValue(a.Hidden, false),
+		Enabled: flagValue(a.Enabled, true),
+	}
+	if a.End != "" {
+		ret.End, err = parseTime(a.End)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if a.SegmentUID != nil {
+		uid, err := a.SegmentUID.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(uid) != 16 {
+			return nil, fmt.Errorf("invalid ChapterSegmentUID length: %d", len(uid))
+		}
+		copy(ret.SegmentUID[:], uid)
+	}
+	if a.Tracks != nil {
+		ret.Tracks = a.Tracks.Numbers
+	}
+
+	for _, d := range a.Display {
+		// Matroska has a display per language, while the XML allows
+		// several languages in one.
+		langs := d.Languages
+		if len(langs) == 0 {
+			langs = []string{"eng"}
+		}
+		country := ""
+		if len(d.Countries) != 0 {
+			country = d.Countries[0]
+		}
+		for _, lang := range langs {
+			ret.Display = append(ret.Display, matroska.ChapterDisplay{
+				String:   d.String,
+				Language: strings.TrimSpace(lang),
+				Country:  strings.TrimSpace(country),
+			})
+		}
+	}
+
+	for _, p := range a.Process {
+		process := matroska.ChapterProcess{
+			CodecID: p.CodecID,
+		}
+		process.CodecPrivate, err = p.Private.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		for _, cmd := range p.Commands {
+			data, err := cmd.Data.Bytes()
+			if err != nil {
+				return nil, err
+			}
+			process.Commands = append(process.Commands, matroska.ChapterCommand{
+				Time:    cmd.Time,
+				Command: data,
+			})
+		}
+		ret.Process = append(ret.Process, process)
+	}
+
+	for i := range a.Atoms {
+		child, err := fromXMLAtom(&a.Atoms[i])
+		if err != nil {
+			return nil, err
+		}
+		ret.Children = append(ret.Children, child)
+	}
+
+	return ret, nil
+}
+
+func parseXML(r io.Reader) ([]*matroska.Chapter, error) {
+	var doc xmlChapters
+	err := xml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse chapter XML: %s", err.Error())
+	}
+
+	var ret []*matroska.Chapter
+	for _, e := range doc.Editions {
+		edition := &matroska.Chapter{
+			UID:     e.UID,
+			Hidden:  flagValue(e.Hidden, false),
+			Default: flagValue(e.Default, false),
+			Ordered: flagValue(e.Ordered, false),
+			Enabled: true,
+		}
+		for i := range e.Atoms {
+			c, err := fromXMLAtom(&e.Atoms[i])
+			if err != nil {
+				return nil, err
+			}
+			edition.Children = append(edition.Children, c)
+		}
+		ret = append(ret, edition)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,166 @@
+// Package clip cuts time ranges out of Matroska files, producing
+// self-contained files with their own Cues and Duration, and serves them
+// over HTTP.
+package clip
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// isWebM returns whether all of d's tracks are allowed in WebM.
+func isWebM(d *matroska.Demuxer) (bool, error) {
+	count, err := d.GetNumTracks()
+	if err != nil {
+		return false, err
+	}
+
+	for i := uint(0); i < count; i++ {
+		ti, err := d.GetTrackInfo(i)
+		if err != nil {
+			return false, err
+		}
+		if !matroska.WebMCodec(ti.CodecID) || ti.CompEnabled {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Write writes the part of d from start to end, in nanoseconds, to w. If
+// end is 0, it runs to the end of the file.
+//
+// The clip starts at the reference track's keyframe at or before start,
+// which is the first video track if there is one, and timestamps are
+// rebased so that keyframe is at 0. Tracks are cut in decode order at end,
+// so the clip stays decodable. Subtitles which are still on screen at the
+// start are kept. Tags are copied, but chapters are not.
+//
+// The output is WebM if all tracks are allowed in WebM, and Matroska
+// otherwise.
+func Write(d *matroska.Demuxer, w io.WriteSeeker, start, end uint64) error {
+	if end != 0 && end <= start {
+		return fmt.Errorf("invalid range: %d-%d", start, end)
+	}
+
+	m, err := matroska.NewMuxer(w)
+	if err != nil {
+		return err
+	}
+
+	info, err := d.GetFileInfo()
+	if err != nil {
+		return err
+	}
+	err = m.SetSegmentInfo(&matroska.SegmentInfo{
+		Title:         info.Title,
+		TimecodeScale: info.TimecodeScale,
+	})
+	if err != nil {
+		return err
+	}
+
+	count, err := d.GetNumTracks()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("could not find any tracks")
+	}
+
+	var tracks []*matroska.TrackInfo
+	for i := uint(0); i < count; i++ {
+		ti, err := d.GetTrackInfo(i)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.AddTrack(ti)
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, ti)
+	}
+	ref := uint8(matroska.ReferenceTrack(tracks))
+
+	webm, err := isWebM(d)
+	if err != nil {
+		return err
+	}
+	if webm {
+		err = m.SetDocType("webm")
+		if err != nil {
+			return err
+		}
+	}
+
+	tags := d.GetTags()
+	if len(tags) != 0 {
+		err = m.SetTags(tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Seeking everything to exactly the keyframe also brings back
+	// subtitles which are still on screen.
+	base, err := d.SeekKeyFrame(ref, start)
+	if err == io.EOF {
+		return m.Close()
+	} else if err != nil {
+		return err
+	}
+	if end != 0 && base >= end {
+		return m.Close()
+	}
+
+	done := make(map[uint8]bool)
+	for {
+		p, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if end != 0 && p.StartTime >= end+matroska.Lookahead {
+			break
+		}
+		if end != 0 && p.StartTime >= end {
+			done[p.Track] = true
+		}
+		if done[p.Track] {
+			continue
+		}
+
+		if p.StartTime < base {
+			// Only subtitles which are still on screen are kept,
+			// cut down to start at the clip's start.
+			ti, err := d.GetTrackInfo(uint(p.Track))
+			if err != nil {
+				return err
+			}
+			if ti.Type != matroska.TypeSubtitle || p.Flags&matroska.UnknownEnd != 0 || p.EndTime <= base {
+				continue
+			}
+			p.StartTime = base
+		}
+
+		p.StartTime -= base
+		if p.EndTime >= base {
+			p.EndTime -= base
+		} else {
+			p.EndTime = p.StartTime
+		}
+
+		err = m.WritePacket(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.Close()
+}
@@ -0,0 +1,135 @@
+package clip
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Handler serves clips of a file. The range is given by the start and end
+// query parameters, in seconds, which may have fractions. Both are
+// optional.
+//
+// Clips are written to a temporary file, which is removed once it has been
+// served with support for range requests. HEAD requests only get the
+// headers, without a clip being built.
+type Handler struct {
+	open func() (io.ReadSeeker, error)
+	name string
+}
+
+// NewHandler creates a handler for the file opened by open, which is
+// called for every request. If the returned reader is an io.Closer, it is
+// closed when the clip has been built. name is used to derive the clip's
+// file name.
+func NewHandler(open func() (io.ReadSeeker, error), name string) *Handler {
+	return &Handler{
+		open: open,
+		name: name,
+	}
+}
+
+// parseSeconds parses a time in seconds to nanoseconds.
+func parseSeconds(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return uint64(math.Round(v * 1000000000)), nil
+}
+
+// clip writes the clip to a temporary file, unless head is set, and returns
+// whether it is WebM. The caller must close and remove the file.
+func (h *Handler) clip(start, end uint64, head bool) (*os.File, bool, error) {
+	r, err := h.open()
+	if err != nil {
+		return nil, false, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	d, err := matroska.NewDemuxer(r)
+	if err != nil {
+		return nil, false, err
+	}
+	defer d.Close()
+
+	webm, err := isWebM(d)
+	if err != nil || head {
+		return nil, webm, err
+	}
+
+	f, err := ioutil.TempFile("", "clip")
+	if err != nil {
+		return nil, false, fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+
+	err = Write(d, f, start, end)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, false, err
+	}
+
+	return f, webm, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := req.URL.Query()
+	start, err := parseSeconds(q.Get("start"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	end, err := parseSeconds(q.Get("end"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if end != 0 && end <= start {
+		http.Error(w, "end must be after start", http.StatusBadRequest)
+		return
+	}
+
+	head := req.Method == http.MethodHead
+	f, webm, err := h.clip(start, end, head)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if f != nil {
+		defer os.Remove(f.Name())
+		defer f.Close()
+	}
+
+	name := h.name + ".mkv"
+	contentType := "video/x-matroska"
+	if webm {
+		name = h.name + ".webm"
+		contentType = "video/webm"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name))
+	if head {
+		w.Header().Set("Accept-Ranges", "bytes")
+		return
+	}
+
+	http.ServeContent(w, req, name, time.Time{}, f)
+}
@@ -0,0 +1,375 @@
+// Package concat appends Matroska files with compatible tracks into a
+// single file, such as recordings which were written in chunks.
+package concat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Appender writes the inputs given to Append one after another to a single
+// output, with continuous timestamps, merged chapters and new Cues.
+//
+// The tags and attachments of all inputs are merged, leaving out those
+// which are the same as ones of an earlier input. Tags which target
+// chapters or editions are dropped, as chapters get new UIDs.
+//
+// All inputs must have the same tracks as the first one, in the same
+// order: the same types and codecs, with the same CodecPrivate, and the
+// same audio and video parameters.
+type Appender struct {
+	m      *matroska.Muxer
+	tracks []*matroska.TrackInfo
+
+	// The end of everything written so far, which is where the next
+	// input starts.
+	end    uint64
+	inputs int
+
+	sourceChapters bool
+	chapters       []*matroska.Chapter
+
+	tags        []*matroska.Tag
+	attachments []attachment
+}
+
+type attachment struct {
+	info *matroska.Attachment
+	data []byte
+}
+
+// NewAppender creates an Appender writing to w.
+func NewAppender(w io.WriteSeeker) (*Appender, error) {
+	m, err := matroska.NewMuxer(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Appender{
+		m: m,
+	}, nil
+}
+
+// SetSourceChapters sets whether a chapter is added for each input, which
+// then contains the input's own chapters. It must be called before the
+// first call to Append.
+func (a *Appender) SetSourceChapters(enabled bool) {
+	a.sourceChapters = enabled
+}
+
+// compatible returns an error describing why ti can not be appended to a
+// track which was set up for ref.
+func compatible(ref, ti *matroska.TrackInfo) error {
+	if ti.Type != ref.Type {
+		return fmt.Errorf("track type %d differs from %d", ti.Type, ref.Type)
+	}
+	if ti.CodecID != ref.CodecID {
+		return fmt.Errorf("CodecID %s differs from %s", ti.CodecID, ref.CodecID)
+	}
+	if !bytes.Equal(ti.CodecPrivate, ref.CodecPrivate) {
+		return fmt.Errorf("CodecPrivate differs from the first input, so the streams were not encoded with the same settings")
+	}
+	if ti.CompEnabled != ref.CompEnabled || ti.CompMethod != ref.CompMethod || !bytes.Equal(ti.CompMethodPrivate, ref.CompMethodPrivate) {
+		return fmt.Errorf("content compression differs")
+	}
+
+	switch ti.Type {
+	case matroska.TypeVideo:
+		if ti.Video.PixelWidth != ref.Video.PixelWidth || ti.Video.PixelHeight != ref.Video.PixelHeight {
+			return fmt.Errorf("resolution %dx%d differs from %dx%d", ti.Video.PixelWidth, ti.Video.PixelHeight, ref.Video.PixelWidth, ref.Video.PixelHeight)
+		}
+		if ti.Video.Interlaced != ref.Video.Interlaced {
+			return fmt.Errorf("interlacing differs")
+		}
+	case matroska.TypeAudio:
+		if ti.Audio.SamplingFreq != ref.Audio.SamplingFreq {
+			return fmt.Errorf("sampling frequency %g differs from %g", ti.Audio.SamplingFreq, ref.Audio.SamplingFreq)
+		}
+		if ti.Audio.Channels != ref.Audio.Channels {
+			return fmt.Errorf("channel count %d differs from %d", ti.Audio.Channels, ref.Audio.Channels)
+		}
+		if ti.Audio.BitDepth != ref.Audio.BitDepth {
+			return fmt.Errorf("bit depth %d differs from %d", ti.Audio.BitDepth, ref.Audio.BitDepth)
+		}
+	}
+
+	return nil
+}
+
+// shiftChapter returns a copy of c, moved by shift nanoseconds, with a new
+// UID so chapters of different inputs do not clash.
+func shiftChapter(c *matroska.Chapter, shift int64) *matroska.Chapter {
+	ret := *c
+	ret.UID = 0
+	ret.Start = shiftTime(c.Start, shift)
+	if c.End != 0 {
+		ret.End = shiftTime(c.End, shift)
+	}
+	ret.Children = nil
+	for _, child := range c.Children {
+		ret.Children = append(ret.Children, shiftChapter(child, shift))
+	}
+	return &ret
+}
+
+func shiftTime(t uint64, shift int64) uint64 {
+	if shift < 0 && uint64(-shift) > t {
+		return 0
+	}
+	return uint64(int64(t) + shift)
+}
+
+// Append appends all of d, from its current position, to the output. Its
+// timestamps are moved so that its first packet directly follows the end
+// of the previous input.
+//
+// name is the title of the input's chapter, if SetSourceChapters is
+// enabled. If it is empty, the input's title is used.
+func (a *Appender) Append(d *matroska.Demuxer, name string) error {
+	count, err := d.GetNumTracks()
+	if err != nil {
+		return err
+	}
+
+	info, err := d.GetFileInfo()
+	if err != nil {
+		return err
+	}
+
+	if a.inputs == 0 {
+		err = a.m.SetSegmentInfo(&matroska.SegmentInfo{
+			Title:         info.Title,
+			TimecodeScale: info.TimecodeScale,
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := uint(0); i < count; i++ {
+			ti, err := d.GetTrackInfo(i)
+			if err != nil {
+				return err
+			}
+			_, err = a.m.AddTrack(ti)
+			if err != nil {
+				return err
+			}
+			a.tracks = append(a.tracks, ti)
+		}
+		if len(a.tracks) == 0 {
+			return fmt.Errorf("could not find any tracks")
+		}
+	} else {
+		if int(count) != len(a.tracks) {
+			return fmt.Errorf("could not append input %d: it has %d tracks instead of %d", a.inputs, count, len(a.tracks))
+		}
+		for i := uint(0); i < count; i++ {
+			ti, err := d.GetTrackInfo(i)
+			if err != nil {
+				return err
+			}
+			err = compatible(a.tracks[i], ti)
+			if err != nil {
+				return fmt.Errorf("could not append input %d: track %d: %s", a.inputs, ti.Number, err.Error())
+			}
+		}
+	}
+
+	err = a.mergeMetadata(d)
+	if err != nil {
+		return fmt.Errorf("could not append input %d: %s", a.inputs, err.Error())
+	}
+
+	start := a.end
+	var shift int64
+	first := true
+	for {
+		p, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if first {
+			shift = int64(start) - int64(p.StartTime)
+			first = false
+		}
+
+		p.StartTime = shiftTime(p.StartTime, shift)
+		p.EndTime = shiftTime(p.EndTime, shift)
+
+		err = a.m.WritePacket(p)
+		if err != nil {
+			return err
+		}
+
+		end := p.StartTime
+		if p.Flags&matroska.UnknownEnd == 0 && p.EndTime > p.StartTime {
+			end = p.EndTime
+		} else {
+			end += a.tracks[p.Track].DefaultDuration
+		}
+		if end > a.end {
+			a.end = end
+		}
+	}
+
+	var chapters []*matroska.Chapter
+	if editions := d.GetChapters(); len(editions) != 0 {
+		edition := editions[0]
+		for _, e := range editions {
+			if e.Default {
+				edition = e
+				break
+			}
+		}
+		for _, c := range edition.Children {
+			chapters = append(chapters, shiftChapter(c, shift))
+		}
+	}
+
+	if a.sourceChapters {
+		if name == "" {
+			name = info.Title
+		}
+		if name == "" {
+			name = fmt.Sprintf("Part %d", a.inputs+1)
+		}
+		a.chapters = append(a.chapters, &matroska.Chapter{
+			Start:    start,
+			End:      a.end,
+			Enabled:  true,
+			Display:  []matroska.ChapterDisplay{{String: name}},
+			Children: chapters,
+		})
+	} else {
+		a.chapters = append(a.chapters, chapters...)
+	}
+
+	a.inputs++
+
+	return nil
+}
+
+// mergeMetadata adds the attachments and tags of d which are not already
+// in the output. Tags targeting tracks or attachments are changed to the
+// UIDs used in the output.
+func (a *Appender) mergeMetadata(d *matroska.Demuxer) error {
+	uids := make(map[uint64]uint64)
+	for _, at := range d.GetAttachments() {
+		data, err := d.ReadAttachment(at)
+		if err != nil {
+			return fmt.Errorf("could not read attachment %s: %s", at.Name, err.Error())
+		}
+
+		uid, found := a.findAttachment(at, data)
+		if !found {
+			info := *at
+			if uid != 0 {
+				// A different attachment already has this UID.
+				info.UID = a.unusedUID()
+			}
+			a.attachments = append(a.attachments, attachment{&info, data})
+			uid = info.UID
+		}
+		uids[at.UID] = uid
+	}
+
+	for i := range a.tracks {
+		ti, err := d.GetTrackInfo(uint(i))
+		if err != nil {
+			return err
+		}
+		if a.tracks[i].UID != 0 {
+			uids[ti.UID] = a.tracks[i].UID
+		}
+	}
+
+tags:
+	for _, t := range d.GetTags() {
+		tag := *t
+		tag.Targets = nil
+		for _, target := range t.Targets {
+			switch target.Type {
+			case matroska.TargetTrack, matroska.TargetAttachment:
+				if uid, ok := uids[target.UID]; ok && uid != 0 {
+					target.UID = uid
+				}
+			default:
+				continue tags
+			}
+			tag.Targets = append(tag.Targets, target)
+		}
+
+		for _, have := range a.tags {
+			if reflect.DeepEqual(have, &tag) {
+				continue tags
+			}
+		}
+		a.tags = append(a.tags, &tag)
+	}
+
+	return nil
+}
+
+// findAttachment returns the UID of an attachment already in the output
+// with the same name, type and data as at, or else at's UID if it is
+// already in use.
+func (a *Appender) findAttachment(at *matroska.Attachment, data []byte) (uint64, bool) {
+	uid := uint64(0)
+	for _, have := range a.attachments {
+		if have.info.Name == at.Name && have.info.MimeType == at.MimeType && bytes.Equal(have.data, data) {
+			return have.info.UID, true
+		}
+		if at.UID != 0 && have.info.UID == at.UID {
+			uid = at.UID
+		}
+	}
+	return uid, false
+}
+
+// unusedUID returns a UID which no attachment in the output has.
+func (a *Appender) unusedUID() uint64 {
+	uid := uint64(1)
+	for _, have := range a.attachments {
+		if have.info.UID >= uid {
+			uid = have.info.UID + 1
+		}
+	}
+	return uid
+}
+
+// Close writes the chapters, tags and attachments, and finalizes the
+// output.
+func (a *Appender) Close() error {
+	for _, at := range a.attachments {
+		err := a.m.AddAttachment(at.info, at.data)
+		if err != nil {
+			return err
+		}
+	}
+	if len(a.tags) != 0 {
+		err := a.m.SetTags(a.tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(a.chapters) != 0 {
+		err := a.m.SetChapters([]*matroska.Chapter{{
+			Default:  true,
+			Enabled:  true,
+			Children: a.chapters,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.m.Close()
+}
@@ -0,0 +1,185 @@
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Segment is a media segment produced by a Segmenter.
+type Segment struct {
+	// The segment's start time and duration, in nanoseconds.
+	Start    uint64
+	Duration uint64
+	// The segment's clusters.
+	Data []byte
+}
+
+// Segmenter cuts a Demuxer into an init segment and media segments for
+// live DASH. Media segments start on keyframes of the reference track,
+// which is the first video track if there is one.
+type Segmenter struct {
+	d        *matroska.Demuxer
+	m        *matroska.Muxer
+	buf      bytes.Buffer
+	init     []byte
+	duration uint64
+
+	mask  uint64
+	index map[uint8]uint8
+	ref   uint8
+
+	pending *matroska.Packet
+	eof     bool
+}
+
+// NewSegmenter creates a Segmenter for the given tracks of d, or all of them
+// if none are given. Segments are cut at the first keyframe after duration
+// nanoseconds. The output is WebM if all tracks are allowed in WebM, and
+// Matroska otherwise.
+//
+// Packets are read from the demuxer's current position.
+func NewSegmenter(d *matroska.Demuxer, duration uint64, tracks ...uint) (*Segmenter, error) {
+	s := &Segmenter{
+		d:        d,
+		duration: duration,
+		mask:     ^uint64(0),
+		index:    make(map[uint8]uint8),
+	}
+	s.m = matroska.NewStreamingMuxer(&s.buf)
+
+	if len(tracks) == 0 {
+		count, err := d.GetNumTracks()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint(0); i < count; i++ {
+			tracks = append(tracks, i)
+		}
+	}
+
+	info, err := d.GetFileInfo()
+	if err != nil {
+		return nil, err
+	}
+	err = s.m.SetSegmentInfo(&matroska.SegmentInfo{
+		Title:         info.Title,
+		TimecodeScale: info.TimecodeScale,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	webm := true
+	var infos []*matroska.TrackInfo
+	for _, track := range tracks {
+		ti, err := d.GetTrackInfo(track)
+		if err != nil {
+			return nil, err
+		}
+
+		idx, err := s.m.AddTrack(ti)
+		if err != nil {
+			return nil, err
+		}
+		s.index[uint8(track)] = uint8(idx)
+		s.mask &^= uint64(1) << track
+		infos = append(infos, ti)
+		webm = webm && matroska.WebMCodec(ti.CodecID) && !ti.CompEnabled
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("could not find any tracks")
+	}
+	s.ref = uint8(matroska.ReferenceTrack(infos))
+
+	if webm {
+		err = s.m.SetDocType("webm")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Clusters are cut by us, at segment boundaries.
+	s.m.SetClusterLimits(^uint64(0), 1<<30)
+
+	err = s.m.WriteHeader()
+	if err != nil {
+		return nil, err
+	}
+	s.init = append([]byte{}, s.buf.Bytes()...)
+	s.buf.Reset()
+
+	return s, nil
+}
+
+// Init returns the init segment, which is everything up to the first
+// cluster, with the segment's size left unknown.
+func (s *Segmenter) Init() []byte {
+	return s.init
+}
+
+// Next returns the next media segment, or io.EOF once there are no more
+// packets.
+func (s *Segmenter) Next() (*Segment, error) {
+	seg := &Segment{}
+	started := false
+	end := uint64(0)
+
+	for {
+		p := s.pending
+		s.pending = nil
+		if p == nil && !s.eof {
+			var err error
+			p, err = s.d.ReadPacketMask(s.mask)
+			if err == io.EOF {
+				s.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+			if p != nil {
+				p.Track = s.index[p.Track]
+			}
+		}
+		if p == nil {
+			break
+		}
+
+		if started && p.Track == s.ref && p.Flags&matroska.KF != 0 && p.StartTime >= seg.Start+s.duration {
+			s.pending = p
+			end = p.StartTime
+			break
+		}
+		if !started {
+			seg.Start = p.StartTime
+			started = true
+		}
+
+		if p.Flags&matroska.UnknownEnd == 0 && p.EndTime > end {
+			end = p.EndTime
+		} else if p.StartTime > end {
+			end = p.StartTime
+		}
+
+		err := s.m.WritePacket(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !started {
+		return nil, io.EOF
+	}
+
+	err := s.m.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	seg.Duration = end - seg.Start
+	seg.Data = append([]byte{}, s.buf.Bytes()...)
+	s.buf.Reset()
+
+	return seg, nil
+}
@@ -0,0 +1,268 @@
+// Package dash generates MPEG-DASH manifests and segments from WebM files.
+//
+// On-demand files, which have one track each and Cues, can be described
+// as they are, with an MPD pointing at byte ranges of the files. For live
+// use, a Segmenter cuts a Demuxer into an init segment and media segments.
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+const (
+	mpdNamespace      = "urn:mpeg:dash:schema:mpd:2011"
+	onDemandProfile   = "urn:mpeg:dash:profile:webm-on-demand:2012"
+	channelConfScheme = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+)
+
+type mpdInitialization struct {
+	Range string `xml:"range,attr"`
+}
+
+type mpdSegmentBase struct {
+	IndexRange     string            `xml:"indexRange,attr"`
+	Initialization mpdInitialization `xml:"Initialization"`
+}
+
+type mpdChannelConf struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	ID                string          `xml:"id,attr"`
+	Bandwidth         uint64          `xml:"bandwidth,attr"`
+	Codecs            string          `xml:"codecs,attr"`
+	Width             uint32          `xml:"width,attr,omitempty"`
+	Height            uint32          `xml:"height,attr,omitempty"`
+	AudioSamplingRate uint32          `xml:"audioSamplingRate,attr,omitempty"`
+	ChannelConf       *mpdChannelConf `xml:"AudioChannelConfiguration,omitempty"`
+	BaseURL           string          `xml:"BaseURL"`
+	SegmentBase       mpdSegmentBase  `xml:"SegmentBase"`
+}
+
+type mpdAdaptationSet struct {
+	ID                      int                  `xml:"id,attr"`
+	MimeType                string               `xml:"mimeType,attr"`
+	Lang                    string               `xml:"lang,attr,omitempty"`
+	SubsegmentAlignment     bool                 `xml:"subsegmentAlignment,attr"`
+	SubsegmentStartsWithSAP int                  `xml:"subsegmentStartsWithSAP,attr"`
+	Representations         []*mpdRepresentation `xml:"Representation"`
+}
+
+type mpdPeriod struct {
+	ID             string              `xml:"id,attr"`
+	Start          string              `xml:"start,attr"`
+	Duration       string              `xml:"duration,attr"`
+	AdaptationSets []*mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdRoot struct {
+	XMLName                   xml.Name  `xml:"MPD"`
+	Namespace                 string    `xml:"xmlns,attr"`
+	Type                      string    `xml:"type,attr"`
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string    `xml:"minBufferTime,attr"`
+	Profiles                  string    `xml:"profiles,attr"`
+	Period                    mpdPeriod `xml:"Period"`
+}
+
+// MPD builds an on-demand MPD out of single track WebM files.
+type MPD struct {
+	sets     []*mpdAdaptationSet
+	keys     []string
+	duration uint64
+	count    int
+}
+
+// NewMPD creates an empty on-demand MPD.
+func NewMPD() *MPD {
+	return &MPD{}
+}
+
+// duration formats nanoseconds as an xs:duration.
+func duration(ns uint64) string {
+	return fmt.Sprintf("PT%d.%03dS", ns/1000000000, ns%1000000000/1000000)
+}
+
+// codecString returns the codecs parameter for a track, as used in DASH
+// and WebM MIME types.
+func codecString(ti *matroska.TrackInfo) (string, error) {
+	switch ti.CodecID {
+	case "V_VP8":
+		return "vp8", nil
+	case "V_VP9":
+		return "vp9", nil
+	case "V_AV1":
+		cp := ti.CodecPrivate
+		if len(cp) < 4 {
+			return "", fmt.Errorf("could not find av1C in CodecPrivate")
+		}
+		tier := "M"
+		if cp[2]&0x80 != 0 {
+			tier = "H"
+		}
+		depth := 8
+		if cp[2]&0x40 != 0 {
+			depth = 10
+			if cp[2]&0x20 != 0 {
+				depth = 12
+			}
+		}
+		return fmt.Sprintf("av01.%d.%02d%s.%02d", cp[1]>>5, cp[1]&0x1f, tier, depth), nil
+	case "A_OPUS":
+		return "opus", nil
+	case "A_VORBIS":
+		return "vorbis", nil
+	}
+
+	return "", fmt.Errorf("unsupported codec: %s", ti.CodecID)
+}
+
+// AddFile adds a WebM file to the MPD, as a representation. The file must
+// have a single audio or video track, and Cues. Files with the same track
+// type, codec and language share an adaptation set, so they should have
+// their keyframes aligned.
+//
+// url is the file's URL, relative to the MPD.
+func (m *MPD) AddFile(d *matroska.Demuxer, url string) error {
+	count, err := d.GetNumTracks()
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return fmt.Errorf("could not add file with %d tracks: on-demand files must have a single track", count)
+	}
+
+	ti, err := d.GetTrackInfo(0)
+	if err != nil {
+		return err
+	}
+	info, err := d.GetFileInfo()
+	if err != nil {
+		return err
+	}
+
+	codecs, err := codecString(ti)
+	if err != nil {
+		return err
+	}
+
+	cues := d.GetCues()
+	cuesPos := d.GetCuesPos()
+	cuesTop := d.GetCuesTopPos()
+	if len(cues) == 0 || cuesPos == 0 || cuesTop <= cuesPos {
+		return fmt.Errorf("could not add file without cues")
+	}
+
+	// The initialization range is everything before the first cluster,
+	// excluding the cues if they come first.
+	first := cues[0].Position
+	for _, c := range cues {
+		if c.Position < first {
+			first = c.Position
+		}
+	}
+	initEnd := d.GetSegment() + first
+	if cuesPos < initEnd {
+		initEnd = cuesPos
+	}
+
+	if info.Duration == 0 {
+		return fmt.Errorf("could not add file without a duration")
+	}
+	if info.Duration > m.duration {
+		m.duration = info.Duration
+	}
+
+	rep := &mpdRepresentation{
+		ID:        strconv.Itoa(m.count),
+		Bandwidth: uint64(float64(d.GetSegmentTop()-d.GetSegment()) * 8 * 1000000000 / float64(info.Duration)),
+		Codecs:    codecs,
+		BaseURL:   url,
+		SegmentBase: mpdSegmentBase{
+			IndexRange: fmt.Sprintf("%d-%d", cuesPos, cuesTop-1),
+			Initialization: mpdInitialization{
+				Range: fmt.Sprintf("0-%d", initEnd-1),
+			},
+		},
+	}
+	m.count++
+
+	var mimeType string
+	switch ti.Type {
+	case matroska.TypeVideo:
+		mimeType = "video/webm"
+		rep.Width = ti.Video.PixelWidth
+		rep.Height = ti.Video.PixelHeight
+	case matroska.TypeAudio:
+		mimeType = "audio/webm"
+		rep.AudioSamplingRate = uint32(ti.Audio.SamplingFreq)
+		rep.ChannelConf = &mpdChannelConf{
+			SchemeIDURI: channelConfScheme,
+			Value:       strconv.Itoa(int(ti.Audio.Channels)),
+		}
+	default:
+		return fmt.Errorf("could not add track of type %d", ti.Type)
+	}
+
+	// Video tracks often have a language only because Matroska defaults
+	// to English.
+	lang := strings.TrimRight(ti.Language, "\x00")
+	if lang == "und" || ti.Type != matroska.TypeAudio {
+		lang = ""
+	}
+
+	key := mimeType + "\x00" + codecs + "\x00" + lang
+	for i, k := range m.keys {
+		if k == key {
+			m.sets[i].Representations = append(m.sets[i].Representations, rep)
+			return nil
+		}
+	}
+
+	m.keys = append(m.keys, key)
+	m.sets = append(m.sets, &mpdAdaptationSet{
+		ID:                      len(m.sets),
+		MimeType:                mimeType,
+		Lang:                    lang,
+		SubsegmentAlignment:     true,
+		SubsegmentStartsWithSAP: 1,
+		Representations:         []*mpdRepresentation{rep},
+	})
+
+	return nil
+}
+
+// Marshal returns the MPD as XML.
+func (m *MPD) Marshal() ([]byte, error) {
+	if len(m.sets) == 0 {
+		return nil, fmt.Errorf("could not create an MPD without any files")
+	}
+
+	root := &mpdRoot{
+		Namespace:                 mpdNamespace,
+		Type:                      "static",
+		MediaPresentationDuration: duration(m.duration),
+		MinBufferTime:             "PT1S",
+		Profiles:                  onDemandProfile,
+		Period: mpdPeriod{
+			ID:             "0",
+			Start:          "PT0S",
+			Duration:       duration(m.duration),
+			AdaptationSets: m.sets,
+		},
+	}
+
+	out, err := xml.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
@@ -0,0 +1,327 @@
+package matroska
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// This file contains the bare minimum needed to write EBML. There is no
+// point in a generic EBML library here; everything that writes Matroska
+// in this package just appends elements to byte slices.
+
+// EBML and Matroska element IDs, with their length markers included.
+const (
+	idEBML               = 0x1a45dfa3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42f7
+	idEBMLMaxIDLength    = 0x42f2
+	idEBMLMaxSizeLength  = 0x42f3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+	idVoid               = 0xec
+	idCRC32              = 0xbf
+
+	idSegment = 0x18538067
+
+	idSeekHead     = 0x114d9b74
+	idSeek         = 0x4dbb
+	idSeekID       = 0x53ab
+	idSeekPosition = 0x53ac
+
+	idInfo          = 0x1549a966
+	idSegmentUID    = 0x73a4
+	idSegmentFile   = 0x7384
+	idPrevUID       = 0x3cb923
+	idPrevFilename  = 0x3c83ab
+	idNextUID       = 0x3eb923
+	idNextFilename  = 0x3e83bb
+	idTimecodeScale = 0x2ad7b1
+	idDuration      = 0x4489
+	idDateUTC       = 0x4461
+	idTitle         = 0x7ba9
+	idMuxingApp     = 0x4d80
+	idWritingApp    = 0x5741
+
+	idCluster         = 0x1f43b675
+	idTimecode        = 0xe7
+	idPrevSize        = 0xab
+	idSimpleBlock     = 0xa3
+	idBlockGroup      = 0xa0
+	idBlock           = 0xa1
+	idBlockDuration   = 0x9b
+	idReferenceBlock  = 0xfb
+	idDiscardPadding  = 0x75a2
+	idBlockAdditions  = 0x75a1
+	idBlockMore       = 0xa6
+	idBlockAddID      = 0xee
+	idBlockAdditional = 0xa5
+
+	idTracks             = 0x1654ae6b
+	idTrackEntry         = 0xae
+	idTrackNumber        = 0xd7
+	idTrackUID           = 0x73c5
+	idTrackType          = 0x83
+	idFlagEnabled        = 0xb9
+	idFlagDefault        = 0x88
+	idFlagForced         = 0x55aa
+	idFlagLacing         = 0x9c
+	idMinCache           = 0x6de7
+	idMaxCache           = 0x6df8
+	idDefaultDuration    = 0x23e383
+	idTrackTimecodeScale = 0x23314f
+	idMaxBlockAdditionID = 0x55ee
+	idName               = 0x536e
+	idLanguage           = 0x22b59c
+	idLanguageBCP47      = 0x22b59d
+	idCodecID            = 0x86
+	idCodecPrivate       = 0x63a2
+	idCodecDecodeAll     = 0xaa
+	idTrackOverlay       = 0x6fab
+	idCodecDelay         = 0x56aa
+	idSeekPreRoll        = 0x56bb
+
+	idVideo           = 0xe0
+	idFlagInterlaced  = 0x9a
+	idStereoMode      = 0x53b8
+	idPixelWidth      = 0xb0
+	idPixelHeight     = 0xba
+	idPixelCropBottom = 0x54aa
+	idPixelCropTop    = 0x54bb
+	idPixelCropLeft   = 0x54cc
+	idPixelCropRight  = 0x54dd
+	idDisplayWidth    = 0x54b0
+	idDisplayHeight   = 0x54ba
+	idDisplayUnit     = 0x54b2
+	idAspectRatioType = 0x54b3
+	idColourSpace     = 0x2eb524
+	idGammaValue      = 0x2fb523
+
+	idColour                  = 0x55b0
+	idMatrixCoefficients      = 0x55b1
+	idBitsPerChannel          = 0x55b2
+	idChromaSubsamplingHorz   = 0x55b3
+	idChromaSubsamplingVert   = 0x55b4
+	idCbSubsamplingHorz       = 0x55b5
+	idCbSubsamplingVert       = 0x55b6
+	idChromaSitingHorz        = 0x55b7
+	idChromaSitingVert        = 0x55b8
+	idRange                   = 0x55b9
+	idTransferCharacteristics = 0x55ba
+	idPrimaries               = 0x55bb
+	idMaxCLL                  = 0x55bc
+	idMaxFALL                 = 0x55bd
+	idMasteringMetadata       = 0x55d0
+	idPrimaryRChromaticityX   = 0x55d1
+	idPrimaryRChromaticityY   = 0x55d2
+	idPrimaryGChromaticityX   = 0x55d3
+	idPrimaryGChromaticityY   = 0x55d4
+	idPrimaryBChromaticityX   = 0x55d5
+	idPrimaryBChromaticityY   = 0x55d6
+	idWhitePointChromaticityX = 0x55d7
+	idWhitePointChromaticityY = 0x55d8
+	idLuminanceMax            = 0x55d9
+	idLuminanceMin            = 0x55da
+
+	idAudio                   = 0xe1
+	idSamplingFrequency       = 0xb5
+	idOutputSamplingFrequency = 0x78b5
+	idChannels                = 0x9f
+	idBitDepth                = 0x6264
+
+	idContentEncodings     = 0x6d80
+	idContentEncoding      = 0x6240
+	idContentEncodingOrder = 0x5031
+	idContentEncodingScope = 0x5032
+	idContentEncodingType  = 0x5033
+	idContentCompression   = 0x5034
+	idContentCompAlgo      = 0x4254
+	idContentCompSettings  = 0x4255
+
+	idCues                = 0x1c53bb6b
+	idCuePoint            = 0xbb
+	idCueTime             = 0xb3
+	idCueTrackPositions   = 0xb7
+	idCueTrack            = 0xf7
+	idCueClusterPosition  = 0xf1
+	idCueRelativePosition = 0xf0
+	idCueDuration         = 0xb2
+	idCueBlockNumber      = 0x5378
+
+	idAttachments     = 0x1941a469
+	idAttachedFile    = 0x61a7
+	idFileDescription = 0x467e
+	idFileName        = 0x466e
+	idFileMimeType    = 0x4660
+	idFileData        = 0x465c
+	idFileUID         = 0x46ae
+
+	idChapters           = 0x1043a770
+	idEditionEntry       = 0x45b9
+	idEditionUID         = 0x45bc
+	idEditionFlagHidden  = 0x45bd
+	idEditionFlagDefault = 0x45db
+	idEditionFlagOrdered = 0x45dd
+	idChapterAtom        = 0xb6
+	idChapterUID         = 0x73c4
+	idChapterTimeStart   = 0x91
+	idChapterTimeEnd     = 0x92
+	idChapterFlagHidden  = 0x98
+	idChapterFlagEnabled = 0x4598
+	idChapterSegmentUID  = 0x6e67
+	idChapterTrack       = 0x8f
+	idChapterTrackNumber = 0x89
+	idChapterDisplay     = 0x80
+	idChapString         = 0x85
+	idChapLanguage       = 0x437c
+	idChapCountry        = 0x437e
+	idChapProcess        = 0x6944
+	idChapProcessCodecID = 0x6955
+	idChapProcessPrivate = 0x450d
+	idChapProcessCommand = 0x6911
+	idChapProcessTime    = 0x6922
+	idChapProcessData    = 0x6933
+	idTags               = 0x1254c367
+	idTag                = 0x7373
+	idTargets            = 0x63c0
+	idTargetTypeValue    = 0x68ca
+	idTargetType         = 0x63ca
+	idTagTrackUID        = 0x63c5
+	idTagEditionUID      = 0x63c9
+	idTagChapterUID      = 0x63c4
+	idTagAttachmentUID   = 0x63c6
+	idSimpleTag          = 0x67c8
+	idTagName            = 0x45a3
+	idTagLanguage        = 0x447a
+	idTagLanguageBCP47   = 0x447b
+	idTagDefault         = 0x4484
+	idTagString          = 0x4487
+	idTagBinary          = 0x4485
+)
+
+// The size value used for elements of unknown size.
+const ebmlUnknownSize = 0x01ffffffffffffff
+
+// ebmlIDLength returns the encoded length of an element ID.
+func ebmlIDLength(id uint32) int {
+	switch {
+	case id >= 0x1000000:
+		return 4
+	case id >= 0x10000:
+		return 3
+	case id >= 0x100:
+		return 2
+	}
+	return 1
+}
+
+func appendID(b []byte, id uint32) []byte {
+	for i := ebmlIDLength(id) - 1; i >= 0; i-- {
+		b = append(b, byte(id>>(uint(i)*8)))
+	}
+	return b
+}
+
+// ebmlSizeLength returns the minimal number of bytes needed to code size
+// as an EBML variable length integer.
+func ebmlSizeLength(size uint64) int {
+	n := 1
+	// All ones is reserved, hence the -1.
+	for size >= (uint64(1)<<(7*uint(n)))-1 && n < 8 {
+		n++
+	}
+	return n
+}
+
+// appendSizeN appends size as an EBML variable length integer of exactly n
+// bytes.
+func appendSizeN(b []byte, size uint64, n int) []byte {
+	size |= uint64(1) << (7 * uint(n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(size>>(uint(i)*8)))
+	}
+	return b
+}
+
+func appendSize(b []byte, size uint64) []byte {
+	return appendSizeN(b, size, ebmlSizeLength(size))
+}
+
+func appendElement(b []byte, id uint32, data []byte) []byte {
+	b = appendID(b, id)
+	b = appendSize(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendUint(b []byte, id uint32, v uint64) []byte {
+	n := 1
+	for n < 8 && v>>(uint(n)*8) != 0 {
+		n++
+	}
+
+	b = appendID(b, id)
+	b = appendSize(b, uint64(n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(uint(i)*8)))
+	}
+	return b
+}
+
+func appendInt(b []byte, id uint32, v int64) []byte {
+	n := 1
+	for n < 8 && (v < -(int64(1)<<(uint(n)*8-1)) || v >= int64(1)<<(uint(n)*8-1)) {
+		n++
+	}
+
+	b = appendID(b, id)
+	b = appendSize(b, uint64(n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(uint(i)*8)))
+	}
+	return b
+}
+
+func appendFloat(b []byte, id uint32, v float64) []byte {
+	b = appendID(b, id)
+	b = appendSize(b, 8)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+func appendFloat32(b []byte, id uint32, v float32) []byte {
+	b = appendID(b, id)
+	b = appendSize(b, 4)
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], math.Float32bits(v))
+	return append(b, buf[:]...)
+}
+
+func appendString(b []byte, id uint32, s string) []byte {
+	return appendElement(b, id, []byte(s))
+}
+
+// appendVoid appends a Void element that is exactly n bytes long in total.
+// n must be at least 2.
+func appendVoid(b []byte, n int) []byte {
+	b = appendID(b, idVoid)
+	// A size of 8 bytes can cover everything; smaller voids need a
+	// shorter size field to fit.
+	sl := 8
+	if n-1-sl < 0 || n < 10 {
+		sl = 1
+	}
+	b = appendSizeN(b, uint64(n-1-sl), sl)
+	return append(b, make([]byte, n-1-sl)...)
+}
+
+func appendUnknownSize(b []byte) []byte {
+	return append(b, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+}
+
+func appendBool(b []byte, id uint32, v bool) []byte {
+	if v {
+		return appendUint(b, id, 1)
+	}
+	return appendUint(b, id, 0)
+}
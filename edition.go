@@ -0,0 +1,58 @@
+package matroska
+
+// DefaultEdition returns the edition flagged as default, or the first one
+// if none is. It returns nil if there are no editions.
+func DefaultEdition(editions []*Edition) *Edition {
+	if len(editions) == 0 {
+		return nil
+	}
+	for _, e := range editions {
+		if e.Default {
+			return e
+		}
+	}
+	return editions[0]
+}
+
+// FindEdition returns the edition with the given UID, or nil.
+func FindEdition(editions []*Edition, uid uint64) *Edition {
+	for _, e := range editions {
+		if e.UID == uid {
+			return e
+		}
+	}
+	return nil
+}
+
+// VisibleChapters returns the edition's enabled, non-hidden chapters,
+// including nested ones, in order. Children of hidden or disabled chapters
+// are left out as well.
+//
+// The returned chapters are copies without Children, and have their End
+// resolved: a chapter without one ends where its next sibling starts, or
+// else where its parent ends, or else at duration, which may be 0 if it is
+// unknown.
+func (e *Edition) VisibleChapters(duration uint64) []*Chapter {
+	return visibleChapters(nil, e.Chapters, duration)
+}
+
+func visibleChapters(ret []*Chapter, chapters []*Chapter, end uint64) []*Chapter {
+	for i, ch := range chapters {
+		if ch.Hidden || !ch.Enabled {
+			continue
+		}
+
+		c := *ch
+		c.Children = nil
+		if c.End == 0 {
+			c.End = end
+			if i+1 < len(chapters) {
+				c.End = chapters[i+1].Start
+			}
+		}
+		ret = append(ret, &c)
+
+		ret = visibleChapters(ret, ch.Children, c.End)
+	}
+	return ret
+}
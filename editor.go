@@ -0,0 +1,1019 @@
+package matroska
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// ErrRewriteNeeded is returned by Editor.Commit when the changes can not be
+// made in place, and the file has to be rewritten instead, for example
+// with the remux package.
+var ErrRewriteNeeded = errors.New("changes do not fit in place, the file needs to be rewritten")
+
+// Largest element the editor reads into memory.
+const maxEditSize = 64 * 1024 * 1024
+
+// ebmlElement is an element in the file being edited.
+type ebmlElement struct {
+	id     uint32
+	pos    int64
+	header int
+	size   uint64
+}
+
+func (el ebmlElement) end() int64 {
+	return el.pos + int64(el.header) + int64(el.size)
+}
+
+// ebmlChild is a raw child element, including its ID and size.
+type ebmlChild struct {
+	id  uint32
+	raw []byte
+}
+
+type seekEntry struct {
+	id  uint32
+	pos uint64
+}
+
+// span is a range of the file which is free to be overwritten. Dirty
+// spans have changed since they were read, and need a Void written.
+type span struct {
+	pos   int64
+	size  int64
+	dirty bool
+}
+
+// Editor changes the metadata of a Matroska file in place, without
+// rewriting its clusters.
+//
+// Changed elements are written where they were if they still fit, using
+// any Void elements around them, or else are moved into Void space
+// elsewhere, or to the end of the segment, and the SeekHead is updated.
+// If none of that works, Commit returns ErrRewriteNeeded, and nothing is
+// written.
+type Editor struct {
+	rw   io.ReadWriteSeeker
+	size int64
+
+	segSizePos int64
+	segSizeLen int
+	segData    int64
+	segEnd     int64
+	segKnown   bool
+
+	// Position of the first cluster. Elements after it can only be found
+	// through the SeekHead.
+	clusters int64
+
+	elements  map[uint32]ebmlElement
+	seekHeads []ebmlElement
+	free      []span
+	numTracks int
+
+	infoEdits  map[uint32][]byte
+	trackEdits map[uint]map[uint32][]byte
+	tags       []*Tag
+	setTags    bool
+	chapters   []*Chapter
+	setChaps   bool
+
+	addAttachments     []muxAttachment
+	replaceAttachments map[uint64][]byte
+	removeAttachments  map[uint64]bool
+}
+
+// NewEditor creates an Editor for the file in rw.
+func NewEditor(rw io.ReadWriteSeeker) (*Editor, error) {
+	e := &Editor{
+		rw: rw,
+	}
+	e.reset()
+
+	err := e.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *Editor) reset() {
+	e.infoEdits = make(map[uint32][]byte)
+	e.trackEdits = make(map[uint]map[uint32][]byte)
+	e.tags = nil
+	e.setTags = false
+	e.chapters = nil
+	e.setChaps = false
+	e.addAttachments = nil
+	e.replaceAttachments = make(map[uint64][]byte)
+	e.removeAttachments = make(map[uint64]bool)
+}
+
+// parseID parses an EBML element ID, keeping its length marker.
+func parseID(b []byte) (uint32, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	n := bits.LeadingZeros8(b[0]) + 1
+	if n > 4 || len(b) < n {
+		return 0, 0, false
+	}
+
+	var id uint32
+	for i := 0; i < n; i++ {
+		id = id<<8 | uint32(b[i])
+	}
+	return id, n, true
+}
+
+// parseSize parses an EBML variable length integer. All ones is returned
+// as ebmlUnknownSize.
+func parseSize(b []byte) (uint64, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	n := bits.LeadingZeros8(b[0]) + 1
+	if len(b) < n {
+		return 0, 0, false
+	}
+
+	v := uint64(b[0] & (0xff >> uint(n)))
+	ones := v == uint64(0xff>>uint(n))
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+		ones = ones && b[i] == 0xff
+	}
+	if ones {
+		return ebmlUnknownSize, n, true
+	}
+	return v, n, true
+}
+
+func parseChildren(b []byte) ([]ebmlChild, error) {
+	var ret []ebmlChild
+	for len(b) != 0 {
+		id, il, ok := parseID(b)
+		if !ok {
+			return nil, fmt.Errorf("could not parse element ID")
+		}
+		size, sl, ok := parseSize(b[il:])
+		if !ok || size == ebmlUnknownSize || size > uint64(len(b)-il-sl) {
+			return nil, fmt.Errorf("could not parse size of element %x", id)
+		}
+		n := il + sl + int(size)
+		ret = append(ret, ebmlChild{id: id, raw: b[:n:n]})
+		b = b[n:]
+	}
+	return ret, nil
+}
+
+// payload returns the data of a raw child.
+func (c ebmlChild) payload() []byte {
+	_, il, _ := parseID(c.raw)
+	_, sl, _ := parseSize(c.raw[il:])
+	return c.raw[il+sl:]
+}
+
+func parseUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// setChild replaces the first child with the given ID with raw, or adds it
+// if there is none. An empty raw removes it.
+func setChild(children []ebmlChild, id uint32, raw []byte) []ebmlChild {
+	for i, c := range children {
+		if c.id != id {
+			continue
+		}
+		if len(raw) == 0 {
+			return append(children[:i:i], children[i+1:]...)
+		}
+		children[i].raw = raw
+		return children
+	}
+	if len(raw) == 0 {
+		return children
+	}
+	return append(children, ebmlChild{id: id, raw: raw})
+}
+
+// buildMaster builds a master element from its children. If it had a
+// CRC-32, it is recomputed.
+func buildMaster(id uint32, children []ebmlChild) []byte {
+	var body []byte
+	hasCRC := false
+	for _, c := range children {
+		if c.id == idCRC32 {
+			hasCRC = true
+			continue
+		}
+		body = append(body, c.raw...)
+	}
+
+	if hasCRC {
+		crc := appendID(nil, idCRC32)
+		crc = appendSize(crc, 4)
+		crc = append(crc, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(crc[len(crc)-4:], crc32.ChecksumIEEE(body))
+		body = append(crc, body...)
+	}
+
+	return appendElement(nil, id, body)
+}
+
+func (e *Editor) readElement(pos int64) (ebmlElement, error) {
+	_, err := e.rw.Seek(pos, io.SeekStart)
+	if err != nil {
+		return ebmlElement{}, fmt.Errorf("could not seek input: %s", err.Error())
+	}
+
+	buf := make([]byte, 12)
+	n, err := io.ReadFull(e.rw, buf)
+	if err == io.ErrUnexpectedEOF {
+		buf = buf[:n]
+	} else if err != nil {
+		return ebmlElement{}, fmt.Errorf("could not read input: %s", err.Error())
+	}
+
+	id, il, ok := parseID(buf)
+	if !ok {
+		return ebmlElement{}, fmt.Errorf("could not parse element ID at %d", pos)
+	}
+	size, sl, ok := parseSize(buf[il:])
+	if !ok {
+		return ebmlElement{}, fmt.Errorf("could not parse element size at %d", pos)
+	}
+
+	return ebmlElement{
+		id:     id,
+		pos:    pos,
+		header: il + sl,
+		size:   size,
+	}, nil
+}
+
+func (e *Editor) readPayload(el ebmlElement) ([]byte, error) {
+	if el.size > maxEditSize {
+		return nil, fmt.Errorf("element %x is too large to edit", el.id)
+	}
+
+	_, err := e.rw.Seek(el.pos+int64(el.header), io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("could not seek input: %s", err.Error())
+	}
+
+	ret := make([]byte, el.size)
+	_, err = io.ReadFull(e.rw, ret)
+	if err != nil {
+		return nil, fmt.Errorf("could not read input: %s", err.Error())
+	}
+
+	return ret, nil
+}
+
+func (e *Editor) readSeekHead(el ebmlElement) ([]seekEntry, []ebmlChild, error) {
+	b, err := e.readPayload(el)
+	if err != nil {
+		return nil, nil, err
+	}
+	children, err := parseChildren(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ret []seekEntry
+	for _, c := range children {
+		if c.id != idSeek {
+			continue
+		}
+		seek, err := parseChildren(c.payload())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var entry seekEntry
+		for _, s := range seek {
+			switch s.id {
+			case idSeekID:
+				entry.id = uint32(parseUint(s.payload()))
+			case idSeekPosition:
+				entry.pos = parseUint(s.payload())
+			}
+		}
+		if entry.id != 0 {
+			ret = append(ret, entry)
+		}
+	}
+
+	return ret, children, nil
+}
+
+func (e *Editor) addElement(el ebmlElement) {
+	switch el.id {
+	case idVoid:
+		for _, f := range e.free {
+			if f.pos == el.pos {
+				return
+			}
+		}
+		e.free = append(e.free, span{pos: el.pos, size: el.end() - el.pos})
+	case idSeekHead:
+		for _, sh := range e.seekHeads {
+			if sh.pos == el.pos {
+				return
+			}
+		}
+		e.seekHeads = append(e.seekHeads, el)
+	default:
+		if _, ok := e.elements[el.id]; !ok {
+			e.elements[el.id] = el
+		}
+	}
+}
+
+// scan finds the top-level elements: everything before the first cluster,
+// and whatever the SeekHeads point to, along with Voids next to those.
+func (e *Editor) scan() error {
+	size, err := e.rw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("could not seek input: %s", err.Error())
+	}
+	e.size = size
+
+	hdr, err := e.readElement(0)
+	if err != nil {
+		return err
+	}
+	if hdr.id != idEBML {
+		return fmt.Errorf("could not find EBML header")
+	}
+
+	seg, err := e.readElement(hdr.end())
+	if err != nil {
+		return err
+	}
+	if seg.id != idSegment {
+		return fmt.Errorf("could not find segment")
+	}
+	e.segSizePos = seg.pos + int64(ebmlIDLength(idSegment))
+	e.segSizeLen = seg.header - ebmlIDLength(idSegment)
+	e.segData = seg.pos + int64(seg.header)
+	e.segKnown = seg.size != ebmlUnknownSize
+	e.segEnd = size
+	if e.segKnown {
+		e.segEnd = seg.end()
+	}
+
+	e.elements = make(map[uint32]ebmlElement)
+	e.seekHeads = nil
+	e.free = nil
+	e.clusters = e.segEnd
+
+	pos := e.segData
+	for pos < e.segEnd {
+		el, err := e.readElement(pos)
+		if err != nil {
+			return err
+		}
+		if el.id == idCluster || el.size == ebmlUnknownSize || el.end() > e.segEnd {
+			e.clusters = pos
+			break
+		}
+		e.addElement(el)
+		pos = el.end()
+	}
+
+	for i := 0; i < len(e.seekHeads); i++ {
+		entries, _, err := e.readSeekHead(e.seekHeads[i])
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.id == idCluster {
+				continue
+			}
+			if _, ok := e.elements[entry.id]; ok && entry.id != idSeekHead {
+				continue
+			}
+
+			el, err := e.readElement(e.segData + int64(entry.pos))
+			if err != nil {
+				return err
+			}
+			if el.id != entry.id || el.size == ebmlUnknownSize || el.end() > e.segEnd {
+				return fmt.Errorf("could not find element %x the SeekHead points to", entry.id)
+			}
+			e.addElement(el)
+
+			if el.end() < e.segEnd {
+				next, err := e.readElement(el.end())
+				if err == nil && next.id == idVoid && next.end() <= e.segEnd {
+					e.addElement(next)
+				}
+			}
+		}
+	}
+
+	e.numTracks = 0
+	if tracks, ok := e.elements[idTracks]; ok {
+		b, err := e.readPayload(tracks)
+		if err != nil {
+			return err
+		}
+		children, err := parseChildren(b)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			if c.id == idTrackEntry {
+				e.numTracks++
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetTitle sets the title of the segment. An empty title removes it.
+func (e *Editor) SetTitle(title string) {
+	var raw []byte
+	if title != "" {
+		raw = appendString(nil, idTitle, title)
+	}
+	e.infoEdits[idTitle] = raw
+}
+
+func (e *Editor) editTrack(track uint, id uint32, raw []byte) error {
+	if track >= uint(e.numTracks) {
+		return fmt.Errorf("invalid track: %d", track)
+	}
+	if e.trackEdits[track] == nil {
+		e.trackEdits[track] = make(map[uint32][]byte)
+	}
+	e.trackEdits[track][id] = raw
+	return nil
+}
+
+// SetTrackName sets the name of a track, by index. An empty name removes
+// it.
+func (e *Editor) SetTrackName(track uint, name string) error {
+	var raw []byte
+	if name != "" {
+		raw = appendString(nil, idName, name)
+	}
+	return e.editTrack(track, idName, raw)
+}
+
+// SetTrackLanguage sets the language of a track, by index. Any
+// LanguageBCP47 is removed, as players use it instead of Language.
+func (e *Editor) SetTrackLanguage(track uint, lang string) error {
+	err := e.editTrack(track, idLanguage, appendString(nil, idLanguage, lang))
+	if err != nil {
+		return err
+	}
+	return e.editTrack(track, idLanguageBCP47, nil)
+}
+
+// SetTrackDefault sets the default flag of a track, by index.
+func (e *Editor) SetTrackDefault(track uint, v bool) error {
+	return e.editTrack(track, idFlagDefault, appendBool(nil, idFlagDefault, v))
+}
+
+// SetTrackForced sets the forced flag of a track, by index.
+func (e *Editor) SetTrackForced(track uint, v bool) error {
+	return e.editTrack(track, idFlagForced, appendBool(nil, idFlagForced, v))
+}
+
+// SetTrackEnabled sets the enabled flag of a track, by index.
+func (e *Editor) SetTrackEnabled(track uint, v bool) error {
+	return e.editTrack(track, idFlagEnabled, appendBool(nil, idFlagEnabled, v))
+}
+
+// SetTags replaces the tags. An empty slice removes them.
+func (e *Editor) SetTags(tags []*Tag) {
+	e.tags = tags
+	e.setTags = true
+}
+
+// SetChapters replaces the chapters, with top-level chapters being
+// editions, the same way GetChapters returns them. An empty slice removes
+// them.
+func (e *Editor) SetChapters(chapters []*Chapter) {
+	e.chapters = chapters
+	e.setChaps = true
+}
+
+// sortedIDs returns the keys of edits in order, so new children are
+// always added in the same order.
+func sortedIDs(edits map[uint32][]byte) []uint32 {
+	var ret []uint32
+	for id := range edits {
+		ret = append(ret, id)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// AddAttachment adds an attachment, such as a font or cover art, and
+// returns its UID. The Position and Length members of a are ignored. If UID
+// is 0, a random one is generated.
+func (e *Editor) AddAttachment(a *Attachment, data []byte) uint64 {
+	at := muxAttachment{
+		info: *a,
+		data: data,
+	}
+	if at.info.UID == 0 {
+		at.info.UID = randomUID()
+	}
+	e.addAttachments = append(e.addAttachments, at)
+	return at.info.UID
+}
+
+// ReplaceAttachment replaces the data of the attachment with the given
+// UID.
+func (e *Editor) ReplaceAttachment(uid uint64, data []byte) {
+	e.replaceAttachments[uid] = data
+}
+
+// RemoveAttachment removes the attachment with the given UID.
+func (e *Editor) RemoveAttachment(uid uint64) {
+	e.removeAttachments[uid] = true
+}
+
+// attachmentsChange builds the new Attachments element, or returns nil if
+// there are no attachments left. Attachments which are not changed are
+// copied as they are.
+func (e *Editor) attachmentsChange() ([]byte, error) {
+	var children []ebmlChild
+	if el, ok := e.elements[idAttachments]; ok {
+		b, err := e.readPayload(el)
+		if err != nil {
+			return nil, err
+		}
+		children, err = parseChildren(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	found := make(map[uint64]bool)
+	var files []ebmlChild
+	for _, c := range children {
+		if c.id != idAttachedFile {
+			files = append(files, c)
+			continue
+		}
+
+		file, err := parseChildren(c.payload())
+		if err != nil {
+			return nil, err
+		}
+		var uid uint64
+		for _, f := range file {
+			if f.id == idFileUID {
+				uid = parseUint(f.payload())
+			}
+		}
+		found[uid] = true
+
+		if e.removeAttachments[uid] {
+			continue
+		}
+		if data, ok := e.replaceAttachments[uid]; ok {
+			file = setChild(file, idFileData, appendElement(nil, idFileData, data))
+			c.raw = buildMaster(idAttachedFile, file)
+		}
+		files = append(files, c)
+	}
+
+	for uid := range e.removeAttachments {
+		if !found[uid] {
+			return nil, fmt.Errorf("could not find attachment %d", uid)
+		}
+	}
+	for uid := range e.replaceAttachments {
+		if !found[uid] {
+			return nil, fmt.Errorf("could not find attachment %d", uid)
+		}
+	}
+
+	for _, a := range e.addAttachments {
+		if found[a.info.UID] {
+			return nil, fmt.Errorf("attachment %d already exists", a.info.UID)
+		}
+		found[a.info.UID] = true
+		files = append(files, ebmlChild{id: idAttachedFile, raw: attachedFile(a)})
+	}
+
+	hasFiles := false
+	for _, f := range files {
+		if f.id == idAttachedFile {
+			hasFiles = true
+		}
+	}
+	if !hasFiles {
+		return nil, nil
+	}
+
+	return buildMaster(idAttachments, files), nil
+}
+
+type editChange struct {
+	id   uint32
+	data []byte
+}
+
+func (e *Editor) changes() ([]editChange, error) {
+	var ret []editChange
+
+	if len(e.infoEdits) != 0 {
+		el, ok := e.elements[idInfo]
+		if !ok {
+			return nil, fmt.Errorf("could not find segment info")
+		}
+		b, err := e.readPayload(el)
+		if err != nil {
+			return nil, err
+		}
+		children, err := parseChildren(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range sortedIDs(e.infoEdits) {
+			children = setChild(children, id, e.infoEdits[id])
+		}
+		ret = append(ret, editChange{idInfo, buildMaster(idInfo, children)})
+	}
+
+	if len(e.trackEdits) != 0 {
+		el, ok := e.elements[idTracks]
+		if !ok {
+			return nil, fmt.Errorf("could not find tracks")
+		}
+		b, err := e.readPayload(el)
+		if err != nil {
+			return nil, err
+		}
+		children, err := parseChildren(b)
+		if err != nil {
+			return nil, err
+		}
+
+		track := uint(0)
+		for i, c := range children {
+			if c.id != idTrackEntry {
+				continue
+			}
+			edits := e.trackEdits[track]
+			track++
+			if len(edits) == 0 {
+				continue
+			}
+
+			entry, err := parseChildren(c.payload())
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range sortedIDs(edits) {
+				entry = setChild(entry, id, edits[id])
+			}
+			children[i].raw = buildMaster(idTrackEntry, entry)
+		}
+		ret = append(ret, editChange{idTracks, buildMaster(idTracks, children)})
+	}
+
+	if len(e.addAttachments) != 0 || len(e.replaceAttachments) != 0 || len(e.removeAttachments) != 0 {
+		data, err := e.attachmentsChange()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, editChange{idAttachments, data})
+	}
+
+	if e.setChaps {
+		var data []byte
+		if len(e.chapters) != 0 {
+			data = chaptersElement(e.chapters)
+		}
+		ret = append(ret, editChange{idChapters, data})
+	}
+
+	if e.setTags {
+		var data []byte
+		if len(e.tags) != 0 {
+			data = tagsElement(e.tags)
+		}
+		ret = append(ret, editChange{idTags, data})
+	}
+
+	return ret, nil
+}
+
+// fitElement returns data, possibly with its size coded one byte longer,
+// such that it fills size bytes exactly or leaves room for a Void after
+// it. It returns nil if it does not fit.
+func fitElement(data []byte, size int64) []byte {
+	n := int64(len(data))
+	if n == size || size-n >= 2 {
+		return data
+	}
+	if size-n != 1 {
+		return nil
+	}
+
+	// A Void needs at least two bytes, so take up the single byte
+	// with a longer size field instead.
+	id, il, _ := parseID(data)
+	payloadSize, sl, _ := parseSize(data[il:])
+	if sl >= 8 {
+		return nil
+	}
+	ret := appendID(nil, id)
+	ret = appendSizeN(ret, payloadSize, sl+1)
+	return append(ret, data[il+sl:]...)
+}
+
+type editWrite struct {
+	pos  int64
+	data []byte
+}
+
+// editPlan is where everything goes.
+type editPlan struct {
+	free    []span
+	writes  []editWrite
+	end     int64
+	pos     map[uint32]int64
+	removed map[uint32]bool
+}
+
+// addFree adds a span of free space, merged with any free space around it.
+func (p *editPlan) addFree(s span) {
+	s.dirty = true
+	for {
+		merged := false
+		for i, f := range p.free {
+			if f.pos+f.size == s.pos {
+				s.pos = f.pos
+				s.size += f.size
+			} else if s.pos+s.size == f.pos {
+				s.size += f.size
+			} else {
+				continue
+			}
+			p.free = append(p.free[:i:i], p.free[i+1:]...)
+			merged = true
+			break
+		}
+		if !merged {
+			break
+		}
+	}
+	p.free = append(p.free, s)
+}
+
+// take removes the free span containing pos.
+func (p *editPlan) take(pos int64) span {
+	for i, f := range p.free {
+		if pos >= f.pos && pos < f.pos+f.size {
+			p.free = append(p.free[:i:i], p.free[i+1:]...)
+			return f
+		}
+	}
+	return span{}
+}
+
+// place writes data at the start of s, and frees the rest of it.
+func (p *editPlan) place(s span, data []byte) {
+	p.writes = append(p.writes, editWrite{s.pos, data})
+	if rest := s.size - int64(len(data)); rest > 0 {
+		p.addFree(span{pos: s.pos + int64(len(data)), size: rest})
+	}
+}
+
+// plan works out where all changes go. If protect is set, free space
+// directly after SeekHeads is only used by them, so they can grow later.
+func (e *Editor) plan(changes []editChange, protect bool) (*editPlan, error) {
+	p := &editPlan{
+		free:    append([]span{}, e.free...),
+		end:     e.segEnd,
+		pos:     make(map[uint32]int64),
+		removed: make(map[uint32]bool),
+	}
+	canAppend := e.segKnown && e.segEnd == e.size && len(e.seekHeads) != 0
+
+	protected := func(s span) bool {
+		if !protect {
+			return false
+		}
+		for _, sh := range e.seekHeads {
+			if s.pos <= sh.end() && sh.end() < s.pos+s.size {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, c := range changes {
+		if old, ok := e.elements[c.id]; ok {
+			p.addFree(span{pos: old.pos, size: old.end() - old.pos})
+			if c.data == nil {
+				p.removed[c.id] = true
+				continue
+			}
+
+			// Prefer to stay where it was, using any free space after
+			// it, but not before it, as that may be the SeekHead's.
+			s := p.take(old.pos)
+			if s.pos < old.pos {
+				p.addFree(span{pos: s.pos, size: old.pos - s.pos})
+				s = span{pos: old.pos, size: s.end() - old.pos}
+			}
+			if data := fitElement(c.data, s.size); data != nil {
+				p.place(s, data)
+				p.pos[c.id] = s.pos
+				continue
+			}
+			p.addFree(s)
+		} else if c.data == nil {
+			continue
+		}
+
+		placed := false
+		for _, f := range p.free {
+			if protected(f) {
+				continue
+			}
+			// Without a SeekHead, things are only found before the
+			// first cluster.
+			if len(e.seekHeads) == 0 && f.pos >= e.clusters {
+				continue
+			}
+			if data := fitElement(c.data, f.size); data != nil {
+				s := p.take(f.pos)
+				p.place(s, data)
+				p.pos[c.id] = s.pos
+				placed = true
+				break
+			}
+		}
+		if placed {
+			continue
+		}
+
+		if !canAppend {
+			return nil, ErrRewriteNeeded
+		}
+		p.writes = append(p.writes, editWrite{p.end, c.data})
+		p.pos[c.id] = p.end
+		p.end += int64(len(c.data))
+	}
+
+	if p.end != e.segEnd && uint64(p.end-e.segData) >= (uint64(1)<<(7*uint(e.segSizeLen)))-1 {
+		return nil, ErrRewriteNeeded
+	}
+
+	// Point the SeekHeads to the new positions. Anything which is new is
+	// added to the first one.
+	for i, sh := range e.seekHeads {
+		entries, children, err := e.readSeekHead(sh)
+		if err != nil {
+			return nil, err
+		}
+
+		var seeks []ebmlChild
+		for _, c := range children {
+			if c.id == idCRC32 {
+				seeks = append(seeks, c)
+			}
+		}
+		listed := make(map[uint32]bool)
+		for _, entry := range entries {
+			if p.removed[entry.id] {
+				continue
+			}
+			if pos, ok := p.pos[entry.id]; ok && e.elements[entry.id].pos == e.segData+int64(entry.pos) {
+				entry.pos = uint64(pos - e.segData)
+			}
+			listed[entry.id] = true
+			seeks = append(seeks, seekChild(entry))
+		}
+		if i == 0 {
+			for _, id := range []uint32{idInfo, idTracks, idAttachments, idChapters, idTags} {
+				if pos, ok := p.pos[id]; ok && !e.listed(id) {
+					seeks = append(seeks, seekChild(seekEntry{id, uint64(pos - e.segData)}))
+				}
+			}
+		}
+
+		p.addFree(span{pos: sh.pos, size: sh.end() - sh.pos})
+		s := p.take(sh.pos)
+		data := fitElement(buildMaster(idSeekHead, seeks), s.end()-sh.pos)
+		if data == nil {
+			return nil, ErrRewriteNeeded
+		}
+		if s.pos < sh.pos {
+			p.addFree(span{pos: s.pos, size: sh.pos - s.pos})
+		}
+		p.place(span{pos: sh.pos, size: s.end() - sh.pos}, data)
+	}
+
+	return p, nil
+}
+
+func (s span) end() int64 {
+	return s.pos + s.size
+}
+
+func seekChild(entry seekEntry) ebmlChild {
+	var seek []byte
+	seek = appendElement(seek, idSeekID, appendID(nil, entry.id))
+	seek = appendUint(seek, idSeekPosition, entry.pos)
+	return ebmlChild{id: idSeek, raw: appendElement(nil, idSeek, seek)}
+}
+
+// listed returns whether any SeekHead has an entry for id.
+func (e *Editor) listed(id uint32) bool {
+	for _, sh := range e.seekHeads {
+		entries, _, err := e.readSeekHead(sh)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.id == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *Editor) writeAt(pos int64, b []byte) error {
+	_, err := e.rw.Seek(pos, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not seek output: %s", err.Error())
+	}
+	_, err = e.rw.Write(b)
+	if err != nil {
+		return fmt.Errorf("could not write output: %s", err.Error())
+	}
+	return nil
+}
+
+// Commit writes all changes to the file. If they do not fit, it returns
+// ErrRewriteNeeded without writing anything.
+func (e *Editor) Commit() error {
+	changes, err := e.changes()
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	// Leave room for the SeekHead to grow if possible.
+	p, err := e.plan(changes, true)
+	if err == ErrRewriteNeeded {
+		p, err = e.plan(changes, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	// New data goes first, then the SeekHead, then the Voids, so the file
+	// is never left pointing at nothing.
+	for _, w := range p.writes {
+		err = e.writeAt(w.pos, w.data)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range p.free {
+		if f.dirty {
+			err = e.writeAt(f.pos, appendVoid(nil, int(f.size)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if p.end != e.segEnd {
+		err = e.writeAt(e.segSizePos, appendSizeN(nil, uint64(p.end-e.segData), e.segSizeLen))
+		if err != nil {
+			return err
+		}
+	}
+
+	e.reset()
+	return e.scan()
+}
@@ -0,0 +1,172 @@
+package matroska_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/dwbuiten/matroska/internal/testutil"
+)
+
+// editorFile muxes a file with one audio track for the editor to change.
+// The track's Name is turned into a LanguageBCP47 of the same size, which
+// the muxer can not write.
+func editorFile(t *testing.T, streaming bool) []byte {
+	f := &testutil.MemFile{}
+	var m *matroska.Muxer
+	if streaming {
+		m = matroska.NewStreamingMuxer(f)
+	} else {
+		var err error
+		m, err = matroska.NewMuxer(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := m.SetSegmentInfo(&matroska.SegmentInfo{
+		Title: "A title which is long enough to be shortened",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &matroska.TrackInfo{
+		Type:            matroska.TypeAudio,
+		CodecID:         "A_AAC",
+		CodecPrivate:    []byte{0x11, 0x90},
+		DefaultDuration: 21333333,
+		Name:            "xen-GB",
+		Language:        "eng",
+	}
+	ti.Audio.SamplingFreq = 48000
+	ti.Audio.Channels = 2
+	_, err = m.AddTrack(ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		err = m.WritePacket(&matroska.Packet{
+			StartTime: uint64(i) * 21333333,
+			EndTime:   uint64(i+1) * 21333333,
+			Data:      []byte{0x21, 0x10, 0x04, byte(i)},
+			Flags:     matroska.KF,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := append([]byte{0x53, 0x6e, 0x86}, "xen-GB"...)
+	bcp47 := append([]byte{0x22, 0xb5, 0x9d, 0x85}, "en-GB"...)
+	b := f.Bytes()
+	if bytes.Count(b, name) != 1 {
+		t.Fatal("could not find the track name")
+	}
+	return bytes.Replace(b, name, bcp47, 1)
+}
+
+func openEditor(t *testing.T, data []byte) (*testutil.MemFile, *matroska.Editor) {
+	f := &testutil.MemFile{}
+	f.Write(data)
+	e, err := matroska.NewEditor(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, e
+}
+
+// checkEdited checks that f has the given title and language, and still
+// has all its packets.
+func checkEdited(t *testing.T, f *testutil.MemFile, title, lang string) {
+	d, err := matroska.NewDemuxer(bytes.NewReader(f.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	info, err := d.GetFileInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Title != title {
+		t.Errorf("got title %q, expected %q", info.Title, title)
+	}
+	ti, err := d.GetTrackInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimRight(ti.Language, "\x00"); got != lang {
+		t.Errorf("got language %q, expected %q", got, lang)
+	}
+	if n := len(readAll(t, d)); n != 50 {
+		t.Errorf("got %d packets, expected 50", n)
+	}
+}
+
+func TestEditorInPlace(t *testing.T) {
+	data := editorFile(t, false)
+	f, e := openEditor(t, data)
+
+	e.SetTitle("Short")
+	err := e.SetTrackLanguage(0, "fra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both elements shrink, so they stay where they were, followed by
+	// Voids.
+	if len(f.Bytes()) != len(data) {
+		t.Errorf("got %d bytes, expected %d", len(f.Bytes()), len(data))
+	}
+	if bytes.Contains(f.Bytes(), []byte("en-GB")) {
+		t.Error("LanguageBCP47 was not removed")
+	}
+	checkEdited(t, f, "Short", "fra")
+}
+
+func TestEditorMove(t *testing.T) {
+	data := editorFile(t, false)
+	f, e := openEditor(t, data)
+
+	title := strings.Repeat("A much longer title. ", 20)
+	e.SetTitle(title)
+	err := e.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The segment info does not fit anywhere, so it goes to the end.
+	if len(f.Bytes()) <= len(data) {
+		t.Errorf("got %d bytes, expected more than %d", len(f.Bytes()), len(data))
+	}
+	if pos := bytes.Index(f.Bytes(), []byte(title)); pos < len(data) {
+		t.Errorf("got the title at %d, expected it after %d", pos, len(data))
+	}
+	checkEdited(t, f, title, "eng")
+}
+
+func TestEditorRewriteNeeded(t *testing.T) {
+	// Without a SeekHead or a known segment size, nothing can be moved
+	// to the end.
+	data := editorFile(t, true)
+	f, e := openEditor(t, data)
+
+	e.SetTitle(strings.Repeat("A much longer title. ", 20))
+	err := e.Commit()
+	if err != matroska.ErrRewriteNeeded {
+		t.Fatalf("got error %v, expected ErrRewriteNeeded", err)
+	}
+	if !bytes.Equal(f.Bytes(), data) {
+		t.Error("the file was changed")
+	}
+}
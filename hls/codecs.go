@@ -0,0 +1,72 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// codecString returns the RFC 6381 codecs parameter for a track, as used
+// in the CODECS attribute.
+func codecString(ti *matroska.TrackInfo) (string, error) {
+	cp := ti.CodecPrivate
+
+	switch {
+	case ti.CodecID == "V_MPEG4/ISO/AVC":
+		if len(cp) < 4 {
+			return "", fmt.Errorf("could not find avcC in CodecPrivate")
+		}
+		return fmt.Sprintf("avc1.%02x%02x%02x", cp[1], cp[2], cp[3]), nil
+	case ti.CodecID == "V_MPEGH/ISO/HEVC":
+		if len(cp) < 13 {
+			return "", fmt.Errorf("could not find hvcC in CodecPrivate")
+		}
+
+		// The compatibility flags are written in reverse bit order.
+		compat := uint32(cp[2])<<24 | uint32(cp[3])<<16 | uint32(cp[4])<<8 | uint32(cp[5])
+		rev := uint32(0)
+		for i := 0; i < 32; i++ {
+			rev = rev<<1 | (compat>>uint(i))&1
+		}
+		tier := "L"
+		if cp[1]&0x20 != 0 {
+			tier = "H"
+		}
+
+		s := fmt.Sprintf("hvc1.%s%d.%X.%s%d", []string{"", "A", "B", "C"}[cp[1]>>6], cp[1]&0x1f, rev, tier, cp[12])
+
+		// Trailing zero constraint bytes are left out.
+		constraints := cp[6:12]
+		for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+			constraints = constraints[:len(constraints)-1]
+		}
+		for _, c := range constraints {
+			s += fmt.Sprintf(".%X", c)
+		}
+		return s, nil
+	case strings.HasPrefix(ti.CodecID, "A_AAC"):
+		objectType := byte(2)
+		switch {
+		case len(cp) >= 2:
+			objectType = cp[0] >> 3
+		case strings.HasSuffix(ti.CodecID, "/SBR"):
+			objectType = 5
+		case strings.HasSuffix(ti.CodecID, "/MAIN"):
+			objectType = 1
+		case strings.HasSuffix(ti.CodecID, "/SSR"):
+			objectType = 3
+		case strings.HasSuffix(ti.CodecID, "/LTP"):
+			objectType = 4
+		}
+		return fmt.Sprintf("mp4a.40.%d", objectType), nil
+	case ti.CodecID == "A_AC3":
+		return "ac-3", nil
+	case ti.CodecID == "A_EAC3":
+		return "ec-3", nil
+	case ti.CodecID == "A_MPEG/L3":
+		return "mp4a.40.34", nil
+	}
+
+	return "", fmt.Errorf("unsupported codec: %s", ti.CodecID)
+}
@@ -0,0 +1,139 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Names the handler serves its playlists under.
+const (
+	MasterName = "master.m3u8"
+	MediaName  = "media.m3u8"
+)
+
+// Handler serves a file as HLS. It answers requests for MasterName,
+// MediaName and the segments, which are named seg<index>.ts, based on the
+// last element of the request path, so it can be mounted anywhere.
+type Handler struct {
+	open     func() (io.ReadSeeker, error)
+	playlist *Playlist
+	master   []byte
+	media    []byte
+}
+
+// NewHandler creates a handler for the file opened by open, with segments
+// of at least target nanoseconds. open is called for every segment
+// request, as demuxers can't be shared between requests. If the returned
+// reader is an io.Closer, it is closed when the request is done.
+func NewHandler(open func() (io.ReadSeeker, error), target uint64) (*Handler, error) {
+	h := &Handler{
+		open: open,
+	}
+
+	err := h.withDemuxer(func(d *matroska.Demuxer) error {
+		p, err := NewPlaylist(d, target)
+		h.playlist = p
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.master = h.playlist.Master(MediaName)
+	h.media = h.playlist.Media(func(i int) string {
+		return fmt.Sprintf("seg%d.ts", i)
+	})
+
+	return h, nil
+}
+
+// Playlist returns the playlist the handler serves.
+func (h *Handler) Playlist() *Playlist {
+	return h.playlist
+}
+
+func (h *Handler) withDemuxer(f func(d *matroska.Demuxer) error) error {
+	r, err := h.open()
+	if err != nil {
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	d, err := matroska.NewDemuxer(r)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return f(d)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Base(req.URL.Path)
+	switch name {
+	case MasterName, MediaName:
+		body := h.master
+		if name == MediaName {
+			body = h.media
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if req.Method == http.MethodGet {
+			w.Write(body)
+		}
+		return
+	}
+
+	if !strings.HasPrefix(name, "seg") || !strings.HasSuffix(name, ".ts") {
+		http.NotFound(w, req)
+		return
+	}
+	i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg"), ".ts"))
+	if err != nil || i < 0 || i >= len(h.playlist.Segments) {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	cw := &countingWriter{w: w}
+	err = h.withDemuxer(func(d *matroska.Demuxer) error {
+		return h.playlist.WriteSegment(d, i, cw)
+	})
+	if err != nil {
+		if cw.n == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Too late for an error status, so make sure the client does
+		// not take the partial segment for a whole one.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
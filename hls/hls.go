@@ -0,0 +1,262 @@
+// Package hls serves Matroska files as HTTP Live Streaming, without
+// transcoding or remuxing them to disk first.
+//
+// Segments are cut at the cue points of the file's reference track, which
+// is the first video track if there is one, and are remuxed to MPEG-TS on
+// the fly when requested. Only tracks which can be carried in a transport
+// stream are included.
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/dwbuiten/matroska/mpegts"
+)
+
+// Segment is a media segment of a Playlist.
+type Segment struct {
+	// Start time and duration, in nanoseconds.
+	Start    uint64
+	Duration uint64
+	// The byte range of the source file the segment's clusters are in.
+	Offset uint64
+	Size   uint64
+}
+
+// Playlist describes how a file is split into segments.
+type Playlist struct {
+	Segments []Segment
+
+	tracks []uint
+	infos  []*matroska.TrackInfo
+	ref    uint8
+	mask   uint64
+
+	codecs    []string
+	width     uint32
+	height    uint32
+	bandwidth uint64
+}
+
+// NewPlaylist splits d into segments of at least target nanoseconds, using
+// its cues. The file must have cues for its reference track.
+func NewPlaylist(d *matroska.Demuxer, target uint64) (*Playlist, error) {
+	p := &Playlist{
+		mask: ^uint64(0),
+	}
+
+	count, err := d.GetNumTracks()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint(0); i < count; i++ {
+		ti, err := d.GetTrackInfo(i)
+		if err != nil {
+			return nil, err
+		}
+		if !mpegts.Supported(ti) {
+			continue
+		}
+
+		codec, err := codecString(ti)
+		if err != nil {
+			return nil, err
+		}
+
+		p.tracks = append(p.tracks, i)
+		p.infos = append(p.infos, ti)
+		p.mask &^= uint64(1) << i
+		p.codecs = append(p.codecs, codec)
+	}
+	r := matroska.ReferenceTrack(p.infos)
+	if r < 0 {
+		return nil, fmt.Errorf("could not find any tracks supported in HLS")
+	}
+	ref := p.infos[r]
+	p.ref = uint8(p.tracks[r])
+	if ref.Type == matroska.TypeVideo {
+		p.width = ref.Video.PixelWidth
+		p.height = ref.Video.PixelHeight
+	}
+
+	info, err := d.GetFileInfo()
+	if err != nil {
+		return nil, err
+	}
+	if info.Duration == 0 {
+		return nil, fmt.Errorf("could not create a playlist for a file without a duration")
+	}
+
+	var cues []*matroska.Cue
+	for _, c := range d.GetCues() {
+		if c.Track == ref.Number {
+			cues = append(cues, c)
+		}
+	}
+	if len(cues) == 0 {
+		return nil, fmt.Errorf("could not find cues for track %d", ref.Number)
+	}
+	sort.Slice(cues, func(i, j int) bool { return cues[i].Time < cues[j].Time })
+
+	seg := d.GetSegment()
+	for i, c := range cues {
+		if len(p.Segments) == 0 {
+			p.Segments = append(p.Segments, Segment{
+				Offset: seg + c.Position,
+			})
+			continue
+		}
+
+		last := &p.Segments[len(p.Segments)-1]
+		if c.Time < last.Start+target || c.Time >= info.Duration {
+			continue
+		}
+		if i > 0 && c.Position == cues[i-1].Position && c.Time != cues[i-1].Time {
+			// Segments must start on a cluster boundary.
+			continue
+		}
+
+		last.Duration = c.Time - last.Start
+		p.Segments = append(p.Segments, Segment{
+			Start:  c.Time,
+			Offset: seg + c.Position,
+		})
+	}
+
+	// The last segment runs to the end of the file, or the cues if they
+	// come after the clusters.
+	last := &p.Segments[len(p.Segments)-1]
+	last.Duration = info.Duration - last.Start
+	end := d.GetSegmentTop()
+	if pos := d.GetCuesPos(); pos > last.Offset && pos < end {
+		end = pos
+	}
+
+	for i := range p.Segments {
+		s := &p.Segments[i]
+		next := end
+		if i+1 < len(p.Segments) {
+			next = p.Segments[i+1].Offset
+		}
+		if next > s.Offset {
+			s.Size = next - s.Offset
+		}
+		if s.Duration != 0 {
+			if rate := s.Size * 8 * 1000000000 / s.Duration; rate > p.bandwidth {
+				p.bandwidth = rate
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// seconds formats nanoseconds as decimal seconds.
+func seconds(ns uint64) string {
+	return fmt.Sprintf("%d.%03d", ns/1000000000, ns%1000000000/1000000)
+}
+
+// Media returns the media playlist. segmentURL returns the URL of the
+// segment with the given index, relative to the playlist.
+func (p *Playlist) Media(segmentURL func(i int) string) []byte {
+	var target uint64
+	for _, s := range p.Segments {
+		if s.Duration > target {
+			target = s.Duration
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int64(math.Ceil(float64(target)/1000000000)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i, s := range p.Segments {
+		fmt.Fprintf(&b, "#EXTINF:%s,\n%s\n", seconds(s.Duration), segmentURL(i))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	return b.Bytes()
+}
+
+// Master returns a master playlist with a single variant, whose media
+// playlist is at mediaURL, relative to the master playlist.
+func (p *Playlist) Master(mediaURL string) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"", p.bandwidth, strings.Join(p.codecs, ","))
+	if p.width != 0 && p.height != 0 {
+		fmt.Fprintf(&b, ",RESOLUTION=%dx%d", p.width, p.height)
+	}
+	fmt.Fprintf(&b, "\n%s\n", mediaURL)
+
+	return b.Bytes()
+}
+
+// WriteSegment remuxes the segment with the given index to MPEG-TS, and
+// writes it to w. d must be a demuxer for the same file the playlist was
+// created from. It is seeked to the start of the segment.
+//
+// Timestamps are kept as they are in the file, so segments line up with
+// each other.
+func (p *Playlist) WriteSegment(d *matroska.Demuxer, i int, w io.Writer) error {
+	if i < 0 || i >= len(p.Segments) {
+		return fmt.Errorf("invalid segment: %d", i)
+	}
+	s := p.Segments[i]
+	end := s.Start + s.Duration
+	last := i == len(p.Segments)-1
+	var next uint64
+	if !last {
+		next = p.Segments[i+1].Offset
+	}
+
+	index := make(map[uint8]uint8)
+	for j, track := range p.tracks {
+		index[uint8(track)] = uint8(j)
+	}
+
+	tw, err := mpegts.NewWriter(w, p.infos)
+	if err != nil {
+		return err
+	}
+
+	d.Seek(s.Start, 0)
+
+	// Seeking to the next segment starts at its first cluster, and drops
+	// packets from before its start time. So this segment gets everything
+	// before that cluster, and anything in it from before the start time,
+	// except for the reference track, which must start on a keyframe.
+	for {
+		pkt, err := d.ReadPacketMask(p.mask)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !last && pkt.FilePos >= next {
+			if pkt.StartTime >= end+matroska.Lookahead {
+				return nil
+			}
+			if pkt.Track == p.ref || pkt.StartTime >= end {
+				continue
+			}
+		}
+
+		pkt.Track = index[pkt.Track]
+		err = tw.WritePacket(pkt)
+		if err != nil {
+			return err
+		}
+	}
+}
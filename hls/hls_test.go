@@ -0,0 +1,262 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dwbuiten/matroska/internal/testutil"
+)
+
+// The test file has 6 seconds of video with a keyframe every second, and a
+// cluster and cue for every keyframe.
+var testOptions = testutil.Options{
+	Frames:          150,
+	KeyInterval:     25,
+	AudioDuration:   20000000,
+	ClusterDuration: 25 * testutil.FrameDuration,
+}
+
+// tsPES is the start of a PES packet in a transport stream.
+type tsPES struct {
+	pid          uint16
+	pts          int64
+	randomAccess bool
+}
+
+// parseTS checks that b is a transport stream starting with a PAT and PMT,
+// and returns the PES packets in it.
+func parseTS(b []byte) ([]tsPES, error) {
+	if len(b) == 0 || len(b)%188 != 0 {
+		return nil, fmt.Errorf("%d bytes is not a whole number of packets", len(b))
+	}
+
+	var ret []tsPES
+	for i := 0; i < len(b); i += 188 {
+		pkt := b[i : i+188]
+		if pkt[0] != 0x47 {
+			return nil, fmt.Errorf("packet %d: no sync byte", i/188)
+		}
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		if i == 0 && pid != 0 {
+			return nil, fmt.Errorf("segment does not start with a PAT")
+		}
+		if i == 188 && pid != 0x1000 {
+			return nil, fmt.Errorf("segment does not have a PMT after the PAT")
+		}
+		if pkt[1]&0x40 == 0 || pid < 0x100 || pid == 0x1000 {
+			continue
+		}
+
+		payload := pkt[4:]
+		randomAccess := false
+		if pkt[3]&0x20 != 0 {
+			n := int(payload[0])
+			if n > 0 {
+				randomAccess = payload[1]&0x40 != 0
+			}
+			payload = payload[1+n:]
+		}
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 || payload[7]&0x80 == 0 {
+			return nil, fmt.Errorf("packet %d: no PES header with a PTS", i/188)
+		}
+
+		ts := payload[9:]
+		pts := int64(ts[0]>>1&7)<<30 | int64(ts[1])<<22 | int64(ts[2]>>1)<<15 | int64(ts[3])<<7 | int64(ts[4]>>1)
+		ret = append(ret, tsPES{
+			pid:          pid,
+			pts:          pts,
+			randomAccess: randomAccess,
+		})
+	}
+
+	return ret, nil
+}
+
+func get(t *testing.T, url string) []byte {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: got status %d: %s", url, resp.StatusCode, body)
+	}
+
+	return body
+}
+
+// uris returns the URI lines of a playlist.
+func uris(playlist []byte) []string {
+	var ret []string
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+func TestHandler(t *testing.T) {
+	file := testutil.File(t, testOptions)
+	h, err := NewHandler(func() (io.ReadSeeker, error) {
+		return bytes.NewReader(file), nil
+	}, 2000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.StripPrefix("/video/", h))
+	defer srv.Close()
+	base := srv.URL + "/video/"
+
+	master := get(t, base+MasterName)
+	if !bytes.Contains(master, []byte(`CODECS="avc1.42001e,mp4a.40.2"`)) || !bytes.Contains(master, []byte("RESOLUTION=320x240")) {
+		t.Errorf("unexpected master playlist:\n%s", master)
+	}
+	media := uris(master)
+	if len(media) != 1 || media[0] != MediaName {
+		t.Fatalf("got media playlists %v, expected [%s]", media, MediaName)
+	}
+
+	playlist := get(t, base+media[0])
+	segments := uris(playlist)
+	if len(segments) != 3 {
+		t.Fatalf("got %d segments, expected 3:\n%s", len(segments), playlist)
+	}
+	if !bytes.Contains(playlist, []byte("#EXT-X-TARGETDURATION:2\n")) || !bytes.HasSuffix(playlist, []byte("#EXT-X-ENDLIST\n")) {
+		t.Errorf("unexpected media playlist:\n%s", playlist)
+	}
+
+	var video, audio []int64
+	for i, name := range segments {
+		packets, err := parseTS(get(t, base+name))
+		if err != nil {
+			t.Fatalf("segment %d: %s", i, err.Error())
+		}
+
+		// Segments start at their cue, in the 90 kHz clock, with the
+		// transport stream offset.
+		start := int64(h.Playlist().Segments[i].Start*9/100000) + 2*90000
+
+		first := true
+		for _, p := range packets {
+			switch p.pid {
+			case 0x100:
+				if first && !p.randomAccess {
+					t.Errorf("segment %d does not start with a keyframe", i)
+				}
+				if first && p.pts != start {
+					t.Errorf("segment %d: first video PTS is %d, expected %d", i, p.pts, start)
+				}
+				first = false
+				video = append(video, p.pts)
+			case 0x101:
+				audio = append(audio, p.pts)
+			default:
+				t.Errorf("segment %d: unexpected PID 0x%04x", i, p.pid)
+			}
+		}
+		if first {
+			t.Errorf("segment %d has no video", i)
+		}
+	}
+
+	// Every frame must be in exactly one segment, with no gaps between
+	// segments.
+	checkContinuous(t, "video", video, testOptions.Frames, testutil.FrameDuration*9/100000)
+	checkContinuous(t, "audio", audio, testOptions.AudioFrames(), int64(testOptions.AudioDuration*9/100000))
+
+	resp, err := http.Get(base + "seg3.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for a segment past the end, expected 404", resp.StatusCode)
+	}
+}
+
+func checkContinuous(t *testing.T, name string, pts []int64, count int, step int64) {
+	if len(pts) != count {
+		t.Errorf("got %d %s packets, expected %d", len(pts), name, count)
+		return
+	}
+
+	sort.Slice(pts, func(i, j int) bool { return pts[i] < pts[j] })
+	for i := 1; i < len(pts); i++ {
+		if pts[i]-pts[i-1] != step {
+			t.Errorf("%s timestamps jump from %d to %d", name, pts[i-1], pts[i])
+			return
+		}
+	}
+}
+
+// failWriter is a ResponseWriter whose connection fails once limit bytes
+// have been written.
+type failWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.Body.Len()+len(p) > w.limit {
+		return 0, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestSegmentError(t *testing.T) {
+	file := testutil.File(t, testOptions)
+	h, err := NewHandler(func() (io.ReadSeeker, error) {
+		return bytes.NewReader(file), nil
+	}, 2000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(limit int) (w *failWriter, aborted bool) {
+		w = &failWriter{httptest.NewRecorder(), limit}
+		defer func() {
+			if r := recover(); r != nil {
+				if r != http.ErrAbortHandler {
+					panic(r)
+				}
+				aborted = true
+			}
+		}()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/seg0.ts", nil))
+		return w, false
+	}
+
+	// If nothing was written, there is still time for an error status.
+	w, aborted := serve(0)
+	if aborted || w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d (aborted %v) for a failure before writing, expected 500", w.Code, aborted)
+	}
+
+	// Once part of the segment is out, the connection must be aborted
+	// instead of an error message being appended.
+	w, aborted = serve(4 * 188)
+	if !aborted {
+		t.Error("the handler did not abort after a partial segment")
+	}
+	if w.Code != http.StatusOK || w.Body.Len() == 0 || w.Body.Len()%188 != 0 {
+		t.Errorf("got status %d with %d bytes, expected part of a segment", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,354 @@
+// Package httpio implements an io.ReadSeeker and io.ReaderAt over HTTP
+// range requests, so that files on HTTP servers and object stores can be
+// passed to matroska.NewDemuxer directly.
+//
+// Data is fetched in blocks, which are cached. MatroskaParser reads the
+// header first, then jumps around to what the SeekHead points to (the Cues
+// and Tags are often near the end of the file), and then reads clusters
+// sequentially. So isolated reads fetch a single block, while sequential
+// reads fetch increasingly many blocks per request.
+package httpio
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Defaults for the block size, the number of cached blocks and the maximum
+// number of blocks fetched per request.
+const (
+	DefaultBlockSize = 64 * 1024
+	DefaultCacheSize = 64
+	DefaultMaxBlocks = 16
+)
+
+type block struct {
+	index int64
+	data  []byte
+}
+
+// Reader reads a remote file with HTTP range requests.
+type Reader struct {
+	client    *http.Client
+	url       string
+	size      int64
+	validator string // A strong ETag or Last-Modified, for If-Range.
+	pos       int64
+
+	blockSize int64
+	cacheSize int
+	maxBlocks int64
+
+	mu       sync.Mutex
+	blocks   map[int64]*list.Element
+	lru      *list.List
+	last     int64
+	run      int64
+	requests int
+}
+
+// NewReader creates a Reader for url, using http.DefaultClient.
+func NewReader(url string) (*Reader, error) {
+	return NewReaderClient(http.DefaultClient, url)
+}
+
+// NewReaderClient creates a Reader for url which uses the given client.
+// The first block is fetched right away, to get the file's size, and
+// because it is where the demuxer starts reading.
+func NewReaderClient(client *http.Client, url string) (*Reader, error) {
+	r := &Reader{
+		client:    client,
+		url:       url,
+		size:      -1,
+		blockSize: DefaultBlockSize,
+		cacheSize: DefaultCacheSize,
+		maxBlocks: DefaultMaxBlocks,
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+		last:      -1,
+	}
+
+	err := r.fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// SetBlockSize sets the size of the blocks data is fetched and cached in,
+// and drops the cache. Sizes below 1 are taken as 1.
+func (r *Reader) SetBlockSize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if size < 1 {
+		size = 1
+	}
+	r.blockSize = int64(size)
+	r.blocks = make(map[int64]*list.Element)
+	r.lru.Init()
+	r.last = -1
+}
+
+// SetCacheSize sets the number of blocks which are cached, and how many of
+// them may be fetched in a single request. Both are at least 1, since the
+// block being read has to be cached.
+func (r *Reader) SetCacheSize(blocks, maxPerRequest int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if blocks < 1 {
+		blocks = 1
+	}
+	if maxPerRequest < 1 {
+		maxPerRequest = 1
+	}
+	r.cacheSize = blocks
+	r.maxBlocks = int64(maxPerRequest)
+	if r.maxBlocks > int64(blocks) {
+		r.maxBlocks = int64(blocks)
+	}
+	r.evict()
+}
+
+// Size returns the size of the file.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Requests returns the number of HTTP requests made so far.
+func (r *Reader) Requests() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.requests
+}
+
+func (r *Reader) evict() {
+	for r.lru.Len() > r.cacheSize {
+		e := r.lru.Back()
+		r.lru.Remove(e)
+		delete(r.blocks, e.Value.(*block).index)
+	}
+}
+
+// parseContentRange parses the start and total size from a Content-Range
+// header, of the form "bytes start-end/size".
+func parseContentRange(s string) (int64, int64, error) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %s", s)
+	}
+	s = s[len("bytes "):]
+
+	slash := strings.IndexByte(s, '/')
+	dash := strings.IndexByte(s, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %s", s)
+	}
+
+	start, err := strconv.ParseInt(s[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %s", s)
+	}
+	size, err := strconv.ParseInt(s[slash+1:], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %s", s)
+	}
+
+	return start, size, nil
+}
+
+// fetch gets count blocks starting at the given block in a single request,
+// and caches them. It must be called with mu held, or before the reader is
+// shared.
+func (r *Reader) fetch(first, count int64) error {
+	start := first * r.blockSize
+	end := start + count*r.blockSize - 1
+	if r.size >= 0 && end >= r.size {
+		end = r.size - 1
+	}
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if r.validator != "" {
+		// Get an error rather than a different file if it has changed.
+		req.Header.Set("If-Range", r.validator)
+	}
+
+	r.requests++
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode == http.StatusOK {
+			return fmt.Errorf("could not read %s: range requests are not supported, or the file has changed", r.url)
+		}
+		return fmt.Errorf("could not read %s: %s", r.url, resp.Status)
+	}
+
+	got, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if got != start {
+		return fmt.Errorf("could not read %s: got range starting at %d instead of %d", r.url, got, start)
+	}
+	if r.size < 0 {
+		r.size = size
+		// Weak ETags are not allowed in If-Range, and servers ignore
+		// them.
+		r.validator = resp.Header.Get("ETag")
+		if r.validator == "" || strings.HasPrefix(r.validator, "W/") {
+			r.validator = resp.Header.Get("Last-Modified")
+		}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	for i := int64(0); i < count && len(data) > 0; i++ {
+		n := r.blockSize
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+
+		b := &block{
+			index: first + i,
+			data:  data[:n:n],
+		}
+		data = data[n:]
+
+		if e, ok := r.blocks[b.index]; ok {
+			r.lru.Remove(e)
+		}
+		r.blocks[b.index] = r.lru.PushFront(b)
+	}
+	r.evict()
+
+	return nil
+}
+
+// getBlock returns a block, fetching it and possibly following blocks if
+// it is not cached. It must be called with mu held.
+func (r *Reader) getBlock(index int64) ([]byte, error) {
+	if e, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(e)
+		r.last = index
+		return e.Value.(*block).data, nil
+	}
+
+	// Sequential reads get increasingly large requests.
+	if index == r.last+1 {
+		r.run *= 2
+		if r.run == 0 {
+			r.run = 1
+		}
+		if r.run > r.maxBlocks {
+			r.run = r.maxBlocks
+		}
+	} else {
+		r.run = 1
+	}
+
+	count := int64(1)
+	for count < r.run && (index+count)*r.blockSize < r.size {
+		if _, ok := r.blocks[index+count]; ok {
+			break
+		}
+		count++
+	}
+
+	err := r.fetch(index, count)
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := r.blocks[index]
+	if !ok {
+		return nil, fmt.Errorf("could not read %s: short response", r.url)
+	}
+	r.last = index
+	return e.Value.(*block).data, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		data, err := r.getBlock(pos / r.blockSize)
+		if err != nil {
+			return n, err
+		}
+		rel := pos % r.blockSize
+		if rel >= int64(len(data)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], data[rel:])
+	}
+
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+
+	r.pos = pos
+	return pos, nil
+}
@@ -0,0 +1,250 @@
+package httpio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var modTime = time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// server serves data with range requests, and counts them.
+type server struct {
+	data []byte
+	etag string
+
+	mu       sync.Mutex
+	requests int
+	ifRange  []string
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	s.ifRange = append(s.ifRange, req.Header.Get("If-Range"))
+	etag := s.etag
+	s.mu.Unlock()
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, req, "file.mkv", modTime, bytes.NewReader(s.data))
+}
+
+func (s *server) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestCache(t *testing.T) {
+	s := &server{data: testData(1 << 20), etag: `"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	r, err := NewReader(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 1<<20 {
+		t.Fatalf("got size %d, expected %d", r.Size(), 1<<20)
+	}
+
+	// The first block is fetched by NewReader.
+	buf := make([]byte, 1000)
+	for i := 0; i < 10; i++ {
+		_, err = r.ReadAt(buf, int64(i*1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, s.data[i*1000:i*1000+1000]) {
+			t.Fatalf("read at %d returned the wrong data", i*1000)
+		}
+	}
+	if s.count() != 1 || r.Requests() != 1 {
+		t.Errorf("got %d requests (%d counted by the reader), expected 1", s.count(), r.Requests())
+	}
+
+	// An isolated read near the end fetches a single block, and reading
+	// it again, or going back to the start, needs no more requests.
+	for i := 0; i < 2; i++ {
+		_, err = r.ReadAt(buf, int64(len(s.data)-len(buf)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, s.data[len(s.data)-len(buf):]) {
+			t.Fatal("read at the end returned the wrong data")
+		}
+	}
+	_, err = r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.count() != 2 {
+		t.Errorf("got %d requests, expected 2", s.count())
+	}
+
+	// Reads across a block boundary are put together from both.
+	_, err = r.ReadAt(buf, DefaultBlockSize-500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, s.data[DefaultBlockSize-500:DefaultBlockSize+500]) {
+		t.Fatal("read across blocks returned the wrong data")
+	}
+	if s.count() != 3 {
+		t.Errorf("got %d requests, expected 3", s.count())
+	}
+
+	// Once evicted, blocks are fetched again.
+	r.SetCacheSize(1, 1)
+	_, err = r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.count() != 4 {
+		t.Errorf("got %d requests after eviction, expected 4", s.count())
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	s := &server{data: testData(64 * 1024), etag: `"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	r, err := NewReader(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetBlockSize(1024)
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, s.data) {
+		t.Fatal("sequential read returned the wrong data")
+	}
+
+	// The initial request, and then requests for 1, 2, 4, 8, 16, 16 and
+	// 16 blocks, and the one remaining.
+	if s.count() != 9 {
+		t.Errorf("got %d requests for 64 blocks, expected 9", s.count())
+	}
+
+	// Seeking elsewhere starts again with single blocks.
+	_, err = r.Seek(10*1024, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetBlockSize(1024)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, s.data[10*1024:10*1024+10]) {
+		t.Fatal("read after seeking returned the wrong data")
+	}
+	if s.count() != 10 {
+		t.Errorf("got %d requests, expected 10", s.count())
+	}
+}
+
+func TestZeroSizes(t *testing.T) {
+	s := &server{data: testData(4096), etag: `"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	r, err := NewReader(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetBlockSize(0)
+	r.SetCacheSize(0, 0)
+
+	buf := make([]byte, 10)
+	_, err = r.ReadAt(buf, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, s.data[100:110]) {
+		t.Fatal("read with zero sizes returned the wrong data")
+	}
+}
+
+func TestNoRanges(t *testing.T) {
+	data := testData(4096)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	_, err := NewReader(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "range requests are not supported") {
+		t.Errorf("got error %v, expected range requests to be unsupported", err)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	s := &server{data: testData(1 << 20), etag: `"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	r, err := NewReader(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	s.etag = `"v2"`
+	s.mu.Unlock()
+
+	buf := make([]byte, 10)
+	_, err = r.ReadAt(buf, 1<<19)
+	if err == nil {
+		t.Error("read of a changed file succeeded")
+	}
+	if s.ifRange[1] != `"v1"` {
+		t.Errorf("got If-Range %q, expected the ETag", s.ifRange[1])
+	}
+}
+
+func TestWeakETag(t *testing.T) {
+	s := &server{data: testData(1 << 20), etag: `W/"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	r, err := NewReader(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 10)
+	_, err = r.ReadAt(buf, 1<<19)
+	if err != nil {
+		t.Fatalf("could not read with a weak ETag: %s", err.Error())
+	}
+	if !bytes.Equal(buf, s.data[1<<19:1<<19+10]) {
+		t.Fatal("read returned the wrong data")
+	}
+
+	lastModified := modTime.Format(http.TimeFormat)
+	if s.ifRange[1] != lastModified {
+		t.Errorf("got If-Range %q, expected the Last-Modified date %q", s.ifRange[1], lastModified)
+	}
+}
@@ -0,0 +1,137 @@
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+var adtsRates = []uint32{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// ADTS imports AAC audio stored in ADTS frames, e.g. .aac files.
+type ADTS struct {
+	r       *bufio.Reader
+	ti      matroska.TrackInfo
+	rate    uint64
+	samples uint64
+	first   []byte
+}
+
+// readFrame reads the next ADTS frame, returning its header and payload.
+func readADTSFrame(r *bufio.Reader) ([]byte, []byte, error) {
+	header := make([]byte, 7)
+	_, err := io.ReadFull(r, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, nil, io.EOF
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if header[0] != 0xff || header[1]&0xf6 != 0xf0 {
+		return nil, nil, fmt.Errorf("could not find ADTS sync word")
+	}
+
+	headerLen := 7
+	if header[1]&1 == 0 {
+		// CRC present.
+		headerLen = 9
+		_, err = r.Discard(2)
+		if err != nil {
+			return nil, nil, io.EOF
+		}
+	}
+	if header[6]&3 != 0 {
+		return nil, nil, fmt.Errorf("could not import ADTS frame with multiple raw data blocks")
+	}
+
+	frameLen := int(header[3]&3)<<11 | int(header[4])<<3 | int(header[5]>>5)
+	if frameLen < headerLen {
+		return nil, nil, fmt.Errorf("could not parse ADTS frame length")
+	}
+
+	data := make([]byte, frameLen-headerLen)
+	_, err = io.ReadFull(r, data)
+	if err == io.ErrUnexpectedEOF {
+		return nil, nil, io.EOF
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return header, data, nil
+}
+
+// NewADTS creates an importer for the ADTS stream in r.
+func NewADTS(r io.Reader) (*ADTS, error) {
+	a := &ADTS{
+		r: bufio.NewReader(r),
+	}
+
+	header, data, err := readADTSFrame(a.r)
+	if err == io.EOF {
+		return nil, fmt.Errorf("could not find any ADTS frames")
+	} else if err != nil {
+		return nil, err
+	}
+	a.first = data
+
+	profile := header[2] >> 6
+	rateIndex := (header[2] >> 2) & 0xf
+	channels := (header[2]&1)<<2 | header[3]>>6
+	if int(rateIndex) >= len(adtsRates) {
+		return nil, fmt.Errorf("could not parse ADTS sampling frequency index %d", rateIndex)
+	}
+	a.rate = uint64(adtsRates[rateIndex])
+
+	// AudioSpecificConfig
+	objectType := profile + 1
+	cp := []byte{objectType<<3 | rateIndex>>1, rateIndex<<7 | channels<<3}
+
+	a.ti = matroska.TrackInfo{
+		Type:            matroska.TypeAudio,
+		CodecID:         "A_AAC",
+		CodecPrivate:    cp,
+		DefaultDuration: samplesToNs(1024, a.rate),
+		Enabled:         true,
+		Default:         true,
+		Language:        "und",
+	}
+	a.ti.Audio.SamplingFreq = float64(a.rate)
+	a.ti.Audio.Channels = channels
+	if channels == 7 {
+		a.ti.Audio.Channels = 8
+	}
+
+	return a, nil
+}
+
+// TrackInfo implements the Importer interface.
+func (a *ADTS) TrackInfo() *matroska.TrackInfo {
+	return &a.ti
+}
+
+// ReadPacket implements the Importer interface.
+func (a *ADTS) ReadPacket() (*matroska.Packet, error) {
+	data := a.first
+	a.first = nil
+	if data == nil {
+		var err error
+		_, data, err = readADTSFrame(a.r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p := &matroska.Packet{
+		StartTime: samplesToNs(a.samples, a.rate),
+		EndTime:   samplesToNs(a.samples+1024, a.rate),
+		Data:      data,
+		Flags:     matroska.KF,
+	}
+	a.samples += 1024
+
+	return p, nil
+}
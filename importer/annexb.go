@@ -0,0 +1,185 @@
+package importer
+
+import (
+	"bytes"
+	"io"
+)
+
+var startCode = []byte{0, 0, 1}
+
+// nalReader splits an Annex B byte stream into NAL units.
+type nalReader struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func (nr *nalReader) fill() error {
+	chunk := make([]byte, 64*1024)
+	n, err := nr.r.Read(chunk)
+	nr.buf = append(nr.buf, chunk[:n]...)
+	if err == io.EOF {
+		nr.eof = true
+		return nil
+	}
+	return err
+}
+
+// next returns the next NAL unit, without its start code or any trailing
+// zero bytes.
+func (nr *nalReader) next() ([]byte, error) {
+	for {
+		// Find the start of the NAL.
+		i := bytes.Index(nr.buf, startCode)
+		for i < 0 {
+			if nr.eof {
+				nr.buf = nil
+				return nil, io.EOF
+			}
+			if len(nr.buf) > 2 {
+				nr.buf = nr.buf[len(nr.buf)-2:]
+			}
+			err := nr.fill()
+			if err != nil {
+				return nil, err
+			}
+			i = bytes.Index(nr.buf, startCode)
+		}
+		nr.buf = nr.buf[i+len(startCode):]
+
+		// And its end, which is either the next start code, or EOF.
+		searched := 0
+		var nal []byte
+		for {
+			i = bytes.Index(nr.buf[searched:], startCode)
+			if i >= 0 {
+				nal = nr.buf[:searched+i]
+				nr.buf = nr.buf[searched+i:]
+				break
+			}
+			if nr.eof {
+				nal = nr.buf
+				nr.buf = nil
+				break
+			}
+			if len(nr.buf) > 2 {
+				searched = len(nr.buf) - 2
+			}
+			err := nr.fill()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for len(nal) > 0 && nal[len(nal)-1] == 0 {
+			nal = nal[:len(nal)-1]
+		}
+		if len(nal) == 0 {
+			continue
+		}
+
+		ret := make([]byte, len(nal))
+		copy(ret, nal)
+		return ret, nil
+	}
+}
+
+// appendNAL appends a NAL unit with a 4 byte length prefix, which is what
+// both avcC and hvcC CodecPrivates produced in this package signal.
+func appendNAL(b []byte, nal []byte) []byte {
+	n := len(nal)
+	b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(b, nal...)
+}
+
+// The maximum number of pictures which can be reordered, which is the
+// maximum DPB size for both H.264 and HEVC.
+const reorderWindow = 16
+
+type picture struct {
+	data     []byte
+	key      bool
+	poc      int
+	pts      uint64
+	assigned bool
+}
+
+// reorderer assigns presentation timestamps to pictures in decoding order
+// based on their picture order counts, assuming a constant frame rate.
+type reorderer struct {
+	duration uint64
+	next     uint64
+	queue    []*picture
+	pending  []*picture
+}
+
+// push adds a picture in decoding order. reset must be set for pictures
+// which reset the picture order count, e.g. IDR pictures.
+func (ro *reorderer) push(pic *picture, reset bool) {
+	if reset {
+		ro.flush()
+	}
+
+	ro.queue = append(ro.queue, pic)
+	ro.pending = append(ro.pending, pic)
+
+	for len(ro.pending) > reorderWindow {
+		ro.assignFirst()
+	}
+}
+
+// assignFirst gives the next timestamp to the pending picture which will
+// be presented first.
+func (ro *reorderer) assignFirst() {
+	first := 0
+	for i, pic := range ro.pending {
+		if pic.poc < ro.pending[first].poc {
+			first = i
+		}
+	}
+
+	pic := ro.pending[first]
+	pic.pts = ro.next
+	pic.assigned = true
+	ro.next += ro.duration
+
+	ro.pending = append(ro.pending[:first], ro.pending[first+1:]...)
+}
+
+// flush assigns timestamps to all pending pictures.
+func (ro *reorderer) flush() {
+	for len(ro.pending) > 0 {
+		ro.assignFirst()
+	}
+}
+
+// pop returns the next picture in decoding order if its timestamp is
+// known, or nil.
+func (ro *reorderer) pop() *picture {
+	if len(ro.queue) == 0 || !ro.queue[0].assigned {
+		return nil
+	}
+
+	pic := ro.queue[0]
+	ro.queue[0] = nil
+	ro.queue = ro.queue[1:]
+	return pic
+}
+
+// frameDuration returns the duration of a frame for a frame rate of
+// timeScale / numUnitsInTick, or 0 if that is not a sane frame rate.
+func frameDuration(numUnitsInTick, timeScale uint32) uint64 {
+	if numUnitsInTick == 0 || timeScale == 0 {
+		return 0
+	}
+	dur := uint64(numUnitsInTick) * 1000000000 / uint64(timeScale)
+	// Anything above 1000 or below 1 fps is probably bogus.
+	if dur < 1000000 || dur > 1000000000 {
+		return 0
+	}
+	return dur
+}
+
+// The frame duration used when the stream does not signal a frame rate and
+// none was given, i.e. 25 fps.
+const defaultFrameDuration = 40000000
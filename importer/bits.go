@@ -0,0 +1,85 @@
+package importer
+
+import (
+	"fmt"
+)
+
+var errBitsEOF = fmt.Errorf("unexpected end of bitstream")
+
+// bitReader reads MSB-first bit fields, as used by all the video and audio
+// headers parsed in this package.
+type bitReader struct {
+	buf []byte
+	pos uint
+	err error
+}
+
+func (br *bitReader) bit() uint32 {
+	if br.pos >= uint(len(br.buf))*8 {
+		br.err = errBitsEOF
+		return 0
+	}
+	b := (br.buf[br.pos/8] >> (7 - br.pos%8)) & 1
+	br.pos++
+	return uint32(b)
+}
+
+func (br *bitReader) flag() bool {
+	return br.bit() == 1
+}
+
+func (br *bitReader) bits(n uint) uint32 {
+	var ret uint32
+	for i := uint(0); i < n; i++ {
+		ret = ret<<1 | br.bit()
+	}
+	return ret
+}
+
+func (br *bitReader) skip(n uint) {
+	br.pos += n
+	if br.pos > uint(len(br.buf))*8 {
+		br.err = errBitsEOF
+	}
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (br *bitReader) ue() uint32 {
+	zeros := uint(0)
+	for br.bit() == 0 {
+		if br.err != nil || zeros > 31 {
+			br.err = errBitsEOF
+			return 0
+		}
+		zeros++
+	}
+	return (1<<zeros - 1) + br.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (br *bitReader) se() int32 {
+	v := br.ue()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+// unescapeRBSP removes emulation prevention bytes from a NAL unit.
+func unescapeRBSP(nal []byte) []byte {
+	ret := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		ret = append(ret, b)
+	}
+	return ret
+}
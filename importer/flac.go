@@ -0,0 +1,285 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// FLAC imports native FLAC files.
+type FLAC struct {
+	r        *bufio.Reader
+	ti       matroska.TrackInfo
+	rate     uint64
+	samples  uint64
+	buf      []byte
+	eof      bool
+	minFrame int
+}
+
+// flacCRC8 computes the CRC-8 used by FLAC frame headers (polynomial 0x07).
+func flacCRC8(b []byte) byte {
+	crc := byte(0)
+	for _, v := range b {
+		crc ^= v
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// flacCRC16 computes the CRC-16 used by FLAC frame footers (polynomial 0x8005).
+func flacCRC16(b []byte) uint16 {
+	crc := uint16(0)
+	for _, v := range b {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// NewFLAC creates an importer for the FLAC file in r.
+func NewFLAC(r io.Reader) (*FLAC, error) {
+	f := &FLAC{
+		r: bufio.NewReader(r),
+	}
+
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(f.r, magic)
+	if err != nil || string(magic) != "fLaC" {
+		return nil, fmt.Errorf("could not find FLAC signature")
+	}
+
+	// The CodecPrivate is the signature and all metadata blocks, as they
+	// appear in the file.
+	cp := magic
+	var streamInfo []byte
+	for {
+		hdr := make([]byte, 4)
+		_, err = io.ReadFull(f.r, hdr)
+		if err != nil {
+			return nil, fmt.Errorf("could not read FLAC metadata block: %s", err.Error())
+		}
+		size := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		body := make([]byte, size)
+		_, err = io.ReadFull(f.r, body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read FLAC metadata block: %s", err.Error())
+		}
+
+		if hdr[0]&0x7f == 0 {
+			streamInfo = body
+		}
+		cp = append(cp, hdr...)
+		cp = append(cp, body...)
+
+		if hdr[0]&0x80 != 0 {
+			break
+		}
+	}
+	if len(streamInfo) < 34 {
+		return nil, fmt.Errorf("could not find FLAC STREAMINFO")
+	}
+
+	f.minFrame = int(streamInfo[4])<<16 | int(streamInfo[5])<<8 | int(streamInfo[6])
+	info := binary.BigEndian.Uint64(streamInfo[10:18])
+	f.rate = info >> 44
+	channels := uint8((info>>41)&7) + 1
+	bitDepth := uint8((info>>36)&0x1f) + 1
+	if f.rate == 0 {
+		return nil, fmt.Errorf("could not import FLAC with a sample rate of 0")
+	}
+
+	maxBlock := uint64(binary.BigEndian.Uint16(streamInfo[2:4]))
+	f.ti = matroska.TrackInfo{
+		Type:         matroska.TypeAudio,
+		CodecID:      "A_FLAC",
+		CodecPrivate: cp,
+		Enabled:      true,
+		Default:      true,
+		Language:     "und",
+	}
+	if minBlock := uint64(binary.BigEndian.Uint16(streamInfo[0:2])); minBlock == maxBlock {
+		f.ti.DefaultDuration = samplesToNs(maxBlock, f.rate)
+	}
+	f.ti.Audio.SamplingFreq = float64(f.rate)
+	f.ti.Audio.Channels = channels
+	f.ti.Audio.BitDepth = bitDepth
+
+	return f, nil
+}
+
+// TrackInfo implements the Importer interface.
+func (f *FLAC) TrackInfo() *matroska.TrackInfo {
+	return &f.ti
+}
+
+// flacFrameHeader parses a frame header at the start of b, returning the block
+// size, or 0 if it is not a valid frame header.
+func flacFrameHeader(b []byte) uint64 {
+	if len(b) < 6 || b[0] != 0xff || b[1]&0xfe != 0xf8 {
+		return 0
+	}
+
+	blockBits := b[2] >> 4
+	rateBits := b[2] & 0xf
+	if blockBits == 0 || rateBits == 0xf || b[3]&0x01 != 0 || (b[3]>>1)&7 == 3 || (b[3]>>1)&7 == 7 {
+		return 0
+	}
+
+	// Skip the UTF-8 coded frame or sample number.
+	pos := 4
+	extra := 0
+	switch {
+	case b[pos]&0x80 == 0:
+	case b[pos]&0xe0 == 0xc0:
+		extra = 1
+	case b[pos]&0xf0 == 0xe0:
+		extra = 2
+	case b[pos]&0xf8 == 0xf0:
+		extra = 3
+	case b[pos]&0xfc == 0xf8:
+		extra = 4
+	case b[pos]&0xfe == 0xfc:
+		extra = 5
+	case b[pos] == 0xfe:
+		extra = 6
+	default:
+		return 0
+	}
+	pos += 1 + extra
+
+	var blockSize uint64
+	switch {
+	case blockBits == 1:
+		blockSize = 192
+	case blockBits <= 5:
+		blockSize = 576 << (blockBits - 2)
+	case blockBits == 6:
+		if pos >= len(b) {
+			return 0
+		}
+		blockSize = uint64(b[pos]) + 1
+		pos++
+	case blockBits == 7:
+		if pos+1 >= len(b) {
+			return 0
+		}
+		blockSize = uint64(b[pos])<<8 | uint64(b[pos+1]) + 1
+		pos += 2
+	default:
+		blockSize = 256 << (blockBits - 8)
+	}
+
+	switch rateBits {
+	case 12:
+		pos++
+	case 13, 14:
+		pos += 2
+	}
+
+	if pos >= len(b) || flacCRC8(b[:pos]) != b[pos] {
+		return 0
+	}
+
+	return blockSize
+}
+
+func (f *FLAC) fill() error {
+	chunk := make([]byte, 64*1024)
+	n, err := f.r.Read(chunk)
+	f.buf = append(f.buf, chunk[:n]...)
+	if err == io.EOF {
+		f.eof = true
+		return nil
+	}
+	return err
+}
+
+// ReadPacket implements the Importer interface.
+func (f *FLAC) ReadPacket() (*matroska.Packet, error) {
+	for len(f.buf) < 16 && !f.eof {
+		err := f.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(f.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	blockSize := flacFrameHeader(f.buf)
+	if blockSize == 0 {
+		return nil, fmt.Errorf("could not parse FLAC frame header")
+	}
+
+	// Frames have no length field, so find the next frame header whose
+	// preceding data passes the CRC check.
+	sync := []byte{0xff}
+	searched := 2
+	if f.minFrame > searched {
+		searched = f.minFrame - 1
+	}
+	end := -1
+	for end < 0 {
+		// Leave room for a full header, unless there is no more data.
+		limit := len(f.buf) - 16
+		if f.eof {
+			limit = len(f.buf)
+		}
+		for searched < limit {
+			i := bytes.Index(f.buf[searched:limit], sync)
+			if i < 0 {
+				searched = limit
+				break
+			}
+			pos := searched + i
+			searched = pos + 1
+			if flacFrameHeader(f.buf[pos:]) != 0 &&
+				flacCRC16(f.buf[:pos-2]) == binary.BigEndian.Uint16(f.buf[pos-2:pos]) {
+				end = pos
+				break
+			}
+		}
+		if end >= 0 {
+			break
+		}
+		if f.eof {
+			end = len(f.buf)
+			break
+		}
+		err := f.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, end)
+	copy(data, f.buf[:end])
+	f.buf = f.buf[end:]
+
+	p := &matroska.Packet{
+		StartTime: samplesToNs(f.samples, f.rate),
+		EndTime:   samplesToNs(f.samples+blockSize, f.rate),
+		Data:      data,
+		Flags:     matroska.KF,
+	}
+	f.samples += blockSize
+
+	return p, nil
+}
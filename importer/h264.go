@@ -0,0 +1,636 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Sample aspect ratios for aspect_ratio_idc 1 through 16, shared by H.264
+// and HEVC.
+var sarTable = [][2]uint32{
+	{1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11},
+	{80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+// vui contains the bits of the VUI parameters that end up in the track
+// information.
+type vui struct {
+	sarW, sarH     uint32
+	videoSignal    bool
+	fullRange      bool
+	colour         bool
+	primaries      uint32
+	transfer       uint32
+	matrix         uint32
+	numUnitsInTick uint32
+	timeScale      uint32
+}
+
+func (v *vui) parseAspectRatio(br *bitReader) {
+	if !br.flag() {
+		return
+	}
+	idc := br.bits(8)
+	if idc == 255 {
+		v.sarW = br.bits(16)
+		v.sarH = br.bits(16)
+	} else if idc >= 1 && int(idc) <= len(sarTable) {
+		v.sarW = sarTable[idc-1][0]
+		v.sarH = sarTable[idc-1][1]
+	}
+}
+
+func (v *vui) parseVideoSignal(br *bitReader) {
+	// overscan_info_present_flag
+	if br.flag() {
+		br.skip(1)
+	}
+	// video_signal_type_present_flag
+	if br.flag() {
+		br.skip(3)
+		v.videoSignal = true
+		v.fullRange = br.flag()
+		if br.flag() {
+			v.colour = true
+			v.primaries = br.bits(8)
+			v.transfer = br.bits(8)
+			v.matrix = br.bits(8)
+		}
+	}
+	// chroma_loc_info_present_flag
+	if br.flag() {
+		br.ue()
+		br.ue()
+	}
+}
+
+// setVideo fills in the video information common to H.264 and HEVC.
+func setVideo(ti *matroska.TrackInfo, width, height, chromaFormat, bitDepth uint32, v *vui) {
+	ti.Video.PixelWidth = width
+	ti.Video.PixelHeight = height
+	ti.Video.DisplayWidth = width
+	ti.Video.DisplayHeight = height
+	if v.sarW != 0 && v.sarH != 0 && v.sarW != v.sarH {
+		if v.sarW > v.sarH {
+			ti.Video.DisplayWidth = uint32(uint64(width) * uint64(v.sarW) / uint64(v.sarH))
+		} else {
+			ti.Video.DisplayHeight = uint32(uint64(height) * uint64(v.sarH) / uint64(v.sarW))
+		}
+	}
+
+	c := &ti.Video.Colour
+	c.BitsPerChannel = bitDepth
+	switch chromaFormat {
+	case 1:
+		c.ChromaSubsamplingHorz = 1
+		c.ChromaSubsamplingVert = 1
+	case 2:
+		c.ChromaSubsamplingHorz = 1
+	}
+	if v.fullRange {
+		c.Range = 2
+	} else if v.videoSignal {
+		c.Range = 1
+	}
+	if v.colour {
+		c.Primaries = v.primaries
+		c.TransferCharacteristics = v.transfer
+		c.MatrixCoefficients = v.matrix
+	}
+}
+
+type h264SPS struct {
+	raw             []byte
+	id              uint32
+	profile         uint32
+	compat          uint32
+	level           uint32
+	chromaFormat    uint32
+	separateColour  bool
+	bitDepthLuma    uint32
+	bitDepthChroma  uint32
+	log2MaxFrameNum uint
+	pocType         uint32
+	log2MaxPOCLsb   uint
+	frameMbsOnly    bool
+	width, height   uint32
+	vui             vui
+}
+
+type h264PPS struct {
+	raw                []byte
+	id                 uint32
+	spsID              uint32
+	bottomFieldPOCFlag bool
+}
+
+type h264Slice struct {
+	nalType   byte
+	refIdc    byte
+	firstMB   uint32
+	sliceType uint32
+	ppsID     uint32
+	frameNum  uint32
+	field     bool
+	bottom    bool
+	pocLsb    uint32
+}
+
+func skipScalingList(br *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			next = (last + br.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+func parseH264SPS(nal []byte) (*h264SPS, error) {
+	sps := &h264SPS{
+		raw:            nal,
+		chromaFormat:   1,
+		bitDepthLuma:   8,
+		bitDepthChroma: 8,
+	}
+
+	br := &bitReader{buf: unescapeRBSP(nal[1:])}
+	sps.profile = br.bits(8)
+	sps.compat = br.bits(8)
+	sps.level = br.bits(8)
+	sps.id = br.ue()
+
+	switch sps.profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.chromaFormat = br.ue()
+		if sps.chromaFormat == 3 {
+			sps.separateColour = br.flag()
+		}
+		sps.bitDepthLuma = br.ue() + 8
+		sps.bitDepthChroma = br.ue() + 8
+		// qpprime_y_zero_transform_bypass_flag
+		br.skip(1)
+		if br.flag() {
+			lists := 8
+			if sps.chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !br.flag() {
+					continue
+				}
+				if i < 6 {
+					skipScalingList(br, 16)
+				} else {
+					skipScalingList(br, 64)
+				}
+			}
+		}
+	}
+
+	sps.log2MaxFrameNum = uint(br.ue() + 4)
+	sps.pocType = br.ue()
+	switch sps.pocType {
+	case 0:
+		sps.log2MaxPOCLsb = uint(br.ue() + 4)
+	case 1:
+		br.skip(1)
+		br.se()
+		br.se()
+		n := br.ue()
+		for i := uint32(0); i < n && br.err == nil; i++ {
+			br.se()
+		}
+	}
+
+	// max_num_ref_frames, gaps_in_frame_num_value_allowed_flag
+	br.ue()
+	br.skip(1)
+
+	widthMbs := br.ue() + 1
+	heightMapUnits := br.ue() + 1
+	sps.frameMbsOnly = br.flag()
+	if !sps.frameMbsOnly {
+		br.skip(1)
+	}
+	br.skip(1)
+
+	var cropL, cropR, cropT, cropB uint32
+	if br.flag() {
+		cropL = br.ue()
+		cropR = br.ue()
+		cropT = br.ue()
+		cropB = br.ue()
+	}
+
+	fieldFactor := uint32(2)
+	if sps.frameMbsOnly {
+		fieldFactor = 1
+	}
+	cropX, cropY := uint32(1), fieldFactor
+	if sps.chromaFormat != 0 && !sps.separateColour {
+		if sps.chromaFormat != 3 {
+			cropX = 2
+		}
+		if sps.chromaFormat == 1 {
+			cropY *= 2
+		}
+	}
+	sps.width = widthMbs*16 - cropX*(cropL+cropR)
+	sps.height = fieldFactor*heightMapUnits*16 - cropY*(cropT+cropB)
+
+	if br.flag() {
+		sps.vui.parseAspectRatio(br)
+		sps.vui.parseVideoSignal(br)
+		if br.flag() {
+			sps.vui.numUnitsInTick = br.bits(32)
+			sps.vui.timeScale = br.bits(32)
+		}
+	}
+
+	if br.err != nil {
+		return nil, fmt.Errorf("could not parse SPS: %s", br.err.Error())
+	}
+
+	return sps, nil
+}
+
+func parseH264PPS(nal []byte) (*h264PPS, error) {
+	br := &bitReader{buf: unescapeRBSP(nal[1:])}
+
+	pps := &h264PPS{raw: nal}
+	pps.id = br.ue()
+	pps.spsID = br.ue()
+	// entropy_coding_mode_flag
+	br.skip(1)
+	pps.bottomFieldPOCFlag = br.flag()
+
+	if br.err != nil {
+		return nil, fmt.Errorf("could not parse PPS: %s", br.err.Error())
+	}
+
+	return pps, nil
+}
+
+// hasRecoveryPoint reports whether a SEI NAL contains a recovery point SEI
+// message.
+func hasRecoveryPoint(nal []byte, header int) bool {
+	rbsp := unescapeRBSP(nal[header:])
+	for len(rbsp) > 2 {
+		typ := 0
+		for len(rbsp) > 0 && rbsp[0] == 0xff {
+			typ += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			return false
+		}
+		typ += int(rbsp[0])
+		rbsp = rbsp[1:]
+
+		size := 0
+		for len(rbsp) > 0 && rbsp[0] == 0xff {
+			size += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			return false
+		}
+		size += int(rbsp[0])
+		rbsp = rbsp[1:]
+
+		if typ == 6 {
+			return true
+		}
+		if size > len(rbsp) {
+			return false
+		}
+		rbsp = rbsp[size:]
+	}
+	return false
+}
+
+// H264 imports raw H.264 Annex B elementary streams.
+//
+// Since Annex B streams carry no timestamps, a constant frame rate is
+// assumed. Presentation timestamps are derived from the picture order count,
+// so streams using B-frames work fine.
+type H264 struct {
+	nr  *nalReader
+	ro  reorderer
+	ti  matroska.TrackInfo
+	sps map[uint32]*h264SPS
+	pps map[uint32]*h264PPS
+
+	// NALs read while probing, which still need to be processed.
+	queued [][]byte
+
+	// The access unit being built, and any non-VCL NALs which may or may
+	// not belong to it yet.
+	cur          *picture
+	curSlice     h264Slice
+	curRecovery  bool
+	paired       bool
+	extra        [][]byte
+	nextRecovery bool
+
+	prevPOCMsb int
+	prevPOCLsb int
+	count      int
+	eof        bool
+}
+
+// NewH264 creates an importer for the H.264 Annex B stream in r. If
+// duration is 0, the frame rate signalled in the SPS is used, or 25 fps
+// if there is none.
+func NewH264(r io.Reader, duration uint64) (*H264, error) {
+	h := &H264{
+		nr:  &nalReader{r: r},
+		sps: make(map[uint32]*h264SPS),
+		pps: make(map[uint32]*h264PPS),
+	}
+
+	// Read up to the first slice, so we can build the CodecPrivate.
+	var spss []*h264SPS
+	var ppss []*h264PPS
+	for {
+		nal, err := h.nr.next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("could not find any slices")
+		} else if err != nil {
+			return nil, err
+		}
+		h.queued = append(h.queued, nal)
+
+		typ := nal[0] & 0x1f
+		if typ == 1 || typ == 5 {
+			break
+		} else if typ == 7 {
+			sps, err := parseH264SPS(nal)
+			if err != nil {
+				return nil, err
+			}
+			spss = append(spss, sps)
+		} else if typ == 8 {
+			pps, err := parseH264PPS(nal)
+			if err != nil {
+				return nil, err
+			}
+			ppss = append(ppss, pps)
+		}
+	}
+	if len(spss) == 0 || len(ppss) == 0 {
+		return nil, fmt.Errorf("could not find SPS and PPS before the first slice")
+	}
+
+	sps := spss[0]
+	if duration == 0 {
+		// H.264 counts fields, not frames.
+		duration = frameDuration(2*sps.vui.numUnitsInTick, sps.vui.timeScale)
+		if duration == 0 {
+			duration = defaultFrameDuration
+		}
+	}
+	h.ro.duration = duration
+
+	// avcC
+	cp := []byte{1, byte(sps.profile), byte(sps.compat), byte(sps.level), 0xff, 0xe0 | byte(len(spss))}
+	for _, s := range spss {
+		cp = append(cp, byte(len(s.raw)>>8), byte(len(s.raw)))
+		cp = append(cp, s.raw...)
+	}
+	cp = append(cp, byte(len(ppss)))
+	for _, p := range ppss {
+		cp = append(cp, byte(len(p.raw)>>8), byte(len(p.raw)))
+		cp = append(cp, p.raw...)
+	}
+	switch sps.profile {
+	case 100, 110, 122, 244:
+		cp = append(cp, 0xfc|byte(sps.chromaFormat), 0xf8|byte(sps.bitDepthLuma-8), 0xf8|byte(sps.bitDepthChroma-8), 0)
+	}
+
+	h.ti = matroska.TrackInfo{
+		Type:            matroska.TypeVideo,
+		CodecID:         "V_MPEG4/ISO/AVC",
+		CodecPrivate:    cp,
+		DefaultDuration: duration,
+		Enabled:         true,
+		Default:         true,
+		Language:        "und",
+	}
+	setVideo(&h.ti, sps.width, sps.height, sps.chromaFormat, sps.bitDepthLuma, &sps.vui)
+	h.ti.Video.Interlaced = !sps.frameMbsOnly
+
+	return h, nil
+}
+
+// TrackInfo implements the Importer interface.
+func (h *H264) TrackInfo() *matroska.TrackInfo {
+	return &h.ti
+}
+
+func (h *H264) nextNAL() ([]byte, error) {
+	if len(h.queued) > 0 {
+		nal := h.queued[0]
+		h.queued = h.queued[1:]
+		return nal, nil
+	}
+	return h.nr.next()
+}
+
+func (h *H264) parseSlice(nal []byte) (h264Slice, error) {
+	s := h264Slice{
+		nalType: nal[0] & 0x1f,
+		refIdc:  (nal[0] >> 5) & 3,
+	}
+
+	// Slice headers are short, so there is no need to unescape the
+	// whole thing.
+	end := len(nal)
+	if end > 64 {
+		end = 64
+	}
+	br := &bitReader{buf: unescapeRBSP(nal[1:end])}
+	s.firstMB = br.ue()
+	s.sliceType = br.ue()
+	s.ppsID = br.ue()
+
+	pps, ok := h.pps[s.ppsID]
+	if !ok {
+		return s, fmt.Errorf("could not find PPS %d", s.ppsID)
+	}
+	sps, ok := h.sps[pps.spsID]
+	if !ok {
+		return s, fmt.Errorf("could not find SPS %d", pps.spsID)
+	}
+
+	if sps.separateColour {
+		br.skip(2)
+	}
+	s.frameNum = br.bits(sps.log2MaxFrameNum)
+	if !sps.frameMbsOnly {
+		s.field = br.flag()
+		if s.field {
+			s.bottom = br.flag()
+		}
+	}
+	if s.nalType == 5 {
+		br.ue()
+	}
+	if sps.pocType == 0 {
+		s.pocLsb = br.bits(sps.log2MaxPOCLsb)
+	}
+
+	if br.err != nil {
+		return s, fmt.Errorf("could not parse slice header: %s", br.err.Error())
+	}
+
+	return s, nil
+}
+
+// finishPicture computes the picture order count of the current access
+// unit and hands it to the reorderer.
+func (h *H264) finishPicture() {
+	if h.cur == nil {
+		return
+	}
+
+	s := &h.curSlice
+	sps := h.sps[h.pps[s.ppsID].spsID]
+	idr := s.nalType == 5
+
+	if idr {
+		h.prevPOCMsb = 0
+		h.prevPOCLsb = 0
+		h.count = 0
+	}
+
+	if sps.pocType == 0 {
+		lsb := int(s.pocLsb)
+		max := 1 << sps.log2MaxPOCLsb
+		msb := h.prevPOCMsb
+		if lsb < h.prevPOCLsb && h.prevPOCLsb-lsb >= max/2 {
+			msb += max
+		} else if lsb > h.prevPOCLsb && lsb-h.prevPOCLsb > max/2 {
+			msb -= max
+		}
+		h.cur.poc = msb + lsb
+		if s.refIdc != 0 {
+			h.prevPOCMsb = msb
+			h.prevPOCLsb = lsb
+		}
+	} else {
+		// The other POC types cannot reorder frames in practice.
+		h.cur.poc = h.count
+	}
+	h.count++
+
+	h.cur.key = idr || (h.curRecovery && s.sliceType%5 == 2)
+	h.ro.push(h.cur, idr)
+
+	h.cur = nil
+	h.curRecovery = false
+}
+
+func (h *H264) handleNAL(nal []byte) error {
+	typ := nal[0] & 0x1f
+
+	switch typ {
+	case 1, 5:
+		s, err := h.parseSlice(nal)
+		if err != nil {
+			return err
+		}
+
+		// Decide whether this slice starts a new access unit. Fields of
+		// the same frame are kept in a single block.
+		if h.cur != nil && s.firstMB == 0 {
+			c := &h.curSlice
+			if !h.paired && c.field && s.field && c.bottom != s.bottom && c.frameNum == s.frameNum {
+				h.paired = true
+			} else {
+				h.finishPicture()
+			}
+		}
+		if h.cur == nil {
+			h.cur = &picture{}
+			h.curSlice = s
+			h.paired = false
+		}
+		if h.nextRecovery {
+			h.curRecovery = true
+			h.nextRecovery = false
+		}
+
+		for _, e := range h.extra {
+			h.cur.data = appendNAL(h.cur.data, e)
+		}
+		h.extra = h.extra[:0]
+		h.cur.data = appendNAL(h.cur.data, nal)
+	case 6:
+		if hasRecoveryPoint(nal, 1) {
+			h.nextRecovery = true
+		}
+		h.extra = append(h.extra, nal)
+	case 7:
+		sps, err := parseH264SPS(nal)
+		if err != nil {
+			return err
+		}
+		h.sps[sps.id] = sps
+		h.extra = append(h.extra, nal)
+	case 8:
+		pps, err := parseH264PPS(nal)
+		if err != nil {
+			return err
+		}
+		h.pps[pps.id] = pps
+		h.extra = append(h.extra, nal)
+	case 9, 12:
+		// Access unit delimiters and filler data are useless in
+		// Matroska.
+	default:
+		h.extra = append(h.extra, nal)
+	}
+
+	return nil
+}
+
+// ReadPacket implements the Importer interface.
+func (h *H264) ReadPacket() (*matroska.Packet, error) {
+	for {
+		if pic := h.ro.pop(); pic != nil {
+			p := &matroska.Packet{
+				StartTime: pic.pts,
+				EndTime:   pic.pts + h.ro.duration,
+				Data:      pic.data,
+			}
+			if pic.key {
+				p.Flags = matroska.KF
+			}
+			return p, nil
+		}
+		if h.eof {
+			return nil, io.EOF
+		}
+
+		nal, err := h.nextNAL()
+		if err == io.EOF {
+			h.finishPicture()
+			h.ro.flush()
+			h.eof = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		err = h.handleNAL(nal)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
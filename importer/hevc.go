@@ -0,0 +1,474 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// HEVC NAL unit types we care about.
+const (
+	hevcRADLN     = 6
+	hevcRASLR     = 9
+	hevcBLAWLP    = 16
+	hevcBLANLP    = 18
+	hevcIDRWRADL  = 19
+	hevcIDRNLP    = 20
+	hevcCRA       = 21
+	hevcIRAPEnd   = 23
+	hevcNALVPS    = 32
+	hevcNALSPS    = 33
+	hevcNALPPS    = 34
+	hevcAUD       = 35
+	hevcEOS       = 36
+	hevcEOB       = 37
+	hevcFD        = 38
+	hevcSEISuffix = 40
+)
+
+type hevcSPS struct {
+	raw            []byte
+	id             uint32
+	maxSubLayers   uint32
+	ptl            []byte
+	chromaFormat   uint32
+	separateColour bool
+	width, height  uint32
+	bitDepthLuma   uint32
+	bitDepthChroma uint32
+	log2MaxPOCLsb  uint
+}
+
+type hevcPPS struct {
+	raw            []byte
+	id             uint32
+	spsID          uint32
+	outputFlag     bool
+	extraSliceBits uint
+}
+
+// skipPTL skips a profile_tier_level structure, including the general
+// profile.
+func skipPTL(br *bitReader, maxSubLayersMinus1 uint32) {
+	br.skip(96)
+
+	profile := make([]bool, maxSubLayersMinus1)
+	level := make([]bool, maxSubLayersMinus1)
+	for i := range profile {
+		profile[i] = br.flag()
+		level[i] = br.flag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		br.skip(uint(2 * (8 - maxSubLayersMinus1)))
+	}
+	for i := range profile {
+		if profile[i] {
+			br.skip(88)
+		}
+		if level[i] {
+			br.skip(8)
+		}
+	}
+}
+
+// parseHEVCVPSTiming returns the frame rate signalled in a VPS, if any.
+func parseHEVCVPSTiming(nal []byte) (uint32, uint32) {
+	br := &bitReader{buf: unescapeRBSP(nal[2:])}
+
+	br.skip(12)
+	maxSubLayersMinus1 := br.bits(3)
+	br.skip(17)
+	skipPTL(br, maxSubLayersMinus1)
+
+	start := maxSubLayersMinus1
+	if br.flag() {
+		start = 0
+	}
+	for i := start; i <= maxSubLayersMinus1 && br.err == nil; i++ {
+		br.ue()
+		br.ue()
+		br.ue()
+	}
+
+	maxLayerID := br.bits(6)
+	numLayerSets := br.ue() + 1
+	for i := uint32(1); i < numLayerSets && br.err == nil; i++ {
+		br.skip(uint(maxLayerID) + 1)
+	}
+
+	if !br.flag() || br.err != nil {
+		return 0, 0
+	}
+	numUnitsInTick := br.bits(32)
+	timeScale := br.bits(32)
+	if br.err != nil {
+		return 0, 0
+	}
+
+	return numUnitsInTick, timeScale
+}
+
+func parseHEVCSPS(nal []byte) (*hevcSPS, error) {
+	rbsp := unescapeRBSP(nal[2:])
+	if len(rbsp) < 13 {
+		return nil, fmt.Errorf("could not parse SPS: too short")
+	}
+
+	sps := &hevcSPS{
+		raw: nal,
+		ptl: rbsp[1:13],
+	}
+
+	br := &bitReader{buf: rbsp}
+	br.skip(4)
+	maxSubLayersMinus1 := br.bits(3)
+	sps.maxSubLayers = maxSubLayersMinus1 + 1
+	br.skip(1)
+	skipPTL(br, maxSubLayersMinus1)
+
+	sps.id = br.ue()
+	sps.chromaFormat = br.ue()
+	if sps.chromaFormat == 3 {
+		sps.separateColour = br.flag()
+	}
+	sps.width = br.ue()
+	sps.height = br.ue()
+	if br.flag() {
+		subW, subH := uint32(1), uint32(1)
+		if !sps.separateColour && (sps.chromaFormat == 1 || sps.chromaFormat == 2) {
+			subW = 2
+		}
+		if !sps.separateColour && sps.chromaFormat == 1 {
+			subH = 2
+		}
+		left, right, top, bottom := br.ue(), br.ue(), br.ue(), br.ue()
+		sps.width -= subW * (left + right)
+		sps.height -= subH * (top + bottom)
+	}
+	sps.bitDepthLuma = br.ue() + 8
+	sps.bitDepthChroma = br.ue() + 8
+	sps.log2MaxPOCLsb = uint(br.ue() + 4)
+
+	if br.err != nil {
+		return nil, fmt.Errorf("could not parse SPS: %s", br.err.Error())
+	}
+
+	return sps, nil
+}
+
+func parseHEVCPPS(nal []byte) (*hevcPPS, error) {
+	br := &bitReader{buf: unescapeRBSP(nal[2:])}
+
+	pps := &hevcPPS{raw: nal}
+	pps.id = br.ue()
+	pps.spsID = br.ue()
+	// dependent_slice_segments_enabled_flag
+	br.skip(1)
+	pps.outputFlag = br.flag()
+	pps.extraSliceBits = uint(br.bits(3))
+
+	if br.err != nil {
+		return nil, fmt.Errorf("could not parse PPS: %s", br.err.Error())
+	}
+
+	return pps, nil
+}
+
+// HEVC imports raw HEVC Annex B elementary streams.
+//
+// Like H264, a constant frame rate is assumed, and presentation timestamps
+// are derived from the picture order count.
+type HEVC struct {
+	nr  *nalReader
+	ro  reorderer
+	ti  matroska.TrackInfo
+	sps map[uint32]*hevcSPS
+	pps map[uint32]*hevcPPS
+
+	queued [][]byte
+
+	cur     *picture
+	curType byte
+	curTid  byte
+	curLsb  uint32
+	curSPS  *hevcSPS
+	extra   [][]byte
+
+	first      bool
+	prevPOCMsb int
+	prevPOCLsb int
+	eof        bool
+}
+
+// NewHEVC creates an importer for the HEVC Annex B stream in r. If duration
+// is 0, the frame rate signalled in the VPS is used, or 25 fps if there is
+// none.
+func NewHEVC(r io.Reader, duration uint64) (*HEVC, error) {
+	h := &HEVC{
+		nr:    &nalReader{r: r},
+		sps:   make(map[uint32]*hevcSPS),
+		pps:   make(map[uint32]*hevcPPS),
+		first: true,
+	}
+
+	var params [3][][]byte
+	var sps *hevcSPS
+	var numUnitsInTick, timeScale uint32
+	for {
+		nal, err := h.nr.next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("could not find any slices")
+		} else if err != nil {
+			return nil, err
+		}
+		if len(nal) < 2 {
+			continue
+		}
+		h.queued = append(h.queued, nal)
+
+		typ := (nal[0] >> 1) & 0x3f
+		if typ < hevcNALVPS {
+			break
+		}
+		switch typ {
+		case hevcNALVPS:
+			if numUnitsInTick == 0 {
+				numUnitsInTick, timeScale = parseHEVCVPSTiming(nal)
+			}
+			params[0] = append(params[0], nal)
+		case hevcNALSPS:
+			if sps == nil {
+				sps, err = parseHEVCSPS(nal)
+				if err != nil {
+					return nil, err
+				}
+			}
+			params[1] = append(params[1], nal)
+		case hevcNALPPS:
+			params[2] = append(params[2], nal)
+		}
+	}
+	if len(params[0]) == 0 || sps == nil || len(params[2]) == 0 {
+		return nil, fmt.Errorf("could not find VPS, SPS and PPS before the first slice")
+	}
+
+	if duration == 0 {
+		duration = frameDuration(numUnitsInTick, timeScale)
+		if duration == 0 {
+			duration = defaultFrameDuration
+		}
+	}
+	h.ro.duration = duration
+
+	// hvcC
+	cp := []byte{1}
+	cp = append(cp, sps.ptl...)
+	cp = append(cp, 0xf0, 0x00, 0xfc, 0xfc|byte(sps.chromaFormat),
+		0xf8|byte(sps.bitDepthLuma-8), 0xf8|byte(sps.bitDepthChroma-8), 0, 0,
+		byte(sps.maxSubLayers)<<3|3, 3)
+	for i, nals := range params {
+		cp = append(cp, 0x80|byte(hevcNALVPS+i), byte(len(nals)>>8), byte(len(nals)))
+		for _, nal := range nals {
+			cp = append(cp, byte(len(nal)>>8), byte(len(nal)))
+			cp = append(cp, nal...)
+		}
+	}
+
+	h.ti = matroska.TrackInfo{
+		Type:            matroska.TypeVideo,
+		CodecID:         "V_MPEGH/ISO/HEVC",
+		CodecPrivate:    cp,
+		DefaultDuration: duration,
+		Enabled:         true,
+		Default:         true,
+		Language:        "und",
+	}
+	setVideo(&h.ti, sps.width, sps.height, sps.chromaFormat, sps.bitDepthLuma, &vui{})
+
+	return h, nil
+}
+
+// TrackInfo implements the Importer interface.
+func (h *HEVC) TrackInfo() *matroska.TrackInfo {
+	return &h.ti
+}
+
+func (h *HEVC) nextNAL() ([]byte, error) {
+	if len(h.queued) > 0 {
+		nal := h.queued[0]
+		h.queued = h.queued[1:]
+		return nal, nil
+	}
+	return h.nr.next()
+}
+
+func (h *HEVC) finishPicture() {
+	if h.cur == nil {
+		return
+	}
+
+	typ := h.curType
+	idr := typ == hevcIDRWRADL || typ == hevcIDRNLP
+	bla := typ >= hevcBLAWLP && typ <= hevcBLANLP
+
+	lsb := int(h.curLsb)
+	msb := 0
+	if !idr && !bla && !(typ == hevcCRA && h.first) {
+		max := 1 << h.curSPS.log2MaxPOCLsb
+		msb = h.prevPOCMsb
+		if lsb < h.prevPOCLsb && h.prevPOCLsb-lsb >= max/2 {
+			msb += max
+		} else if lsb > h.prevPOCLsb && lsb-h.prevPOCLsb > max/2 {
+			msb -= max
+		}
+	}
+	h.cur.poc = msb + lsb
+
+	// Only pictures which can be referenced by later pictures in the same
+	// sub-layer count for msb derivation.
+	subLayerNonRef := typ <= 14 && typ%2 == 0
+	if h.curTid == 0 && !subLayerNonRef && !(typ >= hevcRADLN && typ <= hevcRASLR) {
+		h.prevPOCMsb = msb
+		h.prevPOCLsb = lsb
+	}
+
+	h.cur.key = typ >= hevcBLAWLP && typ <= hevcIRAPEnd
+	h.ro.push(h.cur, idr || bla)
+
+	h.cur = nil
+	h.first = false
+}
+
+func (h *HEVC) handleSlice(nal []byte) error {
+	typ := (nal[0] >> 1) & 0x3f
+
+	end := len(nal)
+	if end > 64 {
+		end = 64
+	}
+	br := &bitReader{buf: unescapeRBSP(nal[2:end])}
+	if !br.flag() {
+		// Not the first slice segment of a picture.
+		if h.cur == nil {
+			return fmt.Errorf("could not find the first slice of a picture")
+		}
+		h.cur.data = appendNAL(h.cur.data, nal)
+		return nil
+	}
+
+	if typ >= hevcBLAWLP && typ <= hevcIRAPEnd {
+		br.skip(1)
+	}
+	ppsID := br.ue()
+	pps, ok := h.pps[ppsID]
+	if !ok {
+		return fmt.Errorf("could not find PPS %d", ppsID)
+	}
+	sps, ok := h.sps[pps.spsID]
+	if !ok {
+		return fmt.Errorf("could not find SPS %d", pps.spsID)
+	}
+
+	br.skip(pps.extraSliceBits)
+	br.ue()
+	if pps.outputFlag {
+		br.skip(1)
+	}
+	if sps.separateColour {
+		br.skip(2)
+	}
+	var lsb uint32
+	if typ != hevcIDRWRADL && typ != hevcIDRNLP {
+		lsb = br.bits(sps.log2MaxPOCLsb)
+	}
+	if br.err != nil {
+		return fmt.Errorf("could not parse slice header: %s", br.err.Error())
+	}
+
+	h.finishPicture()
+	h.cur = &picture{}
+	h.curType = typ
+	h.curTid = (nal[1] & 7) - 1
+	h.curLsb = lsb
+	h.curSPS = sps
+
+	for _, e := range h.extra {
+		h.cur.data = appendNAL(h.cur.data, e)
+	}
+	h.extra = h.extra[:0]
+	h.cur.data = appendNAL(h.cur.data, nal)
+
+	return nil
+}
+
+func (h *HEVC) handleNAL(nal []byte) error {
+	if len(nal) < 2 {
+		return nil
+	}
+
+	typ := (nal[0] >> 1) & 0x3f
+	switch {
+	case typ < hevcNALVPS:
+		return h.handleSlice(nal)
+	case typ == hevcNALSPS:
+		sps, err := parseHEVCSPS(nal)
+		if err != nil {
+			return err
+		}
+		h.sps[sps.id] = sps
+	case typ == hevcNALPPS:
+		pps, err := parseHEVCPPS(nal)
+		if err != nil {
+			return err
+		}
+		h.pps[pps.id] = pps
+	case typ == hevcAUD || typ == hevcFD:
+		return nil
+	case typ == hevcEOS || typ == hevcEOB || typ == hevcSEISuffix:
+		// These belong to the preceding picture.
+		if h.cur != nil {
+			h.cur.data = appendNAL(h.cur.data, nal)
+			return nil
+		}
+	}
+
+	h.extra = append(h.extra, nal)
+
+	return nil
+}
+
+// ReadPacket implements the Importer interface.
+func (h *HEVC) ReadPacket() (*matroska.Packet, error) {
+	for {
+		if pic := h.ro.pop(); pic != nil {
+			p := &matroska.Packet{
+				StartTime: pic.pts,
+				EndTime:   pic.pts + h.ro.duration,
+				Data:      pic.data,
+			}
+			if pic.key {
+				p.Flags = matroska.KF
+			}
+			return p, nil
+		}
+		if h.eof {
+			return nil, io.EOF
+		}
+
+		nal, err := h.nextNAL()
+		if err == io.EOF {
+			h.finishPicture()
+			h.ro.flush()
+			h.eof = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		err = h.handleNAL(nal)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Package importer implements parsers for common elementary stream and
+// single-track file formats (H.264 and HEVC Annex B, AAC ADTS, FLAC, WAV and
+// SRT), producing Matroska track information and timestamped packets that can
+// be written with a matroska.Muxer.
+package importer
+
+import (
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Importer is implemented by all importers in this package.
+type Importer interface {
+	// TrackInfo returns the Matroska track information for the stream,
+	// including any generated CodecPrivate.
+	TrackInfo() *matroska.TrackInfo
+	// ReadPacket returns the next packet in the stream, in decoding
+	// order, or io.EOF once the stream is exhausted. The Track member is
+	// not set.
+	ReadPacket() (*matroska.Packet, error)
+}
+
+type pending struct {
+	imp   Importer
+	track uint
+	p     *matroska.Packet
+}
+
+// Mux adds a track for each importer to m, interleaves all of their packets
+// by StartTime, and writes them to m. Once all importers are exhausted, m
+// is closed.
+func Mux(m *matroska.Muxer, importers ...Importer) error {
+	var streams []*pending
+
+	for _, imp := range importers {
+		track, err := m.AddTrack(imp.TrackInfo())
+		if err != nil {
+			return err
+		}
+
+		p, err := imp.ReadPacket()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		streams = append(streams, &pending{
+			imp:   imp,
+			track: track,
+			p:     p,
+		})
+	}
+
+	for len(streams) > 0 {
+		// Only a handful of streams, so there is no need for
+		// anything fancier than a linear search.
+		next := 0
+		for i, s := range streams {
+			if s.p.StartTime < streams[next].p.StartTime {
+				next = i
+			}
+		}
+
+		s := streams[next]
+		s.p.Track = uint8(s.track)
+
+		err := m.WritePacket(s.p)
+		if err != nil {
+			return err
+		}
+
+		s.p, err = s.imp.ReadPacket()
+		if err == io.EOF {
+			streams = append(streams[:next], streams[next+1:]...)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return m.Close()
+}
+
+// samplesToNs converts a sample count at the given rate to nanoseconds.
+func samplesToNs(samples uint64, rate uint64) uint64 {
+	return samples * 1000000000 / rate
+}
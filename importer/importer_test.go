@@ -0,0 +1,549 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/dwbuiten/matroska/internal/testutil"
+)
+
+// bitWriter writes MSB-first bit fields and Exp-Golomb codes.
+type bitWriter struct {
+	buf []byte
+	n   uint
+}
+
+func (bw *bitWriter) bits(n uint, v uint32) {
+	for i := n; i > 0; i-- {
+		if bw.n%8 == 0 {
+			bw.buf = append(bw.buf, 0)
+		}
+		if v>>(i-1)&1 == 1 {
+			bw.buf[len(bw.buf)-1] |= 0x80 >> (bw.n % 8)
+		}
+		bw.n++
+	}
+}
+
+func (bw *bitWriter) ue(v uint32) {
+	v++
+	n := uint(0)
+	for v>>n > 1 {
+		n++
+	}
+	bw.bits(n, 0)
+	bw.bits(n+1, v)
+}
+
+// rbsp adds the stop bit, and returns the bytes with emulation prevention.
+func (bw *bitWriter) rbsp() []byte {
+	bw.bits(1, 1)
+	for bw.n%8 != 0 {
+		bw.bits(1, 0)
+	}
+
+	var ret []byte
+	zeros := 0
+	for _, b := range bw.buf {
+		if zeros >= 2 && b <= 3 {
+			ret = append(ret, 3)
+			zeros = 0
+		}
+		ret = append(ret, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return ret
+}
+
+func annexB(nals ...[]byte) []byte {
+	var ret []byte
+	for _, nal := range nals {
+		ret = append(ret, 0, 0, 0, 1)
+		ret = append(ret, nal...)
+	}
+	return ret
+}
+
+// A frame of the test streams, in decoding order.
+type testFrame struct {
+	slice int // 0 for I, 1 for P and 2 for B.
+	poc   uint32
+}
+
+// An IPBPB GOP, repeated, so frames need reordering.
+var testFrames = []testFrame{
+	{0, 0}, {1, 4}, {2, 2}, {1, 8}, {2, 6},
+	{0, 0}, {1, 4}, {2, 2}, {1, 8}, {2, 6},
+}
+
+func h264Stream() []byte {
+	sps := &bitWriter{}
+	sps.bits(8, 66) // profile_idc
+	sps.bits(8, 0)
+	sps.bits(8, 30)
+	sps.ue(0) // seq_parameter_set_id
+	sps.ue(0) // log2_max_frame_num_minus4
+	sps.ue(0) // pic_order_cnt_type
+	sps.ue(2) // log2_max_pic_order_cnt_lsb_minus4
+	sps.ue(1) // max_num_ref_frames
+	sps.bits(1, 0)
+	sps.ue(19) // pic_width_in_mbs_minus1
+	sps.ue(14) // pic_height_in_map_units_minus1
+	sps.bits(1, 1)
+	sps.bits(1, 1)
+	sps.bits(1, 0)
+	sps.bits(1, 0)
+
+	pps := &bitWriter{}
+	pps.ue(0)
+	pps.ue(0)
+	pps.bits(1, 0)
+	pps.bits(1, 0)
+
+	stream := annexB(append([]byte{0x67}, sps.rbsp()...), append([]byte{0x68}, pps.rbsp()...))
+
+	frameNum := uint32(0)
+	for _, f := range testFrames {
+		header := byte(0x41)
+		switch f.slice {
+		case 0:
+			header = 0x65
+			frameNum = 0
+		case 2:
+			header = 0x01
+		}
+
+		s := &bitWriter{}
+		s.ue(0)                          // first_mb_in_slice
+		s.ue([]uint32{7, 5, 6}[f.slice]) // slice_type
+		s.ue(0)                          // pic_parameter_set_id
+		s.bits(4, frameNum)
+		if f.slice == 0 {
+			s.ue(0) // idr_pic_id
+		}
+		s.bits(6, f.poc)
+		s.bits(8, 0xaa)
+
+		stream = append(stream, annexB(append([]byte{header}, s.rbsp()...))...)
+		if f.slice != 2 {
+			frameNum++
+		}
+	}
+
+	return stream
+}
+
+func hevcStream() []byte {
+	vps := &bitWriter{}
+	vps.bits(4, 0)
+	vps.bits(2, 3)
+	vps.bits(6, 0)
+	vps.bits(3, 0)
+	vps.bits(1, 1)
+	vps.bits(16, 0xffff)
+	vps.bits(8, 1)
+	vps.bits(32, 0x60000000)
+	vps.bits(32, 0x90000000)
+	vps.bits(24, 0)
+	vps.bits(1, 1)
+	vps.ue(4)
+	vps.ue(0)
+	vps.ue(0)
+	vps.bits(6, 0)
+	vps.ue(0)
+	vps.bits(1, 0)
+	vps.bits(1, 0)
+
+	sps := &bitWriter{}
+	sps.bits(4, 0)
+	sps.bits(3, 0)
+	sps.bits(1, 1)
+	sps.bits(8, 1)
+	sps.bits(32, 0x60000000)
+	sps.bits(32, 0x90000000)
+	sps.bits(16, 0)
+	sps.bits(8, 93)
+	sps.ue(0)   // sps_seq_parameter_set_id
+	sps.ue(1)   // chroma_format_idc
+	sps.ue(320) // pic_width_in_luma_samples
+	sps.ue(240) // pic_height_in_luma_samples
+	sps.bits(1, 0)
+	sps.ue(0)
+	sps.ue(0)
+	sps.ue(4) // log2_max_pic_order_cnt_lsb_minus4
+
+	pps := &bitWriter{}
+	pps.ue(0)
+	pps.ue(0)
+	pps.bits(1, 0)
+	pps.bits(1, 0)
+	pps.bits(3, 0)
+
+	stream := annexB(
+		append([]byte{0x40, 0x01}, vps.rbsp()...),
+		append([]byte{0x42, 0x01}, sps.rbsp()...),
+		append([]byte{0x44, 0x01}, pps.rbsp()...),
+	)
+
+	for _, f := range testFrames {
+		typ := byte(1) // TRAIL_R
+		if f.slice == 0 {
+			typ = 19 // IDR_W_RADL
+		}
+
+		s := &bitWriter{}
+		s.bits(1, 1) // first_slice_segment_in_pic_flag
+		if f.slice == 0 {
+			s.bits(1, 0)
+		}
+		s.ue(0)                          // slice_pic_parameter_set_id
+		s.ue([]uint32{2, 1, 0}[f.slice]) // slice_type
+		if f.slice != 0 {
+			s.bits(8, f.poc)
+		}
+		s.bits(8, 0xaa)
+
+		stream = append(stream, annexB(append([]byte{typ << 1, 0x01}, s.rbsp()...))...)
+	}
+
+	return stream
+}
+
+func adtsStream(frames int) []byte {
+	var stream []byte
+	for i := 0; i < frames; i++ {
+		payload := []byte{byte(i), 0x21, 0x10, 0x04}
+		size := 7 + len(payload)
+		stream = append(stream,
+			0xff, 0xf1,
+			1<<6|3<<2, // AAC LC, 48 kHz
+			2<<6|byte(size>>11),
+			byte(size>>3),
+			byte(size&7)<<5|0x1f,
+			0xfc)
+		stream = append(stream, payload...)
+	}
+	return stream
+}
+
+// roundTrip muxes the importer's packets, and checks that demuxing the
+// result gives the same packets as a second run of the importer.
+func roundTrip(t *testing.T, newImporter func() (Importer, error)) (*matroska.TrackInfo, int) {
+	imp, err := newImporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &testutil.MemFile{}
+	m, err := matroska.NewMuxer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Mux(m, imp)
+	if err != nil {
+		t.Fatalf("could not mux: %s", err.Error())
+	}
+
+	imp, err = newImporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []*matroska.Packet
+	for {
+		p, err := imp.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, p)
+	}
+
+	d, err := matroska.NewDemuxer(bytes.NewReader(f.Bytes()))
+	if err != nil {
+		t.Fatalf("could not demux output: %s", err.Error())
+	}
+	defer d.Close()
+
+	ti, err := d.GetTrackInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ti.CodecPrivate, imp.TrackInfo().CodecPrivate) {
+		t.Errorf("got CodecPrivate %x, expected %x", ti.CodecPrivate, imp.TrackInfo().CodecPrivate)
+	}
+
+	var got []*matroska.Packet
+	for {
+		p, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames, expected %d", len(got), len(want))
+	}
+	for i, p := range got {
+		// The muxer rounds to milliseconds.
+		wantTime := (want[i].StartTime + 500000) / 1000000 * 1000000
+		if p.StartTime != wantTime || !bytes.Equal(p.Data, want[i].Data) || p.Flags&matroska.KF != want[i].Flags&matroska.KF {
+			t.Errorf("frame %d: got %d (flags %x), expected %d (flags %x)", i, p.StartTime, p.Flags, wantTime, want[i].Flags)
+		}
+	}
+
+	return ti, len(got)
+}
+
+// checkVideoTimes checks that the frames of the test streams got their
+// presentation timestamps from the picture order count.
+func checkVideoTimes(t *testing.T, imp Importer) {
+	var pts []uint64
+	for i := 0; ; i++ {
+		p, err := imp.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if key := p.Flags&matroska.KF != 0; key != (testFrames[i].slice == 0) {
+			t.Errorf("frame %d: got keyframe %v", i, key)
+		}
+		gop := uint64(i / 5 * 5)
+		if want := (gop + uint64(testFrames[i].poc/2)) * 40000000; p.StartTime != want {
+			t.Errorf("frame %d: got %d, expected %d", i, p.StartTime, want)
+		}
+		pts = append(pts, p.StartTime)
+	}
+
+	if len(pts) != len(testFrames) {
+		t.Fatalf("got %d frames, expected %d", len(pts), len(testFrames))
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i] < pts[j] })
+	for i, ts := range pts {
+		if ts != uint64(i)*40000000 {
+			t.Errorf("presentation timestamps are not contiguous: %v", pts)
+			break
+		}
+	}
+}
+
+func TestH264(t *testing.T) {
+	newImporter := func() (Importer, error) {
+		return NewH264(bytes.NewReader(h264Stream()), 0)
+	}
+
+	imp, err := newImporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVideoTimes(t, imp)
+
+	ti, _ := roundTrip(t, newImporter)
+	if ti.CodecID != "V_MPEG4/ISO/AVC" || ti.Video.PixelWidth != 320 || ti.Video.PixelHeight != 240 {
+		t.Errorf("got %s %dx%d", ti.CodecID, ti.Video.PixelWidth, ti.Video.PixelHeight)
+	}
+}
+
+func TestHEVC(t *testing.T) {
+	newImporter := func() (Importer, error) {
+		return NewHEVC(bytes.NewReader(hevcStream()), 0)
+	}
+
+	imp, err := newImporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVideoTimes(t, imp)
+
+	ti, _ := roundTrip(t, newImporter)
+	if ti.CodecID != "V_MPEGH/ISO/HEVC" || ti.Video.PixelWidth != 320 || ti.Video.PixelHeight != 240 {
+		t.Errorf("got %s %dx%d", ti.CodecID, ti.Video.PixelWidth, ti.Video.PixelHeight)
+	}
+}
+
+func TestADTS(t *testing.T) {
+	newImporter := func() (Importer, error) {
+		return NewADTS(bytes.NewReader(adtsStream(100)))
+	}
+
+	ti, n := roundTrip(t, newImporter)
+	if n != 100 {
+		t.Errorf("got %d frames, expected 100", n)
+	}
+	if ti.CodecID != "A_AAC" || ti.Audio.SamplingFreq != 48000 || ti.Audio.Channels != 2 {
+		t.Errorf("got %s %v Hz %d channels", ti.CodecID, ti.Audio.SamplingFreq, ti.Audio.Channels)
+	}
+	if !bytes.Equal(ti.CodecPrivate, []byte{0x11, 0x90}) {
+		t.Errorf("got AudioSpecificConfig %x, expected 1190", ti.CodecPrivate)
+	}
+}
+
+// flacStream returns a FLAC file with the given number of frames of 4096
+// samples of 48 kHz 16 bit stereo audio. The subframes are filler, as the
+// importer only parses frame headers.
+func flacStream(frames int) []byte {
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:2], 4096)
+	binary.BigEndian.PutUint16(info[2:4], 4096)
+	binary.BigEndian.PutUint64(info[10:18], 48000<<44|1<<41|15<<36|uint64(frames*4096))
+
+	b := []byte("fLaC")
+	b = append(b, 0x80, 0, 0, byte(len(info)))
+	b = append(b, info...)
+
+	for i := 0; i < frames; i++ {
+		start := len(b)
+		// Fixed block size of 4096 at 48 kHz, independent stereo at 16
+		// bits, and the frame number.
+		b = append(b, 0xff, 0xf8, 0xca, 0x18, byte(i))
+		b = append(b, flacCRC8(b[start:]))
+		for j := 0; j < 100+i; j++ {
+			b = append(b, 0x12, byte(j))
+		}
+		crc := flacCRC16(b[start:])
+		b = append(b, byte(crc>>8), byte(crc))
+	}
+
+	return b
+}
+
+func TestFLAC(t *testing.T) {
+	newImporter := func() (Importer, error) {
+		return NewFLAC(bytes.NewReader(flacStream(20)))
+	}
+
+	ti, n := roundTrip(t, newImporter)
+	if n != 20 {
+		t.Errorf("got %d frames, expected 20", n)
+	}
+	if ti.CodecID != "A_FLAC" || ti.Audio.SamplingFreq != 48000 || ti.Audio.Channels != 2 || ti.Audio.BitDepth != 16 {
+		t.Errorf("got %s %v Hz %d channels %d bits", ti.CodecID, ti.Audio.SamplingFreq, ti.Audio.Channels, ti.Audio.BitDepth)
+	}
+	if ti.DefaultDuration != 85333333 {
+		t.Errorf("got default duration %d, expected 85333333", ti.DefaultDuration)
+	}
+}
+
+// wavFile returns a WAV file of 48 kHz 16 bit stereo audio with a data chunk
+// of the given size field, holding data, and a LIST chunk after it.
+func wavFile(size uint32, data []byte) []byte {
+	le := binary.LittleEndian
+
+	fmtChunk := make([]byte, 16)
+	le.PutUint16(fmtChunk[0:2], 1)
+	le.PutUint16(fmtChunk[2:4], 2)
+	le.PutUint32(fmtChunk[4:8], 48000)
+	le.PutUint32(fmtChunk[8:12], 48000*4)
+	le.PutUint16(fmtChunk[12:14], 4)
+	le.PutUint16(fmtChunk[14:16], 16)
+
+	list := []byte("INFOISFT\x06\x00\x00\x00tests\x00")
+
+	b := []byte("RIFF\x00\x00\x00\x00WAVE")
+	b = append(b, "fmt \x10\x00\x00\x00"...)
+	b = append(b, fmtChunk...)
+	b = append(b, "data\x00\x00\x00\x00"...)
+	le.PutUint32(b[len(b)-4:], size)
+	b = append(b, data...)
+	b = append(b, "LIST\x00\x00\x00\x00"...)
+	le.PutUint32(b[len(b)-4:], uint32(len(list)))
+	b = append(b, list...)
+	le.PutUint32(b[4:8], uint32(len(b)-8))
+
+	return b
+}
+
+func TestWAV(t *testing.T) {
+	// One second of audio.
+	data := make([]byte, 48000*4)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	newImporter := func() (Importer, error) {
+		return NewWAV(bytes.NewReader(wavFile(uint32(len(data)), data)))
+	}
+	ti, n := roundTrip(t, newImporter)
+	if n != 25 {
+		t.Errorf("got %d frames, expected 25", n)
+	}
+	if ti.CodecID != "A_PCM/INT/LIT" || ti.Audio.SamplingFreq != 48000 || ti.Audio.Channels != 2 || ti.Audio.BitDepth != 16 {
+		t.Errorf("got %s %v Hz %d channels %d bits", ti.CodecID, ti.Audio.SamplingFreq, ti.Audio.Channels, ti.Audio.BitDepth)
+	}
+
+	// Chunks after the data are not imported as samples, unless its size
+	// is unknown.
+	for _, tc := range []struct {
+		size uint32
+		data []byte
+		want int
+	}{
+		{uint32(len(data)), data, len(data)},
+		{0, nil, 0},
+		// Without a size, everything up to the end is read, in whole
+		// sample frames.
+		{0xffffffff, data, len(data) + 24},
+	} {
+		imp, err := NewWAV(bytes.NewReader(wavFile(tc.size, tc.data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for {
+			p, err := imp.ReadPacket()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			total += len(p.Data)
+		}
+		if total != tc.want {
+			t.Errorf("data size %x: got %d bytes of samples, expected %d", tc.size, total, tc.want)
+		}
+	}
+}
+
+func TestSRT(t *testing.T) {
+	// The second cue comes first in the file. The first starts at 0, as
+	// the demuxer makes times relative to the first cluster.
+	srt := "2\r\n00:00:03,000 --> 00:00:04,500\r\nsecond\r\n\r\n" +
+		"1\r\n00:00:00,000 --> 00:00:02,000\r\nfirst\r\nline two\r\n\r\n" +
+		"3\r\n00:00:05,250 --> 00:00:06,000\r\nthird\r\n"
+	newImporter := func() (Importer, error) {
+		return NewSRT(strings.NewReader(srt))
+	}
+
+	ti, n := roundTrip(t, newImporter)
+	if n != 3 {
+		t.Errorf("got %d frames, expected 3", n)
+	}
+	if ti.CodecID != "S_TEXT/UTF8" || ti.Type != matroska.TypeSubtitle {
+		t.Errorf("got %s of type %d", ti.CodecID, ti.Type)
+	}
+
+	imp, err := newImporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := imp.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.StartTime != 0 || p.EndTime != 2000000000 || string(p.Data) != "first\nline two" {
+		t.Errorf("got %q from %d to %d, expected the first cue", p.Data, p.StartTime, p.EndTime)
+	}
+}
@@ -0,0 +1,69 @@
+package importer
+
+import (
+	"io"
+	"sort"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/dwbuiten/matroska/subtitles"
+)
+
+// SRT imports SubRip subtitles.
+type SRT struct {
+	ti     matroska.TrackInfo
+	events []*subtitles.Event
+}
+
+// NewSRT creates an importer for the SRT file in r. The whole file is read
+// up front.
+func NewSRT(r io.Reader) (*SRT, error) {
+	doc, err := subtitles.Parse(r, subtitles.SRT)
+	if err != nil {
+		return nil, err
+	}
+
+	// Muxing needs the cues in order, and not every file has them that
+	// way.
+	sort.SliceStable(doc.Events, func(i, j int) bool {
+		return doc.Events[i].Start < doc.Events[j].Start
+	})
+
+	s := &SRT{
+		ti: matroska.TrackInfo{
+			Type:     matroska.TypeSubtitle,
+			CodecID:  "S_TEXT/UTF8",
+			Enabled:  true,
+			Language: "und",
+		},
+		events: doc.Events,
+	}
+
+	return s, nil
+}
+
+// TrackInfo implements the Importer interface.
+func (s *SRT) TrackInfo() *matroska.TrackInfo {
+	return &s.ti
+}
+
+// ReadPacket implements the Importer interface.
+func (s *SRT) ReadPacket() (*matroska.Packet, error) {
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+
+	ev := s.events[0]
+	s.events = s.events[1:]
+
+	p := &matroska.Packet{
+		StartTime: ev.Start,
+		EndTime:   ev.End,
+		Data:      []byte(ev.Text),
+		Flags:     matroska.KF,
+	}
+	if ev.End <= ev.Start {
+		p.Flags |= matroska.UnknownEnd
+	}
+
+	return p, nil
+}
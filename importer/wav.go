@@ -0,0 +1,167 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// The duration of the packets produced by the WAV importer.
+const wavPacketDuration = 40000000
+
+// WAV imports uncompressed PCM audio from RIFF WAVE files.
+type WAV struct {
+	r          *bufio.Reader
+	ti         matroska.TrackInfo
+	rate       uint64
+	blockAlign int
+	remaining  int64
+	samples    uint64
+}
+
+// NewWAV creates an importer for the WAV file in r. Integer and floating
+// point PCM are supported, including WAVE_FORMAT_EXTENSIBLE files.
+func NewWAV(r io.Reader) (*WAV, error) {
+	w := &WAV{
+		r: bufio.NewReader(r),
+	}
+
+	hdr := make([]byte, 12)
+	_, err := io.ReadFull(w.r, hdr)
+	if err != nil || string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("could not find RIFF WAVE header")
+	}
+
+	var format uint16
+	var channels uint16
+	var bits uint16
+	haveFmt := false
+	for {
+		chunk := make([]byte, 8)
+		_, err = io.ReadFull(w.r, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("could not find data chunk")
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		if id == "data" {
+			if !haveFmt {
+				return nil, fmt.Errorf("could not find fmt chunk before data chunk")
+			}
+			// Streamed files often leave the size unset.
+			if size == 0xffffffff {
+				size = -1
+			}
+			w.remaining = size
+			break
+		}
+
+		body := make([]byte, size+size&1)
+		_, err = io.ReadFull(w.r, body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s chunk: %s", id, err.Error())
+		}
+		if id != "fmt " {
+			continue
+		}
+		if size < 16 {
+			return nil, fmt.Errorf("could not parse fmt chunk")
+		}
+
+		format = binary.LittleEndian.Uint16(body[0:2])
+		channels = binary.LittleEndian.Uint16(body[2:4])
+		w.rate = uint64(binary.LittleEndian.Uint32(body[4:8]))
+		w.blockAlign = int(binary.LittleEndian.Uint16(body[12:14]))
+		bits = binary.LittleEndian.Uint16(body[14:16])
+		if format == 0xfffe && size >= 26 {
+			// The first two bytes of the sub-format GUID are the
+			// actual format tag.
+			format = binary.LittleEndian.Uint16(body[24:26])
+		}
+		haveFmt = true
+	}
+
+	var codecID string
+	switch format {
+	case 1:
+		codecID = "A_PCM/INT/LIT"
+	case 3:
+		codecID = "A_PCM/FLOAT/IEEE"
+	default:
+		return nil, fmt.Errorf("could not import WAV format 0x%04x", format)
+	}
+	if w.rate == 0 || w.blockAlign == 0 || channels == 0 {
+		return nil, fmt.Errorf("could not parse fmt chunk")
+	}
+
+	w.ti = matroska.TrackInfo{
+		Type:            matroska.TypeAudio,
+		CodecID:         codecID,
+		DefaultDuration: wavPacketDuration,
+		Enabled:         true,
+		Default:         true,
+		Language:        "und",
+	}
+	w.ti.Audio.SamplingFreq = float64(w.rate)
+	w.ti.Audio.Channels = uint8(channels)
+	w.ti.Audio.BitDepth = uint8(bits)
+
+	return w, nil
+}
+
+// TrackInfo implements the Importer interface.
+func (w *WAV) TrackInfo() *matroska.TrackInfo {
+	return &w.ti
+}
+
+// ReadPacket implements the Importer interface.
+func (w *WAV) ReadPacket() (*matroska.Packet, error) {
+	if w.remaining == 0 {
+		return nil, io.EOF
+	}
+
+	samples := w.rate * wavPacketDuration / 1000000000
+	if samples == 0 {
+		samples = 1
+	}
+	size := int64(samples) * int64(w.blockAlign)
+	if w.remaining > 0 && size > w.remaining {
+		size = w.remaining
+	}
+
+	data := make([]byte, size)
+	n, err := io.ReadFull(w.r, data)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	// Drop any trailing partial sample frame.
+	n -= n % w.blockAlign
+	if n == 0 {
+		return nil, io.EOF
+	}
+	data = data[:n]
+	if w.remaining > 0 {
+		w.remaining -= int64(n)
+	}
+	if err == io.ErrUnexpectedEOF {
+		w.remaining = 0
+	}
+
+	count := uint64(n / w.blockAlign)
+	p := &matroska.Packet{
+		StartTime: samplesToNs(w.samples, w.rate),
+		EndTime:   samplesToNs(w.samples+count, w.rate),
+		Data:      data,
+		Flags:     matroska.KF,
+	}
+	w.samples += count
+
+	return p, nil
+}
@@ -0,0 +1,52 @@
+// Package mkvxml has the parts of mkvmerge's XML formats which are shared
+// by the chapters and tags packages.
+package mkvxml
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Binary is binary data, which mkvmerge reads as base64 unless the format
+// attribute says otherwise.
+type Binary struct {
+	Format string `xml:"format,attr,omitempty"`
+	Data   string `xml:",chardata"`
+}
+
+// NewBinary returns b as hex.
+func NewBinary(b []byte) *Binary {
+	return &Binary{
+		Format: "hex",
+		Data:   hex.EncodeToString(b),
+	}
+}
+
+// Bytes decodes the data. A nil Binary has no data.
+func (b *Binary) Bytes() ([]byte, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	data := strings.Join(strings.Fields(b.Data), "")
+	switch strings.ToLower(b.Format) {
+	case "hex":
+		data = strings.TrimPrefix(strings.ToLower(data), "0x")
+		ret, err := hex.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex data: %s", b.Data)
+		}
+		return ret, nil
+	case "ascii":
+		return []byte(b.Data), nil
+	case "", "base64":
+		ret, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 data: %s", b.Data)
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unsupported binary format: %s", b.Format)
+}
@@ -0,0 +1,169 @@
+package testutil
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// The parameter sets of the test video, which is 320x240 H.264.
+var (
+	SPS = []byte{0x67, 0x42, 0x00, 0x1e, 0xab, 0x40, 0x50, 0x1e, 0xc8}
+	PPS = []byte{0x68, 0xce, 0x38, 0x80}
+)
+
+// FrameDuration is the duration of a video frame, at 25 fps.
+const FrameDuration = 40000000
+
+// Presentation order offsets, in frames, of an IPBPB group in decoding
+// order.
+var BGroup = []int{0, 2, 1, 4, 3}
+
+// Options describes the file written by File.
+type Options struct {
+	// The number of video frames.
+	Frames int
+	// A keyframe every KeyInterval frames.
+	KeyInterval int
+	// Whether frames are coded in groups of IPBPB, with B-frames, as
+	// given by BGroup. KeyInterval must then be a multiple of 5.
+	BFrames bool
+	// The duration of an AAC frame, which are written up to the end of
+	// the video.
+	AudioDuration uint64
+	// Whether to add an S_TEXT/UTF8 track, with one subtitle from 0.5s
+	// to 1.5s.
+	Subtitle bool
+	// If not 0, the cluster duration limit.
+	ClusterDuration uint64
+}
+
+// AudioFrames returns the number of AAC frames in a file written with o.
+func (o Options) AudioFrames() int {
+	d := uint64(o.Frames) * FrameDuration
+	return int((d + o.AudioDuration - 1) / o.AudioDuration)
+}
+
+// VideoTime returns the presentation time of the video frame with the
+// given index in decoding order.
+func (o Options) VideoTime(i int) uint64 {
+	if !o.BFrames {
+		return uint64(i) * FrameDuration
+	}
+	group := i / len(BGroup) * len(BGroup)
+	return uint64(group+BGroup[i%len(BGroup)]) * FrameDuration
+}
+
+// File muxes a file with an H.264 track, an AAC track and optionally a
+// subtitle track, in that order. Video frames are 7 bytes of AVC with a
+// slice NAL unit ending in the frame's index, and AAC frames end in theirs.
+func File(t *testing.T, o Options) []byte {
+	f := &MemFile{}
+	m, err := matroska.NewMuxer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.ClusterDuration != 0 {
+		m.SetClusterLimits(o.ClusterDuration, 5*1024*1024)
+	}
+
+	avcC := []byte{1, 0x42, 0x00, 0x1e, 0xff, 0xe1, 0, byte(len(SPS))}
+	avcC = append(avcC, SPS...)
+	avcC = append(avcC, 1, 0, byte(len(PPS)))
+	avcC = append(avcC, PPS...)
+
+	video := &matroska.TrackInfo{
+		Type:            matroska.TypeVideo,
+		CodecID:         "V_MPEG4/ISO/AVC",
+		CodecPrivate:    avcC,
+		DefaultDuration: FrameDuration,
+		Language:        "und",
+	}
+	video.Video.PixelWidth = 320
+	video.Video.PixelHeight = 240
+	audio := &matroska.TrackInfo{
+		Type:            matroska.TypeAudio,
+		CodecID:         "A_AAC",
+		CodecPrivate:    []byte{0x11, 0x90},
+		DefaultDuration: o.AudioDuration,
+		Language:        "eng",
+	}
+	audio.Audio.SamplingFreq = 48000
+	audio.Audio.Channels = 2
+	tracks := []*matroska.TrackInfo{video, audio}
+	if o.Subtitle {
+		tracks = append(tracks, &matroska.TrackInfo{
+			Type:     matroska.TypeSubtitle,
+			CodecID:  "S_TEXT/UTF8",
+			Language: "eng",
+		})
+	}
+	for _, ti := range tracks {
+		_, err = m.AddTrack(ti)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Packets are written in decoding order, which for video is given by
+	// the frame's index, and for the other tracks by their timestamp.
+	var packets []*matroska.Packet
+	var order []uint64
+	for i := 0; i < o.Frames; i++ {
+		pts := o.VideoTime(i)
+		p := &matroska.Packet{
+			Track:     0,
+			StartTime: pts,
+			EndTime:   pts + FrameDuration,
+			Data:      []byte{0, 0, 0, 3, 0x41, 0x9a, byte(i)},
+		}
+		if i%o.KeyInterval == 0 {
+			p.Flags = matroska.KF
+			p.Data = []byte{0, 0, 0, 3, 0x65, 0x88, byte(i)}
+		}
+		packets = append(packets, p)
+		order = append(order, uint64(i)*FrameDuration)
+	}
+	for i := 0; i < o.AudioFrames(); i++ {
+		packets = append(packets, &matroska.Packet{
+			Track:     1,
+			StartTime: uint64(i) * o.AudioDuration,
+			EndTime:   uint64(i+1) * o.AudioDuration,
+			Data:      []byte{0x21, 0x10, 0x04, byte(i)},
+			Flags:     matroska.KF,
+		})
+		order = append(order, uint64(i)*o.AudioDuration)
+	}
+	if o.Subtitle {
+		packets = append(packets, &matroska.Packet{
+			Track:     2,
+			StartTime: 500000000,
+			EndTime:   1500000000,
+			Data:      []byte("subtitle"),
+			Flags:     matroska.KF,
+		})
+		order = append(order, 500000000)
+	}
+
+	index := make([]int, len(packets))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		return order[index[i]] < order[index[j]]
+	})
+	for _, i := range index {
+		err = m.WritePacket(packets[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Bytes()
+}
@@ -0,0 +1,59 @@
+// Package testutil has helpers shared by the tests of this module.
+package testutil
+
+import (
+	"fmt"
+	"io"
+)
+
+// MemFile is an in-memory io.ReadWriteSeeker, for muxer output and files
+// being edited.
+type MemFile struct {
+	b   []byte
+	pos int
+}
+
+// Bytes returns everything written so far.
+func (f *MemFile) Bytes() []byte {
+	return f.b
+}
+
+// Write implements io.Writer.
+func (f *MemFile) Write(p []byte) (int, error) {
+	if end := f.pos + len(p); end > len(f.b) {
+		f.b = append(f.b, make([]byte, end-len(f.b))...)
+	}
+	n := copy(f.b[f.pos:], p)
+	f.pos += n
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (f *MemFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(f.pos) + offset
+	case io.SeekEnd:
+		pos = int64(len(f.b)) + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	f.pos = int(pos)
+	return pos, nil
+}
+
+// Read implements io.Reader.
+func (f *MemFile) Read(p []byte) (int, error) {
+	if f.pos >= len(f.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.b[f.pos:])
+	f.pos += n
+	return n, nil
+}
@@ -35,7 +35,8 @@ type Demuxer struct {
 	key    string
 }
 
-func newDemuxerWithFlag(r io.ReadSeeker, flag C.unsigned) (*Demuxer, error) {
+// openDemuxer sets up the IO for r, and opens it with open.
+func openDemuxer(r io.ReadSeeker, open func(d *Demuxer) *C.MatroskaFile) (*Demuxer, error) {
 	ret := new(Demuxer)
 
 	ret.key = uuid.New()
@@ -44,12 +45,14 @@ func newDemuxerWithFlag(r io.ReadSeeker, flag C.unsigned) (*Demuxer, error) {
 
 	ret.errbuf = (*C.char)(C.calloc(1, 1024))
 	if ret.errbuf == nil {
+		delReader(ret.key)
 		return nil, fmt.Errorf("could not allocate errbuf")
 	}
 
 	ret.io = C.io_alloc()
 	if ret.io == nil {
 		C.free(unsafe.Pointer(ret.errbuf))
+		delReader(ret.key)
 		return nil, fmt.Errorf("could not allocate io struct")
 	}
 
@@ -58,17 +61,24 @@ func newDemuxerWithFlag(r io.ReadSeeker, flag C.unsigned) (*Demuxer, error) {
 
 	C.io_set_callbacks(ret.io, ckey)
 
-	ret.m = C.mkv_OpenEx(C.convert(ret.io), 0, flag, ret.errbuf, 1024)
+	ret.m = open(ret)
 	if ret.m == nil {
 		reason := C.GoString(ret.errbuf)
 		C.free(unsafe.Pointer(ret.errbuf))
 		C.io_free(ret.io)
+		delReader(ret.key)
 		return nil, fmt.Errorf("couldn't open matroska file: %s", reason)
 	}
 
 	return ret, nil
 }
 
+func newDemuxerWithFlag(r io.ReadSeeker, flag C.unsigned) (*Demuxer, error) {
+	return openDemuxer(r, func(d *Demuxer) *C.MatroskaFile {
+		return C.mkv_OpenEx(C.convert(d.io), 0, flag, d.errbuf, 1024)
+	})
+}
+
 // NewDemuxer creates a new Matroska demuxer from r.
 func NewDemuxer(r io.ReadSeeker) (*Demuxer, error) {
 	return newDemuxerWithFlag(r, 0)
@@ -81,6 +91,25 @@ func NewStreamingDemuxer(r io.Reader) (*Demuxer, error) {
 	return newDemuxerWithFlag(fs, C.MKVF_AVOID_SEEKS)
 }
 
+// Probe reads only the segment info of r, such as its UIDs, linked
+// filenames and title. It seeks to the start of r, and then skips over any
+// elements before the segment info by seeking forward, without reading
+// them. This is much cheaper than NewDemuxer, as it stops before the
+// tracks and does not look for the other top-level elements, so it can be
+// used to index many files, e.g. to find linked segments. The duration is
+// the one in the segment info, and may be 0.
+func Probe(r io.ReadSeeker) (*SegmentInfo, error) {
+	d, err := openDemuxer(r, func(d *Demuxer) *C.MatroskaFile {
+		return C.mkv_OpenSparse(C.convert(d.io), d.errbuf, 1024)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	return d.GetFileInfo()
+}
+
 // Close closes a demuxer.
 func (d *Demuxer) Close() {
 	C.mkv_Close(d.m)
@@ -152,6 +181,52 @@ func (d *Demuxer) GetAttachments() []*Attachment {
 	return ret
 }
 
+// ReadAttachment reads the data of an attachment returned by
+// GetAttachments.
+func (d *Demuxer) ReadAttachment(a *Attachment) (ret []byte, err error) {
+	r, err := getReader(d.key)
+	if err != nil {
+		return nil, err
+	}
+
+	// MatroskaParser keeps track of the position itself, so it must be
+	// put back where it was.
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("could not read attachment: %s", err.Error())
+	}
+	defer func() {
+		_, serr := r.Seek(pos, io.SeekStart)
+		if serr != nil && err == nil {
+			ret = nil
+			err = fmt.Errorf("could not restore position after reading attachment: %s", serr.Error())
+		}
+	}()
+
+	// The length comes from the file, so check it against the file's
+	// size before allocating anything.
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("could not read attachment: %s", err.Error())
+	}
+	if a.Position > uint64(size) || a.Length > uint64(size)-a.Position {
+		return nil, fmt.Errorf("could not read attachment: %d bytes at %d are past the end of the file", a.Length, a.Position)
+	}
+
+	_, err = r.Seek(int64(a.Position), io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("could not read attachment: %s", err.Error())
+	}
+
+	ret = make([]byte, a.Length)
+	_, err = io.ReadFull(r, ret)
+	if err != nil {
+		return nil, fmt.Errorf("could not read attachment: %s", err.Error())
+	}
+
+	return ret, nil
+}
+
 func processChapters(chapters *C.Chapter, count int) []*Chapter {
 	var chapterSlice []C.Chapter
 
@@ -234,6 +309,25 @@ func (d *Demuxer) GetChapters() []*Chapter {
 	return processChapters(chapters, int(count))
 }
 
+// GetEditions returns all chapter editions for a given demuxer. The returned
+// slice may be of length 0.
+func (d *Demuxer) GetEditions() []*Edition {
+	chapters := d.GetChapters()
+
+	ret := make([]*Edition, len(chapters))
+	for i, ch := range chapters {
+		ret[i] = &Edition{
+			UID:      ch.UID,
+			Hidden:   ch.Hidden,
+			Default:  ch.Default,
+			Ordered:  ch.Ordered,
+			Chapters: ch.Children,
+		}
+	}
+
+	return ret
+}
+
 // GetTags returns all tags for a given demuxer. The returned slice may be of
 // length 0.
 func (d *Demuxer) GetTags() []*Tag {
@@ -269,16 +363,27 @@ func (d *Demuxer) GetTags() []*Tag {
 			ret[i].Targets[j] = convertTarget(&targetSlice[j])
 		}
 
-		var simpleTagSlice []C.struct_SimpleTag
+		ret[i].TargetTypeValue = uint64(tagSlice[i].TargetTypeValue)
+		ret[i].TargetType = C.GoString(tagSlice[i].TargetType)
+		ret[i].SimpleTags = processSimpleTags(tagSlice[i].SimpleTags, int(tagSlice[i].nSimpleTags))
+	}
 
-		sSliceConv := (*reflect.SliceHeader)(unsafe.Pointer(&simpleTagSlice))
-		sSliceConv.Data = uintptr(unsafe.Pointer(tagSlice[i].SimpleTags))
-		sSliceConv.Len = int(tagSlice[i].nSimpleTags)
-		sSliceConv.Cap = int(tagSlice[i].nSimpleTags)
+	return ret
+}
+
+func processSimpleTags(tags *C.struct_SimpleTag, count int) []SimpleTag {
+	var simpleTagSlice []C.struct_SimpleTag
+
+	sliceConv := (*reflect.SliceHeader)(unsafe.Pointer(&simpleTagSlice))
+	sliceConv.Data = uintptr(unsafe.Pointer(tags))
+	sliceConv.Len = count
+	sliceConv.Cap = count
 
-		ret[i].SimpleTags = make([]SimpleTag, int(tagSlice[i].nSimpleTags))
-		for j := 0; j < int(tagSlice[i].nSimpleTags); j++ {
-			ret[i].SimpleTags[j] = convertSimpleTag(&simpleTagSlice[j])
+	ret := make([]SimpleTag, count)
+	for i := 0; i < count; i++ {
+		ret[i] = convertPartialSimpleTag(&simpleTagSlice[i])
+		if simpleTagSlice[i].nChildren > 0 {
+			ret[i].Children = processSimpleTags(simpleTagSlice[i].Children, int(simpleTagSlice[i].nChildren))
 		}
 	}
 
@@ -384,8 +489,13 @@ func (d *Demuxer) ReadPacketMask(mask uint64) (*Packet, error) {
 	var frameData *C.char
 	var frameFlags C.unsigned
 	var discard C.longlong
+	var refs *C.longlong
+	var nrefs C.unsigned
+	var adds *C.char
+	var addsLen C.unsigned
 
-	cret := C.mkv_ReadFrame(d.m, C.ulonglong(mask), &track, &startTime, &endTime, &filePos, &frameSize, &frameData, &frameFlags, &discard)
+	cret := C.mkv_ReadFrame(d.m, C.ulonglong(mask), &track, &startTime, &endTime, &filePos, &frameSize, &frameData, &frameFlags, &discard,
+		&refs, &nrefs, &adds, &addsLen)
 	if cret == -1 {
 		return nil, io.EOF
 	} else if cret != 0 {
@@ -404,6 +514,58 @@ func (d *Demuxer) ReadPacketMask(mask uint64) (*Packet, error) {
 
 	ret.Data = C.GoBytes(unsafe.Pointer(frameData), C.int(frameSize))
 
+	if nrefs != 0 {
+		cRefs := (*[1 << 28]C.longlong)(unsafe.Pointer(refs))[:nrefs:nrefs]
+		for _, r := range cRefs {
+			ret.References = append(ret.References, int64(r))
+		}
+		C.free(unsafe.Pointer(refs))
+	}
+	if adds != nil {
+		additions, err := parseAdditions(C.GoBytes(unsafe.Pointer(adds), C.int(addsLen)))
+		C.free(unsafe.Pointer(adds))
+		if err != nil {
+			return nil, fmt.Errorf("could not read packet: %s", err.Error())
+		}
+		ret.Additions = additions
+	}
+
+	return ret, nil
+}
+
+// parseAdditions parses the contents of a BlockAdditions element.
+func parseAdditions(b []byte) ([]BlockAddition, error) {
+	children, err := parseChildren(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BlockAdditions: %s", err.Error())
+	}
+
+	var ret []BlockAddition
+	for _, more := range children {
+		if more.id != idBlockMore {
+			continue
+		}
+		fields, err := parseChildren(more.payload())
+		if err != nil {
+			return nil, fmt.Errorf("invalid BlockMore: %s", err.Error())
+		}
+
+		a := BlockAddition{ID: 1}
+		found := false
+		for _, f := range fields {
+			switch f.id {
+			case idBlockAddID:
+				a.ID = parseUint(f.payload())
+			case idBlockAdditional:
+				a.Data = f.payload()
+				found = true
+			}
+		}
+		if found {
+			ret = append(ret, a)
+		}
+	}
+
 	return ret, nil
 }
 
@@ -0,0 +1,424 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Like the Matroska muxer, boxes are built by appending to byte slices.
+
+func appendU16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendU64(b []byte, v uint64) []byte {
+	return appendU32(appendU32(b, uint32(v>>32)), uint32(v))
+}
+
+func appendBox(b []byte, typ string, body []byte) []byte {
+	b = appendU32(b, uint32(8+len(body)))
+	b = append(b, typ...)
+	return append(b, body...)
+}
+
+// fullBox returns the version and flags header of a FullBox.
+func fullBox(version byte, flags uint32) []byte {
+	return []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+}
+
+// The identity matrix, as used in mvhd and tkhd.
+var unityMatrix = []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000}
+
+func ftyp() []byte {
+	var body []byte
+	body = append(body, "iso6"...)
+	body = appendU32(body, 0)
+	for _, brand := range []string{"iso6", "cmfc", "mp41"} {
+		body = append(body, brand...)
+	}
+	return appendBox(nil, "ftyp", body)
+}
+
+func mvhd(nextTrackID uint32) []byte {
+	body := fullBox(0, 0)
+	// Creation and modification time, timescale, duration.
+	body = appendU32(body, 0)
+	body = appendU32(body, 0)
+	body = appendU32(body, 1000)
+	body = appendU32(body, 0)
+	// Rate, volume, reserved.
+	body = appendU32(body, 0x10000)
+	body = appendU16(body, 0x100)
+	body = append(body, make([]byte, 10)...)
+	for _, v := range unityMatrix {
+		body = appendU32(body, v)
+	}
+	body = append(body, make([]byte, 24)...)
+	body = appendU32(body, nextTrackID)
+	return appendBox(nil, "mvhd", body)
+}
+
+func tkhd(t *track) []byte {
+	// Enabled, in movie.
+	body := fullBox(0, 3)
+	body = appendU32(body, 0)
+	body = appendU32(body, 0)
+	body = appendU32(body, t.id)
+	body = appendU32(body, 0)
+	body = appendU32(body, 0)
+	body = append(body, make([]byte, 8)...)
+	// Layer, alternate group.
+	body = appendU16(body, 0)
+	body = appendU16(body, 0)
+	if t.info.Type == matroska.TypeAudio {
+		body = appendU16(body, 0x100)
+	} else {
+		body = appendU16(body, 0)
+	}
+	body = appendU16(body, 0)
+	for _, v := range unityMatrix {
+		body = appendU32(body, v)
+	}
+
+	var w, h uint32
+	if t.info.Type == matroska.TypeVideo {
+		w, h = displaySize(t.info)
+	}
+	body = appendU32(body, w<<16)
+	body = appendU32(body, h<<16)
+	return appendBox(nil, "tkhd", body)
+}
+
+// displaySize returns the display size of a video track, assuming the
+// display unit is pixels if it is not an aspect ratio.
+func displaySize(ti *matroska.TrackInfo) (uint32, uint32) {
+	v := &ti.Video
+	w, h := v.PixelWidth-v.CropL-v.CropR, v.PixelHeight-v.CropT-v.CropB
+	if v.DisplayWidth == 0 || v.DisplayHeight == 0 {
+		return w, h
+	}
+	if v.DisplayUnit == 3 || uint64(v.DisplayWidth)*uint64(h) != uint64(v.DisplayHeight)*uint64(w) {
+		// Keep the height, and scale the width to the aspect ratio.
+		return uint32(uint64(h) * uint64(v.DisplayWidth) / uint64(v.DisplayHeight)), h
+	}
+	return w, h
+}
+
+// packLanguage packs an ISO 639-2 language code as used in mdhd.
+func packLanguage(lang string) uint16 {
+	lang = strings.TrimRight(lang, "\x00")
+	if len(lang) != 3 {
+		lang = "und"
+	}
+	var ret uint16
+	for i := 0; i < 3; i++ {
+		c := lang[i]
+		if c < 'a' || c > 'z' {
+			return packLanguage("und")
+		}
+		ret = ret<<5 | uint16(c-0x60)
+	}
+	return ret
+}
+
+func mdhd(t *track) []byte {
+	body := fullBox(0, 0)
+	body = appendU32(body, 0)
+	body = appendU32(body, 0)
+	body = appendU32(body, t.timescale)
+	body = appendU32(body, 0)
+	body = appendU16(body, packLanguage(t.info.Language))
+	body = appendU16(body, 0)
+	return appendBox(nil, "mdhd", body)
+}
+
+func hdlr(t *track) []byte {
+	handler, name := "soun", "SoundHandler"
+	if t.info.Type == matroska.TypeVideo {
+		handler, name = "vide", "VideoHandler"
+	}
+
+	body := fullBox(0, 0)
+	body = appendU32(body, 0)
+	body = append(body, handler...)
+	body = append(body, make([]byte, 12)...)
+	body = append(body, name...)
+	body = append(body, 0)
+	return appendBox(nil, "hdlr", body)
+}
+
+func minf(t *track) []byte {
+	var body []byte
+	if t.info.Type == matroska.TypeVideo {
+		vmhd := fullBox(0, 1)
+		vmhd = append(vmhd, make([]byte, 8)...)
+		body = appendBox(body, "vmhd", vmhd)
+	} else {
+		smhd := fullBox(0, 0)
+		smhd = append(smhd, make([]byte, 4)...)
+		body = appendBox(body, "smhd", smhd)
+	}
+
+	// A single self-contained data reference.
+	dref := fullBox(0, 0)
+	dref = appendU32(dref, 1)
+	dref = appendBox(dref, "url ", fullBox(0, 1))
+	body = appendBox(body, "dinf", appendBox(nil, "dref", dref))
+
+	// Samples are all in the fragments, so the tables are empty.
+	stsd := fullBox(0, 0)
+	stsd = appendU32(stsd, 1)
+	stsd = append(stsd, t.sampleEntry...)
+
+	var stbl []byte
+	stbl = appendBox(stbl, "stsd", stsd)
+	empty := appendU32(fullBox(0, 0), 0)
+	stbl = appendBox(stbl, "stts", empty)
+	stbl = appendBox(stbl, "stsc", empty)
+	stbl = appendBox(stbl, "stsz", appendU32(empty, 0))
+	stbl = appendBox(stbl, "stco", empty)
+	body = appendBox(body, "stbl", stbl)
+
+	return appendBox(nil, "minf", body)
+}
+
+func trak(t *track) []byte {
+	var mdia []byte
+	mdia = append(mdia, mdhd(t)...)
+	mdia = append(mdia, hdlr(t)...)
+	mdia = append(mdia, minf(t)...)
+
+	var body []byte
+	body = append(body, tkhd(t)...)
+	body = appendBox(body, "mdia", mdia)
+	return appendBox(nil, "trak", body)
+}
+
+func trex(t *track) []byte {
+	body := fullBox(0, 0)
+	body = appendU32(body, t.id)
+	// Sample description index, and no other defaults.
+	body = appendU32(body, 1)
+	body = appendU32(body, 0)
+	body = appendU32(body, 0)
+	body = appendU32(body, 0)
+	return appendBox(nil, "trex", body)
+}
+
+func moov(tracks []*track) []byte {
+	var body []byte
+	next := uint32(1)
+	for _, t := range tracks {
+		if t.id >= next {
+			next = t.id + 1
+		}
+	}
+	body = append(body, mvhd(next)...)
+	var mvex []byte
+	for _, t := range tracks {
+		body = append(body, trak(t)...)
+		mvex = append(mvex, trex(t)...)
+	}
+	body = appendBox(body, "mvex", mvex)
+	return appendBox(nil, "moov", body)
+}
+
+func visualSampleEntry(typ string, ti *matroska.TrackInfo, config []byte) []byte {
+	v := &ti.Video
+
+	body := make([]byte, 6)
+	body = appendU16(body, 1)
+	body = append(body, make([]byte, 16)...)
+	body = appendU16(body, uint16(v.PixelWidth))
+	body = appendU16(body, uint16(v.PixelHeight))
+	body = appendU32(body, 0x00480000)
+	body = appendU32(body, 0x00480000)
+	body = appendU32(body, 0)
+	body = appendU16(body, 1)
+	body = append(body, make([]byte, 32)...)
+	body = appendU16(body, 0x18)
+	body = appendU16(body, 0xffff)
+	body = append(body, config...)
+
+	// Signal non-square pixels.
+	dw, dh := displaySize(ti)
+	w, h := v.PixelWidth-v.CropL-v.CropR, v.PixelHeight-v.CropT-v.CropB
+	if w != 0 && h != 0 && uint64(dw)*uint64(h) != uint64(dh)*uint64(w) {
+		hs, vs := uint64(dw)*uint64(h), uint64(dh)*uint64(w)
+		for _, d := range []uint64{2, 3, 5, 7} {
+			for hs%d == 0 && vs%d == 0 {
+				hs /= d
+				vs /= d
+			}
+		}
+		if hs <= 0xffffffff && vs <= 0xffffffff {
+			var pasp []byte
+			pasp = appendU32(pasp, uint32(hs))
+			pasp = appendU32(pasp, uint32(vs))
+			body = appendBox(body, "pasp", pasp)
+		}
+	}
+
+	return appendBox(nil, typ, body)
+}
+
+func audioSampleEntry(typ string, ti *matroska.TrackInfo, rate uint32, config []byte) []byte {
+	channels := uint16(ti.Audio.Channels)
+	if channels == 0 {
+		channels = 2
+	}
+
+	body := make([]byte, 6)
+	body = appendU16(body, 1)
+	body = append(body, make([]byte, 8)...)
+	body = appendU16(body, channels)
+	body = appendU16(body, 16)
+	body = appendU32(body, 0)
+	if rate > 0xffff {
+		body = appendU32(body, 0)
+	} else {
+		body = appendU32(body, rate<<16)
+	}
+	body = append(body, config...)
+	return appendBox(nil, typ, body)
+}
+
+// appendDescriptor appends an MPEG-4 descriptor, with its size in the
+// usual 4 byte form.
+func appendDescriptor(b []byte, tag byte, body []byte) []byte {
+	n := len(body)
+	b = append(b, tag, 0x80|byte(n>>21), 0x80|byte(n>>14), 0x80|byte(n>>7), byte(n&0x7f))
+	return append(b, body...)
+}
+
+func esds(objectType byte, dsi []byte) []byte {
+	dcd := []byte{objectType, 0x15, 0, 0, 0}
+	dcd = appendU32(dcd, 0)
+	dcd = appendU32(dcd, 0)
+	if len(dsi) != 0 {
+		dcd = appendDescriptor(dcd, 0x05, dsi)
+	}
+
+	es := []byte{0, 0, 0}
+	es = appendDescriptor(es, 0x04, dcd)
+	es = appendDescriptor(es, 0x06, []byte{0x02})
+
+	return appendBox(nil, "esds", appendDescriptor(fullBox(0, 0), 0x03, es))
+}
+
+var aacRates = []uint32{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// aacConfig returns an AudioSpecificConfig for AAC tracks using the old
+// style codec IDs, which have no CodecPrivate.
+func aacConfig(ti *matroska.TrackInfo) ([]byte, error) {
+	var objectType byte
+	switch {
+	case strings.HasSuffix(ti.CodecID, "/MAIN"):
+		objectType = 1
+	case strings.HasSuffix(ti.CodecID, "/SSR"):
+		objectType = 3
+	case strings.HasSuffix(ti.CodecID, "/LTP"):
+		objectType = 4
+	default:
+		// LC, and LC/SBR, which is signalled implicitly.
+		objectType = 2
+	}
+
+	rate := uint32(ti.Audio.SamplingFreq)
+	index := -1
+	for i, r := range aacRates {
+		if r == rate {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("could not build AAC config for sampling frequency %d", rate)
+	}
+
+	return []byte{objectType<<3 | byte(index>>1), byte(index<<7) | ti.Audio.Channels<<3}, nil
+}
+
+// dOps converts an OpusHead to an Opus Specific Box.
+func dOps(head []byte) ([]byte, error) {
+	if len(head) < 19 || string(head[:8]) != "OpusHead" {
+		return nil, fmt.Errorf("could not parse OpusHead")
+	}
+
+	body := []byte{0, head[9]}
+	body = appendU16(body, binary.LittleEndian.Uint16(head[10:12]))
+	body = appendU32(body, binary.LittleEndian.Uint32(head[12:16]))
+	body = appendU16(body, binary.LittleEndian.Uint16(head[16:18]))
+	body = append(body, head[18])
+	if head[18] != 0 {
+		if len(head) < 21+int(head[9]) {
+			return nil, fmt.Errorf("could not parse OpusHead channel mapping")
+		}
+		body = append(body, head[19:21+int(head[9])]...)
+	}
+
+	return appendBox(nil, "dOps", body), nil
+}
+
+// sampleEntry builds the sample entry for a track, and returns it along
+// with the timescale to use for the track.
+func sampleEntry(ti *matroska.TrackInfo) ([]byte, uint32, error) {
+	rate := uint32(ti.Audio.SamplingFreq)
+	if ti.Audio.OutputSamplingFreq != 0 {
+		// SBR; the output rate is what counts for timing.
+		rate = uint32(ti.Audio.OutputSamplingFreq)
+	}
+
+	switch {
+	case ti.CodecID == "V_MPEG4/ISO/AVC":
+		if len(ti.CodecPrivate) == 0 {
+			return nil, 0, fmt.Errorf("could not find avcC in CodecPrivate")
+		}
+		return visualSampleEntry("avc1", ti, appendBox(nil, "avcC", ti.CodecPrivate)), videoTimescale, nil
+	case ti.CodecID == "V_MPEGH/ISO/HEVC":
+		if len(ti.CodecPrivate) == 0 {
+			return nil, 0, fmt.Errorf("could not find hvcC in CodecPrivate")
+		}
+		return visualSampleEntry("hvc1", ti, appendBox(nil, "hvcC", ti.CodecPrivate)), videoTimescale, nil
+	case ti.CodecID == "V_AV1":
+		if len(ti.CodecPrivate) == 0 {
+			return nil, 0, fmt.Errorf("could not find av1C in CodecPrivate")
+		}
+		return visualSampleEntry("av01", ti, appendBox(nil, "av1C", ti.CodecPrivate)), videoTimescale, nil
+	case ti.CodecID == "A_OPUS":
+		config, err := dOps(ti.CodecPrivate)
+		if err != nil {
+			return nil, 0, err
+		}
+		return audioSampleEntry("Opus", ti, 48000, config), 48000, nil
+	case strings.HasPrefix(ti.CodecID, "A_AAC"):
+		asc := ti.CodecPrivate
+		if len(asc) == 0 {
+			var err error
+			asc, err = aacConfig(ti)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		if rate == 0 {
+			return nil, 0, fmt.Errorf("could not find sampling frequency for AAC track")
+		}
+		return audioSampleEntry("mp4a", ti, rate, esds(0x40, asc)), rate, nil
+	case ti.CodecID == "A_MPEG/L3":
+		if rate == 0 {
+			return nil, 0, fmt.Errorf("could not find sampling frequency for MP3 track")
+		}
+		return audioSampleEntry("mp4a", ti, rate, esds(0x6b, nil)), rate, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported codec: %s", ti.CodecID)
+}
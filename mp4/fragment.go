@@ -0,0 +1,161 @@
+package mp4
+
+import (
+	"sort"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Sample flags for sync and non-sync samples.
+const (
+	flagsSync    = 0x02000000
+	flagsNonSync = 0x01010000
+)
+
+// trun flags: data offset, and per-sample duration, size, flags and
+// composition time offset.
+const trunFlags = 0x000f01
+
+// timing computes the composition and decode times and durations of a
+// track's queued samples, in the track's timescale.
+func timing(t *track) ([]uint64, []uint64, []uint64) {
+	n := len(t.samples)
+	cts := make([]uint64, n)
+	for i, s := range t.samples {
+		cts[i] = toTimescale(s.pts, t.timescale)
+	}
+
+	dts := make([]uint64, n)
+	durations := make([]uint64, n)
+
+	if t.info.Type == matroska.TypeAudio {
+		// Audio timestamps are usually rounded to the millisecond, so
+		// snap them to the end of the previous sample when they are
+		// close enough, so that durations are exact.
+		tolerance := uint64(t.timescale)/1000 + 1
+		for i, s := range t.samples {
+			d := cts[i]
+			if t.hasNext && d+tolerance >= t.next && d <= t.next+tolerance {
+				d = t.next
+			}
+			cts[i] = d
+			dts[i] = d
+
+			if s.duration != 0 {
+				durations[i] = toTimescale(s.duration, t.timescale)
+			} else if i+1 < n && cts[i+1] > d {
+				durations[i] = cts[i+1] - d
+			} else {
+				durations[i] = t.lastDur
+			}
+			t.lastDur = durations[i]
+			t.next = d + durations[i]
+			t.hasNext = true
+		}
+		return cts, dts, durations
+	}
+
+	// Matroska only has presentation timestamps, so the decode timestamps
+	// are the sorted presentation timestamps. For streams without
+	// reordering, they are one and the same.
+	copy(dts, cts)
+	sort.Slice(dts, func(i, j int) bool { return dts[i] < dts[j] })
+
+	for i, s := range t.samples {
+		if i+1 < n {
+			durations[i] = dts[i+1] - dts[i]
+		} else if s.duration != 0 {
+			durations[i] = toTimescale(s.duration, t.timescale)
+		} else {
+			durations[i] = t.lastDur
+		}
+		t.lastDur = durations[i]
+	}
+
+	return cts, dts, durations
+}
+
+// traf builds the traf box for a track's queued samples, returning it along
+// with the position of the trun data offset within it.
+func traf(t *track) ([]byte, int) {
+	cts, dts, durations := timing(t)
+
+	tfhd := fullBox(0, 0x020000)
+	tfhd = appendU32(tfhd, t.id)
+
+	tfdt := fullBox(1, 0)
+	tfdt = appendU64(tfdt, dts[0])
+
+	trun := fullBox(1, trunFlags)
+	trun = appendU32(trun, uint32(len(t.samples)))
+	offsetPos := len(trun)
+	trun = appendU32(trun, 0)
+	for i, s := range t.samples {
+		trun = appendU32(trun, uint32(durations[i]))
+		trun = appendU32(trun, uint32(len(s.data)))
+		if s.key {
+			trun = appendU32(trun, flagsSync)
+		} else {
+			trun = appendU32(trun, flagsNonSync)
+		}
+		trun = appendU32(trun, uint32(int32(int64(cts[i])-int64(dts[i]))))
+	}
+
+	var body []byte
+	body = appendBox(body, "tfhd", tfhd)
+	body = appendBox(body, "tfdt", tfdt)
+	trunStart := len(body)
+	body = appendBox(body, "trun", trun)
+
+	// The box and traf headers come before all of that.
+	return appendBox(nil, "traf", body), 8 + trunStart + 8 + offsetPos
+}
+
+// fragment builds a moof and mdat from all queued samples, and clears them.
+func (r *Remuxer) fragment() []byte {
+	mfhd := appendU32(fullBox(0, 0), r.seq)
+
+	var moofBody []byte
+	moofBody = appendBox(moofBody, "mfhd", mfhd)
+
+	var offsets []int
+	var sizes []int
+	var mdatSize int
+	for _, t := range r.tracks {
+		if len(t.samples) == 0 {
+			continue
+		}
+
+		b, pos := traf(t)
+		offsets = append(offsets, 8+len(moofBody)+pos)
+		moofBody = append(moofBody, b...)
+
+		size := 0
+		for _, s := range t.samples {
+			size += len(s.data)
+		}
+		sizes = append(sizes, size)
+		mdatSize += size
+	}
+
+	moof := appendBox(nil, "moof", moofBody)
+
+	// Data offsets are relative to the start of the moof.
+	dataPos := len(moof) + 8
+	for i, off := range offsets {
+		v := uint32(dataPos)
+		moof[off], moof[off+1], moof[off+2], moof[off+3] = byte(v>>24), byte(v>>16), byte(v>>8), byte(v)
+		dataPos += sizes[i]
+	}
+
+	ret := appendU32(moof, uint32(8+mdatSize))
+	ret = append(ret, "mdat"...)
+	for _, t := range r.tracks {
+		for _, s := range t.samples {
+			ret = append(ret, s.data...)
+		}
+		t.samples = t.samples[:0]
+	}
+
+	return ret
+}
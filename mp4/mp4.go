@@ -0,0 +1,237 @@
+// Package mp4 implements remuxing from a matroska.Demuxer to fragmented MP4,
+// as used by CMAF, DASH and MSE: an init segment (ftyp and moov), followed by
+// media fragments (moof and mdat) which each start on a keyframe.
+//
+// H.264, HEVC, AV1, AAC, MP3 and Opus tracks are supported. Tracks using
+// other codecs, e.g. subtitles, are skipped.
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// The timescale used for video tracks. Audio tracks use their sampling
+// frequency.
+const videoTimescale = 90000
+
+// The fragment duration used when there are neither cues nor video
+// keyframes to go by.
+const defaultFragmentDuration = 2000000000
+
+type sample struct {
+	pts      uint64
+	duration uint64
+	key      bool
+	data     []byte
+}
+
+type track struct {
+	id          uint32
+	info        *matroska.TrackInfo
+	timescale   uint32
+	sampleEntry []byte
+	prefix      []byte
+	samples     []*sample
+	lastDur     uint64
+
+	// The decode time following the last sample, for audio tracks.
+	next    uint64
+	hasNext bool
+}
+
+// Remuxer remuxes the supported tracks of a Demuxer to fragmented MP4.
+type Remuxer struct {
+	d      *matroska.Demuxer
+	tracks []*track
+	byIdx  map[uint]*track
+	mask   uint64
+	ref    *track
+	cues   []uint64
+	seq    uint32
+
+	pending *matroska.Packet
+	eof     bool
+}
+
+// NewRemuxer creates a Remuxer for all supported tracks in d. The MP4 track
+// IDs are the Matroska track numbers.
+//
+// Packets are read from the demuxer's current position.
+func NewRemuxer(d *matroska.Demuxer) (*Remuxer, error) {
+	r := &Remuxer{
+		d:     d,
+		byIdx: make(map[uint]*track),
+		mask:  ^uint64(0),
+	}
+
+	count, err := d.GetNumTracks()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint(0); i < count; i++ {
+		ti, err := d.GetTrackInfo(i)
+		if err != nil {
+			return nil, err
+		}
+		if ti.Type != matroska.TypeVideo && ti.Type != matroska.TypeAudio {
+			continue
+		}
+
+		entry, timescale, err := sampleEntry(ti)
+		if err != nil {
+			// Not something we can put in MP4.
+			continue
+		}
+
+		t := &track{
+			id:          uint32(ti.Number),
+			info:        ti,
+			timescale:   timescale,
+			sampleEntry: entry,
+		}
+		if ti.CompEnabled {
+			if ti.CompMethod != matroska.CompPrepend {
+				return nil, fmt.Errorf("could not remux track %d: unsupported compression %d", ti.Number, ti.CompMethod)
+			}
+			t.prefix = ti.CompMethodPrivate
+		}
+
+		r.tracks = append(r.tracks, t)
+		r.byIdx[i] = t
+		r.mask &^= uint64(1) << i
+
+		if r.ref == nil || (r.ref.info.Type != matroska.TypeVideo && ti.Type == matroska.TypeVideo) {
+			r.ref = t
+		}
+	}
+	if len(r.tracks) == 0 {
+		return nil, fmt.Errorf("could not find any tracks supported in MP4")
+	}
+
+	for _, c := range d.GetCues() {
+		if c.Track == r.ref.info.Number {
+			r.cues = append(r.cues, c.Time)
+		}
+	}
+	sort.Slice(r.cues, func(i, j int) bool { return r.cues[i] < r.cues[j] })
+
+	return r, nil
+}
+
+// InitSegment returns the init segment, which is an ftyp box followed by a
+// moov box describing all tracks.
+func (r *Remuxer) InitSegment() []byte {
+	return append(ftyp(), moov(r.tracks)...)
+}
+
+// startsFragment decides whether a packet should start a new fragment,
+// given the start time of the current one.
+func (r *Remuxer) startsFragment(p *matroska.Packet, t *track, start uint64) bool {
+	if t != r.ref || p.Flags&matroska.KF == 0 || p.StartTime <= start {
+		return false
+	}
+
+	if len(r.cues) > 0 {
+		// Cut at the first keyframe at or after the next cue point.
+		i := sort.Search(len(r.cues), func(i int) bool { return r.cues[i] > start })
+		return i < len(r.cues) && p.StartTime >= r.cues[i]
+	}
+
+	if t.info.Type == matroska.TypeVideo {
+		return true
+	}
+
+	return p.StartTime-start >= defaultFragmentDuration
+}
+
+// NextFragment reads the next fragment's worth of packets from the demuxer,
+// and returns it as a moof box followed by an mdat box. It returns io.EOF
+// once there are no more packets.
+func (r *Remuxer) NextFragment() ([]byte, error) {
+	var start uint64
+	started := false
+
+	for {
+		p := r.pending
+		r.pending = nil
+		if p == nil && !r.eof {
+			var err error
+			p, err = r.d.ReadPacketMask(r.mask)
+			if err == io.EOF {
+				r.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if p == nil {
+			break
+		}
+
+		t := r.byIdx[uint(p.Track)]
+		if started && r.startsFragment(p, t, start) {
+			r.pending = p
+			break
+		}
+		if !started {
+			start = p.StartTime
+			started = true
+		}
+
+		data := p.Data
+		if len(t.prefix) != 0 {
+			data = append(append([]byte{}, t.prefix...), data...)
+		}
+		duration := t.info.DefaultDuration
+		if p.Flags&matroska.UnknownEnd == 0 && p.EndTime > p.StartTime {
+			duration = p.EndTime - p.StartTime
+		}
+		t.samples = append(t.samples, &sample{
+			pts:      p.StartTime,
+			duration: duration,
+			key:      p.Flags&matroska.KF != 0 || t.info.Type != matroska.TypeVideo,
+			data:     data,
+		})
+	}
+
+	if !started {
+		return nil, io.EOF
+	}
+
+	r.seq++
+	return r.fragment(), nil
+}
+
+// WriteTo writes the init segment and all remaining fragments to w.
+func (r *Remuxer) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.InitSegment())
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for {
+		frag, err := r.NextFragment()
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+
+		n, err = w.Write(frag)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// toTimescale converts nanoseconds to the given timescale, with rounding.
+func toTimescale(ns uint64, timescale uint32) uint64 {
+	ts := uint64(timescale)
+	return ns/1000000000*ts + (ns%1000000000*ts+500000000)/1000000000
+}
@@ -0,0 +1,279 @@
+package mpegts
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Stream types, as used in the PMT.
+const (
+	streamTypeMP3  = 0x03
+	streamTypeAAC  = 0x0f
+	streamTypeH264 = 0x1b
+	streamTypeHEVC = 0x24
+	streamTypeAC3  = 0x81
+	streamTypeEAC3 = 0x87
+)
+
+// converter turns a Matroska packet's data into an elementary stream
+// access unit.
+type converter interface {
+	convert(data []byte, key bool) ([]byte, error)
+}
+
+var annexBStartCode = []byte{0, 0, 0, 1}
+
+// annexB converts length-prefixed H.264 and HEVC packets to Annex B, adding
+// access unit delimiters, and parameter sets on keyframes.
+type annexB struct {
+	lengthSize int
+	params     [][]byte
+	aud        []byte
+	isParam    func(nal []byte) bool
+}
+
+func readParamSet(cp []byte, pos int) ([]byte, int, error) {
+	if pos+2 > len(cp) {
+		return nil, 0, fmt.Errorf("could not parse CodecPrivate: truncated")
+	}
+	n := int(cp[pos])<<8 | int(cp[pos+1])
+	pos += 2
+	if pos+n > len(cp) {
+		return nil, 0, fmt.Errorf("could not parse CodecPrivate: truncated")
+	}
+	return cp[pos : pos+n], pos + n, nil
+}
+
+func newAVCConverter(cp []byte) (*annexB, error) {
+	if len(cp) < 7 {
+		return nil, fmt.Errorf("could not find avcC in CodecPrivate")
+	}
+
+	a := &annexB{
+		lengthSize: int(cp[4]&3) + 1,
+		aud:        []byte{0x09, 0xf0},
+		isParam: func(nal []byte) bool {
+			return nal[0]&0x1f == 7
+		},
+	}
+
+	pos := 6
+	for i := 0; i < int(cp[5]&0x1f); i++ {
+		nal, next, err := readParamSet(cp, pos)
+		if err != nil {
+			return nil, err
+		}
+		a.params = append(a.params, nal)
+		pos = next
+	}
+	if pos >= len(cp) {
+		return nil, fmt.Errorf("could not parse CodecPrivate: truncated")
+	}
+	count := int(cp[pos])
+	pos++
+	for i := 0; i < count; i++ {
+		nal, next, err := readParamSet(cp, pos)
+		if err != nil {
+			return nil, err
+		}
+		a.params = append(a.params, nal)
+		pos = next
+	}
+
+	return a, nil
+}
+
+func newHEVCConverter(cp []byte) (*annexB, error) {
+	if len(cp) < 23 {
+		return nil, fmt.Errorf("could not find hvcC in CodecPrivate")
+	}
+
+	a := &annexB{
+		lengthSize: int(cp[21]&3) + 1,
+		aud:        []byte{0x46, 0x01, 0x50},
+		isParam: func(nal []byte) bool {
+			typ := (nal[0] >> 1) & 0x3f
+			return typ == 32 || typ == 33
+		},
+	}
+
+	pos := 23
+	for i := 0; i < int(cp[22]); i++ {
+		if pos+3 > len(cp) {
+			return nil, fmt.Errorf("could not parse CodecPrivate: truncated")
+		}
+		count := int(cp[pos+1])<<8 | int(cp[pos+2])
+		pos += 3
+		for j := 0; j < count; j++ {
+			nal, next, err := readParamSet(cp, pos)
+			if err != nil {
+				return nil, err
+			}
+			a.params = append(a.params, nal)
+			pos = next
+		}
+	}
+
+	return a, nil
+}
+
+func (a *annexB) convert(data []byte, key bool) ([]byte, error) {
+	var nals [][]byte
+	hasParams := false
+	for pos := 0; pos < len(data); {
+		if pos+a.lengthSize > len(data) {
+			return nil, fmt.Errorf("could not parse NAL unit length")
+		}
+		n := 0
+		for i := 0; i < a.lengthSize; i++ {
+			n = n<<8 | int(data[pos+i])
+		}
+		pos += a.lengthSize
+		if n == 0 {
+			continue
+		}
+		if pos+n > len(data) {
+			return nil, fmt.Errorf("could not parse NAL unit: truncated")
+		}
+		nal := data[pos : pos+n]
+		pos += n
+
+		hasParams = hasParams || a.isParam(nal)
+		nals = append(nals, nal)
+	}
+
+	ret := make([]byte, 0, len(data)+64)
+	ret = append(ret, annexBStartCode...)
+	ret = append(ret, a.aud...)
+	if key && !hasParams {
+		for _, p := range a.params {
+			ret = append(ret, annexBStartCode...)
+			ret = append(ret, p...)
+		}
+	}
+	for _, nal := range nals {
+		ret = append(ret, annexBStartCode...)
+		ret = append(ret, nal...)
+	}
+
+	return ret, nil
+}
+
+var aacRates = []uint32{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// adts adds ADTS headers to raw AAC frames.
+type adts struct {
+	profile   byte
+	rateIndex byte
+	channels  byte
+}
+
+func newADTSConverter(ti *matroska.TrackInfo) (*adts, error) {
+	cp := ti.CodecPrivate
+	if len(cp) >= 2 {
+		objectType := cp[0] >> 3
+		rateIndex := (cp[0]&7)<<1 | cp[1]>>7
+		channels := (cp[1] >> 3) & 0xf
+		if objectType == 5 || objectType == 29 {
+			// Explicit SBR/PS signalling; ADTS can only carry the core
+			// AAC-LC config.
+			objectType = 2
+		}
+		if objectType == 0 || objectType > 4 || rateIndex >= 13 {
+			return nil, fmt.Errorf("could not put AAC object type %d with rate index %d in ADTS", objectType, rateIndex)
+		}
+		return &adts{
+			profile:   objectType - 1,
+			rateIndex: rateIndex,
+			channels:  channels,
+		}, nil
+	}
+
+	// Old style codec IDs have no CodecPrivate.
+	a := &adts{
+		profile:   1,
+		rateIndex: 0xff,
+		channels:  ti.Audio.Channels,
+	}
+	switch {
+	case strings.HasSuffix(ti.CodecID, "/MAIN"):
+		a.profile = 0
+	case strings.HasSuffix(ti.CodecID, "/SSR"):
+		a.profile = 2
+	case strings.HasSuffix(ti.CodecID, "/LTP"):
+		a.profile = 3
+	}
+
+	// For SBR, this is the core sampling frequency, which is what ADTS
+	// wants.
+	rate := uint32(ti.Audio.SamplingFreq)
+	for i, r := range aacRates {
+		if r == rate {
+			a.rateIndex = byte(i)
+		}
+	}
+	if a.rateIndex == 0xff {
+		return nil, fmt.Errorf("could not put AAC with sampling frequency %d in ADTS", rate)
+	}
+
+	return a, nil
+}
+
+func (a *adts) convert(data []byte, key bool) ([]byte, error) {
+	n := len(data) + 7
+	if n > 0x1fff {
+		return nil, fmt.Errorf("could not put %d byte AAC frame in ADTS", len(data))
+	}
+
+	ret := make([]byte, 0, n)
+	ret = append(ret,
+		0xff, 0xf1,
+		a.profile<<6|a.rateIndex<<2|a.channels>>2,
+		(a.channels&3)<<6|byte(n>>11),
+		byte(n>>3),
+		byte(n&7)<<5|0x1f,
+		0xfc)
+	return append(ret, data...), nil
+}
+
+// passthrough is used for codecs whose Matroska packets are already
+// elementary stream frames.
+type passthrough struct{}
+
+func (passthrough) convert(data []byte, key bool) ([]byte, error) {
+	return data, nil
+}
+
+// streamInfo returns the stream type, PES stream ID and converter for a
+// track.
+func streamInfo(ti *matroska.TrackInfo) (byte, byte, converter, error) {
+	switch {
+	case ti.CodecID == "V_MPEG4/ISO/AVC":
+		c, err := newAVCConverter(ti.CodecPrivate)
+		return streamTypeH264, 0xe0, c, err
+	case ti.CodecID == "V_MPEGH/ISO/HEVC":
+		c, err := newHEVCConverter(ti.CodecPrivate)
+		return streamTypeHEVC, 0xe0, c, err
+	case strings.HasPrefix(ti.CodecID, "A_AAC"):
+		c, err := newADTSConverter(ti)
+		return streamTypeAAC, 0xc0, c, err
+	case ti.CodecID == "A_AC3":
+		return streamTypeAC3, 0xbd, passthrough{}, nil
+	case ti.CodecID == "A_EAC3":
+		return streamTypeEAC3, 0xbd, passthrough{}, nil
+	case ti.CodecID == "A_MPEG/L3":
+		return streamTypeMP3, 0xc0, passthrough{}, nil
+	}
+
+	return 0, 0, nil, fmt.Errorf("unsupported codec: %s", ti.CodecID)
+}
+
+// Supported returns whether a track can be written to a transport stream.
+func Supported(ti *matroska.TrackInfo) bool {
+	_, _, _, err := streamInfo(ti)
+	return err == nil && !ti.CompEnabled
+}
@@ -0,0 +1,417 @@
+// Package mpegts implements remuxing from Matroska to MPEG-2 transport
+// streams, as used for broadcast and HLS.
+//
+// H.264 and HEVC (converted to Annex B), AAC (converted to ADTS), AC-3,
+// E-AC-3 and MP3 tracks are supported.
+package mpegts
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// PacketSize is the size of a transport stream packet.
+const PacketSize = 188
+
+// PIDs used for the program tables and the first elementary stream.
+const (
+	pidPAT   = 0x0000
+	pidPMT   = 0x1000
+	pidFirst = 0x0100
+)
+
+// All timestamps are offset by this much, in 90 kHz units, so that decode
+// timestamps and the PCR, which may lag behind presentation timestamps,
+// never go negative.
+const timestampOffset = 2 * 90000
+
+// How far the PCR is behind the decode timestamps, in 90 kHz units.
+const pcrDelay = 90000 / 2
+
+// How often the PAT and PMT are repeated, in 90 kHz units, at the least.
+const psiInterval = 90000 / 10
+
+// The number of frames video decode timestamps are delayed by, to allow for
+// frame reordering.
+const reorderDelay = 3
+
+type stream struct {
+	pid        uint16
+	streamType byte
+	streamID   byte
+	conv       converter
+	info       *matroska.TrackInfo
+	cc         byte
+
+	// Decode timestamp derivation for video.
+	video   bool
+	count   int
+	first   uint64
+	pending []uint64
+	lastDTS uint64
+}
+
+// Writer writes Matroska packets to a transport stream with a single
+// program.
+type Writer struct {
+	w       io.Writer
+	streams []*stream
+	pcr     *stream
+	patCC   byte
+	pmtCC   byte
+	lastPSI uint64
+	psiDone bool
+}
+
+// NewWriter creates a transport stream writer for the given tracks. The
+// Track member of packets passed to WritePacket indexes tracks.
+func NewWriter(w io.Writer, tracks []*matroska.TrackInfo) (*Writer, error) {
+	tw := &Writer{
+		w: w,
+	}
+
+	for i, ti := range tracks {
+		if ti.CompEnabled {
+			return nil, fmt.Errorf("could not write track %d: compressed tracks are not supported", ti.Number)
+		}
+
+		streamType, streamID, conv, err := streamInfo(ti)
+		if err != nil {
+			return nil, err
+		}
+
+		s := &stream{
+			pid:        uint16(pidFirst + i),
+			streamType: streamType,
+			streamID:   streamID,
+			conv:       conv,
+			info:       ti,
+			video:      ti.Type == matroska.TypeVideo,
+		}
+		tw.streams = append(tw.streams, s)
+
+		if tw.pcr == nil || (!tw.pcr.video && s.video) {
+			tw.pcr = s
+		}
+	}
+	if len(tw.streams) == 0 {
+		return nil, fmt.Errorf("could not create a transport stream without any tracks")
+	}
+
+	return tw, nil
+}
+
+// Remux writes all tracks of d which can be carried in a transport stream
+// to w.
+// Packets are read from the demuxer's current position until EOF.
+func Remux(d *matroska.Demuxer, w io.Writer) error {
+	count, err := d.GetNumTracks()
+	if err != nil {
+		return err
+	}
+
+	var tracks []*matroska.TrackInfo
+	index := make(map[uint8]uint8)
+	mask := ^uint64(0)
+	for i := uint(0); i < count; i++ {
+		ti, err := d.GetTrackInfo(i)
+		if err != nil {
+			return err
+		}
+		if !Supported(ti) {
+			continue
+		}
+		index[uint8(i)] = uint8(len(tracks))
+		tracks = append(tracks, ti)
+		mask &^= uint64(1) << i
+	}
+
+	tw, err := NewWriter(w, tracks)
+	if err != nil {
+		return err
+	}
+
+	for {
+		p, err := d.ReadPacketMask(mask)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		p.Track = index[p.Track]
+		err = tw.WritePacket(p)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// toClock converts nanoseconds to the 90 kHz clock, with rounding.
+func toClock(ns uint64) uint64 {
+	return ns/1000000000*90000 + (ns%1000000000*90000+500000000)/1000000000
+}
+
+// dts derives a decode timestamp for a packet. Matroska only stores
+// presentation timestamps, so for video, the decode timestamp of a frame is
+// the presentation timestamp reorderDelay frames earlier in presentation
+// order. This is valid as long as frames are not reordered by more than that.
+func (s *stream) dts(pts uint64) uint64 {
+	if !s.video {
+		return pts
+	}
+
+	duration := toClock(s.info.DefaultDuration)
+	if duration == 0 {
+		duration = 90000 / 25
+	}
+
+	var dts uint64
+	s.pending = append(s.pending, pts)
+	if s.count < reorderDelay {
+		if s.count == 0 {
+			s.first = pts
+		}
+		delay := uint64(reorderDelay-s.count) * duration
+		if delay < s.first {
+			dts = s.first - delay
+		}
+	} else {
+		min := 0
+		for i, v := range s.pending {
+			if v < s.pending[min] {
+				min = i
+			}
+		}
+		dts = s.pending[min]
+		s.pending = append(s.pending[:min], s.pending[min+1:]...)
+	}
+	s.count++
+
+	// Decode timestamps must increase, and can't be after the
+	// presentation timestamp.
+	if s.count > 1 && dts <= s.lastDTS {
+		dts = s.lastDTS + 1
+	}
+	if dts > pts {
+		dts = pts
+	}
+	s.lastDTS = dts
+
+	return dts
+}
+
+// WritePacket writes a single packet as a PES packet. Packets should be
+// written in the order they are read from the demuxer.
+func (tw *Writer) WritePacket(p *matroska.Packet) error {
+	if int(p.Track) >= len(tw.streams) {
+		return fmt.Errorf("invalid track: %d", p.Track)
+	}
+	s := tw.streams[p.Track]
+	key := p.Flags&matroska.KF != 0
+
+	data, err := s.conv.convert(p.Data, key)
+	if err != nil {
+		return err
+	}
+
+	pts := toClock(p.StartTime) + timestampOffset
+	dts := s.dts(pts)
+
+	if !tw.psiDone || (s == tw.pcr && (key || dts >= tw.lastPSI+psiInterval)) {
+		err = tw.writePSI()
+		if err != nil {
+			return err
+		}
+		tw.lastPSI = dts
+		tw.psiDone = true
+	}
+
+	pcr := int64(-1)
+	if s == tw.pcr {
+		pcr = int64(dts) - pcrDelay
+		if pcr < 0 {
+			pcr = 0
+		}
+	}
+
+	pes := pesHeader(s.streamID, pts, dts, len(data), s.video)
+	return tw.writePES(s, append(pes, data...), pcr, key)
+}
+
+// appendTimestamp appends a PES timestamp with the given 4 bit prefix.
+func appendTimestamp(b []byte, prefix byte, ts uint64) []byte {
+	ts &= 0x1ffffffff
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0e|1,
+		byte(ts>>22),
+		byte(ts>>14)|1,
+		byte(ts>>7),
+		byte(ts<<1)|1)
+}
+
+func pesHeader(streamID byte, pts, dts uint64, size int, video bool) []byte {
+	hdr := []byte{0, 0, 1, streamID, 0, 0, 0x84}
+
+	if dts != pts {
+		hdr = append(hdr, 0xc0, 10)
+		hdr = appendTimestamp(hdr, 3, pts)
+		hdr = appendTimestamp(hdr, 1, dts)
+	} else {
+		hdr = append(hdr, 0x80, 5)
+		hdr = appendTimestamp(hdr, 2, pts)
+	}
+
+	// Video PES packets may be unbounded, and large frames need to be.
+	length := len(hdr) - 6 + size
+	if !video && length <= 0xffff {
+		hdr[4] = byte(length >> 8)
+		hdr[5] = byte(length)
+	}
+
+	return hdr
+}
+
+// writePES splits a PES packet into transport stream packets and writes
+// them. If pcr is not negative, it is written in the first packet.
+func (tw *Writer) writePES(s *stream, pes []byte, pcr int64, key bool) error {
+	out := make([]byte, 0, (len(pes)/(PacketSize-4)+2)*PacketSize)
+
+	first := true
+	for len(pes) > 0 {
+		pkt := make([]byte, 4, PacketSize)
+		pkt[0] = 0x47
+		pkt[1] = byte(s.pid >> 8)
+		pkt[2] = byte(s.pid)
+		if first {
+			pkt[1] |= 0x40
+		}
+
+		var af []byte
+		if first && (pcr >= 0 || key) {
+			flags := byte(0)
+			if key {
+				flags |= 0x40
+			}
+			af = append(af, flags)
+			if pcr >= 0 {
+				af[0] |= 0x10
+				base := uint64(pcr)
+				af = append(af,
+					byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1),
+					byte(base<<7)|0x7e, 0)
+			}
+		}
+
+		room := PacketSize - 4
+		if af != nil {
+			room -= 1 + len(af)
+		}
+		if stuff := room - len(pes); stuff > 0 {
+			// Stuff the last packet via the adaptation field.
+			if af == nil {
+				af = []byte{}
+				stuff--
+				if stuff > 0 {
+					af = append(af, 0)
+					stuff--
+				}
+			}
+			for ; stuff > 0; stuff-- {
+				af = append(af, 0xff)
+			}
+		}
+
+		if af != nil {
+			pkt[3] = 0x30 | s.cc
+			pkt = append(pkt, byte(len(af)))
+			pkt = append(pkt, af...)
+		} else {
+			pkt[3] = 0x10 | s.cc
+		}
+		s.cc = (s.cc + 1) & 0xf
+
+		n := PacketSize - len(pkt)
+		pkt = append(pkt, pes[:n]...)
+		pes = pes[n:]
+
+		out = append(out, pkt...)
+		first = false
+	}
+
+	_, err := tw.w.Write(out)
+	return err
+}
+
+// psiPacket wraps a PSI section in a transport stream packet.
+func psiPacket(pid uint16, cc byte, section []byte) []byte {
+	pkt := []byte{0x47, 0x40 | byte(pid>>8), byte(pid), 0x10 | cc, 0}
+	pkt = append(pkt, section...)
+	for len(pkt) < PacketSize {
+		pkt = append(pkt, 0xff)
+	}
+	return pkt
+}
+
+// finishSection fills in the section length and appends the CRC.
+func finishSection(section []byte) []byte {
+	length := len(section) - 3 + 4
+	section[1] = 0xb0 | byte(length>>8)
+	section[2] = byte(length)
+	crc := crc32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func (tw *Writer) writePSI() error {
+	pat := []byte{0x00, 0, 0, 0, 1, 0xc1, 0, 0, 0, 1, 0xe0 | pidPMT>>8, pidPMT & 0xff}
+	pat = finishSection(pat)
+
+	pmt := []byte{0x02, 0, 0, 0, 1, 0xc1, 0, 0, 0xe0 | byte(tw.pcr.pid>>8), byte(tw.pcr.pid), 0xf0, 0}
+	for _, s := range tw.streams {
+		var desc []byte
+		switch s.streamType {
+		case streamTypeAC3:
+			desc = append(desc, 0x05, 4, 'A', 'C', '-', '3')
+		case streamTypeEAC3:
+			desc = append(desc, 0x05, 4, 'E', 'A', 'C', '3')
+		}
+		lang := strings.TrimRight(s.info.Language, "\x00")
+		if s.info.Type == matroska.TypeAudio && len(lang) == 3 {
+			desc = append(desc, 0x0a, 4, lang[0], lang[1], lang[2], 0)
+		}
+
+		pmt = append(pmt, s.streamType, 0xe0|byte(s.pid>>8), byte(s.pid), 0xf0|byte(len(desc)>>8), byte(len(desc)))
+		pmt = append(pmt, desc...)
+	}
+	pmt = finishSection(pmt)
+	if len(pmt) > PacketSize-5 {
+		return fmt.Errorf("could not fit PMT in a single packet")
+	}
+
+	out := psiPacket(pidPAT, tw.patCC, pat)
+	out = append(out, psiPacket(pidPMT, tw.pmtCC, pmt)...)
+	tw.patCC = (tw.patCC + 1) & 0xf
+	tw.pmtCC = (tw.pmtCC + 1) & 0xf
+
+	_, err := tw.w.Write(out)
+	return err
+}
+
+// crc32 is the MPEG-2 CRC used for PSI sections.
+func crc32(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,140 @@
+package mpegts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/dwbuiten/matroska/internal/testutil"
+)
+
+// The test file has B-frames, and a subtitle track, which cannot be carried
+// in a transport stream.
+var testOptions = testutil.Options{
+	Frames:        50,
+	KeyInterval:   5,
+	BFrames:       true,
+	AudioDuration: 21333333,
+	Subtitle:      true,
+}
+
+func TestCRC32(t *testing.T) {
+	// The check value of CRC-32/MPEG-2.
+	if crc := crc32([]byte("123456789")); crc != 0x0376e6e7 {
+		t.Errorf("got CRC %08x, expected 0376e6e7", crc)
+	}
+}
+
+func TestRemux(t *testing.T) {
+	d, err := matroska.NewDemuxer(bytes.NewReader(testutil.File(t, testOptions)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var out bytes.Buffer
+	err = Remux(d, &out)
+	if err != nil {
+		t.Fatalf("could not remux: %s", err.Error())
+	}
+	if out.Len()%PacketSize != 0 {
+		t.Fatalf("output is %d bytes, not a whole number of packets", out.Len())
+	}
+
+	// Section CRCs are checked by the reader.
+	tr := newTSReader(bytes.NewReader(out.Bytes()))
+	var video, audio []*pes
+	for {
+		p, err := tr.readPES()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("could not read transport stream: %s", err.Error())
+		}
+
+		switch p.PID {
+		case pidFirst:
+			video = append(video, p)
+		case pidFirst + 1:
+			audio = append(audio, p)
+		default:
+			t.Fatalf("unexpected PID 0x%04x", p.PID)
+		}
+	}
+
+	if tr.pmtPID != pidPMT {
+		t.Errorf("got PMT PID 0x%04x, expected 0x%04x", tr.pmtPID, pidPMT)
+	}
+	if len(tr.streams) != 2 || tr.streams[pidFirst] != streamTypeH264 || tr.streams[pidFirst+1] != streamTypeAAC {
+		t.Errorf("got streams %v, expected H.264 on 0x0100 and AAC on 0x0101", tr.streams)
+	}
+	if tr.ccErrors != 0 {
+		t.Errorf("got %d continuity counter errors", tr.ccErrors)
+	}
+
+	if len(video) != testOptions.Frames {
+		t.Fatalf("got %d video PES packets, expected %d", len(video), testOptions.Frames)
+	}
+	lastDTS := int64(-1)
+	for i, p := range video {
+		pts := int64(toClock(testOptions.VideoTime(i))) + timestampOffset
+		if p.PTS != pts {
+			t.Errorf("video %d: got PTS %d, expected %d", i, p.PTS, pts)
+		}
+		if p.DTS > p.PTS || p.DTS <= lastDTS {
+			t.Errorf("video %d: DTS %d is after PTS %d or not after the previous DTS %d", i, p.DTS, p.PTS, lastDTS)
+		}
+		lastDTS = p.DTS
+
+		key := i%testOptions.KeyInterval == 0
+		if p.RandomAccess != key {
+			t.Errorf("video %d: got random access %v", i, p.RandomAccess)
+		}
+
+		want := []byte{0, 0, 0, 1, 0x09, 0xf0}
+		if key {
+			want = append(want, 0, 0, 0, 1)
+			want = append(want, testutil.SPS...)
+			want = append(want, 0, 0, 0, 1)
+			want = append(want, testutil.PPS...)
+			want = append(want, 0, 0, 0, 1, 0x65, 0x88, byte(i))
+		} else {
+			want = append(want, 0, 0, 0, 1, 0x41, 0x9a, byte(i))
+		}
+		if !bytes.Equal(p.Data, want) {
+			t.Errorf("video %d: got %x, expected %x", i, p.Data, want)
+		}
+	}
+
+	if len(audio) != testOptions.AudioFrames() {
+		t.Fatalf("got %d audio PES packets, expected %d", len(audio), testOptions.AudioFrames())
+	}
+	for i, p := range audio {
+		pts := int64(toClock(uint64(i)*testOptions.AudioDuration)) + timestampOffset
+		// The muxer rounds to milliseconds.
+		if diff := p.PTS - pts; diff < -45 || diff > 45 {
+			t.Errorf("audio %d: got PTS %d, expected %d", i, p.PTS, pts)
+		}
+		if p.DTS != p.PTS {
+			t.Errorf("audio %d: got DTS %d, expected it to equal PTS %d", i, p.DTS, p.PTS)
+		}
+		if len(p.Data) != 11 || p.Data[0] != 0xff || p.Data[1]&0xf0 != 0xf0 || p.Data[10] != byte(i) {
+			t.Errorf("audio %d: got %x, expected an ADTS frame", i, p.Data)
+		}
+	}
+
+	// The PCR is carried on the video PID, once per frame, and must not be
+	// ahead of the decode timestamps.
+	if len(tr.pcrs) != testOptions.Frames {
+		t.Fatalf("got %d PCRs, expected %d", len(tr.pcrs), testOptions.Frames)
+	}
+	for i, pcr := range tr.pcrs {
+		if i > 0 && pcr < tr.pcrs[i-1] {
+			t.Errorf("PCR %d: %d goes backwards from %d", i, pcr, tr.pcrs[i-1])
+		}
+		if pcr > video[i].DTS {
+			t.Errorf("PCR %d: %d is ahead of DTS %d", i, pcr, video[i].DTS)
+		}
+	}
+}
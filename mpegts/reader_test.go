@@ -0,0 +1,257 @@
+package mpegts
+
+import (
+	"fmt"
+	"io"
+)
+
+// pes is an elementary stream packet read by a tsReader.
+type pes struct {
+	// The PID the packet was carried on.
+	PID uint16
+	// The stream type from the PMT.
+	StreamType byte
+	// The PES stream ID.
+	StreamID byte
+	// Presentation and decode timestamps in 90 kHz units, or -1 if not
+	// present. DTS is set to PTS if only PTS is present.
+	PTS int64
+	DTS int64
+	// Whether the random access indicator was set.
+	RandomAccess bool
+	// The PES payload.
+	Data []byte
+}
+
+type pesBuffer struct {
+	data         []byte
+	randomAccess bool
+	cc           byte
+	started      bool
+}
+
+// tsReader is a minimal transport stream demuxer for checking the output of
+// Writer. It handles a single program.
+type tsReader struct {
+	r       io.Reader
+	pmtPID  int
+	streams map[uint16]byte
+	bufs    map[uint16]*pesBuffer
+	ready   []*pes
+	eof     bool
+
+	// The number of continuity counter errors seen so far.
+	ccErrors int
+	// The PCRs seen so far, in 90 kHz units.
+	pcrs []int64
+}
+
+func newTSReader(r io.Reader) *tsReader {
+	return &tsReader{
+		r:       r,
+		pmtPID:  -1,
+		streams: make(map[uint16]byte),
+		bufs:    make(map[uint16]*pesBuffer),
+	}
+}
+
+// readPES returns the next complete PES packet, or io.EOF.
+func (tr *tsReader) readPES() (*pes, error) {
+	pkt := make([]byte, PacketSize)
+	for len(tr.ready) == 0 {
+		if tr.eof {
+			return nil, io.EOF
+		}
+
+		_, err := io.ReadFull(tr.r, pkt)
+		if err == io.EOF {
+			// Flush whatever is still buffered.
+			tr.eof = true
+			for pid := range tr.bufs {
+				tr.finish(pid)
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		err = tr.handlePacket(pkt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p := tr.ready[0]
+	tr.ready = tr.ready[1:]
+	return p, nil
+}
+
+func (tr *tsReader) handlePacket(pkt []byte) error {
+	if pkt[0] != 0x47 {
+		return fmt.Errorf("could not find sync byte")
+	}
+
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	afc := (pkt[3] >> 4) & 3
+	cc := pkt[3] & 0xf
+
+	payload := pkt[4:]
+	randomAccess := false
+	if afc&2 != 0 {
+		n := int(payload[0])
+		if n > len(payload)-1 {
+			return fmt.Errorf("could not parse adaptation field")
+		}
+		af := payload[1 : 1+n]
+		if n > 0 {
+			randomAccess = af[0]&0x40 != 0
+			if af[0]&0x10 != 0 && n >= 7 {
+				base := int64(af[1])<<25 | int64(af[2])<<17 | int64(af[3])<<9 | int64(af[4])<<1 | int64(af[5]>>7)
+				tr.pcrs = append(tr.pcrs, base)
+			}
+		}
+		payload = payload[1+n:]
+	}
+	if afc&1 == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == pidPAT:
+		return tr.parsePAT(payload, pusi)
+	case int(pid) == tr.pmtPID:
+		return tr.parsePMT(payload, pusi)
+	}
+
+	if _, ok := tr.streams[pid]; !ok {
+		return nil
+	}
+
+	buf := tr.bufs[pid]
+	if buf == nil {
+		buf = &pesBuffer{}
+		tr.bufs[pid] = buf
+	}
+	if buf.started && cc != (buf.cc+1)&0xf {
+		tr.ccErrors++
+	}
+	buf.cc = cc
+	buf.started = true
+
+	if pusi {
+		tr.finish(pid)
+		buf.randomAccess = randomAccess
+	}
+	buf.data = append(buf.data, payload...)
+
+	return nil
+}
+
+// section returns the PSI section in a payload.
+func section(payload []byte, pusi bool) ([]byte, error) {
+	if !pusi || len(payload) < 1 {
+		return nil, fmt.Errorf("could not parse PSI: multi-packet sections are not supported")
+	}
+	payload = payload[1+int(payload[0]):]
+	if len(payload) < 3 {
+		return nil, fmt.Errorf("could not parse PSI: truncated")
+	}
+	length := int(payload[1]&0xf)<<8 | int(payload[2])
+	if 3+length > len(payload) || length < 9 {
+		return nil, fmt.Errorf("could not parse PSI: truncated")
+	}
+
+	sec := payload[:3+length]
+	crc := uint32(sec[len(sec)-4])<<24 | uint32(sec[len(sec)-3])<<16 | uint32(sec[len(sec)-2])<<8 | uint32(sec[len(sec)-1])
+	if crc32(sec[:len(sec)-4]) != crc {
+		return nil, fmt.Errorf("could not parse PSI: CRC mismatch")
+	}
+
+	// Skip the header, and drop the CRC.
+	return sec[8 : len(sec)-4], nil
+}
+
+func (tr *tsReader) parsePAT(payload []byte, pusi bool) error {
+	sec, err := section(payload, pusi)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+4 <= len(sec); i += 4 {
+		program := int(sec[i])<<8 | int(sec[i+1])
+		if program != 0 {
+			tr.pmtPID = int(sec[i+2]&0x1f)<<8 | int(sec[i+3])
+			break
+		}
+	}
+
+	return nil
+}
+
+func (tr *tsReader) parsePMT(payload []byte, pusi bool) error {
+	sec, err := section(payload, pusi)
+	if err != nil {
+		return err
+	}
+	if len(sec) < 4 {
+		return fmt.Errorf("could not parse PMT: truncated")
+	}
+
+	pos := 4 + (int(sec[2]&0xf)<<8 | int(sec[3]))
+	for pos+5 <= len(sec) {
+		pid := uint16(sec[pos+1]&0x1f)<<8 | uint16(sec[pos+2])
+		tr.streams[pid] = sec[pos]
+		pos += 5 + (int(sec[pos+3]&0xf)<<8 | int(sec[pos+4]))
+	}
+
+	return nil
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&7)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// finish turns the buffered data for a PID into a PES packet, if there is
+// any.
+func (tr *tsReader) finish(pid uint16) {
+	buf := tr.bufs[pid]
+	if buf == nil || len(buf.data) < 9 {
+		return
+	}
+	data := buf.data
+	buf.data = nil
+
+	if data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return
+	}
+
+	p := &pes{
+		PID:          pid,
+		StreamType:   tr.streams[pid],
+		StreamID:     data[3],
+		PTS:          -1,
+		DTS:          -1,
+		RandomAccess: buf.randomAccess,
+	}
+
+	flags := data[7]
+	hdrLen := int(data[8])
+	if 9+hdrLen > len(data) {
+		return
+	}
+	if flags&0x80 != 0 && hdrLen >= 5 {
+		p.PTS = parseTimestamp(data[9:])
+		p.DTS = p.PTS
+	}
+	if flags&0x40 != 0 && hdrLen >= 10 {
+		p.DTS = parseTimestamp(data[14:])
+	}
+
+	p.Data = data[9+hdrLen:]
+	if length := int(data[4])<<8 | int(data[5]); length != 0 && 6+length <= len(data) {
+		p.Data = data[9+hdrLen : 6+length]
+	}
+
+	tr.ready = append(tr.ready, p)
+}
@@ -0,0 +1,264 @@
+// Package mse turns Matroska and WebM input into WebM as accepted by Media
+// Source Extensions in byte stream mode: an init segment, followed by media
+// segments which are each a single cluster starting on a keyframe.
+package mse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Stream produces MSE segments from a Demuxer. Only audio and video tracks
+// are included, as MSE does not support subtitles in WebM, and they must
+// all use codecs allowed in WebM.
+//
+// Media segments start on keyframes of the reference track, which is the
+// first video track if there is one.
+type Stream struct {
+	d        *matroska.Demuxer
+	m        *matroska.Muxer
+	buf      bytes.Buffer
+	init     []byte
+	duration uint64
+
+	mask   uint64
+	index  map[uint8]uint8
+	prefix map[uint8][]byte
+	ref    uint8
+
+	// Timestamps are rewritten relative to base, the first keyframe of
+	// the reference track after the start or a seek. Packets of other
+	// tracks are queued until it is found.
+	base    uint64
+	waiting bool
+	queue   []*matroska.Packet
+
+	pending *matroska.Packet
+	eof     bool
+}
+
+// NewStream creates a Stream for d, with media segments of at least
+// duration nanoseconds. Packets are read from the demuxer's current
+// position, and timestamps are rewritten to start at 0 at the first
+// keyframe.
+func NewStream(d *matroska.Demuxer, duration uint64) (*Stream, error) {
+	s := &Stream{
+		d:        d,
+		duration: duration,
+		mask:     ^uint64(0),
+		index:    make(map[uint8]uint8),
+		prefix:   make(map[uint8][]byte),
+		waiting:  true,
+	}
+	s.m = matroska.NewStreamingMuxer(&s.buf)
+
+	err := s.m.SetDocType("webm")
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := d.GetFileInfo()
+	if err != nil {
+		return nil, err
+	}
+	err = s.m.SetSegmentInfo(&matroska.SegmentInfo{
+		Title:         info.Title,
+		TimecodeScale: info.TimecodeScale,
+		Duration:      info.Duration,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := d.GetNumTracks()
+	if err != nil {
+		return nil, err
+	}
+
+	var tracks []*matroska.TrackInfo
+	var numbers []uint8
+	for i := uint(0); i < count; i++ {
+		ti, err := d.GetTrackInfo(i)
+		if err != nil {
+			return nil, err
+		}
+		if ti.Type != matroska.TypeVideo && ti.Type != matroska.TypeAudio {
+			continue
+		}
+		if !matroska.WebMCodec(ti.CodecID) {
+			return nil, fmt.Errorf("could not use track %d: codec %s is not allowed in WebM", ti.Number, ti.CodecID)
+		}
+
+		// MSE has no support for content encodings, so header stripping
+		// is undone.
+		var prefix []byte
+		if ti.CompEnabled {
+			if ti.CompMethod != matroska.CompPrepend {
+				return nil, fmt.Errorf("could not use track %d: unsupported compression %d", ti.Number, ti.CompMethod)
+			}
+			prefix = ti.CompMethodPrivate
+			ti.CompEnabled = false
+			ti.CompMethodPrivate = nil
+		}
+
+		idx, err := s.m.AddTrack(ti)
+		if err != nil {
+			return nil, err
+		}
+		s.index[uint8(i)] = uint8(idx)
+		s.prefix[uint8(i)] = prefix
+		s.mask &^= uint64(1) << i
+		tracks = append(tracks, ti)
+		numbers = append(numbers, uint8(i))
+	}
+	ref := matroska.ReferenceTrack(tracks)
+	if ref < 0 {
+		return nil, fmt.Errorf("could not find any audio or video tracks")
+	}
+	s.ref = numbers[ref]
+
+	// Clusters are cut by us, at segment boundaries.
+	s.m.SetClusterLimits(^uint64(0), 1<<30)
+
+	err = s.m.WriteHeader()
+	if err != nil {
+		return nil, err
+	}
+	s.init = append([]byte{}, s.buf.Bytes()...)
+	s.buf.Reset()
+
+	return s, nil
+}
+
+// Init returns the init segment: the EBML header, and a Segment of unknown
+// size with its Info and Tracks.
+func (s *Stream) Init() []byte {
+	return s.init
+}
+
+// Seek seeks the demuxer to the keyframe of the reference track at or
+// before timecode. The timestamps of the following media segments are
+// rewritten to start at 0 at that keyframe, and packets of other tracks
+// from before it are dropped.
+//
+// This changes the demuxer's track mask.
+func (s *Stream) Seek(timecode uint64) error {
+	s.pending = nil
+	s.queue = nil
+	s.eof = false
+	s.waiting = true
+
+	_, err := s.d.SeekKeyFrame(s.ref, timecode)
+	s.d.SetTrackMask(s.mask)
+	if err == io.EOF {
+		s.eof = true
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// read returns the next packet, with timestamps rewritten, or nil at EOF.
+func (s *Stream) read() (*matroska.Packet, error) {
+	for {
+		var p *matroska.Packet
+		if !s.waiting && len(s.queue) != 0 {
+			p = s.queue[0]
+			s.queue = s.queue[1:]
+		} else {
+			var err error
+			p, err = s.d.ReadPacketMask(s.mask)
+			if err == io.EOF {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if s.waiting {
+			if p.Track != s.ref || p.Flags&matroska.KF == 0 {
+				// Packets of other tracks can come before the keyframe
+				// in the file, and still be after it in time.
+				if p.Track != s.ref {
+					s.queue = append(s.queue, p)
+				}
+				continue
+			}
+			s.base = p.StartTime
+			s.waiting = false
+			s.queue = append([]*matroska.Packet{p}, s.queue...)
+			continue
+		}
+		if p.StartTime < s.base {
+			continue
+		}
+
+		if prefix := s.prefix[p.Track]; len(prefix) != 0 {
+			p.Data = append(append([]byte{}, prefix...), p.Data...)
+		}
+
+		p.StartTime -= s.base
+		if p.EndTime >= s.base {
+			p.EndTime -= s.base
+		} else {
+			p.EndTime = p.StartTime
+		}
+
+		return p, nil
+	}
+}
+
+// Next returns the next media segment, or io.EOF once there are no more
+// packets.
+func (s *Stream) Next() ([]byte, error) {
+	var start uint64
+	started := false
+
+	for {
+		p := s.pending
+		s.pending = nil
+		if p == nil && !s.eof {
+			var err error
+			p, err = s.read()
+			if err != nil {
+				return nil, err
+			}
+			s.eof = p == nil
+		}
+		if p == nil {
+			break
+		}
+
+		if started && p.Track == s.ref && p.Flags&matroska.KF != 0 && p.StartTime >= start+s.duration {
+			s.pending = p
+			break
+		}
+		if !started {
+			start = p.StartTime
+			started = true
+		}
+
+		p.Track = s.index[p.Track]
+		err := s.m.WritePacket(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !started {
+		return nil, io.EOF
+	}
+
+	err := s.m.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := append([]byte{}, s.buf.Bytes()...)
+	s.buf.Reset()
+
+	return ret, nil
+}
@@ -0,0 +1,1233 @@
+package matroska
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The MuxingApp written to files made by Muxer.
+const muxingApp = "github.com/dwbuiten/matroska"
+
+// Default cluster limits. See SetClusterLimits.
+const (
+	defaultMaxClusterDuration = 5000000000
+	defaultMaxClusterSize     = 5 * 1024 * 1024
+)
+
+// Space reserved after the segment header for the SeekHead, which can only
+// be written once we know where everything is.
+const seekHeadReserved = 200
+
+// Matroska's epoch for DateUTC.
+var matroskaEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type muxTrack struct {
+	info   TrackInfo
+	number uint64
+
+	// Timecode of the last block written for this track, used
+	// for ReferenceBlock.
+	lastTC  int64
+	hasLast bool
+}
+
+type muxAttachment struct {
+	info Attachment
+	data []byte
+}
+
+type muxCue struct {
+	time     uint64
+	duration uint64
+	track    uint64
+	cluster  int64
+	rel      uint64
+}
+
+// Muxer is a Matroska muxer.
+//
+// Tracks, attachments, chapters, tags and segment info should be set
+// before the first packet is written. Chapters, tags and attachments set
+// after that are written at the end of the file instead.
+type Muxer struct {
+	w  io.Writer
+	ws io.WriteSeeker
+
+	// Number of bytes written so far.
+	pos int64
+
+	docType string
+	info    SegmentInfo
+	scale   uint64
+
+	tracks      []*muxTrack
+	hasVideo    bool
+	attachments []muxAttachment
+	chapters    []*Chapter
+	tags        []*Tag
+
+	lateAttachments bool
+	lateChapters    bool
+	lateTags        bool
+
+	headerWritten bool
+	closed        bool
+
+	// Positions of things that get patched on Close, or referenced by
+	// the SeekHead. Element positions are relative to segData, the
+	// first byte of the segment's payload.
+	segSizePos  int64
+	segData     int64
+	durationPos int64
+	nextUIDPos  int64
+	seekEntries map[uint32]int64
+
+	maxClusterDuration uint64
+	maxClusterSize     int
+
+	cluster      []byte
+	clusterOpen  bool
+	clusterTC    int64
+	clusterStart uint64
+	pendingCues  []muxCue
+	cues         []muxCue
+
+	duration uint64
+}
+
+func newMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w:                  w,
+		docType:            "matroska",
+		scale:              1000000,
+		seekEntries:        make(map[uint32]int64),
+		maxClusterDuration: defaultMaxClusterDuration,
+		maxClusterSize:     defaultMaxClusterSize,
+	}
+}
+
+// NewMuxer creates a new Matroska muxer writing to w. The output is
+// finalized (sizes, duration, SeekHead and Cues) when Close is called.
+func NewMuxer(w io.WriteSeeker) (*Muxer, error) {
+	pos, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("could not get output position: %s", err.Error())
+	}
+
+	ret := newMuxer(w)
+	ret.ws = w
+	ret.pos = pos
+
+	return ret, nil
+}
+
+// NewStreamingMuxer creates a new Matroska muxer writing to an io.Writer
+// that has no ability to seek. The segment is written with an unknown size,
+// and no SeekHead or Cues are written.
+func NewStreamingMuxer(w io.Writer) *Muxer {
+	return newMuxer(w)
+}
+
+// SetDocType sets the EBML DocType of the output, which may be either
+// "matroska" (the default) or "webm".
+func (m *Muxer) SetDocType(docType string) error {
+	if m.headerWritten {
+		return fmt.Errorf("header already written")
+	}
+	if docType != "matroska" && docType != "webm" {
+		return fmt.Errorf("invalid doctype: %s", docType)
+	}
+	m.docType = docType
+	return nil
+}
+
+// webmCodecs are the codecs allowed in WebM.
+var webmCodecs = map[string]bool{
+	"V_VP8":                 true,
+	"V_VP9":                 true,
+	"V_AV1":                 true,
+	"A_OPUS":                true,
+	"A_VORBIS":              true,
+	"D_WEBVTT/SUBTITLES":    true,
+	"D_WEBVTT/CAPTIONS":     true,
+	"D_WEBVTT/DESCRIPTIONS": true,
+	"D_WEBVTT/METADATA":     true,
+}
+
+// WebMCodec returns whether a codec ID is allowed in WebM.
+func WebMCodec(codecID string) bool {
+	return webmCodecs[codecID]
+}
+
+// SetClusterLimits sets the maximum duration (in nanoseconds) and size (in
+// bytes) of a cluster. New clusters are started on video keyframes once
+// the duration is exceeded, or on any packet if the size is exceeded.
+func (m *Muxer) SetClusterLimits(maxDuration uint64, maxSize int) {
+	m.maxClusterDuration = maxDuration
+	m.maxClusterSize = maxSize
+}
+
+// SetSegmentInfo sets the file-level information written to the output.
+// If UID is all zeroes, a random one is generated. Duration is only used
+// if the muxer cannot compute it itself, i.e. for streaming output.
+func (m *Muxer) SetSegmentInfo(info *SegmentInfo) error {
+	if m.headerWritten {
+		return fmt.Errorf("header already written")
+	}
+	m.info = *info
+	if info.TimecodeScale != 0 {
+		m.scale = info.TimecodeScale
+	}
+	return nil
+}
+
+// SetNextUID changes the NextUID of the segment info, for when it is not
+// known whether there will be a next segment until the end of this one.
+// After the header has been written, it can only be changed if the output
+// is seekable and the segment info had a NextUID. A zero uid removes it.
+func (m *Muxer) SetNextUID(uid [16]byte) error {
+	if m.closed {
+		return fmt.Errorf("muxer is closed")
+	}
+	if m.headerWritten && (m.ws == nil || m.nextUIDPos == 0) {
+		return fmt.Errorf("could not set NextUID after the header has been written")
+	}
+	m.info.NextUID = uid
+	return nil
+}
+
+// AddTrack adds a track to the output, and returns its index, which must
+// be used as the Track member of packets for this track. The track's
+// Number is assigned by the muxer. If UID is 0, a random one is generated.
+func (m *Muxer) AddTrack(ti *TrackInfo) (uint, error) {
+	if m.headerWritten {
+		return 0, fmt.Errorf("header already written")
+	}
+	if len(m.tracks) >= 64 {
+		return 0, fmt.Errorf("too many tracks")
+	}
+	if ti.CodecID == "" {
+		return 0, fmt.Errorf("track has no CodecID")
+	}
+	if ti.Type == 0 {
+		return 0, fmt.Errorf("track has no type")
+	}
+
+	t := &muxTrack{
+		info:   *ti,
+		number: uint64(len(m.tracks) + 1),
+	}
+	if t.info.UID == 0 {
+		t.info.UID = randomUID()
+	}
+	if t.info.Type == TypeVideo {
+		m.hasVideo = true
+	}
+
+	m.tracks = append(m.tracks, t)
+
+	return uint(len(m.tracks) - 1), nil
+}
+
+// AddAttachment adds an attachment with the given data to the output. The
+// Position and Length members of a are ignored. If UID is 0, a random one is
+// generated.
+func (m *Muxer) AddAttachment(a *Attachment, data []byte) error {
+	if m.closed {
+		return fmt.Errorf("muxer is closed")
+	}
+
+	at := muxAttachment{
+		info: *a,
+		data: data,
+	}
+	if at.info.UID == 0 {
+		at.info.UID = randomUID()
+	}
+
+	m.attachments = append(m.attachments, at)
+	if m.headerWritten {
+		m.lateAttachments = true
+	}
+
+	return nil
+}
+
+// SetChapters sets the chapters written to the output. Top-level chapters
+// are written as editions, the same way GetChapters returns them.
+func (m *Muxer) SetChapters(chapters []*Chapter) error {
+	if m.closed {
+		return fmt.Errorf("muxer is closed")
+	}
+	m.chapters = chapters
+	if m.headerWritten {
+		m.lateChapters = true
+	}
+	return nil
+}
+
+// SetTags sets the tags written to the output.
+func (m *Muxer) SetTags(tags []*Tag) error {
+	if m.closed {
+		return fmt.Errorf("muxer is closed")
+	}
+	m.tags = tags
+	if m.headerWritten {
+		m.lateTags = true
+	}
+	return nil
+}
+
+func randomUID() uint64 {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic("could not read random data: " + err.Error())
+	}
+	ret := binary.BigEndian.Uint64(b[:])
+	if ret == 0 {
+		ret = 1
+	}
+	return ret
+}
+
+func (m *Muxer) write(b []byte) error {
+	n, err := m.w.Write(b)
+	m.pos += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write output: %s", err.Error())
+	}
+	return nil
+}
+
+func (m *Muxer) writeAt(pos int64, b []byte) error {
+	_, err := m.ws.Seek(pos, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not seek output: %s", err.Error())
+	}
+	_, err = m.ws.Write(b)
+	if err != nil {
+		return fmt.Errorf("could not write output: %s", err.Error())
+	}
+	_, err = m.ws.Seek(m.pos, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not seek output: %s", err.Error())
+	}
+	return nil
+}
+
+func (m *Muxer) webm() bool {
+	return m.docType == "webm"
+}
+
+func (m *Muxer) ebmlHeader() []byte {
+	var body []byte
+	body = appendUint(body, idEBMLVersion, 1)
+	body = appendUint(body, idEBMLReadVersion, 1)
+	body = appendUint(body, idEBMLMaxIDLength, 4)
+	body = appendUint(body, idEBMLMaxSizeLength, 8)
+	body = appendString(body, idDocType, m.docType)
+	body = appendUint(body, idDocTypeVersion, 4)
+	body = appendUint(body, idDocTypeReadVersion, 2)
+
+	return appendElement(nil, idEBML, body)
+}
+
+func isZeroUID(uid [16]byte) bool {
+	for _, b := range uid {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Muxer) infoElement() ([]byte, int, int) {
+	var body []byte
+	nextUIDOff := -1
+
+	if !m.webm() {
+		if isZeroUID(m.info.UID) {
+			var uid [16]byte
+			_, err := rand.Read(uid[:])
+			if err != nil {
+				panic("could not read random data: " + err.Error())
+			}
+			m.info.UID = uid
+		}
+		body = appendElement(body, idSegmentUID, m.info.UID[:])
+		if m.info.Filename != "" {
+			body = appendString(body, idSegmentFile, m.info.Filename)
+		}
+		if !isZeroUID(m.info.PrevUID) {
+			body = appendElement(body, idPrevUID, m.info.PrevUID[:])
+		}
+		if m.info.PrevFilename != "" {
+			body = appendString(body, idPrevFilename, m.info.PrevFilename)
+		}
+		if !isZeroUID(m.info.NextUID) {
+			nextUIDOff = len(body)
+			body = appendElement(body, idNextUID, m.info.NextUID[:])
+		}
+		if m.info.NextFilename != "" {
+			body = appendString(body, idNextFilename, m.info.NextFilename)
+		}
+	}
+
+	body = appendUint(body, idTimecodeScale, m.scale)
+
+	// Always write a Duration if we can patch it later.
+	durationOff := -1
+	if m.ws != nil || m.info.Duration != 0 {
+		durationOff = len(body) + 3
+		body = appendFloat(body, idDuration, float64(m.info.Duration)/float64(m.scale))
+	}
+
+	if m.info.DateUTCValid {
+		body = appendInt(body, idDateUTC, m.info.DateUTC)
+	}
+	if m.info.Title != "" {
+		body = appendString(body, idTitle, m.info.Title)
+	}
+
+	body = appendString(body, idMuxingApp, muxingApp)
+	writingApp := m.info.WritingApp
+	if writingApp == "" {
+		writingApp = muxingApp
+	}
+	body = appendString(body, idWritingApp, writingApp)
+
+	ret := appendElement(nil, idInfo, body)
+	if durationOff >= 0 {
+		durationOff += len(ret) - len(body)
+	}
+	if nextUIDOff >= 0 {
+		nextUIDOff += len(ret) - len(body)
+	}
+
+	return ret, durationOff, nextUIDOff
+}
+
+func trimLanguage(lang string) string {
+	return strings.TrimRight(lang, "\x00 ")
+}
+
+func (m *Muxer) trackEntry(t *muxTrack) []byte {
+	ti := &t.info
+
+	var body []byte
+	body = appendUint(body, idTrackNumber, t.number)
+	body = appendUint(body, idTrackUID, ti.UID)
+	body = appendUint(body, idTrackType, uint64(ti.Type))
+	body = appendBool(body, idFlagEnabled, ti.Enabled)
+	body = appendBool(body, idFlagDefault, ti.Default)
+	if ti.Forced {
+		body = appendBool(body, idFlagForced, true)
+	}
+	body = appendBool(body, idFlagLacing, ti.Lacing)
+	if ti.MinCache != 0 {
+		body = appendUint(body, idMinCache, ti.MinCache)
+	}
+	if ti.MaxCache != 0 {
+		body = appendUint(body, idMaxCache, ti.MaxCache)
+	}
+	if ti.DefaultDuration != 0 {
+		body = appendUint(body, idDefaultDuration, ti.DefaultDuration)
+	}
+	if !m.webm() && ti.TimecodeScale != 0 && ti.TimecodeScale != 1 {
+		body = appendFloat(body, idTrackTimecodeScale, ti.TimecodeScale)
+	}
+	if ti.MaxBlockAdditionID != 0 {
+		body = appendUint(body, idMaxBlockAdditionID, uint64(ti.MaxBlockAdditionID))
+	}
+	if ti.Name != "" {
+		body = appendString(body, idName, ti.Name)
+	}
+	if lang := trimLanguage(ti.Language); lang != "" {
+		body = appendString(body, idLanguage, lang)
+	}
+	body = appendString(body, idCodecID, ti.CodecID)
+	if len(ti.CodecPrivate) != 0 {
+		body = appendElement(body, idCodecPrivate, ti.CodecPrivate)
+	}
+	if !m.webm() && !ti.DecodeAll {
+		body = appendBool(body, idCodecDecodeAll, false)
+	}
+	if !m.webm() && ti.TrackOverlay != 0 {
+		body = appendUint(body, idTrackOverlay, uint64(ti.TrackOverlay))
+	}
+	if ti.CodecDelay != 0 {
+		body = appendUint(body, idCodecDelay, ti.CodecDelay)
+	}
+	if ti.SeekPreRoll != 0 {
+		body = appendUint(body, idSeekPreRoll, ti.SeekPreRoll)
+	}
+
+	switch ti.Type {
+	case TypeVideo:
+		body = appendElement(body, idVideo, videoElement(ti))
+	case TypeAudio:
+		body = appendElement(body, idAudio, audioElement(ti))
+	}
+
+	if ti.CompEnabled {
+		var comp []byte
+		comp = appendUint(comp, idContentCompAlgo, uint64(ti.CompMethod))
+		if len(ti.CompMethodPrivate) != 0 {
+			comp = appendElement(comp, idContentCompSettings, ti.CompMethodPrivate)
+		}
+
+		var enc []byte
+		enc = appendUint(enc, idContentEncodingOrder, 0)
+		enc = appendUint(enc, idContentEncodingScope, 1)
+		enc = appendUint(enc, idContentEncodingType, 0)
+		enc = appendElement(enc, idContentCompression, comp)
+
+		body = appendElement(body, idContentEncodings, appendElement(nil, idContentEncoding, enc))
+	}
+
+	return appendElement(nil, idTrackEntry, body)
+}
+
+func videoElement(ti *TrackInfo) []byte {
+	v := &ti.Video
+
+	var body []byte
+	if v.Interlaced {
+		body = appendUint(body, idFlagInterlaced, 1)
+	}
+	if v.StereoMode != 0 {
+		body = appendUint(body, idStereoMode, uint64(v.StereoMode))
+	}
+	body = appendUint(body, idPixelWidth, uint64(v.PixelWidth))
+	body = appendUint(body, idPixelHeight, uint64(v.PixelHeight))
+	if v.CropB != 0 {
+		body = appendUint(body, idPixelCropBottom, uint64(v.CropB))
+	}
+	if v.CropT != 0 {
+		body = appendUint(body, idPixelCropTop, uint64(v.CropT))
+	}
+	if v.CropL != 0 {
+		body = appendUint(body, idPixelCropLeft, uint64(v.CropL))
+	}
+	if v.CropR != 0 {
+		body = appendUint(body, idPixelCropRight, uint64(v.CropR))
+	}
+	if v.DisplayUnit != 0 || (v.DisplayWidth != 0 && v.DisplayWidth != v.PixelWidth) ||
+		(v.DisplayHeight != 0 && v.DisplayHeight != v.PixelHeight) {
+		body = appendUint(body, idDisplayWidth, uint64(v.DisplayWidth))
+		body = appendUint(body, idDisplayHeight, uint64(v.DisplayHeight))
+	}
+	if v.DisplayUnit != 0 {
+		body = appendUint(body, idDisplayUnit, uint64(v.DisplayUnit))
+	}
+	if v.AspectRatioType != 0 {
+		body = appendUint(body, idAspectRatioType, uint64(v.AspectRatioType))
+	}
+	if v.ColourSpace != 0 {
+		var cs [4]byte
+		binary.BigEndian.PutUint32(cs[:], v.ColourSpace)
+		body = appendElement(body, idColourSpace, cs[:])
+	}
+	if v.GammaValue != 0 {
+		body = appendFloat(body, idGammaValue, v.GammaValue)
+	}
+
+	c := &v.Colour
+	var colour []byte
+	// 2 is "unspecified", which is also what the parser defaults to.
+	if c.MatrixCoefficients != 2 && c.MatrixCoefficients != 0 {
+		colour = appendUint(colour, idMatrixCoefficients, uint64(c.MatrixCoefficients))
+	}
+	fields := []struct {
+		id uint32
+		v  uint32
+	}{
+		{idBitsPerChannel, c.BitsPerChannel},
+		{idChromaSubsamplingHorz, c.ChromaSubsamplingHorz},
+		{idChromaSubsamplingVert, c.ChromaSubsamplingVert},
+		{idCbSubsamplingHorz, c.CbSubsamplingHorz},
+		{idCbSubsamplingVert, c.CbSubsamplingVert},
+		{idChromaSitingHorz, c.ChromaSitingHorz},
+		{idChromaSitingVert, c.ChromaSitingVert},
+		{idRange, c.Range},
+	}
+	for _, f := range fields {
+		if f.v != 0 {
+			colour = appendUint(colour, f.id, uint64(f.v))
+		}
+	}
+	if c.TransferCharacteristics != 2 && c.TransferCharacteristics != 0 {
+		colour = appendUint(colour, idTransferCharacteristics, uint64(c.TransferCharacteristics))
+	}
+	if c.Primaries != 2 && c.Primaries != 0 {
+		colour = appendUint(colour, idPrimaries, uint64(c.Primaries))
+	}
+	if c.MaxCLL != 0 {
+		colour = appendUint(colour, idMaxCLL, uint64(c.MaxCLL))
+	}
+	if c.MaxFALL != 0 {
+		colour = appendUint(colour, idMaxFALL, uint64(c.MaxFALL))
+	}
+
+	mm := &c.MasteringMetadata
+	mfields := []struct {
+		id uint32
+		v  float32
+	}{
+		{idPrimaryRChromaticityX, mm.PrimaryRChromaticityX},
+		{idPrimaryRChromaticityY, mm.PrimaryRChromaticityY},
+		{idPrimaryGChromaticityX, mm.PrimaryGChromaticityX},
+		{idPrimaryGChromaticityY, mm.PrimaryGChromaticityY},
+		{idPrimaryBChromaticityX, mm.PrimaryBChromaticityX},
+		{idPrimaryBChromaticityY, mm.PrimaryBChromaticityY},
+		{idWhitePointChromaticityX, mm.WhitePointChromaticityX},
+		{idWhitePointChromaticityY, mm.WhitePointChromaticityY},
+		{idLuminanceMax, mm.LuminanceMax},
+		{idLuminanceMin, mm.LuminanceMin},
+	}
+	var mastering []byte
+	for _, f := range mfields {
+		if f.v != 0 {
+			mastering = appendFloat32(mastering, f.id, f.v)
+		}
+	}
+	if len(mastering) != 0 {
+		colour = appendElement(colour, idMasteringMetadata, mastering)
+	}
+
+	if len(colour) != 0 {
+		body = appendElement(body, idColour, colour)
+	}
+
+	return body
+}
+
+func audioElement(ti *TrackInfo) []byte {
+	a := &ti.Audio
+
+	var body []byte
+	freq := a.SamplingFreq
+	if freq == 0 {
+		freq = 8000
+	}
+	body = appendFloat(body, idSamplingFrequency, freq)
+	if a.OutputSamplingFreq != 0 && a.OutputSamplingFreq != freq {
+		body = appendFloat(body, idOutputSamplingFrequency, a.OutputSamplingFreq)
+	}
+	channels := a.Channels
+	if channels == 0 {
+		channels = 1
+	}
+	body = appendUint(body, idChannels, uint64(channels))
+	if a.BitDepth != 0 {
+		body = appendUint(body, idBitDepth, uint64(a.BitDepth))
+	}
+
+	return body
+}
+
+func (m *Muxer) tracksElement() []byte {
+	var body []byte
+	for _, t := range m.tracks {
+		body = append(body, m.trackEntry(t)...)
+	}
+	return appendElement(nil, idTracks, body)
+}
+
+func attachedFile(a muxAttachment) []byte {
+	var file []byte
+	if a.info.Description != "" {
+		file = appendString(file, idFileDescription, a.info.Description)
+	}
+	file = appendString(file, idFileName, a.info.Name)
+	file = appendString(file, idFileMimeType, a.info.MimeType)
+	file = appendElement(file, idFileData, a.data)
+	file = appendUint(file, idFileUID, a.info.UID)
+	return appendElement(nil, idAttachedFile, file)
+}
+
+func (m *Muxer) attachmentsElement() []byte {
+	var body []byte
+	for _, a := range m.attachments {
+		body = append(body, attachedFile(a)...)
+	}
+	return appendElement(nil, idAttachments, body)
+}
+
+func chapterAtom(ch *Chapter) []byte {
+	var body []byte
+
+	uid := ch.UID
+	if uid == 0 {
+		uid = randomUID()
+	}
+	body = appendUint(body, idChapterUID, uid)
+	if !isZeroUID(ch.SegmentUID) {
+		body = appendElement(body, idChapterSegmentUID, ch.SegmentUID[:])
+	}
+	body = appendUint(body, idChapterTimeStart, ch.Start)
+	if ch.End != 0 {
+		body = appendUint(body, idChapterTimeEnd, ch.End)
+	}
+	if ch.Hidden {
+		body = appendBool(body, idChapterFlagHidden, true)
+	}
+	if !ch.Enabled {
+		body = appendBool(body, idChapterFlagEnabled, false)
+	}
+
+	if len(ch.Tracks) != 0 {
+		var tracks []byte
+		for _, t := range ch.Tracks {
+			tracks = appendUint(tracks, idChapterTrackNumber, t)
+		}
+		body = appendElement(body, idChapterTrack, tracks)
+	}
+
+	for _, d := range ch.Display {
+		var disp []byte
+		disp = appendString(disp, idChapString, d.String)
+		lang := trimLanguage(d.Language)
+		if lang == "" {
+			lang = "eng"
+		}
+		disp = appendString(disp, idChapLanguage, lang)
+		if country := trimLanguage(d.Country); country != "" {
+			disp = appendString(disp, idChapCountry, country)
+		}
+		body = appendElement(body, idChapterDisplay, disp)
+	}
+
+	for _, p := range ch.Process {
+		var proc []byte
+		proc = appendUint(proc, idChapProcessCodecID, uint64(p.CodecID))
+		if len(p.CodecPrivate) != 0 {
+			proc = appendElement(proc, idChapProcessPrivate, p.CodecPrivate)
+		}
+		for _, c := range p.Commands {
+			var cmd []byte
+			cmd = appendUint(cmd, idChapProcessTime, uint64(c.Time))
+			cmd = appendElement(cmd, idChapProcessData, c.Command)
+			proc = appendElement(proc, idChapProcessCommand, cmd)
+		}
+		body = appendElement(body, idChapProcess, proc)
+	}
+
+	for _, child := range ch.Children {
+		body = append(body, chapterAtom(child)...)
+	}
+
+	return appendElement(nil, idChapterAtom, body)
+}
+
+func chaptersElement(chapters []*Chapter) []byte {
+	var body []byte
+	for _, ed := range chapters {
+		var edition []byte
+		if ed.UID != 0 {
+			edition = appendUint(edition, idEditionUID, ed.UID)
+		}
+		edition = appendBool(edition, idEditionFlagHidden, ed.Hidden)
+		edition = appendBool(edition, idEditionFlagDefault, ed.Default)
+		if ed.Ordered {
+			edition = appendBool(edition, idEditionFlagOrdered, true)
+		}
+		for _, ch := range ed.Children {
+			edition = append(edition, chapterAtom(ch)...)
+		}
+		body = appendElement(body, idEditionEntry, edition)
+	}
+	return appendElement(nil, idChapters, body)
+}
+
+func tagsElement(tags []*Tag) []byte {
+	var body []byte
+	for _, t := range tags {
+		var targets []byte
+		if t.TargetTypeValue != 0 {
+			targets = appendUint(targets, idTargetTypeValue, t.TargetTypeValue)
+		}
+		if t.TargetType != "" {
+			targets = appendString(targets, idTargetType, t.TargetType)
+		}
+		for _, tg := range t.Targets {
+			switch tg.Type {
+			case TargetTrack:
+				targets = appendUint(targets, idTagTrackUID, tg.UID)
+			case TargetChapter:
+				targets = appendUint(targets, idTagChapterUID, tg.UID)
+			case TargetAttachment:
+				targets = appendUint(targets, idTagAttachmentUID, tg.UID)
+			case TargetEdition:
+				targets = appendUint(targets, idTagEditionUID, tg.UID)
+			}
+		}
+
+		var tag []byte
+		tag = appendElement(tag, idTargets, targets)
+		for _, st := range t.SimpleTags {
+			tag = append(tag, simpleTag(st)...)
+		}
+		body = appendElement(body, idTag, tag)
+	}
+	return appendElement(nil, idTags, body)
+}
+
+func simpleTag(st SimpleTag) []byte {
+	var simple []byte
+	simple = appendString(simple, idTagName, st.Name)
+	lang := trimLanguage(st.Language)
+	if lang == "" {
+		lang = "und"
+	}
+	simple = appendString(simple, idTagLanguage, lang)
+	if st.LanguageBCP47 != "" {
+		simple = appendString(simple, idTagLanguageBCP47, st.LanguageBCP47)
+	}
+	simple = appendBool(simple, idTagDefault, st.Default)
+	if st.Binary != nil {
+		simple = appendElement(simple, idTagBinary, st.Binary)
+	} else {
+		simple = appendString(simple, idTagString, st.Value)
+	}
+	for _, child := range st.Children {
+		simple = append(simple, simpleTag(child)...)
+	}
+	return appendElement(nil, idSimpleTag, simple)
+}
+
+// writeElement writes a top-level element and records its position for
+// the SeekHead.
+func (m *Muxer) writeElement(id uint32, b []byte) error {
+	m.seekEntries[id] = m.pos - m.segData
+	return m.write(b)
+}
+
+// WriteHeader writes everything up to the first cluster. It is called
+// automatically by the first call to WritePacket or Close, and only needs
+// to be called directly if the header is needed on its own, for example
+// to produce an initialization segment.
+func (m *Muxer) WriteHeader() error {
+	if m.headerWritten {
+		return nil
+	}
+	if m.closed {
+		return fmt.Errorf("muxer is closed")
+	}
+	if len(m.tracks) == 0 {
+		return fmt.Errorf("no tracks added")
+	}
+
+	m.headerWritten = true
+
+	err := m.write(m.ebmlHeader())
+	if err != nil {
+		return err
+	}
+
+	seg := appendID(nil, idSegment)
+	m.segSizePos = m.pos + int64(len(seg))
+	seg = appendUnknownSize(seg)
+	err = m.write(seg)
+	if err != nil {
+		return err
+	}
+	m.segData = m.pos
+
+	if m.ws != nil {
+		err = m.write(appendVoid(nil, seekHeadReserved))
+		if err != nil {
+			return err
+		}
+	}
+
+	info, durationOff, nextUIDOff := m.infoElement()
+	if durationOff >= 0 {
+		m.durationPos = m.pos + int64(durationOff)
+	}
+	if nextUIDOff >= 0 {
+		m.nextUIDPos = m.pos + int64(nextUIDOff)
+	}
+	err = m.writeElement(idInfo, info)
+	if err != nil {
+		return err
+	}
+
+	err = m.writeElement(idTracks, m.tracksElement())
+	if err != nil {
+		return err
+	}
+
+	if len(m.attachments) != 0 && !m.webm() {
+		err = m.writeElement(idAttachments, m.attachmentsElement())
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(m.chapters) != 0 {
+		err = m.writeElement(idChapters, chaptersElement(m.chapters))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(m.tags) != 0 {
+		err = m.writeElement(idTags, tagsElement(m.tags))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Muxer) toTimecode(ns uint64) int64 {
+	return int64((ns + m.scale/2) / m.scale)
+}
+
+// startsCluster returns whether or not a packet is a suitable place to start
+// a new cluster when the duration limit has been reached.
+func (m *Muxer) startsCluster(t *muxTrack, p *Packet) bool {
+	if p.Flags&KF == 0 {
+		return false
+	}
+	return !m.hasVideo || t.info.Type == TypeVideo
+}
+
+// wantsCue returns whether a cue point should be written for a packet.
+func (m *Muxer) wantsCue(t *muxTrack, p *Packet, newCluster bool) bool {
+	if p.Flags&KF == 0 {
+		return false
+	}
+	switch t.info.Type {
+	case TypeVideo, TypeSubtitle:
+		return true
+	}
+	return !m.hasVideo && newCluster
+}
+
+// WritePacket writes a packet to the output. Packets should be written in
+// increasing StartTime order across all tracks. The Track member is the
+// index returned by AddTrack.
+//
+// Keyframes are signalled by the KF flag. The packet's duration is written
+// if EndTime is known (UnknownEnd is not set), larger than StartTime, and
+// differs from the track's DefaultDuration.
+//
+// The packet's References and Additions are written as ReferenceBlocks
+// and BlockAdditions. Addition IDs should not be above the track's
+// MaxBlockAdditionID. Packets which need a BlockGroup and are neither
+// keyframes nor have References get a ReferenceBlock pointing at the
+// previous block of their track.
+func (m *Muxer) WritePacket(p *Packet) error {
+	if m.closed {
+		return fmt.Errorf("muxer is closed")
+	}
+	if int(p.Track) >= len(m.tracks) {
+		return fmt.Errorf("invalid track: %d", p.Track)
+	}
+
+	err := m.WriteHeader()
+	if err != nil {
+		return err
+	}
+
+	t := m.tracks[p.Track]
+	tc := m.toTimecode(p.StartTime)
+
+	if m.clusterOpen {
+		rel := tc - m.clusterTC
+		if rel > 32767 || rel < -32768 || len(m.cluster) >= m.maxClusterSize ||
+			(p.StartTime >= m.clusterStart+m.maxClusterDuration && m.startsCluster(t, p)) {
+			err = m.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	newCluster := false
+	if !m.clusterOpen {
+		m.clusterOpen = true
+		m.clusterTC = tc
+		m.clusterStart = p.StartTime
+		m.cluster = appendUint(m.cluster[:0], idTimecode, uint64(tc))
+		newCluster = true
+	}
+
+	if m.wantsCue(t, p, newCluster) {
+		cue := muxCue{
+			time:  uint64(tc),
+			track: t.number,
+			rel:   uint64(len(m.cluster)),
+		}
+		// Demuxers use the duration of subtitle cues to find subtitles
+		// which are still on screen after seeking.
+		if t.info.Type == TypeSubtitle && p.Flags&UnknownEnd == 0 && p.EndTime > p.StartTime {
+			cue.duration = uint64(m.toTimecode(p.EndTime) - tc)
+		}
+		m.pendingCues = append(m.pendingCues, cue)
+	}
+
+	m.cluster = m.appendBlock(m.cluster, t, p, tc)
+
+	t.lastTC = tc
+	t.hasLast = true
+
+	end := p.StartTime
+	if p.Flags&UnknownEnd == 0 && p.EndTime > p.StartTime {
+		end = p.EndTime
+	} else {
+		end += t.info.DefaultDuration
+	}
+	if end > m.duration {
+		m.duration = end
+	}
+
+	return nil
+}
+
+// isDefaultDuration returns whether a duration is the track's default
+// duration, at the precision of the timecode scale. Durations derived from
+// sample counts are rarely exact.
+func (m *Muxer) isDefaultDuration(t *muxTrack, duration uint64) bool {
+	def := t.info.DefaultDuration
+	if duration > def {
+		return duration-def < m.scale/2
+	}
+	return def-duration < m.scale/2
+}
+
+func (m *Muxer) appendBlock(b []byte, t *muxTrack, p *Packet, tc int64) []byte {
+	rel := tc - m.clusterTC
+
+	var hdr []byte
+	hdr = appendSize(hdr, t.number)
+	hdr = append(hdr, byte(uint16(rel)>>8), byte(uint16(rel)))
+
+	var duration uint64
+	hasDuration := false
+	if p.Flags&UnknownEnd == 0 && p.EndTime > p.StartTime && !m.isDefaultDuration(t, p.EndTime-p.StartTime) {
+		duration = uint64(m.toTimecode(p.EndTime) - tc)
+		hasDuration = true
+	}
+
+	if !hasDuration && p.Discard == 0 && len(p.References) == 0 && len(p.Additions) == 0 {
+		flags := byte(0)
+		if p.Flags&KF != 0 {
+			flags |= 0x80
+		}
+		hdr = append(hdr, flags)
+
+		b = appendID(b, idSimpleBlock)
+		b = appendSize(b, uint64(len(hdr)+len(p.Data)))
+		b = append(b, hdr...)
+		return append(b, p.Data...)
+	}
+
+	hdr = append(hdr, 0)
+
+	var block []byte
+	block = appendID(block, idBlock)
+	block = appendSize(block, uint64(len(hdr)+len(p.Data)))
+	block = append(block, hdr...)
+	block = append(block, p.Data...)
+
+	if len(p.Additions) != 0 {
+		var adds []byte
+		for _, a := range p.Additions {
+			var more []byte
+			if a.ID != 1 {
+				more = appendUint(more, idBlockAddID, a.ID)
+			}
+			more = appendElement(more, idBlockAdditional, a.Data)
+			adds = appendElement(adds, idBlockMore, more)
+		}
+		block = appendElement(block, idBlockAdditions, adds)
+	}
+	if hasDuration {
+		block = appendUint(block, idBlockDuration, duration)
+	}
+	for _, r := range p.References {
+		ref := int64(p.StartTime) + r
+		if ref < 0 {
+			ref = 0
+		}
+		block = appendInt(block, idReferenceBlock, m.toTimecode(uint64(ref))-tc)
+	}
+	if p.Flags&KF == 0 && len(p.References) == 0 {
+		ref := int64(0)
+		if t.hasLast {
+			ref = t.lastTC - tc
+		}
+		block = appendInt(block, idReferenceBlock, ref)
+	}
+	if p.Discard != 0 {
+		block = appendInt(block, idDiscardPadding, p.Discard)
+	}
+
+	return appendElement(b, idBlockGroup, block)
+}
+
+// Flush writes out the current cluster, if any. The next packet written
+// will start a new cluster. It does not need to be called by users, unless
+// they need control over cluster boundaries.
+func (m *Muxer) Flush() error {
+	if !m.clusterOpen {
+		return nil
+	}
+
+	pos := m.pos - m.segData
+
+	var hdr []byte
+	hdr = appendID(hdr, idCluster)
+	hdr = appendSize(hdr, uint64(len(m.cluster)))
+
+	for i := range m.pendingCues {
+		m.pendingCues[i].cluster = pos
+	}
+	m.cues = append(m.cues, m.pendingCues...)
+	m.pendingCues = m.pendingCues[:0]
+	m.clusterOpen = false
+
+	err := m.write(hdr)
+	if err != nil {
+		return err
+	}
+
+	return m.write(m.cluster)
+}
+
+func (m *Muxer) cuesElement() []byte {
+	var body []byte
+	for _, c := range m.cues {
+		var pos []byte
+		pos = appendUint(pos, idCueTrack, c.track)
+		pos = appendUint(pos, idCueClusterPosition, uint64(c.cluster))
+		pos = appendUint(pos, idCueRelativePosition, c.rel)
+		if c.duration != 0 {
+			pos = appendUint(pos, idCueDuration, c.duration)
+		}
+
+		var point []byte
+		point = appendUint(point, idCueTime, c.time)
+		point = appendElement(point, idCueTrackPositions, pos)
+
+		body = appendElement(body, idCuePoint, point)
+	}
+	return appendElement(nil, idCues, body)
+}
+
+func (m *Muxer) seekHeadElement() []byte {
+	var body []byte
+	for _, id := range []uint32{idInfo, idTracks, idAttachments, idChapters, idTags, idCues} {
+		pos, ok := m.seekEntries[id]
+		if !ok {
+			continue
+		}
+
+		var seek []byte
+		seek = appendElement(seek, idSeekID, appendID(nil, id))
+		seek = appendUint(seek, idSeekPosition, uint64(pos))
+
+		body = appendElement(body, idSeek, seek)
+	}
+	return appendElement(nil, idSeekHead, body)
+}
+
+// Close finishes writing the output. It does not close the underlying
+// writer.
+func (m *Muxer) Close() error {
+	if m.closed {
+		return nil
+	}
+
+	err := m.WriteHeader()
+	if err != nil {
+		return err
+	}
+
+	err = m.Flush()
+	if err != nil {
+		return err
+	}
+
+	m.closed = true
+
+	if m.ws != nil && len(m.cues) != 0 {
+		err = m.writeElement(idCues, m.cuesElement())
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.lateAttachments && !m.webm() {
+		err = m.writeElement(idAttachments, m.attachmentsElement())
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.lateChapters && len(m.chapters) != 0 {
+		err = m.writeElement(idChapters, chaptersElement(m.chapters))
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.lateTags && len(m.tags) != 0 {
+		err = m.writeElement(idTags, tagsElement(m.tags))
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.ws == nil {
+		return nil
+	}
+
+	err = m.writeAt(m.segSizePos, appendSizeN(nil, uint64(m.pos-m.segData), 8))
+	if err != nil {
+		return err
+	}
+
+	if m.durationPos != 0 {
+		dur := appendFloat(nil, idDuration, float64(m.duration)/float64(m.scale))
+		err = m.writeAt(m.durationPos, dur[3:])
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.nextUIDPos != 0 {
+		// It has the same size either way, so it can be replaced by a
+		// Void if it was removed.
+		next := appendElement(nil, idNextUID, m.info.NextUID[:])
+		if isZeroUID(m.info.NextUID) {
+			next = appendVoid(nil, len(next))
+		}
+		err = m.writeAt(m.nextUIDPos, next)
+		if err != nil {
+			return err
+		}
+	}
+
+	sh := m.seekHeadElement()
+	if len(sh) > seekHeadReserved-2 {
+		return fmt.Errorf("SeekHead too large")
+	}
+	sh = appendVoid(sh, seekHeadReserved-len(sh))
+
+	return m.writeAt(m.segData, sh)
+}
+
+// DateUTC converts t to the representation used by SegmentInfo.DateUTC.
+func DateUTC(t time.Time) int64 {
+	return t.Sub(matroskaEpoch).Nanoseconds()
+}
@@ -0,0 +1,309 @@
+package matroska_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/dwbuiten/matroska/internal/testutil"
+)
+
+func readAll(t *testing.T, d *matroska.Demuxer) []*matroska.Packet {
+	var ret []*matroska.Packet
+	for {
+		p, err := d.ReadPacket()
+		if err == io.EOF {
+			return ret
+		} else if err != nil {
+			t.Fatalf("could not read packet: %s", err.Error())
+		}
+		ret = append(ret, p)
+	}
+}
+
+func TestMuxerRoundTrip(t *testing.T) {
+	f := &testutil.MemFile{}
+	m, err := matroska.NewMuxer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := []*matroska.TrackInfo{
+		{
+			Type:            matroska.TypeVideo,
+			CodecID:         "V_MPEG4/ISO/AVC",
+			CodecPrivate:    []byte{1, 66, 0, 30, 0xff, 0xe0, 0},
+			DefaultDuration: 40000000,
+			Enabled:         true,
+			Default:         true,
+			Language:        "und",
+		},
+		{
+			Type:            matroska.TypeAudio,
+			CodecID:         "A_AAC",
+			CodecPrivate:    []byte{0x11, 0x90},
+			DefaultDuration: 21333333,
+			Enabled:         true,
+			Language:        "eng",
+		},
+		{
+			Type:     matroska.TypeSubtitle,
+			CodecID:  "S_TEXT/UTF8",
+			Enabled:  true,
+			Language: "fre",
+		},
+	}
+	tracks[0].Video.PixelWidth = 320
+	tracks[0].Video.PixelHeight = 240
+	tracks[1].Audio.SamplingFreq = 48000
+	tracks[1].Audio.Channels = 2
+
+	for i, ti := range tracks {
+		n, err := m.AddTrack(ti)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != uint(i) {
+			t.Fatalf("track %d got index %d", i, n)
+		}
+	}
+
+	var written []*matroska.Packet
+	for i := 0; i < 100; i++ {
+		ts := uint64(i) * 20000000
+		p := &matroska.Packet{
+			Track:     1,
+			StartTime: ts,
+			EndTime:   ts + 20000000,
+			Data:      []byte{byte(i), 1},
+			Flags:     matroska.KF,
+		}
+		if i%2 == 0 {
+			p.Track = 0
+			p.EndTime = ts + 40000000
+			p.Data = []byte{byte(i), 0}
+			if i%50 == 0 {
+				p.Flags = matroska.KF
+			} else {
+				p.Flags = 0
+			}
+		}
+		written = append(written, p)
+		err = m.WritePacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i%25 == 0 {
+			sub := &matroska.Packet{
+				Track:     2,
+				StartTime: ts,
+				EndTime:   ts + 1500000000,
+				Data:      []byte(fmt.Sprintf("line %d", i)),
+				Flags:     matroska.KF,
+			}
+			written = append(written, sub)
+			err = m.WritePacket(sub)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := matroska.NewDemuxer(bytes.NewReader(f.Bytes()))
+	if err != nil {
+		t.Fatalf("could not demux output: %s", err.Error())
+	}
+	defer d.Close()
+
+	n, err := d.GetNumTracks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != uint(len(tracks)) {
+		t.Fatalf("got %d tracks, expected %d", n, len(tracks))
+	}
+	for i, want := range tracks {
+		ti, err := d.GetTrackInfo(uint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti.CodecID != want.CodecID || !bytes.Equal(ti.CodecPrivate, want.CodecPrivate) || ti.Type != want.Type {
+			t.Errorf("track %d: got %s %x, expected %s %x", i, ti.CodecID, ti.CodecPrivate, want.CodecID, want.CodecPrivate)
+		}
+		if ti.DefaultDuration != want.DefaultDuration {
+			t.Errorf("track %d: got default duration %d, expected %d", i, ti.DefaultDuration, want.DefaultDuration)
+		}
+	}
+	ti, _ := d.GetTrackInfo(0)
+	if ti.Video.PixelWidth != 320 || ti.Video.PixelHeight != 240 {
+		t.Errorf("got %dx%d, expected 320x240", ti.Video.PixelWidth, ti.Video.PixelHeight)
+	}
+
+	info, err := d.GetFileInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration != 2000000000 {
+		t.Errorf("got duration %d, expected 2000000000", info.Duration)
+	}
+
+	got := readAll(t, d)
+	if len(got) != len(written) {
+		t.Fatalf("got %d packets, expected %d", len(got), len(written))
+	}
+	for i, p := range got {
+		w := written[i]
+		if p.Track != w.Track || p.StartTime != w.StartTime || !bytes.Equal(p.Data, w.Data) || p.Flags&matroska.KF != w.Flags&matroska.KF {
+			t.Errorf("packet %d: got track %d at %d (%x, flags %x), expected track %d at %d (%x, flags %x)",
+				i, p.Track, p.StartTime, p.Data, p.Flags, w.Track, w.StartTime, w.Data, w.Flags)
+		}
+		if w.Track == 2 && p.EndTime != w.EndTime {
+			t.Errorf("packet %d: got end time %d, expected %d", i, p.EndTime, w.EndTime)
+		}
+	}
+
+	var videoCues, subCues int
+	for _, c := range d.GetCues() {
+		switch c.Track {
+		case 1:
+			videoCues++
+		case 3:
+			subCues++
+		}
+	}
+	if videoCues != 2 || subCues != 4 {
+		t.Errorf("got %d video and %d subtitle cues, expected 2 and 4", videoCues, subCues)
+	}
+}
+
+func TestMuxerStreaming(t *testing.T) {
+	var b bytes.Buffer
+	m := matroska.NewStreamingMuxer(&b)
+
+	_, err := m.AddTrack(&matroska.TrackInfo{
+		Type:     matroska.TypeAudio,
+		CodecID:  "A_OPUS",
+		Enabled:  true,
+		Language: "und",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		err = m.WritePacket(&matroska.Packet{
+			StartTime: uint64(i) * 20000000,
+			EndTime:   uint64(i+1) * 20000000,
+			Data:      []byte{byte(i)},
+			Flags:     matroska.KF,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := matroska.NewStreamingDemuxer(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("could not demux output: %s", err.Error())
+	}
+	defer d.Close()
+
+	got := readAll(t, d)
+	if len(got) != 50 {
+		t.Fatalf("got %d packets, expected 50", len(got))
+	}
+	for i, p := range got {
+		if p.StartTime != uint64(i)*20000000 || p.Data[0] != byte(i) {
+			t.Errorf("packet %d: got %x at %d", i, p.Data, p.StartTime)
+		}
+	}
+}
+
+func TestMuxerReferences(t *testing.T) {
+	f := &testutil.MemFile{}
+	m, err := matroska.NewMuxer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ti := &matroska.TrackInfo{
+		Type:               matroska.TypeVideo,
+		CodecID:            "V_MPEG4/ISO/AVC",
+		CodecPrivate:       []byte{1, 66, 0, 30, 0xff, 0xe0, 0},
+		DefaultDuration:    40000000,
+		MaxBlockAdditionID: 2,
+		Language:           "und",
+	}
+	ti.Video.PixelWidth = 320
+	ti.Video.PixelHeight = 240
+	_, err = m.AddTrack(ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An IPBB GOP in decoding order: the B-frames reference the I- and
+	// P-frames on either side of them.
+	written := []*matroska.Packet{
+		{StartTime: 0, Flags: matroska.KF},
+		{StartTime: 120000000, References: []int64{-120000000}},
+		{StartTime: 40000000, References: []int64{-40000000, 80000000}},
+		{StartTime: 80000000, References: []int64{-80000000, 40000000}, Additions: []matroska.BlockAddition{
+			{ID: 1, Data: []byte("one")},
+			{ID: 2, Data: []byte("two")},
+		}},
+	}
+	for i, p := range written {
+		p.EndTime = p.StartTime + 40000000
+		p.Data = []byte{byte(i)}
+		err = m.WritePacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := matroska.NewDemuxer(bytes.NewReader(f.Bytes()))
+	if err != nil {
+		t.Fatalf("could not demux output: %s", err.Error())
+	}
+	defer d.Close()
+
+	ti, err = d.GetTrackInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.MaxBlockAdditionID != 2 {
+		t.Errorf("got MaxBlockAdditionID %d, expected 2", ti.MaxBlockAdditionID)
+	}
+
+	got := readAll(t, d)
+	if len(got) != len(written) {
+		t.Fatalf("got %d packets, expected %d", len(got), len(written))
+	}
+	for i, p := range got {
+		w := written[i]
+		if p.StartTime != w.StartTime || p.Flags&matroska.KF != w.Flags&matroska.KF {
+			t.Errorf("packet %d: got %d (flags %x), expected %d (flags %x)", i, p.StartTime, p.Flags, w.StartTime, w.Flags)
+		}
+		if fmt.Sprint(p.References) != fmt.Sprint(w.References) {
+			t.Errorf("packet %d: got references %v, expected %v", i, p.References, w.References)
+		}
+		if fmt.Sprintf("%q", p.Additions) != fmt.Sprintf("%q", w.Additions) {
+			t.Errorf("packet %d: got additions %q, expected %q", i, p.Additions, w.Additions)
+		}
+	}
+}
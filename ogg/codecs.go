@@ -0,0 +1,346 @@
+package ogg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dwbuiten/matroska"
+)
+
+type opus struct {
+	head []byte
+	tags []byte
+}
+
+func newOpus(ti *matroska.TrackInfo) (*opus, error) {
+	if len(ti.CodecPrivate) < 19 || !bytes.HasPrefix(ti.CodecPrivate, []byte("OpusHead")) {
+		return nil, fmt.Errorf("could not find OpusHead in CodecPrivate")
+	}
+
+	o := &opus{
+		head: append([]byte{}, ti.CodecPrivate...),
+		tags: append([]byte("OpusTags"), commentHeader(ti)...),
+	}
+
+	// The CodecDelay is authoritative, and in practice matches the
+	// pre-skip anyway.
+	if ti.CodecDelay != 0 {
+		preSkip := (ti.CodecDelay*48000 + 500000000) / 1000000000
+		binary.LittleEndian.PutUint16(o.head[10:], uint16(preSkip))
+	}
+
+	return o, nil
+}
+
+func (o *opus) headers() ([][]byte, error) {
+	return [][]byte{o.head, o.tags}, nil
+}
+
+func (o *opus) rate() uint64 {
+	return 48000
+}
+
+// samples parses the TOC byte, see RFC 6716 section 3.1.
+func (o *opus) samples(packet []byte) (int64, error) {
+	if len(packet) < 1 {
+		return 0, fmt.Errorf("could not parse empty Opus packet")
+	}
+
+	config := packet[0] >> 3
+	var frame int64
+	switch {
+	case config < 12:
+		frame = []int64{480, 960, 1920, 2880}[config&3]
+	case config < 16:
+		frame = []int64{480, 960}[config&1]
+	default:
+		frame = []int64{120, 240, 480, 960}[config&3]
+	}
+
+	frames := int64(1)
+	switch packet[0] & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, fmt.Errorf("could not parse Opus packet: truncated")
+		}
+		frames = int64(packet[1] & 0x3f)
+	}
+
+	return frame * frames, nil
+}
+
+type vorbis struct {
+	packets    [][]byte
+	blockSizes [2]int64
+	modes      []bool
+	modeBits   uint
+	prev       int64
+}
+
+// splitXiph splits Xiph laced CodecPrivate into its packets.
+func splitXiph(cp []byte) ([][]byte, error) {
+	if len(cp) < 1 {
+		return nil, fmt.Errorf("could not parse CodecPrivate: empty")
+	}
+
+	count := int(cp[0]) + 1
+	pos := 1
+	sizes := make([]int, count-1)
+	for i := range sizes {
+		for {
+			if pos >= len(cp) {
+				return nil, fmt.Errorf("could not parse CodecPrivate: truncated")
+			}
+			sizes[i] += int(cp[pos])
+			pos++
+			if cp[pos-1] != 255 {
+				break
+			}
+		}
+	}
+
+	var packets [][]byte
+	for _, n := range sizes {
+		if pos+n > len(cp) {
+			return nil, fmt.Errorf("could not parse CodecPrivate: truncated")
+		}
+		packets = append(packets, cp[pos:pos+n])
+		pos += n
+	}
+	packets = append(packets, cp[pos:])
+
+	return packets, nil
+}
+
+func newVorbis(ti *matroska.TrackInfo) (*vorbis, error) {
+	packets, err := splitXiph(ti.CodecPrivate)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) != 3 {
+		return nil, fmt.Errorf("could not find Vorbis headers in CodecPrivate")
+	}
+
+	id := packets[0]
+	if len(id) < 30 || !bytes.Equal(id[:7], []byte("\x01vorbis")) {
+		return nil, fmt.Errorf("could not parse Vorbis identification header")
+	}
+	if !bytes.HasPrefix(packets[2], []byte("\x05vorbis")) {
+		return nil, fmt.Errorf("could not parse Vorbis setup header")
+	}
+
+	v := &vorbis{
+		packets:    packets,
+		blockSizes: [2]int64{1 << (id[28] & 0xf), 1 << (id[28] >> 4)},
+		prev:       -1,
+	}
+
+	v.modes, err = vorbisModes(packets[2])
+	if err != nil {
+		return nil, err
+	}
+	for 1<<v.modeBits < len(v.modes) {
+		v.modeBits++
+	}
+
+	return v, nil
+}
+
+// vorbisModes finds the block flags of the modes in a setup header. The
+// modes are at the very end, but everything before them must be parsed to
+// find where they start, so instead they are read backwards from the
+// framing bit. Each mode is 41 bits, and the count before them is found by
+// checking which mode count is consistent with the data.
+func vorbisModes(setup []byte) ([]bool, error) {
+	total := len(setup) * 8
+	bit := func(i int) uint32 {
+		// Bit i counted backwards from the end of the packet.
+		b := setup[len(setup)-1-i/8]
+		return uint32(b>>(7-uint(i%8))) & 1
+	}
+	bits := func(i, n int) uint32 {
+		v := uint32(0)
+		for j := 0; j < n; j++ {
+			v = v<<1 | bit(i+j)
+		}
+		return v
+	}
+
+	framing := -1
+	for i := 0; total-i > 97; i++ {
+		if bit(i) == 1 {
+			framing = i + 1
+			break
+		}
+	}
+	if framing < 0 {
+		return nil, fmt.Errorf("could not find Vorbis setup header framing bit")
+	}
+
+	count := 0
+	pos := framing
+	for i := 1; i <= 64 && total-pos >= 97; i++ {
+		// Mapping, transform type and window type, then the block flag.
+		if bits(pos, 8) > 63 || bits(pos+8, 16) != 0 || bits(pos+24, 16) != 0 {
+			break
+		}
+		pos += 41
+		if bits(pos, 6)+1 == uint32(i) {
+			count = i
+		}
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("could not find Vorbis modes in setup header")
+	}
+
+	modes := make([]bool, count)
+	for i := 0; i < count; i++ {
+		modes[count-1-i] = bit(framing+i*41+40) == 1
+	}
+
+	return modes, nil
+}
+
+func (v *vorbis) headers() ([][]byte, error) {
+	return v.packets, nil
+}
+
+func (v *vorbis) rate() uint64 {
+	return uint64(binary.LittleEndian.Uint32(v.packets[0][12:]))
+}
+
+// samples works out a packet's block size from its mode. Each packet
+// finishes the overlap with the previous one, so the first packet decodes
+// to nothing.
+func (v *vorbis) samples(packet []byte) (int64, error) {
+	if len(packet) < 1 || packet[0]&1 != 0 {
+		return 0, fmt.Errorf("could not parse Vorbis audio packet")
+	}
+
+	mode := int(packet[0]>>1) & (1<<v.modeBits - 1)
+	if mode >= len(v.modes) {
+		return 0, fmt.Errorf("invalid Vorbis mode: %d", mode)
+	}
+	cur := v.blockSizes[0]
+	if v.modes[mode] {
+		cur = v.blockSizes[1]
+	}
+
+	n := int64(0)
+	if v.prev >= 0 {
+		n = v.prev/4 + cur/4
+	}
+	v.prev = cur
+
+	return n, nil
+}
+
+type flac struct {
+	packets    [][]byte
+	sampleRate uint64
+}
+
+func newFLAC(ti *matroska.TrackInfo) (*flac, error) {
+	cp := ti.CodecPrivate
+	if !bytes.HasPrefix(cp, []byte("fLaC")) {
+		return nil, fmt.Errorf("could not find fLaC in CodecPrivate")
+	}
+
+	var streamInfo, comment []byte
+	var others [][]byte
+	for pos := 4; pos < len(cp); {
+		if pos+4 > len(cp) {
+			return nil, fmt.Errorf("could not parse FLAC metadata: truncated")
+		}
+		typ := cp[pos] & 0x7f
+		n := int(cp[pos+1])<<16 | int(cp[pos+2])<<8 | int(cp[pos+3])
+		if pos+4+n > len(cp) {
+			return nil, fmt.Errorf("could not parse FLAC metadata: truncated")
+		}
+		block := append([]byte{}, cp[pos:pos+4+n]...)
+		block[0] = typ
+		last := cp[pos]&0x80 != 0
+		pos += 4 + n
+
+		switch typ {
+		case 0:
+			streamInfo = block
+		case 4:
+			comment = block
+		case 1, 3:
+			// Padding is pointless, and seek tables point into the
+			// native FLAC stream.
+		default:
+			others = append(others, block)
+		}
+
+		if last {
+			break
+		}
+	}
+	if len(streamInfo) != 38 {
+		return nil, fmt.Errorf("could not find FLAC STREAMINFO in CodecPrivate")
+	}
+
+	// The Ogg mapping requires a comment block right after STREAMINFO.
+	if comment == nil {
+		c := commentHeader(ti)
+		comment = append([]byte{4, byte(len(c) >> 16), byte(len(c) >> 8), byte(len(c))}, c...)
+	}
+	others = append([][]byte{comment}, others...)
+	others[len(others)-1][0] |= 0x80
+
+	first := []byte{0x7f, 'F', 'L', 'A', 'C', 1, 0, byte(len(others) >> 8), byte(len(others)), 'f', 'L', 'a', 'C'}
+	first = append(first, streamInfo...)
+
+	return &flac{
+		packets:    append([][]byte{first}, others...),
+		sampleRate: uint64(streamInfo[14])<<12 | uint64(streamInfo[15])<<4 | uint64(streamInfo[16])>>4,
+	}, nil
+}
+
+func (f *flac) headers() ([][]byte, error) {
+	return f.packets, nil
+}
+
+func (f *flac) rate() uint64 {
+	return f.sampleRate
+}
+
+// samples parses the block size from a frame header.
+func (f *flac) samples(packet []byte) (int64, error) {
+	if len(packet) < 5 || packet[0] != 0xff || packet[1]&0xfe != 0xf8 {
+		return 0, fmt.Errorf("could not find FLAC frame header")
+	}
+
+	code := packet[2] >> 4
+	switch {
+	case code == 1:
+		return 192, nil
+	case code >= 2 && code <= 5:
+		return 576 << (code - 2), nil
+	case code >= 8:
+		return 256 << (code - 8), nil
+	case code == 0:
+		return 0, fmt.Errorf("invalid FLAC block size")
+	}
+
+	// The block size follows the UTF-8 coded frame or sample number.
+	pos := 5
+	for b := packet[4]; b&0x80 != 0 && b&0x40 != 0; b <<= 1 {
+		pos++
+	}
+	if code == 6 {
+		if pos >= len(packet) {
+			return 0, fmt.Errorf("could not parse FLAC frame header: truncated")
+		}
+		return int64(packet[pos]) + 1, nil
+	}
+	if pos+1 >= len(packet) {
+		return 0, fmt.Errorf("could not parse FLAC frame header: truncated")
+	}
+	return int64(packet[pos])<<8 | int64(packet[pos+1]) + 1, nil
+}
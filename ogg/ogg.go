@@ -0,0 +1,340 @@
+// Package ogg implements remuxing Opus, Vorbis and FLAC tracks from Matroska
+// to Ogg, for audio-only exports.
+//
+// Granule positions are computed from the packets themselves rather than
+// from their timestamps, so the output is gapless. The track's CodecDelay is
+// used to trim the start, and the DiscardPadding of the last packet to trim
+// the end.
+package ogg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Pages are flushed once they hold at least this many bytes.
+const pageSize = 4096
+
+// The vendor string written to comment headers we generate.
+const vendor = "github.com/dwbuiten/matroska"
+
+// crc32 is the CRC used for Ogg pages.
+func crc32(b []byte) uint32 {
+	crc := uint32(0)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// pageWriter packs packets into the pages of a single logical stream.
+type pageWriter struct {
+	w        io.Writer
+	serial   uint32
+	seq      uint32
+	segments []byte
+	data     []byte
+	// The granule position of the last packet finished on the current
+	// page, or -1 if there is none.
+	granule   int64
+	continued bool
+	bos       bool
+}
+
+func (pw *pageWriter) writePacket(packet []byte, granule int64) error {
+	first := true
+	for {
+		if len(pw.segments) == 255 {
+			err := pw.flush(false)
+			if err != nil {
+				return err
+			}
+			pw.continued = !first
+		}
+		first = false
+
+		n := len(packet)
+		if n > 255 {
+			n = 255
+		}
+		pw.segments = append(pw.segments, byte(n))
+		pw.data = append(pw.data, packet[:n]...)
+		packet = packet[n:]
+		if n < 255 {
+			break
+		}
+	}
+	pw.granule = granule
+
+	return nil
+}
+
+func (pw *pageWriter) flush(eos bool) error {
+	if len(pw.segments) == 0 && !eos {
+		return nil
+	}
+
+	flags := byte(0)
+	if pw.continued {
+		flags |= 1
+	}
+	if pw.bos {
+		flags |= 2
+	}
+	if eos {
+		flags |= 4
+	}
+
+	page := make([]byte, 0, 27+len(pw.segments)+len(pw.data))
+	page = append(page, 'O', 'g', 'g', 'S', 0, flags)
+	page = append(page, make([]byte, 20)...)
+	binary.LittleEndian.PutUint64(page[6:], uint64(pw.granule))
+	binary.LittleEndian.PutUint32(page[14:], pw.serial)
+	binary.LittleEndian.PutUint32(page[18:], pw.seq)
+	page = append(page, byte(len(pw.segments)))
+	page = append(page, pw.segments...)
+	page = append(page, pw.data...)
+	binary.LittleEndian.PutUint32(page[22:], crc32(page))
+
+	pw.seq++
+	pw.segments = pw.segments[:0]
+	pw.data = pw.data[:0]
+	pw.granule = -1
+	pw.continued = false
+	pw.bos = false
+
+	_, err := pw.w.Write(page)
+	return err
+}
+
+// codec handles the codec specific parts of the Ogg mapping.
+type codec interface {
+	// headers returns the header packets. The first one is put on a page
+	// of its own.
+	headers() ([][]byte, error)
+	// rate returns the granule position rate.
+	rate() uint64
+	// samples returns the number of samples a packet decodes to.
+	samples(packet []byte) (int64, error)
+}
+
+// Writer writes a single Matroska audio track to an Ogg stream.
+type Writer struct {
+	pw    *pageWriter
+	codec codec
+	rate  uint64
+
+	// The number of samples written so far, and how many of them are
+	// trimmed from the start.
+	pos  int64
+	trim int64
+
+	// The DiscardPadding of the last packet, in samples.
+	discard int64
+
+	started bool
+	closed  bool
+}
+
+// NewWriter creates an Ogg writer for the given track, which must be an
+// A_OPUS, A_VORBIS or A_FLAC track. The headers are written right away.
+func NewWriter(w io.Writer, ti *matroska.TrackInfo) (*Writer, error) {
+	if ti.CompEnabled {
+		return nil, fmt.Errorf("could not write track %d: compressed tracks are not supported", ti.Number)
+	}
+
+	var c codec
+	var err error
+	switch ti.CodecID {
+	case "A_OPUS":
+		c, err = newOpus(ti)
+	case "A_VORBIS":
+		c, err = newVorbis(ti)
+	case "A_FLAC":
+		c, err = newFLAC(ti)
+	default:
+		return nil, fmt.Errorf("unsupported codec: %s", ti.CodecID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ow := &Writer{
+		pw: &pageWriter{
+			w:       w,
+			serial:  rand.Uint32(),
+			granule: -1,
+			bos:     true,
+		},
+		codec: c,
+		rate:  c.rate(),
+	}
+
+	// Opus signals the codec delay with the pre-skip in its header
+	// instead.
+	if ti.CodecID != "A_OPUS" {
+		ow.trim = ow.toSamples(int64(ti.CodecDelay))
+	}
+
+	headers, err := c.headers()
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range headers {
+		err = ow.pw.writePacket(h, 0)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 || i == len(headers)-1 {
+			err = ow.pw.flush(false)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ow, nil
+}
+
+// toSamples converts nanoseconds to samples, with rounding.
+func (ow *Writer) toSamples(ns int64) int64 {
+	neg := ns < 0
+	if neg {
+		ns = -ns
+	}
+	r := int64(ow.rate)
+	s := ns/1000000000*r + (ns%1000000000*r+500000000)/1000000000
+	if neg {
+		return -s
+	}
+	return s
+}
+
+func (ow *Writer) granule() int64 {
+	g := ow.pos - ow.trim
+	if g < 0 {
+		return 0
+	}
+	return g
+}
+
+// WritePacket writes a packet. Packets must all belong to the writer's
+// track, and be written in order.
+func (ow *Writer) WritePacket(p *matroska.Packet) error {
+	if ow.closed {
+		return fmt.Errorf("writer already closed")
+	}
+
+	n, err := ow.codec.samples(p.Data)
+	if err != nil {
+		return err
+	}
+
+	if len(ow.pw.data) >= pageSize {
+		err = ow.pw.flush(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A negative DiscardPadding on the first packet trims from the
+	// start.
+	if !ow.started && p.Discard < 0 {
+		ow.trim -= ow.toSamples(p.Discard)
+	}
+	ow.started = true
+
+	ow.pos += n
+	ow.discard = 0
+	if p.Discard > 0 {
+		ow.discard = ow.toSamples(p.Discard)
+		if ow.discard > n {
+			ow.discard = n
+		}
+	}
+
+	return ow.pw.writePacket(p.Data, ow.granule())
+}
+
+// Close writes the last page, trimming the end of the stream by the
+// DiscardPadding of the last packet. It does not close the underlying
+// writer.
+func (ow *Writer) Close() error {
+	if ow.closed {
+		return nil
+	}
+	ow.closed = true
+
+	if ow.started {
+		ow.pos -= ow.discard
+		ow.pw.granule = ow.granule()
+	}
+
+	return ow.pw.flush(true)
+}
+
+// Remux writes the given track of d to w as Ogg. Packets are read from the
+// demuxer's current position until EOF.
+func Remux(d *matroska.Demuxer, w io.Writer, track uint) error {
+	ti, err := d.GetTrackInfo(track)
+	if err != nil {
+		return err
+	}
+
+	ow, err := NewWriter(w, ti)
+	if err != nil {
+		return err
+	}
+
+	mask := ^(uint64(1) << track)
+	for {
+		p, err := d.ReadPacketMask(mask)
+		if err == io.EOF {
+			return ow.Close()
+		} else if err != nil {
+			return err
+		}
+
+		err = ow.WritePacket(p)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// commentHeader builds a Vorbis comment structure, as used by Opus and
+// FLAC, from the track's name.
+func commentHeader(ti *matroska.TrackInfo) []byte {
+	var comments []string
+	if ti.Name != "" {
+		comments = append(comments, "TITLE="+ti.Name)
+	}
+	if lang := strings.TrimRight(ti.Language, "\x00"); lang != "" && lang != "und" {
+		comments = append(comments, "LANGUAGE="+lang)
+	}
+
+	b := make([]byte, 4, 64)
+	binary.LittleEndian.PutUint32(b, uint32(len(vendor)))
+	b = append(b, vendor...)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(comments)))
+	for _, c := range comments {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(c)))
+		b = append(b, c...)
+	}
+
+	return b
+}
@@ -0,0 +1,42 @@
+package matroska
+
+// Lookahead is how far past a point in time packets are looked for, in
+// nanoseconds, when cutting a file there. Tracks are not perfectly
+// interleaved, so packets belonging before that point may come after
+// packets from after it.
+const Lookahead = 1000000000
+
+// ReferenceTrack returns the index in tracks of the track to cut and seek
+// on, which is the first video track if there is one, and the first track
+// otherwise. It returns -1 if tracks is empty.
+func ReferenceTrack(tracks []*TrackInfo) int {
+	for i, ti := range tracks {
+		if ti.Type == TypeVideo {
+			return i
+		}
+	}
+	if len(tracks) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// SeekKeyFrame seeks all tracks to the keyframe of track at or before
+// timecode, and returns its timestamp. The track is seeked on its own
+// first, as other tracks would be seeked to their own keyframes.
+//
+// If the track has no packets from there on, io.EOF is returned without
+// seeking the other tracks. Either way, the track mask is cleared.
+func (d *Demuxer) SeekKeyFrame(track uint8, timecode uint64) (uint64, error) {
+	mask := ^(uint64(1) << track)
+	d.SetTrackMask(mask)
+	d.Seek(timecode, SeekToPrevKeyFrame)
+	p, err := d.ReadPacketMask(mask)
+	d.SetTrackMask(0)
+	if err != nil {
+		return 0, err
+	}
+
+	d.Seek(p.StartTime, 0)
+	return p.StartTime, nil
+}
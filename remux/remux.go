@@ -0,0 +1,447 @@
+// Package remux copies Matroska files into new ones, with a different
+// selection and order of tracks, and changed track and file properties.
+package remux
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// timing maps the timestamps of a track: they are multiplied by num/den,
+// and offset is added.
+type timing struct {
+	offset int64
+	num    uint64
+	den    uint64
+}
+
+func (tm *timing) apply(t uint64) int64 {
+	if tm == nil {
+		return int64(t)
+	}
+	if tm.den != 0 {
+		// Split up to avoid overflowing.
+		t = t/tm.den*tm.num + t%tm.den*tm.num/tm.den
+	}
+	return int64(t) + tm.offset
+}
+
+// same returns whether tm and o map timestamps the same way.
+func (tm *timing) same(o *timing) bool {
+	var a, b timing
+	if tm != nil {
+		a = *tm
+	}
+	if o != nil {
+		b = *o
+	}
+	return a == b
+}
+
+// mapChapters returns copies of chapters with their times mapped by tm.
+// Times before 0 become 0.
+func mapChapters(chapters []*matroska.Chapter, tm *timing) []*matroska.Chapter {
+	var ret []*matroska.Chapter
+	for _, c := range chapters {
+		ch := *c
+		ch.Start = clampTime(tm.apply(c.Start))
+		if c.End != 0 {
+			ch.End = clampTime(tm.apply(c.End))
+		}
+		ch.Children = mapChapters(c.Children, tm)
+		ret = append(ret, &ch)
+	}
+	return ret
+}
+
+func clampTime(t int64) uint64 {
+	if t < 0 {
+		return 0
+	}
+	return uint64(t)
+}
+
+// Remuxer copies the packets of a Demuxer into a new file byte for byte.
+// Keyframe flags, block durations, ReferenceBlocks, BlockAdditions and
+// DiscardPadding are kept, so blocks are written as BlockGroups where the
+// input needs them.
+type Remuxer struct {
+	d *matroska.Demuxer
+
+	tracks    []uint
+	overrides map[uint][]func(ti *matroska.TrackInfo)
+	timings   map[uint]*timing
+
+	dropAttachments bool
+	dropChapters    bool
+	title           string
+	hasTitle        bool
+}
+
+// NewRemuxer creates a Remuxer for d, which copies all tracks by default.
+func NewRemuxer(d *matroska.Demuxer) *Remuxer {
+	return &Remuxer{
+		d:         d,
+		overrides: make(map[uint][]func(ti *matroska.TrackInfo)),
+		timings:   make(map[uint]*timing),
+	}
+}
+
+// SelectTracks sets which tracks are copied, by index, in the order they
+// are written in.
+func (r *Remuxer) SelectTracks(tracks ...uint) {
+	r.tracks = append([]uint{}, tracks...)
+}
+
+func (r *Remuxer) override(track uint, f func(ti *matroska.TrackInfo)) {
+	r.overrides[track] = append(r.overrides[track], f)
+}
+
+// SetName overrides the name of a track.
+func (r *Remuxer) SetName(track uint, name string) {
+	r.override(track, func(ti *matroska.TrackInfo) { ti.Name = name })
+}
+
+// SetLanguage overrides the language of a track.
+func (r *Remuxer) SetLanguage(track uint, lang string) {
+	r.override(track, func(ti *matroska.TrackInfo) { ti.Language = lang })
+}
+
+// SetDefault overrides the default flag of a track.
+func (r *Remuxer) SetDefault(track uint, v bool) {
+	r.override(track, func(ti *matroska.TrackInfo) { ti.Default = v })
+}
+
+// SetForced overrides the forced flag of a track.
+func (r *Remuxer) SetForced(track uint, v bool) {
+	r.override(track, func(ti *matroska.TrackInfo) { ti.Forced = v })
+}
+
+// SetEnabled overrides the enabled flag of a track.
+func (r *Remuxer) SetEnabled(track uint, v bool) {
+	r.override(track, func(ti *matroska.TrackInfo) { ti.Enabled = v })
+}
+
+func (r *Remuxer) timing(track uint) *timing {
+	tm, ok := r.timings[track]
+	if !ok {
+		tm = &timing{}
+		r.timings[track] = tm
+	}
+	return tm
+}
+
+// SetOffset shifts the timestamps of a track by offset nanoseconds, after
+// any scaling. Packets which would start before 0 are dropped, along with
+// the following ones up to the next keyframe, except for subtitles which
+// are still on screen at 0, which are cut to start at 0.
+//
+// Chapters are moved the same way if all copied tracks have the same
+// offset and scale. Otherwise they keep their original times.
+func (r *Remuxer) SetOffset(track uint, offset int64) {
+	r.timing(track).offset = offset
+}
+
+// SetScale multiplies the timestamps of a track by num/den, for example
+// 25/23.976 as 25000/23976. The track's default duration is scaled too.
+// Chapters are scaled as described for SetOffset.
+func (r *Remuxer) SetScale(track uint, num, den uint64) {
+	tm := r.timing(track)
+	tm.num = num
+	tm.den = den
+}
+
+// DropAttachments makes the output have no attachments.
+func (r *Remuxer) DropAttachments() {
+	r.dropAttachments = true
+}
+
+// DropChapters makes the output have no chapters.
+func (r *Remuxer) DropChapters() {
+	r.dropChapters = true
+}
+
+// SetTitle sets the title of the output.
+func (r *Remuxer) SetTitle(title string) {
+	r.title = title
+	r.hasTitle = true
+}
+
+// keepTag returns whether a tag still applies to something in the output.
+// Tags without targets apply to the whole file.
+func keepTag(t *matroska.Tag, tracks map[uint64]bool, chapters, attachments bool) bool {
+	if len(t.Targets) == 0 {
+		return true
+	}
+
+	for _, tg := range t.Targets {
+		switch tg.Type {
+		case matroska.TargetTrack:
+			if tracks[tg.UID] {
+				return true
+			}
+		case matroska.TargetChapter, matroska.TargetEdition:
+			if chapters {
+				return true
+			}
+		case matroska.TargetAttachment:
+			if attachments {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Write writes the output to w. Packets are read from the demuxer's
+// current position.
+func (r *Remuxer) Write(w io.WriteSeeker) error {
+	m, err := matroska.NewMuxer(w)
+	if err != nil {
+		return err
+	}
+
+	info, err := r.d.GetFileInfo()
+	if err != nil {
+		return err
+	}
+	title := info.Title
+	if r.hasTitle {
+		title = r.title
+	}
+	err = m.SetSegmentInfo(&matroska.SegmentInfo{
+		Title:         title,
+		TimecodeScale: info.TimecodeScale,
+		DateUTC:       info.DateUTC,
+		DateUTCValid:  info.DateUTCValid,
+	})
+	if err != nil {
+		return err
+	}
+
+	count, err := r.d.GetNumTracks()
+	if err != nil {
+		return err
+	}
+
+	tracks := r.tracks
+	if tracks == nil {
+		for i := uint(0); i < count; i++ {
+			tracks = append(tracks, i)
+		}
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("no tracks selected")
+	}
+
+	mask := ^uint64(0)
+	var timings []*timing
+	var types []uint8
+	index := make(map[uint8]uint8)
+	uids := make(map[uint64]bool)
+	for _, track := range tracks {
+		if track >= count {
+			return fmt.Errorf("invalid track: %d", track)
+		}
+		if mask&(uint64(1)<<track) == 0 {
+			return fmt.Errorf("track %d selected more than once", track)
+		}
+
+		ti, err := r.d.GetTrackInfo(track)
+		if err != nil {
+			return err
+		}
+		for _, f := range r.overrides[track] {
+			f(ti)
+		}
+		tm := r.timings[track]
+		if tm != nil && tm.den != 0 && tm.num == 0 {
+			return fmt.Errorf("invalid scale for track %d: %d/%d", track, tm.num, tm.den)
+		}
+		if tm != nil && tm.den != 0 {
+			ti.DefaultDuration = uint64(tm.apply(ti.DefaultDuration) - tm.offset)
+		}
+		timings = append(timings, tm)
+		types = append(types, ti.Type)
+
+		idx, err := m.AddTrack(ti)
+		if err != nil {
+			return err
+		}
+		index[uint8(track)] = uint8(idx)
+		mask &^= uint64(1) << track
+		uids[ti.UID] = true
+	}
+
+	attachments := !r.dropAttachments && len(r.d.GetAttachments()) != 0
+	if attachments {
+		for _, a := range r.d.GetAttachments() {
+			data, err := r.d.ReadAttachment(a)
+			if err != nil {
+				return err
+			}
+			err = m.AddAttachment(a, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	chapters := !r.dropChapters && len(r.d.GetChapters()) != 0
+	if chapters {
+		editions := r.d.GetChapters()
+		shared := true
+		for _, tm := range timings {
+			if !tm.same(timings[0]) {
+				shared = false
+			}
+		}
+		if shared && timings[0] != nil {
+			editions = mapChapters(editions, timings[0])
+		}
+		err = m.SetChapters(editions)
+		if err != nil {
+			return err
+		}
+	}
+
+	var tags []*matroska.Tag
+	for _, t := range r.d.GetTags() {
+		if keepTag(t, uids, chapters, attachments) {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) != 0 {
+		err = m.SetTags(tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(r.timings) == 0 {
+		for {
+			p, err := r.d.ReadPacketMask(mask)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			p.Track = index[p.Track]
+			err = m.WritePacket(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		return m.Close()
+	}
+
+	err = writeTimed(r.d, m, mask, index, timings, types)
+	if err != nil {
+		return err
+	}
+
+	return m.Close()
+}
+
+// writeTimed copies packets while changing their timestamps. Shifted
+// tracks no longer line up with the input's interleaving, so packets are
+// queued per track, which keeps their decoding order, and written in
+// order of time once nothing earlier can come from the input anymore.
+func writeTimed(d *matroska.Demuxer, m *matroska.Muxer, mask uint64, index map[uint8]uint8, timings []*timing, types []uint8) error {
+	queues := make([][]*matroska.Packet, len(timings))
+	needKF := make([]bool, len(timings))
+
+	flush := func(limit int64, all bool) error {
+		for {
+			next := -1
+			for i, q := range queues {
+				if len(q) == 0 {
+					continue
+				}
+				if next < 0 || q[0].StartTime < queues[next][0].StartTime {
+					next = i
+				}
+			}
+			if next < 0 || (!all && int64(queues[next][0].StartTime) >= limit) {
+				return nil
+			}
+
+			p := queues[next][0]
+			queues[next] = queues[next][1:]
+			err := m.WritePacket(p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		p, err := d.ReadPacketMask(mask)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		in := p.StartTime
+		track := index[p.Track]
+		tm := timings[track]
+		start := tm.apply(p.StartTime)
+		end := tm.apply(p.EndTime)
+
+		if start < 0 {
+			if types[track] != matroska.TypeSubtitle || p.Flags&matroska.UnknownEnd != 0 || end <= 0 {
+				needKF[track] = true
+				continue
+			}
+			start = 0
+		}
+		if needKF[track] {
+			if p.Flags&matroska.KF == 0 {
+				continue
+			}
+			needKF[track] = false
+		}
+		if end < start {
+			end = start
+		}
+
+		for i, r := range p.References {
+			ref := int64(in) + r
+			if ref < 0 {
+				ref = 0
+			}
+			p.References[i] = tm.apply(uint64(ref)) - start
+		}
+
+		p.Track = track
+		p.StartTime = uint64(start)
+		p.EndTime = uint64(end)
+		queues[track] = append(queues[track], p)
+
+		// Packets still to come from the input start no earlier than
+		// matroska.Lookahead before this one, so their output times can be
+		// no earlier than the smallest mapping of that.
+		if in < matroska.Lookahead {
+			continue
+		}
+		limit := int64(-1)
+		for i, tm := range timings {
+			t := tm.apply(in - matroska.Lookahead)
+			if i == 0 || t < limit {
+				limit = t
+			}
+		}
+		err = flush(limit, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return flush(0, true)
+}
@@ -0,0 +1,368 @@
+// Package split losslessly cuts Matroska files into several files, at
+// keyframes of the reference track, which is the first video track if
+// there is one.
+package split
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/pborman/uuid"
+)
+
+type part struct {
+	m    *matroska.Muxer
+	w    io.WriteSeeker
+	uid  [16]byte
+	base uint64
+}
+
+// Splitter splits a file at the boundaries it is given. A new part starts
+// at the first keyframe of the reference track at or after a boundary.
+// Boundaries of different kinds can be combined.
+type Splitter struct {
+	d      *matroska.Demuxer
+	create func(part int) (io.WriteSeeker, error)
+
+	times     []uint64
+	chapters  bool
+	size      uint64
+	keyframes int
+}
+
+// NewSplitter creates a Splitter for d. create is called to create the
+// output for each part, numbered from 0. If the returned writer is an
+// io.Closer, it is closed once the part has been written.
+func NewSplitter(d *matroska.Demuxer, create func(part int) (io.WriteSeeker, error)) *Splitter {
+	return &Splitter{
+		d:      d,
+		create: create,
+	}
+}
+
+// SplitAt adds boundaries at the given times, in nanoseconds.
+func (s *Splitter) SplitAt(times ...uint64) {
+	s.times = append(s.times, times...)
+}
+
+// SplitAtChapters adds boundaries at the start of each chapter, using the
+// default edition, or the first one if there is no default.
+func (s *Splitter) SplitAtChapters() {
+	s.chapters = true
+}
+
+// SplitBySize starts a new part once the current one holds size bytes of
+// packet data. Parts are larger than that by the container overhead and
+// the rest of the last GOP.
+func (s *Splitter) SplitBySize(size uint64) {
+	s.size = size
+}
+
+// SplitByKeyframes starts a new part every n keyframes of the reference
+// track.
+func (s *Splitter) SplitByKeyframes(n int) {
+	s.keyframes = n
+}
+
+func chapterTimes(editions []*matroska.Chapter) []uint64 {
+	if len(editions) == 0 {
+		return nil
+	}
+
+	edition := editions[0]
+	for _, e := range editions {
+		if e.Default {
+			edition = e
+			break
+		}
+	}
+
+	var ret []uint64
+	for _, c := range edition.Children {
+		ret = append(ret, c.Start)
+	}
+	return ret
+}
+
+func newUID() [16]byte {
+	var ret [16]byte
+	copy(ret[:], uuid.NewRandom())
+	return ret
+}
+
+func closePart(p *part) error {
+	err := p.m.Close()
+	if err != nil {
+		return err
+	}
+	if c, ok := p.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Split reads d from its current position and writes the parts, and
+// returns how many were written.
+//
+// Each part gets all tracks, attachments and tags, and its timestamps
+// start at 0 at its first keyframe. Parts are linked with SegmentUID,
+// PrevUID and NextUID, so they are always Matroska and not WebM. Chapters
+// are not copied.
+func (s *Splitter) Split() (int, error) {
+	info, err := s.d.GetFileInfo()
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := s.d.GetNumTracks()
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("could not find any tracks")
+	}
+
+	var tracks []*matroska.TrackInfo
+	for i := uint(0); i < count; i++ {
+		ti, err := s.d.GetTrackInfo(i)
+		if err != nil {
+			return 0, err
+		}
+		tracks = append(tracks, ti)
+	}
+	ref := uint8(matroska.ReferenceTrack(tracks))
+
+	attachments := s.d.GetAttachments()
+	data := make([][]byte, len(attachments))
+	for i, a := range attachments {
+		data[i], err = s.d.ReadAttachment(a)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	tags := s.d.GetTags()
+
+	times := append([]uint64{}, s.times...)
+	if s.chapters {
+		times = append(times, chapterTimes(s.d.GetChapters())...)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	parts := 0
+	nextUID := newUID()
+	open := func(base uint64, prev *part) (*part, error) {
+		w, err := s.create(parts)
+		if err != nil {
+			return nil, err
+		}
+		m, err := matroska.NewMuxer(w)
+		if err != nil {
+			return nil, err
+		}
+		parts++
+
+		p := &part{
+			m:    m,
+			w:    w,
+			uid:  nextUID,
+			base: base,
+		}
+		nextUID = newUID()
+
+		si := &matroska.SegmentInfo{
+			UID:           p.uid,
+			NextUID:       nextUID,
+			Title:         info.Title,
+			TimecodeScale: info.TimecodeScale,
+			DateUTC:       info.DateUTC,
+			DateUTCValid:  info.DateUTCValid,
+		}
+		if prev != nil {
+			si.PrevUID = prev.uid
+		}
+		err = m.SetSegmentInfo(si)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ti := range tracks {
+			_, err = m.AddTrack(ti)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for i, a := range attachments {
+			err = m.AddAttachment(a, data[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(tags) != 0 {
+			err = m.SetTags(tags)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return p, nil
+	}
+
+	var cur, prev *part
+	var size uint64
+	keyframes := 0
+	write := func(target *part, p *matroska.Packet) error {
+		p.StartTime -= target.base
+		if p.EndTime >= target.base {
+			p.EndTime -= target.base
+		} else {
+			p.EndTime = p.StartTime
+		}
+
+		err := target.m.WritePacket(p)
+		if err != nil {
+			return err
+		}
+		if target == cur {
+			size += uint64(len(p.Data))
+		}
+		return nil
+	}
+
+	// Packets of other tracks which come before the first keyframe of the
+	// reference track are held back until it has been read, as they may
+	// still belong to the first part.
+	var pending []*matroska.Packet
+	for {
+		p, err := s.d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return parts, err
+		}
+
+		if p.Track == ref && p.Flags&matroska.KF != 0 {
+			split := false
+			for len(times) != 0 && times[0] <= p.StartTime {
+				times = times[1:]
+				split = true
+			}
+			if s.size != 0 && size >= s.size {
+				split = true
+			}
+			if s.keyframes > 0 && keyframes >= s.keyframes {
+				split = true
+			}
+
+			if cur != nil && keyframes > 0 && split {
+				if prev != nil {
+					err = closePart(prev)
+					if err != nil {
+						return parts, err
+					}
+				}
+				prev = cur
+				cur, err = open(p.StartTime, prev)
+				if err != nil {
+					return parts, err
+				}
+				size = 0
+				keyframes = 0
+			}
+			keyframes++
+		}
+
+		if cur == nil {
+			if p.Track != ref {
+				pending = append(pending, p)
+				continue
+			}
+			if p.Flags&matroska.KF == 0 {
+				continue
+			}
+
+			cur, err = open(p.StartTime, nil)
+			if err != nil {
+				return parts, err
+			}
+			err = write(cur, p)
+			if err != nil {
+				return parts, err
+			}
+			for _, q := range pending {
+				if q.StartTime < cur.base {
+					continue
+				}
+				err = write(cur, q)
+				if err != nil {
+					return parts, err
+				}
+			}
+			pending = nil
+			continue
+		}
+		if prev != nil && p.StartTime >= cur.base+matroska.Lookahead {
+			err = closePart(prev)
+			if err != nil {
+				return parts, err
+			}
+			prev = nil
+		}
+
+		target := cur
+		if p.StartTime < cur.base {
+			if prev == nil || p.Track == ref {
+				continue
+			}
+			target = prev
+		}
+
+		err = write(target, p)
+		if err != nil {
+			return parts, err
+		}
+	}
+
+	if cur == nil && len(pending) != 0 {
+		// Without a keyframe of the reference track, everything else
+		// goes into a single part.
+		base := pending[0].StartTime
+		for _, q := range pending {
+			if q.StartTime < base {
+				base = q.StartTime
+			}
+		}
+		cur, err = open(base, nil)
+		if err != nil {
+			return parts, err
+		}
+		for _, q := range pending {
+			err = write(cur, q)
+			if err != nil {
+				return parts, err
+			}
+		}
+	}
+
+	if prev != nil {
+		err = closePart(prev)
+		if err != nil {
+			return parts, err
+		}
+	}
+	if cur != nil {
+		// The last part has nothing to link to.
+		err = cur.m.SetNextUID([16]byte{})
+		if err != nil {
+			return parts, err
+		}
+		err = closePart(cur)
+		if err != nil {
+			return parts, err
+		}
+	}
+
+	return parts, nil
+}
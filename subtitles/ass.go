@@ -0,0 +1,320 @@
+package subtitles
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultASSHeader = `[Script Info]
+ScriptType: v4.00+
+PlayResX: 384
+PlayResY: 288
+WrapStyle: 0
+ScaledBorderAndShadow: yes
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Default,Arial,16,&H00FFFFFF,&H00FFFFFF,&H00000000,&H00000000,0,0,0,0,100,100,0,0,1,1,0,2,10,10,10,1
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+
+const defaultSSAHeader = `[Script Info]
+ScriptType: v4.00
+PlayResX: 384
+PlayResY: 288
+
+[V4 Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, TertiaryColour, BackColour, Bold, Italic, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, AlphaLevel, Encoding
+Style: Default,Arial,16,16777215,16777215,16777215,0,0,0,1,1,0,2,10,10,10,0,1
+
+[Events]
+Format: Marked, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+
+// The order of fields inside a Matroska ASS/SSA block.
+//
+// See: https://www.matroska.org/technical/subtitles.html#ssaass-subtitles
+const assBlockFields = 9
+
+func parseASSBlock(ev *Event, data []byte) error {
+	fields := strings.SplitN(strings.TrimRight(string(data), "\x00\r\n"), ",", assBlockFields)
+	if len(fields) != assBlockFields {
+		return fmt.Errorf("invalid ASS block: %q", string(data))
+	}
+
+	order, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return fmt.Errorf("invalid ASS ReadOrder: %s", fields[0])
+	}
+
+	ev.ReadOrder = order
+	ev.Layer = fields[1]
+	ev.Style = fields[2]
+	ev.Name = fields[3]
+	ev.MarginL = fields[4]
+	ev.MarginR = fields[5]
+	ev.MarginV = fields[6]
+	ev.Effect = fields[7]
+	ev.Text = fields[8]
+
+	return nil
+}
+
+func sortByReadOrder(events []*Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].ReadOrder < events[j].ReadOrder
+	})
+}
+
+func sortedByStart(events []*Event) []*Event {
+	ret := make([]*Event, len(events))
+	copy(ret, events)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Start < ret[j].Start
+	})
+	return ret
+}
+
+// formatASSTime formats a nanosecond timestamp as H:MM:SS.cc.
+func formatASSTime(ns uint64) string {
+	cs := ns / 10000000
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, (cs/6000)%60, (cs/100)%60, cs%100)
+}
+
+// eventFormat returns the event field names listed in the last Format line
+// of the [Events] section of header, lower-cased.
+func eventFormat(header string, format Format) []string {
+	var ret []string
+
+	inEvents := false
+	for _, line := range strings.Split(normalizeNewlines(header), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if inEvents && strings.HasPrefix(line, "Format:") {
+			ret = nil
+			for _, f := range strings.Split(line[len("Format:"):], ",") {
+				ret = append(ret, strings.ToLower(strings.TrimSpace(f)))
+			}
+		}
+	}
+
+	if len(ret) == 0 || ret[len(ret)-1] != "text" {
+		if format == SSA {
+			return []string{"marked", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+		}
+		return []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+	}
+
+	return ret
+}
+
+func parseASS(r io.Reader, format Format) (*Document, error) {
+	doc := &Document{
+		Format: format,
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var header []string
+	var fields []string
+	section := ""
+	order := 0
+	first := true
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.ToLower(trimmed)
+			if section == "[events]" || fields == nil {
+				header = append(header, line)
+			}
+			continue
+		}
+
+		if section != "[events]" {
+			// Anything after the events ([Fonts], [Graphics]) is not
+			// part of the header Matroska would store, and is dropped.
+			if fields == nil {
+				header = append(header, line)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "Format:") {
+			header = append(header, line)
+			fields = eventFormat(strings.Join(header, "\n"), format)
+			continue
+		}
+
+		if !strings.HasPrefix(trimmed, "Dialogue:") {
+			continue
+		}
+
+		if fields == nil {
+			fields = eventFormat("", format)
+		}
+
+		values := strings.SplitN(strings.TrimSpace(trimmed[len("Dialogue:"):]), ",", len(fields))
+		if len(values) != len(fields) {
+			return nil, fmt.Errorf("invalid Dialogue line: %s", line)
+		}
+
+		ev := &Event{
+			ReadOrder: order,
+		}
+		order++
+
+		for i, f := range fields {
+			v := values[i]
+			switch f {
+			case "layer", "marked":
+				ev.Layer = v
+			case "start":
+				t, err := parseTime(v)
+				if err != nil {
+					return nil, err
+				}
+				ev.Start = t
+			case "end":
+				t, err := parseTime(v)
+				if err != nil {
+					return nil, err
+				}
+				ev.End = t
+			case "style":
+				ev.Style = v
+			case "name", "actor":
+				ev.Name = v
+			case "marginl":
+				ev.MarginL = v
+			case "marginr":
+				ev.MarginR = v
+			case "marginv":
+				ev.MarginV = v
+			case "effect":
+				ev.Effect = v
+			case "text":
+				ev.Text = v
+			}
+		}
+
+		doc.Events = append(doc.Events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if fields == nil && len(doc.Events) == 0 && len(header) == 0 {
+		return nil, fmt.Errorf("not an %s script", format)
+	}
+
+	doc.Header = strings.Join(header, "\n") + "\n"
+
+	return doc, nil
+}
+
+// assHeader returns the header to use when writing doc as an ASS or SSA
+// script, making sure it ends with an [Events] section and Format line.
+//
+// Style sections differ between ASS and SSA, so converting between the two
+// falls back to the default header.
+func (doc *Document) assHeader(format Format) string {
+	if doc.Format != format || strings.TrimSpace(doc.Header) == "" {
+		if format == SSA {
+			return defaultSSAHeader
+		}
+		return defaultASSHeader
+	}
+
+	header := strings.TrimRight(normalizeNewlines(doc.Header), "\n") + "\n"
+
+	hasEvents := false
+	for _, line := range strings.Split(header, "\n") {
+		if strings.EqualFold(strings.TrimSpace(line), "[Events]") {
+			hasEvents = true
+		}
+	}
+
+	if !hasEvents {
+		f := "Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n"
+		if format == SSA {
+			f = "Format: Marked, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n"
+		}
+		header += "\n[Events]\n" + f
+	}
+
+	return header
+}
+
+func orDefault(s string, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func (doc *Document) writeASS(w io.Writer, format Format) error {
+	bw := bufio.NewWriter(w)
+
+	header := doc.assHeader(format)
+	fields := eventFormat(header, format)
+
+	bw.WriteString(header)
+
+	events := doc.Events
+	if doc.Format != ASS && doc.Format != SSA {
+		events = sortedByStart(events)
+	}
+
+	values := make([]string, len(fields))
+	for _, ev := range events {
+		for i, f := range fields {
+			switch f {
+			case "layer":
+				values[i] = orDefault(strings.TrimPrefix(ev.Layer, "Marked="), "0")
+			case "marked":
+				values[i] = "Marked=" + orDefault(strings.TrimPrefix(ev.Layer, "Marked="), "0")
+			case "start":
+				values[i] = formatASSTime(ev.Start)
+			case "end":
+				values[i] = formatASSTime(ev.End)
+			case "style":
+				values[i] = orDefault(ev.Style, "Default")
+			case "name", "actor":
+				values[i] = ev.Name
+			case "marginl":
+				values[i] = orDefault(ev.MarginL, "0")
+			case "marginr":
+				values[i] = orDefault(ev.MarginR, "0")
+			case "marginv":
+				values[i] = orDefault(ev.MarginV, "0")
+			case "effect":
+				values[i] = ev.Effect
+			case "text":
+				values[i] = convertText(ev.Text, doc.Format, format)
+			default:
+				values[i] = ""
+			}
+		}
+
+		fmt.Fprintf(bw, "Dialogue: %s\n", strings.Join(values, ","))
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,188 @@
+// Package bitmap implements decoding of bitmap subtitle tracks (S_HDMV/PGS and
+// S_VOBSUB) from a matroska.Demuxer into images, as well as exporting them to
+// their usual standalone formats (.sup, and .idx/.sub pairs).
+package bitmap
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Frame is a single decoded subtitle picture.
+type Frame struct {
+	// Start time in nanoseconds.
+	Start uint64
+	// End time in nanoseconds. May be 0 when returned directly from a
+	// decoder, if it is not known until the next frame arrives.
+	End uint64
+	// Horizontal display position of the image's top left corner, in
+	// pixels relative to the video frame.
+	X int
+	// Vertical display position of the image's top left corner.
+	Y int
+	// Width of the video frame the subtitle was authored for, if known.
+	ScreenWidth int
+	// Height of the video frame the subtitle was authored for, if known.
+	ScreenHeight int
+	// The decoded picture. Nil if this frame clears the screen.
+	Image *image.Paletted
+	// Whether or not this frame should be shown even if subtitles
+	// are turned off.
+	Forced bool
+}
+
+// Decoder is implemented by the bitmap subtitle decoders in this package.
+type Decoder interface {
+	// Decode decodes a single Matroska packet. It may return a nil
+	// Frame if the packet did not complete a picture.
+	Decode(p *matroska.Packet) (*Frame, error)
+}
+
+// NewDecoder returns the appropriate decoder for the given track. Packets
+// of tracks using zlib or header stripping compression, as mkvmerge does
+// by default for both codecs, are decompressed before decoding.
+func NewDecoder(ti *matroska.TrackInfo) (Decoder, error) {
+	err := checkCompression(ti)
+	if err != nil {
+		return nil, err
+	}
+
+	var dec Decoder
+	switch ti.CodecID {
+	case "S_HDMV/PGS":
+		dec = NewPGSDecoder()
+	case "S_VOBSUB":
+		dec, err = NewVobSubDecoder(ti.CodecPrivate)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported bitmap subtitle codec: %s", ti.CodecID)
+	}
+
+	if ti.CompEnabled {
+		dec = &compressedDecoder{
+			dec: dec,
+			ti:  ti,
+		}
+	}
+
+	return dec, nil
+}
+
+// compressedDecoder decompresses packets before passing them on.
+type compressedDecoder struct {
+	dec Decoder
+	ti  *matroska.TrackInfo
+}
+
+func (cd *compressedDecoder) Decode(p *matroska.Packet) (*Frame, error) {
+	data, err := packetData(cd.ti, p)
+	if err != nil {
+		return nil, err
+	}
+
+	q := *p
+	q.Data = data
+	return cd.dec.Decode(&q)
+}
+
+// checkCompression returns an error if the track uses a compression
+// method packetData cannot undo.
+func checkCompression(ti *matroska.TrackInfo) error {
+	if ti.CompEnabled && ti.CompMethod != matroska.CompZlib && ti.CompMethod != matroska.CompPrepend {
+		return fmt.Errorf("could not decode track %d: unsupported compression %d", ti.Number, ti.CompMethod)
+	}
+	return nil
+}
+
+// packetData returns the decompressed data of a packet.
+func packetData(ti *matroska.TrackInfo, p *matroska.Packet) ([]byte, error) {
+	if !ti.CompEnabled {
+		return p.Data, nil
+	}
+
+	switch ti.CompMethod {
+	case matroska.CompZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(p.Data))
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress packet: %s", err.Error())
+		}
+		defer zr.Close()
+
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress packet: %s", err.Error())
+		}
+		return data, nil
+	case matroska.CompPrepend:
+		data := make([]byte, 0, len(ti.CompMethodPrivate)+len(p.Data))
+		data = append(data, ti.CompMethodPrivate...)
+		return append(data, p.Data...), nil
+	}
+
+	return nil, fmt.Errorf("could not decode track %d: unsupported compression %d", ti.Number, ti.CompMethod)
+}
+
+// Extract decodes all packets of the given track from d, and returns the
+// resulting frames with their end times resolved. Frames which only clear
+// the screen are not returned.
+//
+// Packets are read from the demuxer's current position until EOF.
+func Extract(d *matroska.Demuxer, track uint) ([]*Frame, error) {
+	ti, err := d.GetTrackInfo(track)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := NewDecoder(ti)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*Frame
+	var last *Frame
+
+	mask := ^(uint64(1) << track)
+	for {
+		p, err := d.ReadPacketMask(mask)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		f, err := dec.Decode(p)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			continue
+		}
+
+		if last != nil && (last.End == 0 || last.End > f.Start) {
+			last.End = f.Start
+		}
+		last = nil
+
+		if f.Image != nil {
+			ret = append(ret, f)
+			last = f
+		}
+	}
+
+	return ret, nil
+}
+
+// trimLanguage turns the NUL-padded language codes returned by the
+// demuxer into something usable.
+func trimLanguage(lang string) string {
+	return strings.TrimRight(lang, "\x00 ")
+}
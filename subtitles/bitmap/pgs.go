@@ -0,0 +1,485 @@
+package bitmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// PGS segment types.
+const (
+	pgsPDS = 0x14
+	pgsODS = 0x15
+	pgsPCS = 0x16
+	pgsWDS = 0x17
+	pgsEND = 0x80
+)
+
+type pgsPaletteEntry struct {
+	y, cr, cb, a uint8
+	set          bool
+}
+
+type pgsObject struct {
+	width  int
+	height int
+	length int
+	data   []byte
+}
+
+type pgsCompObject struct {
+	id     uint16
+	window uint8
+	forced bool
+	x, y   int
+	crop   *image.Rectangle
+}
+
+type pgsComposition struct {
+	width, height int
+	state         uint8
+	paletteID     uint8
+	objects       []pgsCompObject
+}
+
+// PGSDecoder decodes HDMV Presentation Graphic Stream (Blu-ray) subtitles.
+//
+// A Matroska S_HDMV/PGS block contains one or more PGS segments, without
+// the "PG" headers and timestamps found in .sup files.
+type PGSDecoder struct {
+	palettes map[uint8]*[256]pgsPaletteEntry
+	objects  map[uint16]*pgsObject
+	comp     *pgsComposition
+	start    uint64
+	end      uint64
+}
+
+// NewPGSDecoder creates a new PGS decoder.
+func NewPGSDecoder() *PGSDecoder {
+	return &PGSDecoder{
+		palettes: make(map[uint8]*[256]pgsPaletteEntry),
+		objects:  make(map[uint16]*pgsObject),
+	}
+}
+
+// Decode decodes all segments in a PGS packet. A Frame is returned once a
+// complete display set has been decoded.
+func (pd *PGSDecoder) Decode(p *matroska.Packet) (*Frame, error) {
+	var ret *Frame
+
+	data := p.Data
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("truncated PGS segment header")
+		}
+
+		typ := data[0]
+		size := int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) < 3+size {
+			return nil, fmt.Errorf("truncated PGS segment")
+		}
+		seg := data[3 : 3+size]
+		data = data[3+size:]
+
+		var err error
+		switch typ {
+		case pgsPCS:
+			err = pd.parsePCS(seg)
+			pd.start = p.StartTime
+			pd.end = 0
+			if p.Flags&matroska.UnknownEnd == 0 && p.EndTime > p.StartTime {
+				pd.end = p.EndTime
+			}
+		case pgsWDS:
+			// Windows only bound where objects may be drawn. The
+			// composition objects carry all the positioning we need.
+		case pgsPDS:
+			err = pd.parsePDS(seg)
+		case pgsODS:
+			err = pd.parseODS(seg)
+		case pgsEND:
+			ret, err = pd.compose()
+		default:
+			err = fmt.Errorf("unknown PGS segment type: 0x%02x", typ)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (pd *PGSDecoder) parsePCS(seg []byte) error {
+	if len(seg) < 11 {
+		return fmt.Errorf("truncated PGS presentation composition segment")
+	}
+
+	c := &pgsComposition{
+		width:     int(binary.BigEndian.Uint16(seg[0:])),
+		height:    int(binary.BigEndian.Uint16(seg[2:])),
+		state:     seg[7],
+		paletteID: seg[9],
+	}
+
+	// Epoch start; everything from before is gone.
+	if c.state&0x80 != 0 {
+		pd.palettes = make(map[uint8]*[256]pgsPaletteEntry)
+		pd.objects = make(map[uint16]*pgsObject)
+	}
+
+	n := int(seg[10])
+	seg = seg[11:]
+	for i := 0; i < n; i++ {
+		if len(seg) < 8 {
+			return fmt.Errorf("truncated PGS composition object")
+		}
+
+		o := pgsCompObject{
+			id:     binary.BigEndian.Uint16(seg[0:]),
+			window: seg[2],
+			forced: seg[3]&0x40 != 0,
+			x:      int(binary.BigEndian.Uint16(seg[4:])),
+			y:      int(binary.BigEndian.Uint16(seg[6:])),
+		}
+
+		if seg[3]&0x80 != 0 {
+			if len(seg) < 16 {
+				return fmt.Errorf("truncated PGS composition object")
+			}
+			cx := int(binary.BigEndian.Uint16(seg[8:]))
+			cy := int(binary.BigEndian.Uint16(seg[10:]))
+			cw := int(binary.BigEndian.Uint16(seg[12:]))
+			ch := int(binary.BigEndian.Uint16(seg[14:]))
+			r := image.Rect(cx, cy, cx+cw, cy+ch)
+			o.crop = &r
+			seg = seg[16:]
+		} else {
+			seg = seg[8:]
+		}
+
+		c.objects = append(c.objects, o)
+	}
+
+	pd.comp = c
+
+	return nil
+}
+
+func (pd *PGSDecoder) parsePDS(seg []byte) error {
+	if len(seg) < 2 {
+		return fmt.Errorf("truncated PGS palette definition segment")
+	}
+
+	pal, ok := pd.palettes[seg[0]]
+	if !ok {
+		pal = new([256]pgsPaletteEntry)
+		pd.palettes[seg[0]] = pal
+	}
+
+	for seg = seg[2:]; len(seg) >= 5; seg = seg[5:] {
+		pal[seg[0]] = pgsPaletteEntry{
+			y:   seg[1],
+			cr:  seg[2],
+			cb:  seg[3],
+			a:   seg[4],
+			set: true,
+		}
+	}
+
+	return nil
+}
+
+func (pd *PGSDecoder) parseODS(seg []byte) error {
+	if len(seg) < 4 {
+		return fmt.Errorf("truncated PGS object definition segment")
+	}
+
+	id := binary.BigEndian.Uint16(seg[0:])
+	flags := seg[3]
+	seg = seg[4:]
+
+	if flags&0x80 != 0 {
+		if len(seg) < 7 {
+			return fmt.Errorf("truncated PGS object definition segment")
+		}
+
+		o := &pgsObject{
+			// The length includes the width and height fields.
+			length: int(seg[0])<<16 | int(seg[1])<<8 | int(seg[2]) - 4,
+			width:  int(binary.BigEndian.Uint16(seg[3:])),
+			height: int(binary.BigEndian.Uint16(seg[5:])),
+		}
+		pd.objects[id] = o
+		seg = seg[7:]
+	}
+
+	o, ok := pd.objects[id]
+	if !ok {
+		// A continuation without a start; nothing we can do.
+		return nil
+	}
+
+	o.data = append(o.data, seg...)
+
+	return nil
+}
+
+func (pd *PGSDecoder) compose() (*Frame, error) {
+	c := pd.comp
+	pd.comp = nil
+	if c == nil {
+		return nil, nil
+	}
+
+	f := &Frame{
+		Start:        pd.start,
+		End:          pd.end,
+		ScreenWidth:  c.width,
+		ScreenHeight: c.height,
+	}
+
+	if len(c.objects) == 0 {
+		return f, nil
+	}
+
+	pal := pgsPalette(pd.palettes[c.paletteID], c.height > 576)
+
+	var bounds image.Rectangle
+	var imgs []*image.Paletted
+	var offsets []image.Point
+	for _, co := range c.objects {
+		o, ok := pd.objects[co.id]
+		if !ok {
+			continue
+		}
+
+		img, err := decodePGSRLE(o, pal)
+		if err != nil {
+			return nil, err
+		}
+
+		if co.crop != nil {
+			img = img.SubImage(co.crop.Intersect(img.Bounds())).(*image.Paletted)
+		}
+
+		off := image.Pt(co.x, co.y).Sub(img.Bounds().Min)
+		bounds = bounds.Union(img.Bounds().Add(off))
+		imgs = append(imgs, img)
+		offsets = append(offsets, off)
+
+		if co.forced {
+			f.Forced = true
+		}
+	}
+
+	if len(imgs) == 0 {
+		return f, nil
+	}
+
+	// Everything not covered by an object is transparent, which is
+	// palette entry 0xff in practice, and guaranteed transparent by
+	// pgsPalette if it is undefined.
+	canvas := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), pal)
+	for i := range canvas.Pix {
+		canvas.Pix[i] = transparentIndex(pal)
+	}
+
+	for i, img := range imgs {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				p := image.Pt(x, y).Add(offsets[i]).Sub(bounds.Min)
+				canvas.SetColorIndex(p.X, p.Y, img.ColorIndexAt(x, y))
+			}
+		}
+	}
+
+	f.X = bounds.Min.X
+	f.Y = bounds.Min.Y
+	f.Image = canvas
+
+	return f, nil
+}
+
+func transparentIndex(pal color.Palette) uint8 {
+	for i := len(pal) - 1; i >= 0; i-- {
+		if c, ok := pal[i].(color.NRGBA); ok && c.A == 0 {
+			return uint8(i)
+		}
+	}
+	return 0xff
+}
+
+func clamp8(v float64) uint8 {
+	v = math.Floor(v + 0.5)
+	if v < 0 {
+		return 0
+	} else if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// ycbcrToNRGBA converts limited range YCbCr to RGB using either BT.709
+// or BT.601 coefficients.
+func ycbcrToNRGBA(y, cb, cr, a uint8, bt709 bool) color.NRGBA {
+	yf := (float64(y) - 16) * 255 / 219
+	cbf := (float64(cb) - 128) * 255 / 224
+	crf := (float64(cr) - 128) * 255 / 224
+
+	if bt709 {
+		return color.NRGBA{
+			R: clamp8(yf + 1.5748*crf),
+			G: clamp8(yf - 0.1873*cbf - 0.4681*crf),
+			B: clamp8(yf + 1.8556*cbf),
+			A: a,
+		}
+	}
+
+	return color.NRGBA{
+		R: clamp8(yf + 1.402*crf),
+		G: clamp8(yf - 0.344136*cbf - 0.714136*crf),
+		B: clamp8(yf + 1.772*cbf),
+		A: a,
+	}
+}
+
+func pgsPalette(entries *[256]pgsPaletteEntry, bt709 bool) color.Palette {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		if entries == nil || !entries[i].set {
+			pal[i] = color.NRGBA{}
+			continue
+		}
+		e := entries[i]
+		pal[i] = ycbcrToNRGBA(e.y, e.cb, e.cr, e.a, bt709)
+	}
+	return pal
+}
+
+func decodePGSRLE(o *pgsObject, pal color.Palette) (*image.Paletted, error) {
+	img := image.NewPaletted(image.Rect(0, 0, o.width, o.height), pal)
+
+	data := o.data
+	x, y := 0, 0
+	i := 0
+
+	next := func() (byte, error) {
+		if i >= len(data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		b := data[i]
+		i++
+		return b, nil
+	}
+
+	for y < o.height && i < len(data) {
+		b, _ := next()
+
+		col := b
+		run := 1
+
+		if b == 0 {
+			flags, err := next()
+			if err != nil {
+				return nil, fmt.Errorf("truncated PGS RLE data")
+			}
+
+			if flags == 0 {
+				x = 0
+				y++
+				continue
+			}
+
+			run = int(flags & 0x3f)
+			if flags&0x40 != 0 {
+				lo, err := next()
+				if err != nil {
+					return nil, fmt.Errorf("truncated PGS RLE data")
+				}
+				run = run<<8 | int(lo)
+			}
+
+			col = 0
+			if flags&0x80 != 0 {
+				col, err = next()
+				if err != nil {
+					return nil, fmt.Errorf("truncated PGS RLE data")
+				}
+			}
+		}
+
+		for ; run > 0 && x < o.width; run-- {
+			img.Pix[y*img.Stride+x] = col
+			x++
+		}
+	}
+
+	return img, nil
+}
+
+// ExportSUP writes all packets of the given PGS track from d to w as a .sup
+// file, which is the raw segment stream with a "PG" header carrying the
+// presentation timestamp in front of every segment.
+//
+// Packets are read from the demuxer's current position until EOF.
+func ExportSUP(d *matroska.Demuxer, track uint, w io.Writer) error {
+	ti, err := d.GetTrackInfo(track)
+	if err != nil {
+		return err
+	}
+	if ti.CodecID != "S_HDMV/PGS" {
+		return fmt.Errorf("track %d is not a PGS track", track)
+	}
+	err = checkCompression(ti)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 10)
+	hdr[0] = 'P'
+	hdr[1] = 'G'
+
+	mask := ^(uint64(1) << track)
+	for {
+		p, err := d.ReadPacketMask(mask)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// 90kHz, truncated to 32 bits like the format requires.
+		pts := uint32(p.StartTime * 9 / 100000)
+		binary.BigEndian.PutUint32(hdr[2:], pts)
+		binary.BigEndian.PutUint32(hdr[6:], 0)
+
+		data, err := packetData(ti, p)
+		if err != nil {
+			return err
+		}
+		for len(data) >= 3 {
+			size := 3 + int(binary.BigEndian.Uint16(data[1:]))
+			if size > len(data) {
+				return fmt.Errorf("truncated PGS segment")
+			}
+
+			_, err = w.Write(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data[:size])
+			if err != nil {
+				return err
+			}
+
+			data = data[size:]
+		}
+	}
+}
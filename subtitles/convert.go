@@ -0,0 +1,241 @@
+package subtitles
+
+import (
+	"strings"
+)
+
+// Event text is converted between formats by way of a tiny intermediate
+// representation, which only knows about text, line breaks, and the
+// italic/bold/underline styling that all of the formats have in common.
+// Everything else (colours, positioning, karaoke, VTT classes and voices)
+// is dropped on conversion.
+
+type token struct {
+	// Text content. Empty for style tokens.
+	text string
+	// Style this token toggles: 'i', 'b' or 'u'. Zero for text.
+	style byte
+	// Whether a style is turned on or off.
+	on bool
+}
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+var htmlUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", "\u00a0", "&lrm;", "\u200e", "&rlm;", "\u200f")
+
+func convertText(text string, from Format, to Format) string {
+	var tokens []token
+
+	switch from {
+	case ASS, SSA:
+		if to == ASS || to == SSA {
+			return text
+		}
+		tokens = tokenizeASS(text)
+	case WebVTT:
+		if to == WebVTT {
+			return stripBlankLines(text)
+		}
+		tokens = tokenizeHTML(text, true)
+	default:
+		if to == SRT {
+			return stripBlankLines(text)
+		}
+		tokens = tokenizeHTML(text, false)
+	}
+
+	switch to {
+	case ASS, SSA:
+		return renderASS(tokens)
+	case WebVTT:
+		return stripBlankLines(renderHTML(tokens, true))
+	default:
+		return stripBlankLines(renderHTML(tokens, false))
+	}
+}
+
+// stripBlankLines removes empty lines, since they terminate cues in both
+// SRT and WebVTT.
+func stripBlankLines(s string) string {
+	var lines []string
+	for _, l := range strings.Split(normalizeNewlines(s), "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func tokenizeHTML(text string, unescape bool) []token {
+	var ret []token
+
+	appendText := func(s string) {
+		if s == "" {
+			return
+		}
+		if unescape {
+			s = htmlUnescaper.Replace(s)
+		}
+		ret = append(ret, token{text: s})
+	}
+
+	for len(text) > 0 {
+		start := strings.IndexByte(text, '<')
+		if start < 0 {
+			appendText(text)
+			break
+		}
+		end := strings.IndexByte(text[start:], '>')
+		if end < 0 {
+			appendText(text)
+			break
+		}
+		end += start
+
+		appendText(text[:start])
+
+		tag := strings.ToLower(strings.TrimSpace(text[start+1 : end]))
+		on := true
+		if strings.HasPrefix(tag, "/") {
+			on = false
+			tag = tag[1:]
+		}
+		// Strip classes (<i.loud>) and annotations (<b foo>).
+		if i := strings.IndexAny(tag, ". \t"); i >= 0 {
+			tag = tag[:i]
+		}
+
+		switch tag {
+		case "i", "b", "u":
+			ret = append(ret, token{style: tag[0], on: on})
+		}
+
+		text = text[end+1:]
+	}
+
+	return ret
+}
+
+func tokenizeASS(text string) []token {
+	var ret []token
+	var buf strings.Builder
+	drawing := false
+
+	flush := func() {
+		if buf.Len() > 0 && !drawing {
+			ret = append(ret, token{text: buf.String()})
+		}
+		buf.Reset()
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '{':
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				buf.WriteString(text[i:])
+				i = len(text)
+				break
+			}
+			flush()
+			for _, o := range strings.Split(text[i+1:i+end], "\\")[1:] {
+				o = strings.TrimSpace(o)
+				switch {
+				case len(o) == 0:
+				case o[0] == 'p' && len(o) > 1 && o[1] >= '0' && o[1] <= '9':
+					drawing = o[1:] != "0"
+				case (o[0] == 'i' || o[0] == 'u') && (o[1:] == "" || o[1:] == "0" || o[1:] == "1"):
+					ret = append(ret, token{style: o[0], on: o[1:] == "1"})
+				case o[0] == 'b' && len(o) > 1 && o[1] >= '0' && o[1] <= '9':
+					ret = append(ret, token{style: 'b', on: o[1:] != "0" && o[1:] != "400"})
+				case o[0] == 'b' && len(o) == 1:
+					ret = append(ret, token{style: 'b', on: false})
+				case o[0] == 'r':
+					// Reset to style defaults; the best we can do is turn
+					// everything off.
+					ret = append(ret, token{style: 'i'}, token{style: 'b'}, token{style: 'u'})
+				}
+			}
+			i += end
+		case c == '\\' && i+1 < len(text) && (text[i+1] == 'N' || text[i+1] == 'n'):
+			buf.WriteByte('\n')
+			i++
+		case c == '\\' && i+1 < len(text) && text[i+1] == 'h':
+			buf.WriteString("\u00a0")
+			i++
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+
+	return ret
+}
+
+func renderHTML(tokens []token, escape bool) string {
+	var sb strings.Builder
+	var open []byte
+
+	isOpen := func(s byte) int {
+		for i, o := range open {
+			if o == s {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, t := range tokens {
+		if t.style == 0 {
+			if escape {
+				sb.WriteString(htmlEscaper.Replace(t.text))
+			} else {
+				sb.WriteString(t.text)
+			}
+			continue
+		}
+
+		idx := isOpen(t.style)
+		if t.on && idx < 0 {
+			sb.WriteString("<" + string(t.style) + ">")
+			open = append(open, t.style)
+		} else if !t.on && idx >= 0 {
+			// Close in reverse order to keep the markup properly nested,
+			// and reopen anything that should still be on.
+			for j := len(open) - 1; j >= idx; j-- {
+				sb.WriteString("</" + string(open[j]) + ">")
+			}
+			reopen := append([]byte(nil), open[idx+1:]...)
+			open = open[:idx]
+			for _, s := range reopen {
+				sb.WriteString("<" + string(s) + ">")
+				open = append(open, s)
+			}
+		}
+	}
+
+	for j := len(open) - 1; j >= 0; j-- {
+		sb.WriteString("</" + string(open[j]) + ">")
+	}
+
+	return sb.String()
+}
+
+func renderASS(tokens []token) string {
+	var sb strings.Builder
+
+	for _, t := range tokens {
+		if t.style == 0 {
+			sb.WriteString(strings.Replace(normalizeNewlines(t.text), "\n", "\\N", -1))
+			continue
+		}
+
+		v := "0"
+		if t.on {
+			v = "1"
+		}
+		sb.WriteString("{\\" + string(t.style) + v + "}")
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,154 @@
+package subtitles
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// formatTime formats a nanosecond timestamp as HH:MM:SS<sep>mmm, which
+// is shared between SRT and WebVTT.
+func formatTime(ns uint64, sep byte) string {
+	ms := ns / 1000000
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, (ms/60000)%60, (ms/1000)%60, sep, ms%1000)
+}
+
+// parseTime parses [HH:]MM:SS(.|,)mmm timestamps into nanoseconds. It is
+// deliberately lenient, since real world files are not.
+func parseTime(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	s = strings.Replace(s, ",", ".", 1)
+
+	var frac uint64
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		f := s[i+1:]
+		for len(f) < 3 {
+			f += "0"
+		}
+		v, err := strconv.ParseUint(f[:3], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp: %s", s)
+		}
+		frac = v
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+
+	var secs uint64
+	for _, p := range parts {
+		v, err := strconv.ParseUint(strings.TrimSpace(p), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp: %s", s)
+		}
+		secs = secs*60 + v
+	}
+
+	return (secs*1000 + frac) * 1000000, nil
+}
+
+// parseTiming parses a "start --> end [settings]" line.
+func parseTiming(line string) (start uint64, end uint64, settings string, err error) {
+	i := strings.Index(line, "-->")
+	if i < 0 {
+		return 0, 0, "", fmt.Errorf("invalid timing line: %s", line)
+	}
+
+	start, err = parseTime(line[:i])
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	rest := strings.Fields(line[i+3:])
+	if len(rest) == 0 {
+		return 0, 0, "", fmt.Errorf("invalid timing line: %s", line)
+	}
+
+	end, err = parseTime(rest[0])
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	return start, end, strings.Join(rest[1:], " "), nil
+}
+
+func parseSRT(r io.Reader) (*Document, error) {
+	doc := &Document{
+		Format: SRT,
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var ev *Event
+	var lines []string
+	first := true
+
+	flush := func() {
+		if ev != nil {
+			ev.Text = strings.Join(lines, "\n")
+			doc.Events = append(doc.Events, ev)
+		}
+		ev = nil
+		lines = nil
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+
+		if ev == nil {
+			if strings.Contains(line, "-->") {
+				start, end, _, err := parseTiming(line)
+				if err != nil {
+					return nil, err
+				}
+				ev = &Event{
+					Start: start,
+					End:   end,
+				}
+			}
+			// Anything else here is a counter line or junk.
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	flush()
+
+	return doc, nil
+}
+
+func (doc *Document) writeSRT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	n := 1
+	for _, ev := range sortedByStart(doc.Events) {
+		text := convertText(ev.Text, doc.Format, SRT)
+		if text == "" {
+			continue
+		}
+
+		fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n\n", n, formatTime(ev.Start, ','), formatTime(ev.End, ','), text)
+		n++
+	}
+
+	return bw.Flush()
+}
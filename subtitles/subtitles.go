@@ -0,0 +1,235 @@
+// Package subtitles implements extraction of text subtitle tracks from a
+// matroska.Demuxer into complete SRT, WebVTT and ASS/SSA documents, as well
+// as conversion between those formats.
+//
+// Matroska stores text subtitles as bare block payloads, with timing in the
+// block itself, and for ASS/SSA, with the script header in CodecPrivate and the
+// event fields reordered. This package puts all of that back together.
+package subtitles
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Format is a text subtitle document format.
+type Format int
+
+// Supported formats.
+const (
+	SRT Format = iota
+	WebVTT
+	ASS
+	SSA
+)
+
+func (f Format) String() string {
+	switch f {
+	case SRT:
+		return "SRT"
+	case WebVTT:
+		return "WebVTT"
+	case ASS:
+		return "ASS"
+	case SSA:
+		return "SSA"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Event is a single subtitle event (a cue, or a Dialogue line).
+type Event struct {
+	// Start time in nanoseconds.
+	Start uint64
+	// End time in nanoseconds.
+	End uint64
+	// The event text, in the markup of the document format it
+	// came from. Lines are separated by '\n' for SRT and WebVTT, and
+	// by "\N" for ASS/SSA.
+	Text string
+
+	// The original position of the event in the script. Only
+	// meaningful for ASS/SSA.
+	ReadOrder int
+	// ASS/SSA layer (or Marked, for SSA).
+	Layer string
+	// ASS/SSA style name.
+	Style string
+	// ASS/SSA actor name.
+	Name string
+	// ASS/SSA margins.
+	MarginL, MarginR, MarginV string
+	// ASS/SSA transition effect.
+	Effect string
+
+	// WebVTT cue identifier.
+	ID string
+	// WebVTT cue settings, e.g. "align:start line:0".
+	Settings string
+}
+
+// Document is a complete text subtitle document.
+type Document struct {
+	// The format the events' text is in.
+	Format Format
+	// The format-specific header. For ASS/SSA, this is the whole
+	// script up to and including the [Events] Format line. For WebVTT,
+	// this is everything in the file before the first cue, including
+	// the WEBVTT line. Empty for SRT.
+	Header string
+	// All events in the document, in presentation order.
+	Events []*Event
+}
+
+// FormatForCodec returns the document format used by the given Matroska
+// CodecID, or an error if it is not a supported text subtitle codec.
+func FormatForCodec(codecID string) (Format, error) {
+	switch codecID {
+	case "S_TEXT/UTF8", "S_TEXT/ASCII":
+		return SRT, nil
+	case "S_TEXT/WEBVTT", "D_WEBVTT/SUBTITLES", "D_WEBVTT/CAPTIONS", "D_WEBVTT/DESCRIPTIONS":
+		return WebVTT, nil
+	case "S_TEXT/ASS", "S_ASS":
+		return ASS, nil
+	case "S_TEXT/SSA", "S_SSA":
+		return SSA, nil
+	}
+	return 0, fmt.Errorf("unsupported subtitle codec: %s", codecID)
+}
+
+// Extract reads all packets of the given track from d and rebuilds a
+// complete subtitle document from them, using the packets' StartTime and
+// EndTime for timing.
+//
+// Packets are read from the demuxer's current position until EOF; packets
+// belonging to other tracks are skipped. For S_TEXT/WEBVTT, cue identifiers
+// and settings are taken from the packets' BlockAdditions. Comments stored
+// there are dropped.
+func Extract(d *matroska.Demuxer, track uint) (*Document, error) {
+	ti, err := d.GetTrackInfo(track)
+	if err != nil {
+		return nil, err
+	}
+
+	if ti.Type != matroska.TypeSubtitle {
+		return nil, fmt.Errorf("track %d is not a subtitle track", track)
+	}
+
+	format, err := FormatForCodec(ti.CodecID)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &Document{
+		Format: format,
+	}
+
+	switch format {
+	case ASS, SSA:
+		doc.Header = string(ti.CodecPrivate)
+	case WebVTT:
+		doc.Header = string(ti.CodecPrivate)
+		if doc.Header == "" {
+			doc.Header = "WEBVTT\n"
+		}
+	}
+
+	mask := ^(uint64(1) << track)
+	for {
+		p, err := d.ReadPacketMask(mask)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		ev := &Event{
+			Start: p.StartTime,
+			End:   p.EndTime,
+		}
+
+		switch format {
+		case ASS, SSA:
+			err = parseASSBlock(ev, p.Data)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			ev.Text = normalizeNewlines(strings.TrimRight(string(p.Data), "\x00"))
+			if ti.CodecID == "S_TEXT/WEBVTT" {
+				parseWebVTTAdditions(ev, p.Additions)
+			}
+		}
+
+		doc.Events = append(doc.Events, ev)
+	}
+
+	fixupEnds(doc.Events)
+
+	if format == ASS || format == SSA {
+		sortByReadOrder(doc.Events)
+	}
+
+	return doc, nil
+}
+
+// fixupEnds gives events with no known duration an end time of the
+// start of the following event.
+func fixupEnds(events []*Event) {
+	for i, ev := range events {
+		if ev.End > ev.Start {
+			continue
+		}
+		if i+1 < len(events) && events[i+1].Start > ev.Start {
+			ev.End = events[i+1].Start
+		} else {
+			// No better guess available.
+			ev.End = ev.Start + 2000000000
+		}
+	}
+}
+
+// Parse reads a subtitle document of the given format from r.
+func Parse(r io.Reader, format Format) (*Document, error) {
+	switch format {
+	case SRT:
+		return parseSRT(r)
+	case WebVTT:
+		return parseWebVTT(r)
+	case ASS, SSA:
+		return parseASS(r, format)
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+// Write writes doc to w as a complete document in the given format,
+// converting event text and headers as required.
+func (doc *Document) Write(w io.Writer, format Format) error {
+	switch format {
+	case SRT:
+		return doc.writeSRT(w)
+	case WebVTT:
+		return doc.writeWebVTT(w)
+	case ASS, SSA:
+		return doc.writeASS(w, format)
+	}
+	return fmt.Errorf("unsupported format: %s", format)
+}
+
+// Convert reads a document in format from from r, and writes it to w in
+// format to.
+func Convert(r io.Reader, from Format, w io.Writer, to Format) error {
+	doc, err := Parse(r, from)
+	if err != nil {
+		return err
+	}
+	return doc.Write(w, to)
+}
+
+func normalizeNewlines(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\r", "\n", -1)
+}
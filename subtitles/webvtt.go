@@ -0,0 +1,157 @@
+package subtitles
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+func parseWebVTT(r io.Reader) (*Document, error) {
+	doc := &Document{
+		Format: WebVTT,
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var block []string
+	var header []string
+	inHeader := true
+	first := true
+
+	flush := func() error {
+		defer func() { block = nil }()
+
+		if len(block) == 0 {
+			return nil
+		}
+
+		timing := -1
+		for i, l := range block {
+			if strings.Contains(l, "-->") {
+				timing = i
+				break
+			}
+		}
+
+		// Not a cue; STYLE, REGION and NOTE blocks before the first cue
+		// belong in the header. Anywhere else, we drop them.
+		if timing < 0 || timing > 1 {
+			if inHeader {
+				header = append(header, strings.Join(block, "\n"))
+			}
+			return nil
+		}
+
+		inHeader = false
+
+		start, end, settings, err := parseTiming(block[timing])
+		if err != nil {
+			return err
+		}
+
+		ev := &Event{
+			Start:    start,
+			End:      end,
+			Settings: settings,
+			Text:     strings.Join(block[timing+1:], "\n"),
+		}
+		if timing == 1 {
+			ev.ID = block[0]
+		}
+
+		doc.Events = append(doc.Events, ev)
+
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			if !strings.HasPrefix(line, "WEBVTT") {
+				return nil, fmt.Errorf("missing WEBVTT signature")
+			}
+			first = false
+		}
+
+		if line == "" {
+			err := flush()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		block = append(block, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	err := flush()
+	if err != nil {
+		return nil, err
+	}
+
+	if first {
+		return nil, fmt.Errorf("missing WEBVTT signature")
+	}
+
+	doc.Header = strings.Join(header, "\n\n") + "\n"
+
+	return doc, nil
+}
+
+// parseWebVTTAdditions sets the cue identifier and settings of ev from the
+// BlockAdditional of an S_TEXT/WEBVTT block, which holds the settings on
+// its first line, the identifier on the second, and then any comments.
+func parseWebVTTAdditions(ev *Event, additions []matroska.BlockAddition) {
+	for _, a := range additions {
+		if a.ID != 1 {
+			continue
+		}
+
+		lines := strings.SplitN(normalizeNewlines(string(a.Data)), "\n", 3)
+		ev.Settings = strings.TrimSpace(lines[0])
+		if len(lines) > 1 {
+			ev.ID = strings.TrimSpace(lines[1])
+		}
+		return
+	}
+}
+
+func (doc *Document) writeWebVTT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	header := "WEBVTT\n"
+	if doc.Format == WebVTT && strings.HasPrefix(doc.Header, "WEBVTT") {
+		header = strings.TrimRight(normalizeNewlines(doc.Header), "\n") + "\n"
+	}
+
+	bw.WriteString(header)
+
+	for _, ev := range sortedByStart(doc.Events) {
+		text := convertText(ev.Text, doc.Format, WebVTT)
+		if text == "" {
+			continue
+		}
+
+		bw.WriteString("\n")
+		if ev.ID != "" {
+			bw.WriteString(ev.ID + "\n")
+		}
+
+		timing := formatTime(ev.Start, '.') + " --> " + formatTime(ev.End, '.')
+		if ev.Settings != "" {
+			timing += " " + ev.Settings
+		}
+
+		fmt.Fprintf(bw, "%s\n%s\n", timing, text)
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,124 @@
+package tags
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// The JSON form mirrors the XML one. Binary values are base64, as usual
+// for []byte in encoding/json.
+type jsonTag struct {
+	TargetTypeValue uint64       `json:"targetTypeValue,omitempty"`
+	TargetType      string       `json:"targetType,omitempty"`
+	TrackUIDs       []uint64     `json:"trackUIDs,omitempty"`
+	EditionUIDs     []uint64     `json:"editionUIDs,omitempty"`
+	ChapterUIDs     []uint64     `json:"chapterUIDs,omitempty"`
+	AttachmentUIDs  []uint64     `json:"attachmentUIDs,omitempty"`
+	SimpleTags      []jsonSimple `json:"simpleTags"`
+}
+
+type jsonSimple struct {
+	Name     string       `json:"name"`
+	String   *string      `json:"string,omitempty"`
+	Binary   []byte       `json:"binary,omitempty"`
+	Language string       `json:"language,omitempty"`
+	BCP47    string       `json:"languageBCP47,omitempty"`
+	Default  *bool        `json:"default,omitempty"`
+	Children []jsonSimple `json:"children,omitempty"`
+}
+
+func toJSONSimple(st *matroska.SimpleTag) jsonSimple {
+	def := st.Default
+	ret := jsonSimple{
+		Name:     st.Name,
+		Language: language(st.Language),
+		BCP47:    st.LanguageBCP47,
+		Default:  &def,
+	}
+	if len(st.Binary) != 0 {
+		ret.Binary = st.Binary
+	} else {
+		value := st.Value
+		ret.String = &value
+	}
+
+	for i := range st.Children {
+		ret.Children = append(ret.Children, toJSONSimple(&st.Children[i]))
+	}
+
+	return ret
+}
+
+func writeJSON(w io.Writer, tags []*matroska.Tag) error {
+	doc := []jsonTag{}
+	for _, t := range tags {
+		tag := jsonTag{
+			TargetTypeValue: t.TargetTypeValue,
+			TargetType:      t.TargetType,
+			SimpleTags:      []jsonSimple{},
+		}
+		tag.TrackUIDs, tag.EditionUIDs, tag.ChapterUIDs, tag.AttachmentUIDs = targetUIDs(t.Targets)
+		for i := range t.SimpleTags {
+			tag.SimpleTags = append(tag.SimpleTags, toJSONSimple(&t.SimpleTags[i]))
+		}
+		doc = append(doc, tag)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func fromJSONSimple(s *jsonSimple) matroska.SimpleTag {
+	ret := matroska.SimpleTag{
+		Name:          s.Name,
+		Language:      s.Language,
+		LanguageBCP47: s.BCP47,
+		Default:       s.Default == nil || *s.Default,
+		Binary:        s.Binary,
+	}
+	if ret.Language == "" {
+		ret.Language = "und"
+	}
+	if s.String != nil && s.Binary == nil {
+		ret.Value = *s.String
+	}
+
+	for i := range s.Children {
+		ret.Children = append(ret.Children, fromJSONSimple(&s.Children[i]))
+	}
+
+	return ret
+}
+
+func parseJSON(r io.Reader) ([]*matroska.Tag, error) {
+	var doc []jsonTag
+	err := json.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse tags JSON: %s", err.Error())
+	}
+
+	var ret []*matroska.Tag
+	for i := range doc {
+		t := &doc[i]
+		tag := &matroska.Tag{
+			TargetTypeValue: t.TargetTypeValue,
+			TargetType:      t.TargetType,
+		}
+		tag.Targets = appendTargets(tag.Targets, matroska.TargetTrack, t.TrackUIDs)
+		tag.Targets = appendTargets(tag.Targets, matroska.TargetEdition, t.EditionUIDs)
+		tag.Targets = appendTargets(tag.Targets, matroska.TargetChapter, t.ChapterUIDs)
+		tag.Targets = appendTargets(tag.Targets, matroska.TargetAttachment, t.AttachmentUIDs)
+
+		for j := range t.SimpleTags {
+			tag.SimpleTags = append(tag.SimpleTags, fromJSONSimple(&t.SimpleTags[j]))
+		}
+		ret = append(ret, tag)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,293 @@
+package tags
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Target levels (TargetTypeValue) from the Matroska tagging spec, named by
+// their most common target type.
+const (
+	LevelCollection = 70
+	LevelSeason     = 60
+	LevelAlbum      = 50 // Also MOVIE, EPISODE, CONCERT.
+	LevelPart       = 40
+	LevelTrack      = 30 // Also SONG, CHAPTER.
+	LevelSubtrack   = 20
+	LevelShot       = 10
+)
+
+// Metadata is a view of the commonly used tags, resolved at the levels
+// the tagging spec puts them.
+//
+// For music, Title and Artist are the track's, at level 30, and Album and
+// AlbumArtist are the TITLE and ARTIST at level 50. A file without any
+// level 30 TITLE or ARTIST, such as a movie, has them at level 50 instead,
+// and no Album or AlbumArtist.
+type Metadata struct {
+	Title        string
+	Artist       string
+	Album        string
+	AlbumArtist  string
+	TrackNumber  int // PART_NUMBER at level 30.
+	TotalParts   int // TOTAL_PARTS at level 50.
+	DateReleased string
+	Genre        string
+	Comment      string
+	Encoder      string
+	Copyright    string
+	ISRC         string
+}
+
+// A field is a tag name, the levels it is looked up at, most specific
+// first, and the level it is written at. A write level of 0 means the
+// same level as Title.
+type field struct {
+	name   string
+	levels []uint64
+	write  uint64
+	value  func(m *Metadata) *string
+}
+
+var fields = []field{
+	{"DATE_RELEASED", []uint64{LevelAlbum, LevelTrack}, LevelAlbum, func(m *Metadata) *string { return &m.DateReleased }},
+	{"GENRE", []uint64{LevelTrack, LevelAlbum}, 0, func(m *Metadata) *string { return &m.Genre }},
+	{"COMMENT", []uint64{LevelTrack, LevelAlbum}, 0, func(m *Metadata) *string { return &m.Comment }},
+	{"ENCODER", []uint64{LevelTrack, LevelAlbum}, 0, func(m *Metadata) *string { return &m.Encoder }},
+	{"COPYRIGHT", []uint64{LevelTrack, LevelAlbum}, 0, func(m *Metadata) *string { return &m.Copyright }},
+	{"ISRC", []uint64{LevelTrack}, LevelTrack, func(m *Metadata) *string { return &m.ISRC }},
+}
+
+// level returns the effective TargetTypeValue of a tag.
+func level(t *matroska.Tag) uint64 {
+	if t.TargetTypeValue == 0 {
+		return LevelAlbum
+	}
+	return t.TargetTypeValue
+}
+
+// applies returns whether t applies to the given track, and whether it
+// does so specifically. Tags for chapters, editions or attachments never
+// apply.
+func applies(t *matroska.Tag, trackUID uint64) (ok bool, specific bool) {
+	hasTracks := false
+	for _, tg := range t.Targets {
+		if tg.Type != matroska.TargetTrack {
+			return false, false
+		}
+		hasTracks = true
+		if trackUID != 0 && tg.UID == trackUID {
+			specific = true
+		}
+	}
+	if !hasTracks {
+		return true, false
+	}
+	return specific, specific
+}
+
+// lookup finds the value of a simple tag at a level, preferring tags
+// targeting the track itself, and then default simple tags.
+func lookup(tags []*matroska.Tag, trackUID uint64, name string, lvl uint64) (string, bool) {
+	var value string
+	found, foundSpecific, foundDefault := false, false, false
+
+	for _, t := range tags {
+		if level(t) != lvl {
+			continue
+		}
+		ok, specific := applies(t, trackUID)
+		if !ok || (foundSpecific && !specific) {
+			continue
+		}
+
+		for _, st := range t.SimpleTags {
+			if !strings.EqualFold(st.Name, name) || st.Binary != nil {
+				continue
+			}
+			if !found || (specific && !foundSpecific) || (st.Default && !foundDefault) {
+				value = st.Value
+				found, foundSpecific, foundDefault = true, specific, st.Default
+			}
+		}
+	}
+
+	return value, found
+}
+
+func lookupLevels(tags []*matroska.Tag, trackUID uint64, name string, levels []uint64) string {
+	for _, lvl := range levels {
+		if v, ok := lookup(tags, trackUID, name, lvl); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// number parses a numeric tag, tolerating the n/total form.
+func number(s string) int {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// GetMetadata resolves the common tags for a track, or for the whole file
+// if trackUID is 0.
+func GetMetadata(tags []*matroska.Tag, trackUID uint64) *Metadata {
+	ret := new(Metadata)
+
+	if title, ok := lookup(tags, trackUID, "TITLE", LevelTrack); ok {
+		ret.Title = title
+		ret.Album, _ = lookup(tags, trackUID, "TITLE", LevelAlbum)
+	} else {
+		ret.Title, _ = lookup(tags, trackUID, "TITLE", LevelAlbum)
+	}
+	if artist, ok := lookup(tags, trackUID, "ARTIST", LevelTrack); ok {
+		ret.Artist = artist
+		ret.AlbumArtist, _ = lookup(tags, trackUID, "ARTIST", LevelAlbum)
+	} else {
+		ret.Artist, _ = lookup(tags, trackUID, "ARTIST", LevelAlbum)
+	}
+
+	if v, ok := lookup(tags, trackUID, "PART_NUMBER", LevelTrack); ok {
+		ret.TrackNumber = number(v)
+	}
+	if v, ok := lookup(tags, trackUID, "TOTAL_PARTS", LevelAlbum); ok {
+		ret.TotalParts = number(v)
+	}
+
+	for _, f := range fields {
+		*f.value(ret) = lookupLevels(tags, trackUID, f.name, f.levels)
+	}
+
+	return ret
+}
+
+// metadataSetter tracks which tags SetMetadata has copied, so the caller's
+// tags are never modified.
+type metadataSetter struct {
+	tags     []*matroska.Tag
+	copied   map[*matroska.Tag]bool
+	trackUID uint64
+}
+
+// tag finds or creates the tag at lvl targeting exactly the track, or
+// nothing if trackUID is 0.
+func (s *metadataSetter) tag(lvl uint64) *matroska.Tag {
+	for i, t := range s.tags {
+		if level(t) != lvl {
+			continue
+		}
+		if s.trackUID == 0 && len(t.Targets) != 0 {
+			continue
+		}
+		if s.trackUID != 0 && (len(t.Targets) != 1 || t.Targets[0].Type != matroska.TargetTrack || t.Targets[0].UID != s.trackUID) {
+			continue
+		}
+
+		if !s.copied[t] {
+			c := *t
+			c.SimpleTags = append([]matroska.SimpleTag(nil), t.SimpleTags...)
+			s.tags[i] = &c
+			s.copied[&c] = true
+			t = &c
+		}
+		return t
+	}
+
+	t := &matroska.Tag{
+		TargetTypeValue: lvl,
+	}
+	if s.trackUID != 0 {
+		t.Targets = []matroska.Target{{UID: s.trackUID, Type: matroska.TargetTrack}}
+	}
+	s.tags = append(s.tags, t)
+	s.copied[t] = true
+	return t
+}
+
+// set replaces all simple tags called name at lvl with value.
+func (s *metadataSetter) set(lvl uint64, name, value string) {
+	t := s.tag(lvl)
+
+	var simple []matroska.SimpleTag
+	for _, st := range t.SimpleTags {
+		if !strings.EqualFold(st.Name, name) {
+			simple = append(simple, st)
+		}
+	}
+	t.SimpleTags = append(simple, matroska.SimpleTag{
+		Name:     name,
+		Value:    value,
+		Language: "und",
+		Default:  true,
+	})
+}
+
+// SetMetadata returns tags with the non-empty fields of m set for a track,
+// or for the whole file if trackUID is 0. Existing values of the same
+// fields in tags for exactly that target are replaced. The input tags are
+// not modified.
+//
+// Title and Artist are set at level 30 if m has an Album, AlbumArtist,
+// TrackNumber or TotalParts, or if tags already has them there, and at
+// level 50 otherwise, mirroring GetMetadata.
+func SetMetadata(tags []*matroska.Tag, m *Metadata, trackUID uint64) []*matroska.Tag {
+	s := &metadataSetter{
+		tags:     append([]*matroska.Tag(nil), tags...),
+		copied:   make(map[*matroska.Tag]bool),
+		trackUID: trackUID,
+	}
+
+	titleLevel := uint64(LevelAlbum)
+	if m.Album != "" || m.AlbumArtist != "" || m.TrackNumber != 0 || m.TotalParts != 0 {
+		titleLevel = LevelTrack
+	}
+	if _, ok := lookup(tags, trackUID, "TITLE", LevelTrack); ok {
+		titleLevel = LevelTrack
+	}
+	artistLevel := titleLevel
+	if _, ok := lookup(tags, trackUID, "ARTIST", LevelTrack); ok {
+		artistLevel = LevelTrack
+	}
+
+	if m.Title != "" {
+		s.set(titleLevel, "TITLE", m.Title)
+	}
+	if m.Artist != "" {
+		s.set(artistLevel, "ARTIST", m.Artist)
+	}
+	if m.Album != "" {
+		s.set(LevelAlbum, "TITLE", m.Album)
+	}
+	if m.AlbumArtist != "" {
+		s.set(LevelAlbum, "ARTIST", m.AlbumArtist)
+	}
+	if m.TrackNumber != 0 {
+		s.set(LevelTrack, "PART_NUMBER", strconv.Itoa(m.TrackNumber))
+	}
+	if m.TotalParts != 0 {
+		s.set(LevelAlbum, "TOTAL_PARTS", strconv.Itoa(m.TotalParts))
+	}
+
+	for _, f := range fields {
+		v := *f.value(m)
+		if v == "" {
+			continue
+		}
+		lvl := f.write
+		if lvl == 0 {
+			lvl = titleLevel
+		}
+		s.set(lvl, f.name, v)
+	}
+
+	return s.tags
+}
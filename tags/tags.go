@@ -0,0 +1,102 @@
+// Package tags converts between Matroska tags, as returned by
+// matroska.Demuxer.GetTags, and mkvmerge's tags XML or a JSON form.
+//
+// Both formats keep the target level and type, the target UIDs, nested
+// simple tags and binary values, so the result can be passed to the
+// muxer or editor as-is.
+//
+// GetMetadata and SetMetadata read and write the commonly used tags, such
+// as title, artist and album, at the levels the tagging spec puts them.
+package tags
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+)
+
+// Format is a tags file format.
+type Format int
+
+// Supported formats.
+const (
+	XML Format = iota
+	JSON
+)
+
+func (f Format) String() string {
+	switch f {
+	case XML:
+		return "XML"
+	case JSON:
+		return "JSON"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Parse reads tags of the given format from r.
+func Parse(r io.Reader, format Format) ([]*matroska.Tag, error) {
+	switch format {
+	case XML:
+		return parseXML(r)
+	case JSON:
+		return parseJSON(r)
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+// Write writes tags to w in the given format.
+func Write(w io.Writer, tags []*matroska.Tag, format Format) error {
+	switch format {
+	case XML:
+		return writeXML(w, tags)
+	case JSON:
+		return writeJSON(w, tags)
+	}
+	return fmt.Errorf("unsupported format: %s", format)
+}
+
+// Convert reads tags in format from from r, and writes them to w in
+// format to.
+func Convert(r io.Reader, from Format, w io.Writer, to Format) error {
+	tags, err := Parse(r, from)
+	if err != nil {
+		return err
+	}
+	return Write(w, tags, to)
+}
+
+// targetUIDs splits a tag's targets by type.
+func targetUIDs(targets []matroska.Target) (tracks, editions, chapters, attachments []uint64) {
+	for _, t := range targets {
+		switch t.Type {
+		case matroska.TargetTrack:
+			tracks = append(tracks, t.UID)
+		case matroska.TargetEdition:
+			editions = append(editions, t.UID)
+		case matroska.TargetChapter:
+			chapters = append(chapters, t.UID)
+		case matroska.TargetAttachment:
+			attachments = append(attachments, t.UID)
+		}
+	}
+	return
+}
+
+// appendTargets appends targets of a single type.
+func appendTargets(targets []matroska.Target, typ uint32, uids []uint64) []matroska.Target {
+	for _, uid := range uids {
+		targets = append(targets, matroska.Target{
+			UID:  uid,
+			Type: typ,
+		})
+	}
+	return targets
+}
+
+// language trims the NUL padding the parser leaves on language codes.
+func language(lang string) string {
+	return strings.TrimRight(lang, "\x00 ")
+}
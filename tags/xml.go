@@ -0,0 +1,165 @@
+package tags
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dwbuiten/matroska"
+	"github.com/dwbuiten/matroska/internal/mkvxml"
+)
+
+// The layout of mkvmerge's tags XML.
+type xmlTags struct {
+	XMLName xml.Name `xml:"Tags"`
+	Tags    []xmlTag `xml:"Tag"`
+}
+
+type xmlTag struct {
+	Targets xmlTargets  `xml:"Targets"`
+	Simple  []xmlSimple `xml:"Simple"`
+}
+
+type xmlTargets struct {
+	TypeValue   uint64   `xml:"TargetTypeValue,omitempty"`
+	Type        string   `xml:"TargetType,omitempty"`
+	Tracks      []uint64 `xml:"TrackUID"`
+	Editions    []uint64 `xml:"EditionUID"`
+	Chapters    []uint64 `xml:"ChapterUID"`
+	Attachments []uint64 `xml:"AttachmentUID"`
+}
+
+type xmlSimple struct {
+	Name     string         `xml:"Name"`
+	String   *string        `xml:"String"`
+	Binary   *mkvxml.Binary `xml:"Binary"`
+	Language string         `xml:"TagLanguage,omitempty"`
+	BCP47    string         `xml:"TagLanguageIETF,omitempty"`
+	Default  *int           `xml:"DefaultLanguage"`
+	Simple   []xmlSimple    `xml:"Simple"`
+}
+
+func toXMLSimple(st *matroska.SimpleTag) xmlSimple {
+	def := 0
+	if st.Default {
+		def = 1
+	}
+
+	ret := xmlSimple{
+		Name:     st.Name,
+		Language: language(st.Language),
+		BCP47:    st.LanguageBCP47,
+		Default:  &def,
+	}
+	if len(st.Binary) != 0 {
+		ret.Binary = mkvxml.NewBinary(st.Binary)
+	} else {
+		value := st.Value
+		ret.String = &value
+	}
+
+	for i := range st.Children {
+		ret.Simple = append(ret.Simple, toXMLSimple(&st.Children[i]))
+	}
+
+	return ret
+}
+
+func writeXML(w io.Writer, tags []*matroska.Tag) error {
+	var doc xmlTags
+	for _, t := range tags {
+		tag := xmlTag{
+			Targets: xmlTargets{
+				TypeValue: t.TargetTypeValue,
+				Type:      t.TargetType,
+			},
+		}
+		tag.Targets.Tracks, tag.Targets.Editions, tag.Targets.Chapters, tag.Targets.Attachments = targetUIDs(t.Targets)
+		for i := range t.SimpleTags {
+			tag.Simple = append(tag.Simple, toXMLSimple(&t.SimpleTags[i]))
+		}
+		doc.Tags = append(doc.Tags, tag)
+	}
+
+	b, err := xml.MarshalIndent(&doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	out = append(out, "<?xml version=\"1.0\"?>\n"...)
+	out = append(out, "<!-- <!DOCTYPE Tags SYSTEM \"matroskatags.dtd\"> -->\n"...)
+	out = append(out, b...)
+	out = append(out, '\n')
+
+	_, err = w.Write(out)
+	return err
+}
+
+func fromXMLSimple(s *xmlSimple) (matroska.SimpleTag, error) {
+	ret := matroska.SimpleTag{
+		Name:          s.Name,
+		Language:      strings.TrimSpace(s.Language),
+		LanguageBCP47: strings.TrimSpace(s.BCP47),
+		Default:       s.Default == nil || *s.Default != 0,
+	}
+	if ret.Language == "" {
+		ret.Language = "und"
+	}
+	if s.String != nil {
+		ret.Value = *s.String
+	}
+	if s.Binary != nil {
+		if s.String != nil {
+			return ret, fmt.Errorf("simple tag %s has both a string and a binary value", s.Name)
+		}
+		var err error
+		ret.Binary, err = s.Binary.Bytes()
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	for i := range s.Simple {
+		child, err := fromXMLSimple(&s.Simple[i])
+		if err != nil {
+			return ret, err
+		}
+		ret.Children = append(ret.Children, child)
+	}
+
+	return ret, nil
+}
+
+func parseXML(r io.Reader) ([]*matroska.Tag, error) {
+	var doc xmlTags
+	err := xml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse tags XML: %s", err.Error())
+	}
+
+	var ret []*matroska.Tag
+	for i := range doc.Tags {
+		t := &doc.Tags[i]
+		tag := &matroska.Tag{
+			TargetTypeValue: t.Targets.TypeValue,
+			TargetType:      strings.TrimSpace(t.Targets.Type),
+		}
+		tag.Targets = appendTargets(tag.Targets, matroska.TargetTrack, t.Targets.Tracks)
+		tag.Targets = appendTargets(tag.Targets, matroska.TargetEdition, t.Targets.Editions)
+		tag.Targets = appendTargets(tag.Targets, matroska.TargetChapter, t.Targets.Chapters)
+		tag.Targets = appendTargets(tag.Targets, matroska.TargetAttachment, t.Targets.Attachments)
+
+		for j := range t.Simple {
+			st, err := fromXMLSimple(&t.Simple[j])
+			if err != nil {
+				return nil, err
+			}
+			tag.SimpleTags = append(tag.SimpleTags, st)
+		}
+		ret = append(ret, tag)
+	}
+
+	return ret, nil
+}
@@ -188,13 +188,20 @@ func convertTarget(t *C.struct_Target) Target {
 	}
 }
 
-func convertSimpleTag(s *C.struct_SimpleTag) SimpleTag {
-	return SimpleTag{
-		Name:     C.GoString(s.Name),
-		Value:    C.GoString(s.Value),
-		Language: string(C.GoBytes(unsafe.Pointer(&(s.Language[0])), 4)),
-		Default:  C.stDefault(s) == 1,
+func convertPartialSimpleTag(s *C.struct_SimpleTag) SimpleTag {
+	ret := SimpleTag{
+		Name:          C.GoString(s.Name),
+		Value:         C.GoString(s.Value),
+		Language:      string(C.GoBytes(unsafe.Pointer(&(s.Language[0])), 4)),
+		LanguageBCP47: C.GoString(s.LanguageBCP47),
+		Default:       C.stDefault(s) == 1,
 	}
+
+	if s.Binary != nil {
+		ret.Binary = C.GoBytes(unsafe.Pointer(s.Binary), C.int(s.BinaryLength))
+	}
+
+	return ret
 }
 
 func convertCue(cc *C.Cue) *Cue {
@@ -59,6 +59,20 @@ type Packet struct {
 	Flags uint32
 	// Whether this packet can be discarded.
 	Discard int64
+	// The times of the blocks this packet references, relative to
+	// StartTime, from its ReferenceBlock elements.
+	References []int64
+	// The packet's BlockAdditions.
+	Additions []BlockAddition
+}
+
+// BlockAddition is additional data for a packet, such as WebVTT cue
+// settings, or alpha channels for video.
+type BlockAddition struct {
+	// The BlockAddID, which is 1 if the file does not set it.
+	ID uint64
+	// The addition's data.
+	Data []byte
 }
 
 // TrackInfo contains information about a track.
@@ -328,6 +342,21 @@ type Chapter struct {
 	Ordered bool
 }
 
+// Edition contains a Matroska edition and its chapters. GetChapters returns
+// editions as top-level Chapters; GetEditions returns them as this type.
+type Edition struct {
+	// The edition's UID.
+	UID uint64
+	// Whether or not this edition is hidden.
+	Hidden bool
+	// Whether or not this edition is the default.
+	Default bool
+	// Whether or not this edition is ordered.
+	Ordered bool
+	// The edition's chapters.
+	Chapters []*Chapter
+}
+
 // Cue contains all information about a matroska cue.
 type Cue struct {
 	// The cue's start time.
@@ -360,12 +389,23 @@ type SimpleTag struct {
 	Value string
 	// Tag language
 	Language string
+	// Tag language as a BCP 47 tag, which overrides Language if set.
+	LanguageBCP47 string
 	// Whether or not this tag is applied by default.
 	Default bool
+	// Binary value, used instead of Value for binary tags.
+	Binary []byte
+	// Nested simple tags, which further describe this one.
+	Children []SimpleTag
 }
 
 // Tag contains all information relating to a Matroska tag.
 type Tag struct {
+	// The logical level of the target, e.g. 50 for an album or movie, and
+	// 30 for a track or chapter. When muxing, zero means the default, 50.
+	TargetTypeValue uint64
+	// An informational name for the target level, e.g. ALBUM or MOVIE.
+	TargetType string
 	// A list of associated targets.
 	Targets []Target
 	// A list of associated simple tags.
@@ -0,0 +1,504 @@
+package matroska
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SegmentResolver returns a reader for the segment with the given
+// SegmentUID, used by VirtualDemuxer to open the segments ordered chapters
+// link to.
+type SegmentResolver func(uid [16]byte) (io.ReadSeeker, error)
+
+// DirectoryResolver returns a SegmentResolver for the Matroska files in
+// dir, which are indexed up front using Probe. Files that cannot be probed
+// are ignored. The resolver opens files with os.Open, and VirtualDemuxer
+// closes them.
+func DirectoryResolver(dir string) (SegmentResolver, error) {
+	paths, err := indexDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(uid [16]byte) (io.ReadSeeker, error) {
+		path, ok := paths[uid]
+		if !ok {
+			return nil, fmt.Errorf("no file in %s has segment UID %x", dir, uid)
+		}
+		return os.Open(path)
+	}, nil
+}
+
+// probeFile probes the file at path.
+func probeFile(path string) (*SegmentInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Probe(f)
+}
+
+// indexDirectory maps the segment UIDs of the Matroska files in dir to
+// their paths.
+func indexDirectory(dir string) (map[[16]byte]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory: %s", err.Error())
+	}
+
+	paths := make(map[[16]byte]string)
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(fi.Name())) {
+		case ".mkv", ".mka", ".mks", ".mk3d", ".webm":
+		default:
+			continue
+		}
+
+		path := filepath.Join(dir, fi.Name())
+		info, err := probeFile(path)
+		if err != nil || isZeroUID(info.UID) {
+			continue
+		}
+
+		if _, ok := paths[info.UID]; !ok {
+			paths[info.UID] = path
+		}
+	}
+
+	return paths, nil
+}
+
+// virtualSegment is a segment the timeline plays from.
+type virtualSegment struct {
+	d *Demuxer
+	r io.ReadSeeker // nil for the main segment, which the caller owns.
+
+	// Maps the segment's track indexes to the main segment's, or -1.
+	tracks []int
+	// The reference track seeks are done on, and its track number.
+	ref       uint
+	refNumber uint8
+}
+
+// virtualPart is a single chapter of the timeline.
+type virtualPart struct {
+	seg *virtualSegment
+	ch  *Chapter
+
+	// The range played from the segment.
+	start, end uint64
+	// Where it is on the timeline.
+	offset uint64
+}
+
+// VirtualDemuxer plays an edition of ordered chapters as a single timeline,
+// reading each chapter from the segment its SegmentUID points at, and
+// returning packets with continuous timestamps.
+//
+// Tracks are those of the main segment; tracks of linked segments are
+// matched to them by track number, type and codec, and packets of tracks
+// with no match are skipped. Video packets from before a chapter's start
+// are dropped, along with any following ones up to the next keyframe, so
+// chapters should start on keyframes. A chapter ends once every track
+// other than subtitles has had a packet past its end, or at the latest
+// once packets are Lookahead past it.
+type VirtualDemuxer struct {
+	tracks   []*TrackInfo
+	segments map[[16]byte]*virtualSegment
+	parts    []*virtualPart
+	duration uint64
+
+	cur     int
+	entered bool
+	skip    []bool
+	// Tracks which have passed the end of the current part, and how many
+	// more have to before the next part starts.
+	done    []bool
+	pending int
+}
+
+// NewVirtualDemuxer creates a VirtualDemuxer for an edition of the main
+// segment d, or its default edition if e is nil. Linked segments are opened
+// with resolve. If the edition is not ordered, the timeline is just d.
+//
+// The VirtualDemuxer seeks and reads from d, so it should not be used
+// directly while the VirtualDemuxer is. It is not closed by Close.
+func NewVirtualDemuxer(d *Demuxer, e *Edition, resolve SegmentResolver) (*VirtualDemuxer, error) {
+	info, err := d.GetFileInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := newVirtualDemuxer(d)
+	if err != nil {
+		return nil, err
+	}
+
+	mainSeg, err := v.newSegment(d, nil)
+	if err != nil {
+		return nil, err
+	}
+	v.segments[info.UID] = mainSeg
+
+	if e == nil {
+		e = DefaultEdition(d.GetEditions())
+	}
+	if e == nil || !e.Ordered {
+		v.parts = []*virtualPart{{
+			seg:   mainSeg,
+			start: 0,
+			end:   info.Duration,
+		}}
+		v.duration = info.Duration
+		return v, nil
+	}
+
+	for _, ch := range e.Chapters {
+		if !ch.Enabled {
+			continue
+		}
+
+		seg := mainSeg
+		if !isZeroUID(ch.SegmentUID) {
+			seg, err = v.segment(ch.SegmentUID, resolve)
+			if err != nil {
+				v.Close()
+				return nil, err
+			}
+		}
+
+		end := ch.End
+		if end == 0 {
+			segInfo, err := seg.d.GetFileInfo()
+			if err != nil {
+				v.Close()
+				return nil, err
+			}
+			end = segInfo.Duration
+		}
+		if end <= ch.Start {
+			continue
+		}
+
+		v.parts = append(v.parts, &virtualPart{
+			seg:    seg,
+			ch:     ch,
+			start:  ch.Start,
+			end:    end,
+			offset: v.duration,
+		})
+		v.duration += end - ch.Start
+	}
+	if len(v.parts) == 0 {
+		v.Close()
+		return nil, fmt.Errorf("edition %d has no playable chapters", e.UID)
+	}
+
+	return v, nil
+}
+
+// newVirtualDemuxer creates an empty timeline with the tracks of d.
+func newVirtualDemuxer(d *Demuxer) (*VirtualDemuxer, error) {
+	ntracks, err := d.GetNumTracks()
+	if err != nil {
+		return nil, err
+	}
+	if ntracks > 64 {
+		return nil, fmt.Errorf("too many tracks: %d", ntracks)
+	}
+
+	v := &VirtualDemuxer{
+		segments: make(map[[16]byte]*virtualSegment),
+		skip:     make([]bool, ntracks),
+		done:     make([]bool, ntracks),
+	}
+	for i := uint(0); i < ntracks; i++ {
+		ti, err := d.GetTrackInfo(i)
+		if err != nil {
+			return nil, err
+		}
+		v.tracks = append(v.tracks, ti)
+	}
+
+	return v, nil
+}
+
+// segment returns the linked segment with the given UID, opening it if
+// needed.
+func (v *VirtualDemuxer) segment(uid [16]byte, resolve SegmentResolver) (*virtualSegment, error) {
+	if seg, ok := v.segments[uid]; ok {
+		return seg, nil
+	}
+
+	if resolve == nil {
+		return nil, fmt.Errorf("could not resolve segment %x: no resolver", uid)
+	}
+	r, err := resolve(uid)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve segment %x: %s", uid, err.Error())
+	}
+
+	d, err := NewDemuxer(r)
+	if err != nil {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, fmt.Errorf("could not open segment %x: %s", uid, err.Error())
+	}
+
+	seg, err := v.newSegment(d, r)
+	if err != nil {
+		d.Close()
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, fmt.Errorf("could not open segment %x: %s", uid, err.Error())
+	}
+	v.segments[uid] = seg
+
+	return seg, nil
+}
+
+// newSegment maps a segment's tracks to the main segment's.
+func (v *VirtualDemuxer) newSegment(d *Demuxer, r io.ReadSeeker) (*virtualSegment, error) {
+	ntracks, err := d.GetNumTracks()
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &virtualSegment{
+		d:      d,
+		r:      r,
+		tracks: make([]int, ntracks),
+	}
+
+	infos := make([]*TrackInfo, ntracks)
+	for i := uint(0); i < ntracks; i++ {
+		ti, err := d.GetTrackInfo(i)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = ti
+
+		seg.tracks[i] = -1
+		for j, mti := range v.tracks {
+			if mti.Number == ti.Number && mti.Type == ti.Type && mti.CodecID == ti.CodecID {
+				seg.tracks[i] = j
+				break
+			}
+		}
+	}
+	if ntracks != 0 {
+		seg.ref = uint(ReferenceTrack(infos))
+		seg.refNumber = infos[seg.ref].Number
+	}
+
+	return seg, nil
+}
+
+// GetNumTracks returns the number of tracks, which are those of the main
+// segment.
+func (v *VirtualDemuxer) GetNumTracks() (uint, error) {
+	return uint(len(v.tracks)), nil
+}
+
+// GetTrackInfo returns the main segment's track info for a given track.
+func (v *VirtualDemuxer) GetTrackInfo(track uint) (*TrackInfo, error) {
+	if track >= uint(len(v.tracks)) {
+		return nil, fmt.Errorf("could not get track info: invalid track %d", track)
+	}
+	return v.tracks[track], nil
+}
+
+// GetDuration returns the duration of the timeline.
+func (v *VirtualDemuxer) GetDuration() uint64 {
+	return v.duration
+}
+
+// GetChapters returns the chapters the timeline is made of, with their
+// times on the timeline. For a timeline that is not made of ordered
+// chapters, this is empty.
+func (v *VirtualDemuxer) GetChapters() []*Chapter {
+	ret := []*Chapter{}
+	for _, part := range v.parts {
+		if part.ch == nil {
+			continue
+		}
+
+		c := *part.ch
+		c.Start = part.offset
+		c.End = part.offset + (part.end - part.start)
+		c.SegmentUID = [16]byte{}
+		c.Children = nil
+		ret = append(ret, &c)
+	}
+	return ret
+}
+
+// enter seeks to timecode within a part, on a keyframe of its reference
+// track.
+func (v *VirtualDemuxer) enter(part *virtualPart, timecode uint64) error {
+	d := part.seg.d
+
+	ref := uint8(part.seg.ref)
+	_, err := d.SeekKeyFrame(ref, timecode)
+	if err == io.EOF && timecode > part.start {
+		// The parser cannot seek past the last packet, so use the last
+		// cue before timecode instead.
+		target := timecode
+		timecode = part.start
+		for _, cue := range d.GetCues() {
+			if cue.Track == part.seg.refNumber && cue.Time >= part.start && cue.Time <= target {
+				timecode = cue.Time
+			}
+		}
+		_, err = d.SeekKeyFrame(ref, timecode)
+	}
+	if err == io.EOF {
+		d.Seek(timecode, 0)
+	} else if err != nil {
+		return err
+	}
+
+	for i := range v.skip {
+		v.skip[i] = false
+		v.done[i] = false
+	}
+
+	// Subtitles are not waited for, as they can have no packets for a long
+	// time.
+	v.pending = 0
+	counted := make([]bool, len(v.tracks))
+	for _, track := range part.seg.tracks {
+		if track >= 0 && !counted[track] && v.tracks[track].Type != TypeSubtitle {
+			counted[track] = true
+			v.pending++
+		}
+	}
+	v.entered = true
+
+	return nil
+}
+
+// ReadPacket returns the next packet of the timeline.
+func (v *VirtualDemuxer) ReadPacket() (*Packet, error) {
+	for v.cur < len(v.parts) {
+		part := v.parts[v.cur]
+		if !v.entered {
+			err := v.enter(part, part.start)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		p, err := part.seg.d.ReadPacket()
+		if err == io.EOF {
+			v.cur++
+			v.entered = false
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if p.StartTime >= part.end+Lookahead {
+			// A track with nothing after the end would otherwise keep
+			// the part going to the end of its segment.
+			v.cur++
+			v.entered = false
+			continue
+		}
+
+		track := part.seg.tracks[p.Track]
+		if track < 0 {
+			continue
+		}
+
+		if p.StartTime >= part.end {
+			// Tracks are not perfectly interleaved, so the others can
+			// still have packets before the end.
+			if !v.done[track] {
+				v.done[track] = true
+				if v.tracks[track].Type != TypeSubtitle {
+					v.pending--
+				}
+			}
+			if v.pending <= 0 {
+				v.cur++
+				v.entered = false
+			}
+			continue
+		}
+
+		if p.StartTime < part.start {
+			// Subtitles still on screen are cut to the chapter's start.
+			if v.tracks[track].Type != TypeSubtitle || p.EndTime <= part.start {
+				v.skip[track] = true
+				continue
+			}
+			p.StartTime = part.start
+		}
+		if v.skip[track] {
+			if p.Flags&KF == 0 {
+				continue
+			}
+			v.skip[track] = false
+		}
+
+		if p.EndTime > part.end {
+			p.EndTime = part.end
+		}
+		if p.EndTime < p.StartTime {
+			p.EndTime = p.StartTime
+		}
+
+		p.Track = uint8(track)
+		p.StartTime = p.StartTime - part.start + part.offset
+		p.EndTime = p.EndTime - part.start + part.offset
+		// Positions are meaningless across segments.
+		p.FilePos = 0
+
+		return p, nil
+	}
+
+	return nil, io.EOF
+}
+
+// Seek seeks to a time on the timeline, landing on the previous keyframe
+// of the reference track within the chapter containing it.
+func (v *VirtualDemuxer) Seek(timecode uint64) error {
+	v.cur = len(v.parts)
+	v.entered = false
+
+	for i, part := range v.parts {
+		if timecode < part.offset+(part.end-part.start) {
+			v.cur = i
+			return v.enter(part, part.start+(timecode-part.offset))
+		}
+	}
+
+	return nil
+}
+
+// Close closes the linked segments, and their readers if they are
+// io.Closers. The main segment is left open.
+func (v *VirtualDemuxer) Close() {
+	for _, seg := range v.segments {
+		if seg.r == nil {
+			continue
+		}
+		seg.d.Close()
+		if c, ok := seg.r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	v.segments = nil
+}